@@ -18,10 +18,12 @@
 package gossip
 
 import (
+	"context"
 	"encoding/gob"
 	"net"
 	"time"
 
+	"gossipgo/proto"
 	"gossipgo/rpc"
 	"gossipgo/util"
 	"log"
@@ -46,19 +48,24 @@ func init() {
 
 // client is a client-side RPC connection to a gossip peer node.
 type client struct {
-	addr        net.Addr      // Peer node network address
-	rpcClient   *rpc.Client   // RPC client
-	forwardAddr net.Addr      // Set if disconnected with an alternate addr
-	lastFresh   int64         // Last wall time client received fresh info
-	err         error         // Set if client experienced an error
-	closer      chan struct{} // Client shutdown channel
+	addr        net.Addr           // Peer node network address
+	rpcClient   *rpc.Client        // RPC client
+	forwardAddr net.Addr           // Set if disconnected with an alternate addr
+	lastFresh   int64              // Last wall time client received fresh info
+	err         error              // Set if client experienced an error
+	ctx         context.Context    // Done when the client is closed
+	cancel      context.CancelFunc // Closes the client
+	compression string             // Codec negotiated with the peer for request deltas
+	limiter     *rateLimiter       // Limits bytes of deltas sent to the peer
 }
 
 // newClient creates and returns a client struct.
 func newClient(addr net.Addr) *client {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &client{
 		addr:   addr,
-		closer: make(chan struct{}, 1),
+		ctx:    ctx,
+		cancel: cancel,
 	}
 }
 
@@ -67,19 +74,33 @@ func newClient(addr net.Addr) *client {
 // channel. If the client experienced an error, its err field will
 // be set. This method blocks and should be invoked via goroutine.
 func (c *client) start(g *Gossip, done chan *client) {
-	c.rpcClient = rpc.NewClient(c.addr)
+	c.rpcClient = rpc.NewClient(c.addr, g.rpcContext)
+	defer c.rpcClient.Close()
 	select {
 	case <-c.rpcClient.Ready:
 		// Start gossip; see below.
+	case <-c.rpcClient.Closed:
+		c.err = util.Errorf("client closed connecting to remote server: %v", c.addr)
+		done <- c
+		return
+	case <-c.ctx.Done():
+		done <- c
+		return
 	case <-time.After(gossipDialTimeout):
 		c.err = util.Errorf("timeout connecting to remote server: %v", c.addr)
 		done <- c
 		return
 	}
 
-	// Start gossipping and wait for disconnect or error.
+	// Start gossipping and wait for disconnect or error. Gossip stops
+	// if the connection to the peer becomes unhealthy.
+	g.mu.Lock()
 	c.lastFresh = time.Now().UnixNano()
-	err := c.gossip(g)
+	g.mu.Unlock()
+	ctx, cancel := context.WithCancel(c.ctx)
+	defer cancel()
+	go c.watchHealth(ctx, cancel)
+	err := c.gossip(ctx, g)
 	if err != nil {
 		c.err = util.Errorf("gossip client: %s", err)
 	}
@@ -88,15 +109,37 @@ func (c *client) start(g *Gossip, done chan *client) {
 
 // close stops the client gossip loop and returns immediately.
 func (c *client) close() {
-	close(c.closer)
+	c.cancel()
+}
+
+// watchHealth subscribes to state changes of the RPC client and
+// invokes unhealthy once the connection to the peer is no longer
+// ready. Returns when that happens or ctx is done.
+func (c *client) watchHealth(ctx context.Context, unhealthy func()) {
+	for {
+		changed := c.rpcClient.StateChanged()
+		if c.rpcClient.State() != rpc.Ready {
+			unhealthy()
+			return
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return
+		}
+	}
 }
 
 // gossip loops, sending deltas of the infostore and receiving deltas
-// in turn. If an alternate is proposed on response, the client addr
-// is modified and method returns for forwarding by caller.
-func (c *client) gossip(g *Gossip) error {
+// in turn, until ctx is done. If an alternate is proposed on
+// response, the client addr is modified and method returns for
+// forwarding by caller.
+func (c *client) gossip(ctx context.Context, g *Gossip) error {
 	localMaxSeq := int64(0)
 	remoteMaxSeq := int64(-1)
+	g.mu.Lock()
+	c.limiter = newRateLimiter(g.peerRate)
+	g.mu.Unlock()
 	for {
 		// Do a periodic check to determine whether this outgoing client
 		// is duplicating work already being done by an incoming client.
@@ -106,53 +149,82 @@ func (c *client) gossip(g *Gossip) error {
 			return util.Errorf("stopping outgoing client %s; already have incoming", c.addr)
 		}
 
-		// Compute the delta of local node's infostore to send with request.
+		// Compute the delta of local node's infostore to send with
+		// request, paged to fit the byte budget and the peer's rate limit.
+		var delta *infoStore
+		var accept []string
 		g.mu.Lock()
-		delta := g.is.delta(c.addr, localMaxSeq)
-		if delta != nil {
-			localMaxSeq = delta.MaxSeq
+		if budget, ok := deltaBudget(g.maxDeltaBytes, c.limiter, time.Now().UnixNano()); ok {
+			if delta = g.is.delta(c.addr, localMaxSeq, budget); delta != nil {
+				localMaxSeq = delta.MaxSeq
+			}
+		}
+		if g.compression != CompressionNone {
+			accept = []string{g.compression}
 		}
 		g.mu.Unlock()
 
 		// Send gossip with timeout.
-		args := &GossipRequest{
-			Addr:   g.is.NodeAddr,
-			LAddr:  c.rpcClient.LAddr,
-			MaxSeq: remoteMaxSeq,
-			Delta:  delta,
+		deltaBytes, err := encodeDelta(delta, c.compression)
+		if err != nil {
+			return err
 		}
-		reply := new(GossipResponse)
-		gossipCall := c.rpcClient.Go("Gossip.Gossip", args, reply, nil)
-		select {
-		case <-gossipCall.Done:
-			if gossipCall.Error != nil {
-				return gossipCall.Error
-			}
-		case <-time.After(*gossipInterval * 2):
-			// Allowed twice gossip interval.
-			return util.Errorf("timeout after: %v", *gossipInterval*2)
-		case <-c.closer:
+		args := &proto.GossipRequest{
+			Addr:              *proto.FromNetAddr(g.is.NodeAddr),
+			LAddr:             *proto.FromNetAddr(c.rpcClient.LocalAddr()),
+			MaxSeq:            remoteMaxSeq,
+			Delta:             deltaBytes,
+			Compression:       c.compression,
+			AcceptCompression: accept,
+		}
+		reply := new(proto.GossipResponse)
+		// Allowed twice gossip interval.
+		callCtx, cancel := context.WithTimeout(ctx, *gossipInterval*2)
+		err = c.rpcClient.CallWithContext(callCtx, "Gossip.Gossip", args, reply)
+		cancel()
+		if c.ctx.Err() != nil {
+			// The client was closed.
 			return nil
 		}
+		if ctx.Err() != nil {
+			return util.Errorf("connection to %s unhealthy", c.addr)
+		}
+		if err == context.DeadlineExceeded {
+			return util.Errorf("timeout after: %v", *gossipInterval*2)
+		} else if err != nil {
+			return err
+		}
 
 		// Handle remote forwarding.
 		if reply.Alternate != nil {
 			log.Printf("received forward from %+v to %+v", c.addr, reply.Alternate)
-			c.forwardAddr = reply.Alternate
+			if c.forwardAddr, err = reply.Alternate.NetAddr(); err != nil {
+				return util.Errorf("invalid forwarding address: %s", err)
+			}
 			return nil
 		}
 
-		// Combine remote node's infostore delta with ours.
+		// Combine remote node's infostore delta with ours. The peer
+		// replied with a codec it supports, so use it for requests.
 		now := time.Now().UnixNano()
-		if reply.Delta != nil {
-			g.mu.Lock()
-			freshCount := g.is.combine(reply.Delta)
+		replyDelta, err := decodeDelta(reply.Delta, reply.Compression)
+		if err != nil {
+			return util.Errorf("invalid gossip delta: %s", err)
+		}
+		c.compression = reply.Compression
+		g.mu.Lock()
+		c.limiter.consume(len(deltaBytes))
+		g.bytesSent += int64(len(deltaBytes))
+		g.bytesReceived += int64(len(reply.Delta))
+		if replyDelta != nil {
+			g.infosDropped += int64(replyDelta.dropInvalid())
+			freshCount := g.is.combine(replyDelta)
 			if freshCount > 0 {
 				c.lastFresh = now
 			}
-			remoteMaxSeq = reply.Delta.MaxSeq
-			g.mu.Unlock()
+			remoteMaxSeq = replyDelta.MaxSeq
 		}
+		g.mu.Unlock()
 		// Check whether peer node is too boring--disconnect if yes.
 		if (now - c.lastFresh) > int64(maxWaitForNewGossip) {
 			return util.Errorf("peer is too boring")
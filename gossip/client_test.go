@@ -23,6 +23,7 @@ import (
 	"time"
 
 	"gossipgo/rpc"
+	"gossipgo/util/hlc"
 	"log"
 )
 
@@ -41,14 +42,18 @@ func waitFor(cond func() bool, desc string, t *testing.T) {
 // startGossip creates local and remote gossip instances.
 // The remote gossip instance launches its gossip service.
 func startGossip(t *testing.T) (local, remote *Gossip, lserver, rserver *rpc.Server) {
+	lclock := hlc.NewClock(hlc.UnixNano, 0)
+	lcontext := rpc.NewContext(lclock, nil)
 	laddr := &net.UnixAddr{Net: "unix", Name: tempUnixFile()}
-	lserver = rpc.NewServer(laddr)
+	lserver = rpc.NewServer(laddr, lcontext)
 	go lserver.ListenAndServe()
-	local = New(lserver)
+	local = New(lcontext, lserver)
+	rclock := hlc.NewClock(hlc.UnixNano, 0)
+	rcontext := rpc.NewContext(rclock, nil)
 	raddr := &net.UnixAddr{Net: "unix", Name: tempUnixFile()}
-	rserver = rpc.NewServer(raddr)
+	rserver = rpc.NewServer(raddr, rcontext)
 	go rserver.ListenAndServe()
-	remote = New(rserver)
+	remote = New(rcontext, rserver)
 	go remote.serve()
 	time.Sleep(time.Millisecond)
 	return
@@ -44,6 +44,13 @@ the system with minimal total hops. The algorithm is as follows:
    c. If sentinelGossip is missing or expired, node is considered
       partitioned; goto #1.
 
+   d. If no fresh info has been received from some known members in
+      partitionIntervals and num connected peers < maxPeers, node is
+      considered partitioned from them; choose a random unreachable
+      member, preferring bootstrap hosts, start it, and goto #2.
+      Nodes which originate no other info gossip heartbeats so that
+      they remain reachable.
+
  3 On connect, if node has too many connected clients, gossip requests
    are returned immediately with an alternate address set to a random
    selection from amongst already-connected clients. If MaxSeq is -1
@@ -62,6 +69,8 @@ import (
 	"log"
 	"math"
 	"net"
+	"reflect"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -74,6 +83,19 @@ var (
 	gossipInterval = flag.Duration(
 		"gossip_interval", 2*time.Second,
 		"approximate interval (time.Duration) for gossiping new information to peers")
+	gossipMaxDeltaBytes = flag.Int(
+		"gossip_max_delta_bytes", 1<<20,
+		"approximate maximum size in bytes of the delta sent in a single gossip exchange; "+
+			"larger deltas are paged across rounds (0 for no limit)")
+	gossipCompression = flag.String(
+		"gossip_compression", CompressionNone,
+		"compression codec requested for gossip deltas: one of \"\" (none), \"snappy\" or \"gzip\"")
+	gossipPeerRate = flag.Int64(
+		"gossip_peer_bytes_per_sec", 0,
+		"maximum rate in bytes per second of gossip deltas sent to each peer (0 for no limit)")
+	gossipCheckpointInterval = flag.Duration(
+		"gossip_checkpoint_interval", time.Minute,
+		"approximate interval (time.Duration) for checkpointing gossip infos to storage")
 )
 
 const (
@@ -81,7 +103,7 @@ const (
 	MaxPeers = 10
 	// defaultNodeCount is the default number of nodes in the gossip
 	// network. The actual count of nodes in the cluster is gossiped
-	// by the range which contains node statistics.
+	// by the node holding the first range; see NodeCount().
 	//
 	// The count of nodes is used to compute the maximum hops allowed
 	// for info transmission given the maxPeers parameter by the
@@ -102,26 +124,36 @@ type Gossip struct {
 	Connected    chan struct{}      // Closed upon initial connection
 	hasConnected bool               // Set first time network is connected
 	*server                         // Embedded gossip RPC server
+	rpcContext   *rpc.Context       // The context required for RPC
 	bootstraps   *addrSet           // Bootstrap host addresses
 	outgoing     *addrSet           // Set of outgoing client addresses
 	clients      map[string]*client // Map from address to client
 	disconnected chan *client       // Channel of disconnected clients
 	exited       chan error         // Channel to signal exit
 	stalled      *sync.Cond         // Indicates bootstrap is required
+	storage      Storage            // Optional storage for info checkpoints
+	lastHeal     int64              // Wall time of last partition healing attempt (Unix-nanos)
 }
 
 // New creates an instance of a gossip node using the specified
 // Cockroach RPC server to initialize the gossip service endpoint.
-func New(rpcServer *rpc.Server) *Gossip {
+// Clients to peers are created using the supplied RPC context.
+func New(rpcContext *rpc.Context, rpcServer *rpc.Server) *Gossip {
 	g := &Gossip{
 		Connected:    make(chan struct{}, 1),
 		server:       newServer(rpcServer, *gossipInterval),
+		rpcContext:   rpcContext,
 		bootstraps:   newAddrSet(MaxPeers),
 		outgoing:     newAddrSet(MaxPeers),
 		clients:      make(map[string]*client),
 		disconnected: make(chan *client, MaxPeers),
 	}
 	g.stalled = sync.NewCond(&g.mu)
+	g.maxDeltaBytes = *gossipMaxDeltaBytes
+	g.peerRate = *gossipPeerRate
+	if err := g.SetCompression(*gossipCompression); err != nil {
+		log.Printf("ignoring --gossip_compression: %s", err)
+	}
 	return g
 }
 
@@ -143,9 +175,69 @@ func (g *Gossip) SetInterval(interval time.Duration) {
 	g.interval = interval
 }
 
+// SetMaxDeltaBytes sets the approximate byte budget for the delta
+// sent in a single gossip exchange. Larger deltas are paged across
+// successive exchanges in sequence order. Zero means no limit.
+func (g *Gossip) SetMaxDeltaBytes(maxBytes int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.maxDeltaBytes = maxBytes
+}
+
+// SetCompression sets the compression codec which outgoing clients
+// request for gossip deltas. Returns an error if the codec is not
+// supported.
+func (g *Gossip) SetCompression(codec string) error {
+	if !validCompression(codec) {
+		return util.Errorf("unsupported gossip compression %q", codec)
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.compression = codec
+	return nil
+}
+
+// SetPeerRateLimit sets the maximum rate in bytes per second of
+// gossip deltas sent to each peer. Zero means no limit. Applies to
+// peers connected after the call.
+func (g *Gossip) SetPeerRateLimit(bytesPerSec int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.peerRate = bytesPerSec
+}
+
+// BytesSent returns the count of bytes of deltas sent to peers, as
+// encoded on the wire.
+func (g *Gossip) BytesSent() int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.bytesSent
+}
+
+// BytesReceived returns the count of bytes of deltas received from
+// peers, as encoded on the wire.
+func (g *Gossip) BytesReceived() int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.bytesReceived
+}
+
+// InfosDropped returns the count of infos received from peers which
+// were dropped because their values didn't match the types
+// registered for their keys.
+func (g *Gossip) InfosDropped() int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.infosDropped
+}
+
 // AddInfo adds or updates an info object. Returns an error if info
-// couldn't be added.
+// couldn't be added, including if val doesn't match the type
+// registered for the key via RegisterInfoType.
 func (g *Gossip) AddInfo(key string, val interface{}, ttl time.Duration) error {
+	if err := checkInfoType(key, val); err != nil {
+		return err
+	}
 	g.mu.Lock()
 	defer g.mu.Unlock()
 	return g.is.addInfo(g.is.newInfo(key, val, ttl))
@@ -162,6 +254,20 @@ func (g *Gossip) GetInfo(key string) (interface{}, error) {
 	return nil, util.Errorf("key %q does not exist or has expired", key)
 }
 
+// GetInfoAs sets the value pointed to by ptr to the info value for
+// key. Returns an error if specified key does not exist or has
+// expired, or if its value isn't assignable to *ptr. For example:
+//
+//	var addr net.Addr
+//	err := g.GetInfoAs(MakeNodeIDGossipKey(nodeID), &addr)
+func (g *Gossip) GetInfoAs(key string, ptr interface{}) error {
+	val, err := g.GetInfo(key)
+	if err != nil {
+		return err
+	}
+	return assignInfo(key, val, ptr)
+}
+
 // GetGroupInfos returns a slice of info values from specified group,
 // or an error if group is not registered.
 func (g *Gossip) GetGroupInfos(prefix string) ([]interface{}, error) {
@@ -178,6 +284,29 @@ func (g *Gossip) GetGroupInfos(prefix string) ([]interface{}, error) {
 	return values, nil
 }
 
+// GetGroupInfosAs sets the slice pointed to by slicePtr to the info
+// values from specified group, in the order returned by
+// GetGroupInfos. Returns an error if group is not registered or any
+// value isn't assignable to the slice's element type.
+func (g *Gossip) GetGroupInfosAs(prefix string, slicePtr interface{}) error {
+	values, err := g.GetGroupInfos(prefix)
+	if err != nil {
+		return err
+	}
+	pv := reflect.ValueOf(slicePtr)
+	if pv.Kind() != reflect.Ptr || pv.IsNil() || pv.Elem().Kind() != reflect.Slice {
+		return util.Errorf("expected non-nil pointer to slice for group %q; got %T", prefix, slicePtr)
+	}
+	slice := reflect.MakeSlice(pv.Elem().Type(), len(values), len(values))
+	for i, val := range values {
+		if err := assignInfo(prefix, val, slice.Index(i).Addr().Interface()); err != nil {
+			return err
+		}
+	}
+	pv.Elem().Set(slice)
+	return nil
+}
+
 // RegisterGroup registers a new group with info store. Returns an
 // error if the group was already registered.
 func (g *Gossip) RegisterGroup(prefix string, limit int, typeOf GroupType) error {
@@ -217,9 +346,18 @@ func (g *Gossip) Outgoing() []net.Addr {
 // gossip network using the node addresses supplied to NewGossip and
 // specified via command-line flag: -gossip_bootstrap.
 //
+// If storage has been set, infos are first reloaded from its most
+// recent checkpoint and are thereafter checkpointed periodically.
+//
 // This method starts bootstrap loop, gossip server, and client
 // management in separate goroutines and returns.
 func (g *Gossip) Start() {
+	if g.storage != nil {
+		if err := g.restore(); err != nil {
+			log.Printf("unable to reload gossip from storage: %s", err)
+		}
+		go g.manageCheckpoints(*gossipCheckpointInterval)
+	}
 	go g.serve()     // serve gossip protocol
 	go g.bootstrap() // bootstrap gossip client
 	go g.manage()    // manage gossip clients
@@ -237,15 +375,51 @@ func (g *Gossip) Stop() <-chan error {
 	return g.exited
 }
 
+// NodeCount returns the count of nodes whose node ID infos are
+// currently held by this gossip instance. The node which holds the
+// first range gossips this count as KeyNodeCount.
+func (g *Gossip) NodeCount() int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.countNodeIDs()
+}
+
+// countNodeIDs counts the unexpired node ID infos in the info
+// store. Nodes refresh their node ID infos while running, so nodes
+// which have left the cluster stop being counted once their infos
+// expire. Keys which share KeyNodeIDPrefix but aren't suffixed by a
+// hexadecimal node ID (e.g. KeyNodeCount) are skipped.
+func (g *Gossip) countNodeIDs() int64 {
+	var count int64
+	g.is.visitInfos(nil, func(i *info) error {
+		if !strings.HasPrefix(i.Key, KeyNodeIDPrefix) {
+			return nil
+		}
+		if _, err := strconv.ParseInt(strings.TrimPrefix(i.Key, KeyNodeIDPrefix), 16, 32); err == nil {
+			count++
+		}
+		return nil
+	})
+	return count
+}
+
 // maxToleratedHops computes the maximum number of hops which the
 // gossip network should allow when optimally configured. It's based
 // on the level of fanout (MaxPeers) and the count of nodes in the
-// cluster.
+// cluster. The gossiped KeyNodeCount is preferred, raised if this
+// node has seen more node IDs than it accounts for; without it,
+// defaultNodeCount is used.
 func (g *Gossip) maxToleratedHops() uint32 {
 	// Get info directly as we have mutex held here.
 	var nodeCount = int64(defaultNodeCount)
 	if info := g.is.getInfo(KeyNodeCount); info != nil {
 		nodeCount = info.Val.(int64)
+		if count := g.countNodeIDs(); count > nodeCount {
+			nodeCount = count
+		}
+	}
+	if nodeCount < 1 {
+		nodeCount = 1
 	}
 	return uint32(math.Ceil(math.Log(float64(nodeCount))/math.Log(float64(MaxPeers))))*2 + 1
 }
@@ -329,12 +503,15 @@ func (g *Gossip) bootstrap() {
 	}
 }
 
-// manage manages outgoing clients. Periodically, the infostore is
-// scanned for infos with hop count exceeding maxToleratedHops()
-// threshold. If the number of outgoing clients doesn't exceed
-// MaxPeers, a new gossip client is connected to a randomly selected
-// peer beyond maxToleratedHops threshold. Otherwise, the least useful
-// peer node is cut off to make room for a replacement. Disconnected
+// manage manages outgoing clients. Periodically, this node's
+// heartbeat is gossiped if it's due, and a client is connected to an
+// unreachable member, if any, to heal a partition; see heal().
+// Otherwise, the infostore is scanned for infos with hop count
+// exceeding maxToleratedHops() threshold. If the number of outgoing
+// clients doesn't exceed MaxPeers, a new gossip client is connected
+// to a randomly selected peer beyond maxToleratedHops threshold.
+// Otherwise, the least useful peer node is cut off to make room for
+// a replacement. Disconnected
 // clients are processed via the disconnected channel and taken out of
 // the outgoing address set. If there are no longer any outgoing
 // connections or the sentinel gossip is unavailable, the bootstrapper
@@ -359,8 +536,14 @@ func (g *Gossip) manage() {
 
 		case <-checkTimeout:
 			g.mu.Lock()
-			// Check whether the graph needs to be tightened to
-			// accommodate distant infos.
+			now := time.Now().UnixNano()
+			g.heartbeat(now)
+			// Check whether the network is partitioned, and if not,
+			// whether the graph needs to be tightened to accommodate
+			// distant infos.
+			if g.heal(now) {
+				break
+			}
 			distant := g.filterExtant(g.is.distant(g.maxToleratedHops()))
 			if distant.len() > 0 {
 				// If we have space, start a client immediately.
@@ -416,7 +599,10 @@ func (g *Gossip) startClient(addr net.Addr) {
 // closeClient closes an existing client specified by client's
 // remote address.
 func (g *Gossip) closeClient(addr net.Addr) {
-	c := g.clients[addr.String()]
-	c.close()
-	delete(g.clients, addr.String())
+	// The address remains in the outgoing set until the client's
+	// disconnect is processed, so it may already have been closed.
+	if c, ok := g.clients[addr.String()]; ok {
+		c.close()
+		delete(g.clients, addr.String())
+	}
 }
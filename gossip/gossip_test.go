@@ -19,10 +19,14 @@ package gossip
 
 import (
 	"fmt"
+	"net"
+	"strings"
 	"testing"
 	"time"
 
+	"gossipgo/proto"
 	"gossipgo/rpc"
+	"gossipgo/util/hlc"
 	"log"
 )
 
@@ -75,7 +79,8 @@ func TestConvergence(t *testing.T) {
 
 // TestGossipInfoStore verifies operation of gossip instance infostore.
 func TestGossipInfoStore(t *testing.T) {
-	g := New(rpc.NewServer(testAddr("test-addr:0")))
+	rpcContext := rpc.NewContext(hlc.NewClock(hlc.UnixNano, 0), nil)
+	g := New(rpcContext, rpc.NewServer(testAddr("test-addr:0"), rpcContext))
 	g.AddInfo("i", int64(1), time.Hour)
 	if val, err := g.GetInfo("i"); val.(int64) != int64(1) || err != nil {
 		t.Errorf("error fetching int64: %v", err)
@@ -102,7 +107,8 @@ func TestGossipInfoStore(t *testing.T) {
 // TestGossipGroupsInfoStore verifies gossiping of groups via the
 // gossip instance infostore.
 func TestGossipGroupsInfoStore(t *testing.T) {
-	g := New(rpc.NewServer(testAddr("test-addr:0")))
+	rpcContext := rpc.NewContext(hlc.NewClock(hlc.UnixNano, 0), nil)
+	g := New(rpcContext, rpc.NewServer(testAddr("test-addr:0"), rpcContext))
 
 	// For int64.
 	g.RegisterGroup("i", 3, MinGroup)
@@ -161,3 +167,251 @@ func TestGossipGroupsInfoStore(t *testing.T) {
 		}
 	}
 }
+
+// TestNodeCount verifies that node ID infos are counted and that
+// the gossiped node count determines the maximum tolerated hops.
+func TestNodeCount(t *testing.T) {
+	rpcContext := rpc.NewContext(hlc.NewClock(hlc.UnixNano, 0), nil)
+	g := New(rpcContext, rpc.NewServer(testAddr("test-addr:0"), rpcContext))
+	if count := g.NodeCount(); count != 0 {
+		t.Errorf("expected no nodes; got %d", count)
+	}
+	// Without a gossiped count, the default is used.
+	if hops, expHops := g.maxToleratedHops(), uint32(7); hops != expHops {
+		t.Errorf("expected %d hops with default node count; got %d", expHops, hops)
+	}
+
+	for i := int32(1); i <= 50; i++ {
+		g.AddInfo(MakeNodeIDGossipKey(i), testAddr(fmt.Sprintf("host%d:8080", i)), time.Hour)
+	}
+	// Expired node IDs and unrelated keys aren't counted.
+	g.AddInfo(MakeNodeIDGossipKey(51), testAddr("host51:8080"), 1*time.Nanosecond)
+	g.AddInfo(KeyNodeCount, int64(5), time.Hour)
+	g.AddInfo("node-address", testAddr("host0:8080"), time.Hour)
+	time.Sleep(time.Millisecond)
+	if count := g.NodeCount(); count != 50 {
+		t.Errorf("expected 50 nodes; got %d", count)
+	}
+	// The gossiped count is raised to the count of node IDs seen.
+	if hops, expHops := g.maxToleratedHops(), uint32(5); hops != expHops {
+		t.Errorf("expected %d hops for 50 nodes; got %d", expHops, hops)
+	}
+
+	g.AddInfo(KeyNodeCount, int64(500), time.Hour)
+	if hops, expHops := g.maxToleratedHops(), uint32(7); hops != expHops {
+		t.Errorf("expected %d hops for 500 nodes; got %d", expHops, hops)
+	}
+	g.AddInfo(KeyNodeCount, int64(10), time.Hour)
+	g.mu.Lock()
+	for i := int32(11); i <= 50; i++ {
+		delete(g.is.Infos, MakeNodeIDGossipKey(i))
+	}
+	g.mu.Unlock()
+	if hops, expHops := g.maxToleratedHops(), uint32(3); hops != expHops {
+		t.Errorf("expected %d hops for 10 nodes; got %d", expHops, hops)
+	}
+}
+
+// TestConvergenceBandwidth simulates a gossip network under various
+// bandwidth controls, logging cycles to convergence against bytes of
+// deltas sent. Each node gossips infos with sizable values, so that
+// small byte budgets require paging deltas across rounds.
+func TestConvergenceBandwidth(t *testing.T) {
+	const numNodes = 10
+	const infosPerNode = 20
+	const maxCycles = 100
+	payload := strings.Repeat("x", 100)
+
+	testCases := []struct {
+		name          string
+		maxDeltaBytes int
+		compression   string
+		peerRate      int64
+	}{
+		{"unlimited", 0, CompressionNone, 0},
+		{"paged-2KB", 2 << 10, CompressionNone, 0},
+		{"snappy", 0, CompressionSnappy, 0},
+		{"gzip", 0, CompressionGzip, 0},
+		{"rate-256KB/s", 0, CompressionNone, 256 << 10},
+	}
+	for _, test := range testCases {
+		var connectedAtCycle int
+		var bytesSent int64
+		SimulateNetwork(numNodes, "tcp", testGossipInterval, func(cycle int, nodes map[string]*Gossip) bool {
+			if cycle == 0 {
+				for addr, node := range nodes {
+					node.SetMaxDeltaBytes(test.maxDeltaBytes)
+					if err := node.SetCompression(test.compression); err != nil {
+						t.Fatal(err)
+					}
+					node.SetPeerRateLimit(test.peerRate)
+					for i := 0; i < infosPerNode; i++ {
+						node.AddInfo(fmt.Sprintf("%s-%d", addr, i), payload, time.Hour)
+					}
+				}
+			}
+			connectedAtCycle = cycle
+			if cycle >= maxCycles {
+				return false
+			}
+			for _, node := range nodes {
+				for addr := range nodes {
+					for i := 0; i < infosPerNode; i++ {
+						if _, err := node.GetInfo(fmt.Sprintf("%s-%d", addr, i)); err != nil {
+							return true
+						}
+					}
+				}
+			}
+			for _, node := range nodes {
+				bytesSent += node.BytesSent()
+			}
+			return false
+		})
+		if connectedAtCycle >= maxCycles {
+			t.Errorf("%s: network failed to converge within %d cycles", test.name, maxCycles)
+			continue
+		}
+		t.Logf("%s: converged in %d cycles with %d bytes sent", test.name, connectedAtCycle, bytesSent)
+	}
+}
+
+// TestTypedInfos verifies that AddInfo rejects values of the wrong
+// type and that typed accessors return errors rather than panicking.
+func TestTypedInfos(t *testing.T) {
+	rpcContext := rpc.NewContext(hlc.NewClock(hlc.UnixNano, 0), nil)
+	g := New(rpcContext, rpc.NewServer(testAddr("test-addr:0"), rpcContext))
+	if err := g.AddInfo(KeyNodeCount, "ten", time.Hour); err == nil {
+		t.Error("expected error adding string node count")
+	}
+	if err := g.AddInfo(KeyNodeCount, int64(10), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	var count int64
+	if err := g.GetInfoAs(KeyNodeCount, &count); err != nil || count != 10 {
+		t.Errorf("expected node count 10; got %d, %v", count, err)
+	}
+	var str string
+	if err := g.GetInfoAs(KeyNodeCount, &str); err == nil {
+		t.Error("expected error getting node count as string")
+	}
+	if err := g.GetInfoAs(KeyNodeCount, count); err == nil {
+		t.Error("expected error getting info into non-pointer")
+	}
+	if err := g.GetInfoAs(KeyClusterID, &str); err == nil {
+		t.Error("expected error getting missing info")
+	}
+
+	g.AddInfo(MakeNodeIDGossipKey(1), testAddr("host1:8080"), time.Hour)
+	var addr net.Addr
+	if err := g.GetInfoAs(MakeNodeIDGossipKey(1), &addr); err != nil || addr.String() != "host1:8080" {
+		t.Errorf("expected node address host1:8080; got %v, %v", addr, err)
+	}
+
+	if err := g.RegisterGroup("a", 10, MinGroup); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := g.AddInfo(fmt.Sprintf("a.%d", i), float64(3-i), time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var values []float64
+	if err := g.GetGroupInfosAs("a", &values); err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 3 || values[0] != 1 || values[2] != 3 {
+		t.Errorf("expected ascending group values; got %v", values)
+	}
+	var strs []string
+	if err := g.GetGroupInfosAs("a", &strs); err == nil {
+		t.Error("expected error getting float group values as strings")
+	}
+	if err := g.GetGroupInfosAs("b", &values); err == nil {
+		t.Error("expected error getting unregistered group")
+	}
+}
+
+// TestGossipDropsInvalidInfos verifies that infos received from a
+// peer with values of the wrong type are dropped and counted.
+func TestGossipDropsInvalidInfos(t *testing.T) {
+	addr, err := net.ResolveTCPAddr("tcp", "127.0.0.1:8079")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerAddr, err := net.ResolveTCPAddr("tcp", "127.0.0.1:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rpcContext := rpc.NewContext(hlc.NewClock(hlc.UnixNano, 0), nil)
+	g := New(rpcContext, rpc.NewServer(addr, rpcContext))
+
+	peer := newInfoStore(peerAddr)
+	peer.addInfo(peer.newInfo(KeyNodeCount, "ten", time.Hour))
+	peer.addInfo(peer.newInfo(KeyClusterID, "cluster", time.Hour))
+	delta, err := encodeDelta(peer.delta(emptyAddr, 0, 0), CompressionNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := &proto.GossipRequest{
+		Addr:   *proto.FromNetAddr(peerAddr),
+		LAddr:  *proto.FromNetAddr(peerAddr),
+		MaxSeq: -1,
+		Delta:  delta,
+	}
+	if err := g.Gossip(args, &proto.GossipResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if dropped := g.InfosDropped(); dropped != 1 {
+		t.Errorf("expected 1 dropped info; got %d", dropped)
+	}
+	if _, err := g.GetInfo(KeyNodeCount); err == nil {
+		t.Error("expected invalid node count to be dropped")
+	}
+	var clusterID string
+	if err := g.GetInfoAs(KeyClusterID, &clusterID); err != nil || clusterID != "cluster" {
+		t.Errorf("expected cluster ID; got %q, %v", clusterID, err)
+	}
+}
+
+// isNetworkHeardSince returns true if every node has received fresh
+// info originated by every other node at or after the specified wall
+// time.
+func isNetworkHeardSince(since int64, nodes map[string]*Gossip) bool {
+	for addr, node := range nodes {
+		node.mu.Lock()
+		heard := node.is.heard
+		for peer := range nodes {
+			if h, ok := heard[peer]; peer != addr && (!ok || h.at < since) {
+				node.mu.Unlock()
+				return false
+			}
+		}
+		node.mu.Unlock()
+	}
+	return true
+}
+
+// isPartitionDetected returns true if every node finds a majority of
+// the nodes on the far side of a partition unreachable.
+func isPartitionDetected(nodes map[string]*Gossip, side map[string]bool) bool {
+	for addr, node := range nodes {
+		node.mu.Lock()
+		unreachable := node.unreachable(time.Now().UnixNano())
+		node.mu.Unlock()
+		var far, count int
+		for peer := range nodes {
+			if side[peer] != side[addr] {
+				far++
+				if unreachable.hasAddr(nodes[peer].is.NodeAddr) {
+					count++
+				}
+			}
+		}
+		if count*2 <= far {
+			return false
+		}
+	}
+	return true
+}
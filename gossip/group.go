@@ -18,7 +18,10 @@
 package gossip
 
 import (
+	"fmt"
 	"math"
+	"math/rand"
+	"net"
 	"reflect"
 	"sort"
 	"time"
@@ -35,22 +38,58 @@ const (
 	MinGroup GroupType = iota
 	// MaxGroup maintains maximum values for keys matching group prefix.
 	MaxGroup
+	// RecentGroup maintains the most recently originated infos (by
+	// info timestamp) for keys matching group prefix.
+	RecentGroup
+	// PerNodeGroup maintains at most one info per originating node:
+	// the most recent. When full, the info from the node heard from
+	// least recently is evicted.
+	PerNodeGroup
+	// SampledGroup maintains a uniformly random sample of fixed size
+	// (a reservoir) of the infos offered for keys matching group
+	// prefix.
+	SampledGroup
 )
 
+// String returns the name of the group type.
+func (t GroupType) String() string {
+	switch t {
+	case MinGroup:
+		return "min"
+	case MaxGroup:
+		return "max"
+	case RecentGroup:
+		return "recent"
+	case PerNodeGroup:
+		return "per-node"
+	case SampledGroup:
+		return "sampled"
+	}
+	return fmt.Sprintf("GroupType(%d)", int(t))
+}
+
 // group organizes a collection of Info objects sharing a common key
 // prefix (prefix is defined up to the last period character '.').
 // Groups maintain a limited-size set of Info objects with set
-// inclusion determined by group type. Two types are implemented here:
+// inclusion determined by group type. The types implemented here:
 //
 // MinGroup, MaxGroup: maintain only minimum/maximum values added
 // to group respectively.
+//
+// RecentGroup: maintains only the most recent infos added to group.
+//
+// PerNodeGroup: maintains the most recent info from each originating
+// node, and only the most recently heard from nodes.
+//
+// SampledGroup: maintains a reservoir sample of infos added to group.
 type group struct {
-	Prefix      string    // Key prefix for Info items in group
-	Limit       int       // Maximum number of keys in group
-	TypeOf      GroupType // Minimums or maximums of all values encountered
-	Infos       infoMap   // Map of infos in group
-	minTTLStamp int64     // Minimum of all infos' TTLs (Unix nanos)
-	gatekeeper  *info     // Minimum or maximum value in infos map, depending on type
+	Prefix      string              // Key prefix for Info items in group
+	Limit       int                 // Maximum number of keys in group
+	TypeOf      GroupType           // Determines which infos are kept when the group is full
+	Infos       infoMap             // Map of infos in group
+	minTTLStamp int64               // Minimum of all infos' TTLs (Unix nanos)
+	gatekeeper  *info               // Info first evicted from infos map, depending on type
+	offered     map[string]struct{} // Keys of infos offered to a SampledGroup
 }
 
 // groupMap is a map of group prefixes => *group.
@@ -67,6 +106,7 @@ func newGroup(prefix string, limit int, typeOf GroupType) *group {
 		TypeOf:      typeOf,
 		minTTLStamp: math.MaxInt64,
 		Infos:       make(infoMap),
+		offered:     make(map[string]struct{}),
 	}
 }
 
@@ -81,6 +121,11 @@ func (g *group) shouldInclude(i *info) bool {
 		return i.less(g.gatekeeper)
 	case MaxGroup:
 		return !i.less(g.gatekeeper)
+	case RecentGroup, PerNodeGroup:
+		return i.Timestamp > g.gatekeeper.Timestamp
+	case SampledGroup:
+		// Inclusion in sampled groups is random; see addInfo.
+		return true
 	default:
 		log.Printf("unknown group type %d", g.TypeOf)
 		return false
@@ -162,9 +207,10 @@ func (g *group) getInfo(key string) *info {
 	return nil
 }
 
-// infosAsArray returns an array of infos from group, sorted by value;
-// sort order is dependent on group type (MinGroup: ascending,
-// MaxGroup: descending).
+// infosAsArray returns an array of infos from group; sort order is
+// dependent on group type (MinGroup: ascending by value, MaxGroup:
+// descending by value, RecentGroup and PerNodeGroup: most recent
+// first, SampledGroup: by key).
 func (g *group) infosAsArray() infoArray {
 	now := time.Now().UnixNano()
 	infos := make(infoArray, 0, len(g.Infos))
@@ -181,10 +227,41 @@ func (g *group) infosAsArray() infoArray {
 		sort.Sort(infos)
 	case MaxGroup:
 		sort.Sort(sort.Reverse(infos))
+	case RecentGroup, PerNodeGroup:
+		sort.Sort(sort.Reverse(infosByTimestamp(infos)))
+	case SampledGroup:
+		sort.Sort(infosByKey(infos))
 	}
 	return infos
 }
 
+// nodeInfo returns the info in the group originated by the node at
+// addr, or nil if there is none.
+func (g *group) nodeInfo(addr net.Addr) *info {
+	for _, i := range g.Infos {
+		if addrString(i.NodeAddr) == addrString(addr) {
+			return i
+		}
+	}
+	return nil
+}
+
+// randomInfo returns an info selected uniformly at random from the
+// group, or nil if the group is empty.
+func (g *group) randomInfo() *info {
+	if len(g.Infos) == 0 {
+		return nil
+	}
+	n := rand.Intn(len(g.Infos))
+	for _, i := range g.Infos {
+		if n == 0 {
+			return i
+		}
+		n--
+	}
+	return nil
+}
+
 // addInfo adds the info to the group if there is sufficient space
 // or if the info has a value which guarantees it a spot within the
 // group according to the group type.
@@ -194,37 +271,72 @@ func (g *group) infosAsArray() infoArray {
 // currently have.
 func (g *group) addInfo(i *info) error {
 	// First, see if info is already in the group. If so, and this
-	// info timestamp is newer, remove existing info.  If the
+	// info timestamp is newer, it replaces the existing info. If the
 	// timestamps are equal (i.e. this is the same info), but hops
 	// value of prospective info is lower, take the minimum of the two
 	// Hops values.
-	if existingInfo, ok := g.Infos[i.Key]; ok {
-		if existingInfo.Timestamp < i.Timestamp ||
-			(existingInfo.Timestamp == i.Timestamp && existingInfo.Hops > i.Hops) {
-			g.removeInternal(i)
-		} else {
-			return util.Errorf("current group info %+v newer than proposed info %+v", existingInfo, i)
+	existingInfo, replacing := g.Infos[i.Key]
+	if replacing && !(existingInfo.Timestamp < i.Timestamp ||
+		(existingInfo.Timestamp == i.Timestamp && existingInfo.Hops > i.Hops)) {
+		return util.Errorf("current group info %+v newer than proposed info %+v", existingInfo, i)
+	}
+
+	// Per node groups keep only the most recent info from each node,
+	// which may have a different key.
+	if g.TypeOf == PerNodeGroup && !replacing {
+		if existingInfo = g.nodeInfo(i.NodeAddr); existingInfo != nil {
+			if existingInfo.Timestamp >= i.Timestamp {
+				return util.Errorf("current group info %+v from node %s newer than proposed info %+v",
+					existingInfo, addrString(i.NodeAddr), i)
+			}
+			replacing = true
 		}
 	}
 
-	// If the group is not empty, verify types match by comparing to
-	// gatekeeper.
-	if g.gatekeeper != nil {
-		t1 := reflect.TypeOf(i.Val).Kind()
-		t2 := reflect.TypeOf(g.gatekeeper.Val).Kind()
+	// Min and max group values must be ordered. If the group holds
+	// other infos, verify types match by comparing to gatekeeper.
+	if (g.TypeOf == MinGroup || g.TypeOf == MaxGroup) && !isOrdered(i.Val) {
+		return util.Errorf("info %+v has type %T which can't be ordered within a group", i, i.Val)
+	}
+	if g.gatekeeper != nil && !(replacing && len(g.Infos) == 1) {
+		t1 := reflect.TypeOf(i.Val)
+		t2 := reflect.TypeOf(g.gatekeeper.Val)
 		if t1 != t2 {
 			return util.Errorf("info %+v has type %s whereas group has type %s", i, t1, t2)
 		}
 	}
 
+	// A replacement takes the place of the info it replaces.
+	if replacing {
+		g.removeInternal(existingInfo)
+		g.addInternal(i)
+		return nil
+	}
+
 	// If there's free space or we successfully compacted, add info.
+	if g.TypeOf == SampledGroup {
+		g.offered[i.Key] = struct{}{}
+	}
 	if len(g.Infos) < g.Limit || g.compact() {
 		g.addInternal(i)
 		return nil // Successfully appended to group
 	}
 
-	// Group limit is reached. Check gatekeeper; if we should include,
-	// it means we toss current gatekeeper and add info.
+	// Group limit is reached. For sampled groups, the info with the
+	// nth distinct key offered replaces a random info with probability
+	// Limit/n, so that each key offered is equally likely to be in the
+	// sample. Infos re-offered for a key don't count again.
+	if g.TypeOf == SampledGroup {
+		if rand.Int63n(int64(len(g.offered))) < int64(g.Limit) {
+			g.removeInternal(g.randomInfo())
+			g.addInternal(i)
+			return nil
+		}
+		return util.Errorf("info %+v not sampled into group", i)
+	}
+
+	// Otherwise, check gatekeeper; if we should include, it means we
+	// toss current gatekeeper and add info.
 	if g.shouldInclude(i) {
 		g.removeInternal(g.gatekeeper)
 		g.addInternal(i)
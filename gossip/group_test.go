@@ -111,6 +111,59 @@ func TestTypeMismatch(t *testing.T) {
 	}
 }
 
+// TestRejectedReplacement verifies that an info which fails
+// validation leaves the info it would have replaced in the group.
+func TestRejectedReplacement(t *testing.T) {
+	group := newGroup("a", 2, MinGroup)
+	for _, i := range []*info{newTestInfo("a.a", int64(1)), newTestInfo("a.b", int64(2))} {
+		if err := group.addInfo(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := group.addInfo(newTestInfo("a.a", "foo")); err == nil {
+		t.Error("expected error replacing int64 info with string info")
+	}
+	if i := group.getInfo("a.a"); i == nil || i.Val.(int64) != 1 {
+		t.Errorf("expected rejected replacement to leave info in group; got %+v", i)
+	}
+
+	perNode := newGroup("a", 2, PerNodeGroup)
+	i1 := newTestInfo("a.1a", int64(1))
+	i1.NodeAddr = testAddr("node1")
+	i2 := newTestInfo("a.2", int64(2))
+	i2.NodeAddr = testAddr("node2")
+	for _, i := range []*info{i1, i2} {
+		if err := perNode.addInfo(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	i1b := newTestInfo("a.1b", "foo")
+	i1b.NodeAddr = testAddr("node1")
+	if err := perNode.addInfo(i1b); err == nil {
+		t.Error("expected error replacing int64 info with string info")
+	}
+	if perNode.getInfo("a.1a") == nil {
+		t.Errorf("expected rejected replacement to leave node1's info in group; got %+v", perNode.infosAsArray())
+	}
+}
+
+// TestUnorderedValues verifies that values which can't be ordered
+// are rejected from groups, as are values of a different type but
+// the same kind as the group's.
+func TestUnorderedValues(t *testing.T) {
+	group := newGroup("a", 2, MinGroup)
+	if err := group.addInfo(newTestInfo("a.a", []byte("foo"))); err == nil {
+		t.Error("expected error inserting unordered value into group")
+	}
+	if err := group.addInfo(newTestInfo("a.b", &testValue{1, "b"})); err != nil {
+		t.Fatal(err)
+	}
+	type otherValue struct{ testValue }
+	if err := group.addInfo(newTestInfo("a.c", &otherValue{testValue{0, "c"}})); err == nil {
+		t.Error("expected error inserting value of another pointer type into group")
+	}
+}
+
 // TestSameKeyInserts inserts the same key into group and verifies
 // earlier timestamps are ignored and later timestamps always replace it.
 func TestSameKeyInserts(t *testing.T) {
@@ -336,3 +389,126 @@ func TestGroupWithStructVal(t *testing.T) {
 		t.Error("Ordered interface not working properly with groups")
 	}
 }
+
+// TestRecentGroup verifies that recent groups keep the most recently
+// originated infos, regardless of value, and evict the oldest.
+func TestRecentGroup(t *testing.T) {
+	g := newGroup("a", 3, RecentGroup)
+	var infos infoArray
+	for i := 0; i < 5; i++ {
+		info := newTestInfo(fmt.Sprintf("a.%d", i), int64(5-i))
+		infos = append(infos, info)
+		if err := g.addInfo(info); err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+	}
+	// An info older than all in the full group isn't added.
+	stale := newTestInfo("a.stale", int64(0))
+	stale.Timestamp = infos[0].Timestamp
+	if err := g.addInfo(stale); err == nil {
+		t.Error("expected stale info to be rejected from full group")
+	}
+
+	result := g.infosAsArray()
+	if len(result) != 3 {
+		t.Fatalf("expected 3 infos; got %d", len(result))
+	}
+	for j, i := range result {
+		if exp := infos[4-j]; i != exp {
+			t.Errorf("%d: expected %s; got %s", j, exp.Key, i.Key)
+		}
+	}
+
+	// Expired infos are compacted to make room for older ones.
+	g.Infos["a.4"].TTLStamp = monotonicUnixNano()
+	g.minTTLStamp = g.Infos["a.4"].TTLStamp
+	if err := g.addInfo(newTestInfo("a.5", int64(0))); err != nil {
+		t.Error(err)
+	}
+	if g.getInfo("a.4") != nil || g.getInfo("a.5") == nil || len(g.Infos) != 3 {
+		t.Errorf("expected expired info replaced; got %+v", g.infosAsArray())
+	}
+}
+
+// TestPerNodeGroup verifies that per node groups keep only the most
+// recent info from each node, and only the most recently heard from
+// nodes.
+func TestPerNodeGroup(t *testing.T) {
+	g := newGroup("a", 2, PerNodeGroup)
+	newNodeInfo := func(key, node string) *info {
+		i := newTestInfo(key, int64(1))
+		i.NodeAddr = testAddr(node)
+		return i
+	}
+	n1a := newNodeInfo("a.1a", "node1")
+	n2 := newNodeInfo("a.2", "node2")
+	n1b := newNodeInfo("a.1b", "node1")
+	for _, i := range []*info{n1a, n2, n1b} {
+		if err := g.addInfo(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The newer info from node1 replaced the older, under a new key.
+	if len(g.Infos) != 2 || g.getInfo("a.1a") != nil || g.getInfo("a.1b") == nil {
+		t.Errorf("expected one info per node; got %+v", g.infosAsArray())
+	}
+	// An older info from node1 is rejected.
+	if err := g.addInfo(n1a); err == nil {
+		t.Error("expected older info from node1 to be rejected")
+	}
+
+	// A third node evicts node2, heard from least recently.
+	if err := g.addInfo(newNodeInfo("a.3", "node3")); err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Infos) != 2 || g.getInfo("a.2") != nil || g.getInfo("a.3") == nil {
+		t.Errorf("expected node2 evicted; got %+v", g.infosAsArray())
+	}
+}
+
+// TestSampledGroup verifies that sampled groups respect their limit
+// and that every info offered is roughly equally likely to be kept.
+func TestSampledGroup(t *testing.T) {
+	const limit = 10
+	const offered = 50
+	const trials = 2000
+	counts := make([]int, offered)
+	for trial := 0; trial < trials; trial++ {
+		g := newGroup("a", limit, SampledGroup)
+		for i := 0; i < offered; i++ {
+			g.addInfo(newTestInfo(fmt.Sprintf("a.%02d", i), int64(i)))
+		}
+		if len(g.Infos) != limit {
+			t.Fatalf("expected %d sampled infos; got %d", limit, len(g.Infos))
+		}
+		for _, i := range g.infosAsArray() {
+			counts[i.Val.(int64)]++
+		}
+	}
+	// Each info is expected in limit/offered of trials (400). Allow
+	// a generous margin of more than seven standard deviations.
+	for i, count := range counts {
+		if count < 250 || count > 550 {
+			t.Errorf("info %d sampled in %d of %d trials; expected ~%d", i, count, trials, trials*limit/offered)
+		}
+	}
+
+	// Updates to sampled infos always replace them in the sample.
+	g := newGroup("a", 1, SampledGroup)
+	g.addInfo(newTestInfo("a.a", int64(1)))
+	if err := g.addInfo(newTestInfo("a.a", int64(2))); err != nil {
+		t.Fatal(err)
+	}
+	if i := g.getInfo("a.a"); i == nil || i.Val.(int64) != 2 || len(g.offered) != 1 {
+		t.Errorf("expected updated info; got %+v", i)
+	}
+
+	// Re-offering a key which wasn't sampled doesn't count as another
+	// offer.
+	for i := 0; i < 10; i++ {
+		g.addInfo(newTestInfo("a.b", int64(i)))
+	}
+	if len(g.offered) != 2 {
+		t.Errorf("expected 2 keys offered; got %d", len(g.offered))
+	}
+}
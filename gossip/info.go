@@ -1,6 +1,8 @@
 package gossip
 
 import (
+	"bytes"
+	"encoding/gob"
 	"log"
 	"net"
 	"strings"
@@ -38,20 +40,37 @@ func infoPrefix(key string) string {
 }
 
 // less returns true if i's value is less than b's value. i's and
-// b's types must match.
+// b's types must match; values which aren't ordered (see isOrdered)
+// or whose types don't match are never less.
 func (i *info) less(b *info) bool {
 	switch t := i.Val.(type) {
 	case int64:
-		return t < b.Val.(int64)
+		if bv, ok := b.Val.(int64); ok {
+			return t < bv
+		}
 	case float64:
-		return t < b.Val.(float64)
+		if bv, ok := b.Val.(float64); ok {
+			return t < bv
+		}
 	case string:
-		return t < b.Val.(string)
-	default:
-		if ord, ok := i.Val.(Ordered); ok {
-			return ord.Less(b.Val.(Ordered))
+		if bv, ok := b.Val.(string); ok {
+			return t < bv
 		}
-		log.Fatalf("unhandled info value type: %s", t)
+	case Ordered:
+		if bv, ok := b.Val.(Ordered); ok {
+			return t.Less(bv)
+		}
+	}
+	log.Printf("can't order info values of types %T and %T", i.Val, b.Val)
+	return false
+}
+
+// isOrdered returns true if the value may be ordered by info.less,
+// as required of the values of infos in groups.
+func isOrdered(val interface{}) bool {
+	switch val.(type) {
+	case int64, float64, string, Ordered:
+		return true
 	}
 	return false
 }
@@ -77,6 +96,31 @@ func (i *info) isFresh(addr net.Addr, seq int64) bool {
 	return true
 }
 
+// infoOverhead approximates the encoded size of an info's fixed
+// width fields: timestamps, hops and the network of its node address.
+const infoOverhead = 32
+
+// size returns an estimate of the info's encoded size in bytes. It's
+// used to fit deltas within a byte budget and needn't be exact.
+func (i *info) size() int {
+	size := infoOverhead + len(i.Key)
+	if i.NodeAddr != nil {
+		size += len(i.NodeAddr.String())
+	}
+	switch t := i.Val.(type) {
+	case int64, float64:
+		size += 8
+	case string:
+		size += len(t)
+	default:
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(i.Val); err == nil {
+			size += buf.Len()
+		}
+	}
+	return size
+}
+
 // infoMap is a map of keys to info object pointers.
 type infoMap map[string]*info
 
@@ -87,3 +131,27 @@ type infoArray []*info
 func (a infoArray) Len() int           { return len(a) }
 func (a infoArray) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a infoArray) Less(i, j int) bool { return a[i].less(a[j]) }
+
+// infosByTimestamp implements sort.Interface, ordering infos by
+// timestamp.
+type infosByTimestamp infoArray
+
+func (a infosByTimestamp) Len() int           { return len(a) }
+func (a infosByTimestamp) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a infosByTimestamp) Less(i, j int) bool { return a[i].Timestamp < a[j].Timestamp }
+
+// infosByKey implements sort.Interface, ordering infos by key.
+type infosByKey infoArray
+
+func (a infosByKey) Len() int           { return len(a) }
+func (a infosByKey) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a infosByKey) Less(i, j int) bool { return a[i].Key < a[j].Key }
+
+// addrString returns the string form of addr, or the empty string if
+// addr is nil.
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
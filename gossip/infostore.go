@@ -18,8 +18,10 @@
 package gossip
 
 import (
+	"log"
 	"math"
 	"net"
+	"sort"
 	"sync"
 	"time"
 
@@ -37,11 +39,19 @@ import (
 //
 // infoStores are not thread safe.
 type infoStore struct {
-	Infos    infoMap  // Map from key to info
-	Groups   groupMap // Map from key prefix to groups of infos
-	NodeAddr net.Addr // Address of node owning this info store: "host:port"
-	MaxSeq   int64    // Maximum sequence number inserted
-	seqGen   int64    // Sequence generator incremented each time info is added
+	Infos    infoMap              // Map from key to info
+	Groups   groupMap             // Map from key prefix to groups of infos
+	NodeAddr net.Addr             // Address of node owning this info store: "host:port"
+	MaxSeq   int64                // Maximum sequence number inserted
+	seqGen   int64                // Sequence generator incremented each time info is added
+	heard    map[string]heardFrom // Originating node address -> latest receipt of its infos
+}
+
+// heardFrom records when fresh info originated by a node was last
+// combined into an info store.
+type heardFrom struct {
+	addr net.Addr // Originating node's address
+	at   int64    // Wall time of receipt (Unix-nanos)
 }
 
 // monotonicUnixNano returns a monotonically increasing value for
@@ -84,6 +94,7 @@ func newInfoStore(nodeAddr net.Addr) *infoStore {
 		Infos:    infoMap{},
 		Groups:   groupMap{},
 		NodeAddr: nodeAddr,
+		heard:    map[string]heardFrom{},
 	}
 }
 
@@ -255,12 +266,28 @@ func (is *infoStore) visitInfos(visitGroup func(*group) error, visitInfo func(*i
 // The sequence numbers on all info objects are reset using the info
 // store's sequence generator. All hop distances on infos are
 // incremented to indicate they've arrived from an external source.
-// Returns the count of "fresh" infos in the provided delta.
+// Returns the count of "fresh" infos in the provided delta. The
+// originating nodes of fresh infos are recorded as heard from.
 func (is *infoStore) combine(delta *infoStore) int {
+	return is.combineInfos(delta, true)
+}
+
+// restore combines infos reloaded from a checkpoint with the current
+// infoStore, as combine does. Reloaded infos say nothing about
+// whether their originating nodes are alive, so those nodes aren't
+// recorded as heard from. Returns the count of "fresh" infos.
+func (is *infoStore) restore(snapshot *infoStore) int {
+	return is.combineInfos(snapshot, false)
+}
+
+// combineInfos implements combine and restore. If heard is true, the
+// originating nodes of fresh infos are recorded as heard from.
+func (is *infoStore) combineInfos(delta *infoStore, heard bool) int {
 	// combine group info. If the group doesn't yet exist, register
 	// it. Extract the infos from the group and combine them
 	// one-by-one using addInfo.
 	var freshCount int
+	now := time.Now().UnixNano()
 	delta.visitInfos(func(g *group) error {
 		if _, ok := is.Groups[g.Prefix]; !ok {
 			// Make a copy of the group.
@@ -275,19 +302,54 @@ func (is *infoStore) combine(delta *infoStore) int {
 		i.peerAddr = delta.NodeAddr
 		if is.addInfo(i) == nil {
 			freshCount++
+			if heard {
+				is.heard[i.NodeAddr.String()] = heardFrom{addr: i.NodeAddr, at: now}
+			}
 		}
 		return nil
 	})
 	return freshCount
 }
 
+// dropInvalid removes infos received from a peer whose values don't
+// match the types registered for their keys, or which belong to a
+// min or max group but can't be ordered. Returns the count of infos
+// dropped.
+func (is *infoStore) dropInvalid() int {
+	var dropped int
+	check := func(infos infoMap, ordered bool) {
+		for key, i := range infos {
+			err := checkInfoType(key, i.Val)
+			if err == nil && ordered && !isOrdered(i.Val) {
+				err = util.Errorf("info %q has type %T which can't be ordered within a group", key, i.Val)
+			}
+			if err != nil {
+				log.Printf("dropping gossip from %s: %s", is.NodeAddr, err)
+				delete(infos, key)
+				dropped++
+			}
+		}
+	}
+	for _, g := range is.Groups {
+		check(g.Infos, g.TypeOf == MinGroup || g.TypeOf == MaxGroup)
+	}
+	check(is.Infos, false)
+	return dropped
+}
+
 // delta returns an incremental delta of infos added to the info store
 // since (not including) the specified sequence number. These deltas
 // are intended for efficiently updating peer nodes. Any infos passed
 // from node requesting delta are ignored.
 //
+// If maxBytes is greater than zero, the delta is limited to the
+// infos, in sequence order, whose estimated sizes fit within maxBytes
+// (but always includes at least one info). The delta's MaxSeq is then
+// the sequence number of the last included info, so that the peer
+// requests the remainder in subsequent rounds.
+//
 // Returns nil if there are no deltas.
-func (is *infoStore) delta(addr net.Addr, seq int64) *infoStore {
+func (is *infoStore) delta(addr net.Addr, seq int64, maxBytes int) *infoStore {
 	if seq >= is.MaxSeq {
 		return nil
 	}
@@ -295,21 +357,60 @@ func (is *infoStore) delta(addr net.Addr, seq int64) *infoStore {
 	delta := newInfoStore(is.NodeAddr)
 
 	// Compute delta of groups and infos.
+	var fresh infoArray
 	is.visitInfos(func(g *group) error {
 		gDelta := newGroup(g.Prefix, g.Limit, g.TypeOf)
 		delta.registerGroup(gDelta)
 		return nil
 	}, func(i *info) error {
 		if i.isFresh(addr, seq) {
-			delta.addInfo(i)
+			fresh = append(fresh, i)
 		}
 		return nil
 	})
 
+	if maxBytes > 0 {
+		sort.Sort(infosBySeq(fresh))
+	}
 	delta.MaxSeq = is.MaxSeq
+	var size int
+	for idx, i := range fresh {
+		if maxBytes > 0 {
+			if size += i.size(); size > maxBytes && idx > 0 {
+				delta.MaxSeq = fresh[idx-1].seq
+				break
+			}
+		}
+		delta.addInfo(i)
+	}
 	return delta
 }
 
+// snapshot returns a copy of the info store containing all groups
+// and all non-expired infos. Infos are copied so that the snapshot
+// may be encoded without holding the lock which protects the info
+// store; values are shared, as infos are never modified in place.
+func (is *infoStore) snapshot() *infoStore {
+	snapshot := newInfoStore(is.NodeAddr)
+	is.visitInfos(func(g *group) error {
+		snapshot.registerGroup(newGroup(g.Prefix, g.Limit, g.TypeOf))
+		return nil
+	}, func(i *info) error {
+		iCopy := *i
+		snapshot.addInfo(&iCopy)
+		return nil
+	})
+	return snapshot
+}
+
+// infosBySeq implements sort.Interface, ordering infos by sequence
+// number.
+type infosBySeq infoArray
+
+func (a infosBySeq) Len() int           { return len(a) }
+func (a infosBySeq) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a infosBySeq) Less(i, j int) bool { return a[i].seq < a[j].seq }
+
 // distant returns an addrSet of node addresses for gossip peers which
 // originated infos with info.Hops > maxHops.
 func (is *infoStore) distant(maxHops uint32) *addrSet {
@@ -344,6 +344,45 @@ func TestCombine(t *testing.T) {
 	}
 }
 
+// TestCombineGroupTypes verifies that deltas of recent and sampled
+// groups register groups of the same type and limit on combine, and
+// that combined infos respect the group types.
+func TestCombineGroupTypes(t *testing.T) {
+	is1 := newInfoStore(testAddr("<addr1>"))
+	is2 := newInfoStore(testAddr("<addr2>"))
+	if is2.registerGroup(newGroup("r", 2, RecentGroup)) != nil ||
+		is2.registerGroup(newGroup("s", 3, SampledGroup)) != nil {
+		t.Fatal("unable to register groups")
+	}
+	for i := 0; i < 5; i++ {
+		is2.addInfo(is2.newInfo(fmt.Sprintf("r.%d", i), int64(i), time.Hour))
+		is2.addInfo(is2.newInfo(fmt.Sprintf("s.%d", i), int64(i), time.Hour))
+	}
+
+	if freshCount := is1.combine(is2.delta(is1.NodeAddr, 0, 0)); freshCount != 5 {
+		t.Errorf("expected 5 fresh infos; got %d", freshCount)
+	}
+	for prefix, typeOf := range map[string]GroupType{"r": RecentGroup, "s": SampledGroup} {
+		g, ok := is1.Groups[prefix]
+		if !ok || g.TypeOf != typeOf || g.Limit != is2.Groups[prefix].Limit {
+			t.Errorf("expected group %q of type %d; got %+v", prefix, typeOf, g)
+		}
+	}
+	if infos := is1.getGroupInfos("r"); len(infos) != 2 || infos[0].Key != "r.4" || infos[1].Key != "r.3" {
+		t.Errorf("expected most recent infos r.4, r.3; got %+v", infos)
+	}
+
+	// A newer info originated by is1 evicts the oldest from is2's
+	// recent group once gossiped back.
+	is1.addInfo(is1.newInfo("r.5", int64(5), time.Hour))
+	if freshCount := is2.combine(is1.delta(is2.NodeAddr, 0, 0)); freshCount != 1 {
+		t.Errorf("expected 1 fresh info; got %d", freshCount)
+	}
+	if infos := is2.getGroupInfos("r"); len(infos) != 2 || infos[0].Key != "r.5" || infos[1].Key != "r.4" {
+		t.Errorf("expected most recent infos r.5, r.4; got %+v", infos)
+	}
+}
+
 // Helper method creates an infostore with two groups with 10
 // infos each and 10 non-group infos.
 func createTestInfoStore(t *testing.T) *infoStore {
@@ -377,7 +416,7 @@ func TestInfoStoreDelta(t *testing.T) {
 
 	// Verify deltas with successive sequence numbers.
 	for i := 0; i < 10; i++ {
-		delta := is.delta(testAddr("<client-addr>"), int64(i*3))
+		delta := is.delta(testAddr("<client-addr>"), int64(i*3), 0)
 		infosA := delta.getGroupInfos("a")
 		infosB := delta.getGroupInfos("b")
 		if len(infosA) != 10-i || len(infosB) != 10-i {
@@ -404,11 +443,55 @@ func TestInfoStoreDelta(t *testing.T) {
 		}
 	}
 
-	if delta := is.delta(emptyAddr, int64(30)); delta != nil {
+	if delta := is.delta(emptyAddr, int64(30), 0); delta != nil {
 		t.Error("fetching delta of infostore at maximum sequence number should return nil")
 	}
 }
 
+// TestInfoStoreDeltaPaging verifies that deltas limited to a byte
+// budget page through fresh infos in sequence order.
+func TestInfoStoreDeltaPaging(t *testing.T) {
+	is := createTestInfoStore(t)
+	// All test infos have the same estimated size; fit three per page.
+	maxBytes := 3 * is.getInfo("c.0").size()
+
+	seen := map[string]struct{}{}
+	seq := int64(0)
+	for page := 0; ; page++ {
+		delta := is.delta(testAddr("<client-addr>"), seq, maxBytes)
+		if delta == nil {
+			if page != 10 {
+				t.Errorf("expected 10 pages; got %d", page)
+			}
+			break
+		}
+		var count int
+		delta.visitInfos(nil, func(i *info) error {
+			if i.seq <= seq || i.seq > delta.MaxSeq {
+				t.Errorf("page %d: info %s with seq %d outside (%d, %d]", page, i.Key, i.seq, seq, delta.MaxSeq)
+			}
+			if _, ok := seen[i.Key]; ok {
+				t.Errorf("page %d: info %s sent twice", page, i.Key)
+			}
+			seen[i.Key] = struct{}{}
+			count++
+			return nil
+		})
+		if count != 3 {
+			t.Errorf("page %d: expected 3 infos; got %d", page, count)
+		}
+		seq = delta.MaxSeq
+	}
+	if len(seen) != 30 {
+		t.Errorf("expected all 30 infos to be paged; got %d", len(seen))
+	}
+
+	// A budget smaller than a single info still makes progress.
+	if delta := is.delta(testAddr("<client-addr>"), 0, 1); delta == nil || delta.MaxSeq != 1 {
+		t.Errorf("expected a single info delta; got %+v", delta)
+	}
+}
+
 // TestInfoStoreDistant verifies selection of infos from store with
 // Hops > maxHops.
 func TestInfoStoreDistant(t *testing.T) {
@@ -32,9 +32,9 @@ const (
 	KeyMaxAvailCapacityPrefix = "max-avail-capacity-"
 
 	// KeyNodeCount is the count of gossip nodes in the network.  The
-	// value is an int64 containing the count of nodes in the cluster.
-	// TODO(spencer): should remove this and instead just count the
-	//   number of node ids being gossiped.
+	// value is an int64 containing the count of nodes in the cluster,
+	// derived from the node ids being gossiped. It's maintained by the
+	// node holding the first range.
 	KeyNodeCount = "node-count"
 
 	// KeyNodeIDPrefix is the key prefix for gossiping node id
@@ -43,6 +43,12 @@ const (
 	// string address of the node. E.g. node-1bfa: fwd56.sjcb1:24001
 	KeyNodeIDPrefix = "node-"
 
+	// KeyHeartbeatPrefix is the key prefix for the heartbeat gossiped
+	// by nodes which haven't recently originated any other info. The
+	// key is suffixed with the node's gossip address and the value is
+	// the address. See Gossip.unreachable().
+	KeyHeartbeatPrefix = "heartbeat-"
+
 	// KeySentinel is a key for gossip which must not expire or else the
 	// node considers itself partitioned and will retry with bootstrap hosts.
 	KeySentinel = KeyClusterID
@@ -18,21 +18,115 @@
 package gossip
 
 import (
-	"net"
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+	"io/ioutil"
+
+	"github.com/golang/snappy"
+
+	"gossipgo/util"
 )
 
-// GossipRequest is passed to the Gossip.Gossip RPC.
-type GossipRequest struct {
-	Addr   net.Addr // Address of requesting node's server
-	LAddr  net.Addr // Local address of client on requesting node
-	MaxSeq int64    // Maximum sequence number of gossip from this peer
+// The Gossip.Gossip RPC is served with the proto.GossipRequest and
+// proto.GossipResponse messages. Infostore deltas are carried in
+// their Delta fields gob-encoded, as info values may be of any type
+// registered with gob. An empty Delta means no delta.
+//
+// Deltas may be compressed with one of the codecs below, named in the
+// message's Compression field. Each connection negotiates its codec:
+// the client lists the codecs it accepts with each request and the
+// server compresses its reply with the first one it supports. The
+// client compresses subsequent requests with the codec the server
+// last replied with, which the server is then known to support.
+
+const (
+	// CompressionNone leaves deltas uncompressed.
+	CompressionNone = ""
+	// CompressionSnappy compresses deltas with snappy.
+	CompressionSnappy = "snappy"
+	// CompressionGzip compresses deltas with gzip.
+	CompressionGzip = "gzip"
+)
+
+// validCompression returns true if codec is a supported compression
+// codec.
+func validCompression(codec string) bool {
+	switch codec {
+	case CompressionNone, CompressionSnappy, CompressionGzip:
+		return true
+	}
+	return false
+}
+
+// negotiateCompression returns the first supported codec from the
+// accepted codecs, or CompressionNone if none are supported.
+func negotiateCompression(accept []string) string {
+	for _, codec := range accept {
+		if validCompression(codec) {
+			return codec
+		}
+	}
+	return CompressionNone
+}
 
-	Delta *infoStore // Reciprocal delta of new info since last gossip
+// encodeDelta encodes an infostore delta for a gossip message,
+// compressed with the specified codec. A nil delta is encoded as nil.
+func encodeDelta(delta *infoStore, codec string) ([]byte, error) {
+	if delta == nil {
+		return nil, nil
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(delta); err != nil {
+		return nil, err
+	}
+	switch codec {
+	case CompressionNone:
+		return buf.Bytes(), nil
+	case CompressionSnappy:
+		return snappy.Encode(nil, buf.Bytes()), nil
+	case CompressionGzip:
+		var zbuf bytes.Buffer
+		w := gzip.NewWriter(&zbuf)
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return zbuf.Bytes(), nil
+	}
+	return nil, util.Errorf("unsupported gossip compression %q", codec)
 }
 
-// GossipResponse is returned from the Gossip.Gossip RPC.
-// Delta will be nil in the event that Alternate is set.
-type GossipResponse struct {
-	Delta     *infoStore // Requested delta of server's infostore
-	Alternate net.Addr   // Non-nil means client should retry with this address
+// decodeDelta decodes an infostore delta from a gossip message,
+// decompressing it with the specified codec. Returns nil if the
+// message carries no delta.
+func decodeDelta(data []byte, codec string) (*infoStore, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	switch codec {
+	case CompressionNone:
+	case CompressionSnappy:
+		var err error
+		if data, err = snappy.Decode(nil, data); err != nil {
+			return nil, err
+		}
+	case CompressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if data, err = ioutil.ReadAll(r); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, util.Errorf("unsupported gossip compression %q", codec)
+	}
+	delta := &infoStore{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(delta); err != nil {
+		return nil, err
+	}
+	return delta, nil
 }
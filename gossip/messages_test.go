@@ -0,0 +1,88 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package gossip
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestDeltaCompression verifies deltas round trip through each
+// compression codec and that unsupported codecs are rejected.
+func TestDeltaCompression(t *testing.T) {
+	addr, err := net.ResolveTCPAddr("tcp", "127.0.0.1:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	is := newInfoStore(addr)
+	for i := 0; i < 100; i++ {
+		is.addInfo(is.newInfo(fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i%10), time.Hour))
+	}
+	delta := is.delta(testAddr("<client-addr>"), 0, 0)
+	uncompressed, err := encodeDelta(delta, CompressionNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, codec := range []string{CompressionNone, CompressionSnappy, CompressionGzip} {
+		data, err := encodeDelta(delta, codec)
+		if err != nil {
+			t.Fatalf("%q: %s", codec, err)
+		}
+		if codec != CompressionNone && len(data) >= len(uncompressed) {
+			t.Errorf("%q: expected compressed size < %d; got %d", codec, len(uncompressed), len(data))
+		}
+		decoded, err := decodeDelta(data, codec)
+		if err != nil {
+			t.Fatalf("%q: %s", codec, err)
+		}
+		if decoded.MaxSeq != delta.MaxSeq || len(decoded.Infos) != len(delta.Infos) {
+			t.Errorf("%q: expected %d infos through %d; got %d through %d", codec,
+				len(delta.Infos), delta.MaxSeq, len(decoded.Infos), decoded.MaxSeq)
+		}
+		if i := decoded.getInfo("key-42"); i == nil || i.Val.(string) != "value-2" {
+			t.Errorf("%q: unexpected info %+v", codec, i)
+		}
+	}
+	if _, err := encodeDelta(delta, "lz4"); err == nil {
+		t.Error("expected error encoding with unsupported codec")
+	}
+	if _, err := decodeDelta(uncompressed, "lz4"); err == nil {
+		t.Error("expected error decoding with unsupported codec")
+	}
+}
+
+// TestNegotiateCompression verifies the first supported codec is
+// selected.
+func TestNegotiateCompression(t *testing.T) {
+	testCases := []struct {
+		accept []string
+		expect string
+	}{
+		{nil, CompressionNone},
+		{[]string{"lz4"}, CompressionNone},
+		{[]string{CompressionGzip}, CompressionGzip},
+		{[]string{"lz4", CompressionSnappy, CompressionGzip}, CompressionSnappy},
+	}
+	for i, test := range testCases {
+		if codec := negotiateCompression(test.accept); codec != test.expect {
+			t.Errorf("%d: expected %q; got %q", i, test.expect, codec)
+		}
+	}
+}
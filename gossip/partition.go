@@ -0,0 +1,120 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package gossip
+
+import (
+	"log"
+	"net"
+)
+
+const (
+	// heartbeatIntervals is the number of gossip intervals after
+	// which a node which hasn't otherwise originated any info gossips
+	// a heartbeat.
+	heartbeatIntervals = 5
+	// partitionIntervals is the number of gossip intervals after
+	// which a member from which no fresh info has been received is
+	// considered unreachable. It must comfortably exceed the
+	// heartbeat period.
+	partitionIntervals = 20
+	// forgetIntervals is the number of gossip intervals after which a
+	// member from which no fresh info has been received is forgotten,
+	// and no longer dialed when healing partitions. It's also the TTL
+	// of heartbeats.
+	forgetIntervals = 300
+)
+
+// heartbeat gossips this node's heartbeat if it hasn't originated
+// any info within heartbeatIntervals. Heartbeats let peers
+// distinguish members they can hear from, directly or transitively,
+// from those they can't. Must be called with the lock held.
+func (g *Gossip) heartbeat(now int64) {
+	var latest int64
+	self := g.is.NodeAddr.String()
+	g.is.visitInfos(nil, func(i *info) error {
+		if i.NodeAddr.String() == self && i.Timestamp > latest {
+			latest = i.Timestamp
+		}
+		return nil
+	})
+	if now-latest < int64(heartbeatIntervals*g.interval) {
+		return
+	}
+	key := KeyHeartbeatPrefix + self
+	if err := g.is.addInfo(g.is.newInfo(key, g.is.NodeAddr, forgetIntervals*g.interval)); err != nil {
+		log.Printf("unable to gossip heartbeat: %s", err)
+	}
+}
+
+// unreachable returns the members of the gossip network from which
+// no fresh info has been received within partitionIntervals gossip
+// intervals. The members are the other nodes from which fresh info
+// has been received within forgetIntervals; older members are
+// forgotten. Members are unreachable if they've failed or if the
+// network is partitioned; the two can't be distinguished, and either
+// way the membership and the reachable set differ. Receipt is timed
+// by the local clock, so this tolerates both slow propagation and
+// clock skew. Must be called with the lock held.
+func (g *Gossip) unreachable(now int64) *addrSet {
+	unreachable := newAddrSet(len(g.is.heard))
+	for key, h := range g.is.heard {
+		switch age := now - h.at; {
+		case age > int64(forgetIntervals*g.interval):
+			delete(g.is.heard, key)
+		case age > int64(partitionIntervals*g.interval):
+			unreachable.addAddr(h.addr)
+		}
+	}
+	unreachable.removeAddr(g.is.NodeAddr)
+	return unreachable
+}
+
+// heal attempts to heal a partition of the gossip network, if one is
+// detected, by connecting to an unreachable member. A member which
+// is also a bootstrap host is preferred. This catches partitions
+// which the sentinel check in manage() doesn't: when the sentinel's
+// originator is on the far side of a partition, both sides keep the
+// sentinel alive until its TTL expires.
+//
+// Connected clients aren't closed to make room: clients to the far
+// side of a partition fail, leaving room for replacements. Attempts
+// are made at most once per partitionIntervals, so that failed
+// members aren't dialed incessantly before they're forgotten.
+// Returns true if an attempt was made. Must be called with the lock
+// held.
+func (g *Gossip) heal(now int64) bool {
+	if g.outgoing.len() >= MaxPeers || now-g.lastHeal < int64(partitionIntervals*g.interval) {
+		return false
+	}
+	unreachable := g.filterExtant(g.unreachable(now))
+	if unreachable.len() == 0 {
+		return false
+	}
+	g.lastHeal = now
+	candidates := unreachable.filter(func(addr net.Addr) bool {
+		return g.bootstraps.hasAddr(addr)
+	})
+	if candidates.len() == 0 {
+		candidates = unreachable
+	}
+	addr := candidates.selectRandom()
+	log.Printf("%d gossip members unreachable; assuming partition and connecting to %s",
+		unreachable.len(), addr)
+	g.startClient(addr)
+	return true
+}
@@ -0,0 +1,205 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package gossip
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"gossipgo/proto"
+	"gossipgo/rpc"
+	"gossipgo/util"
+	"gossipgo/util/hlc"
+	"log"
+)
+
+// A partition divides a simulated network in two. Nodes on different
+// sides can't gossip with each other while the partition is split.
+type partition struct {
+	mu   sync.Mutex
+	side map[string]bool // Node address -> side; nil if not split
+}
+
+// split divides the network according to side, keyed by node
+// address. A nil side lifts the partition.
+func (p *partition) split(side map[string]bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.side = side
+}
+
+// divides returns true if the partition separates a from b.
+func (p *partition) divides(a, b net.Addr) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.side != nil && p.side[a.String()] != p.side[b.String()]
+}
+
+// partitionedServer serves the Gossip RPC in front of a node's gossip
+// server, refusing gossip from peers across the partition.
+type partitionedServer struct {
+	s    *server
+	addr net.Addr
+	p    *partition
+}
+
+// Gossip refuses gossip from peers on the far side of the partition
+// and otherwise passes through to the node's gossip server.
+func (ps *partitionedServer) Gossip(args *proto.GossipRequest, reply *proto.GossipResponse) error {
+	addr, err := args.Addr.NetAddr()
+	if err == nil && ps.p.divides(addr, ps.addr) {
+		return util.Errorf("gossip from %s refused by partition", addr)
+	}
+	return ps.s.Gossip(args, reply)
+}
+
+// simulatePartitionedNetwork is like SimulateNetwork over tcp, except
+// that each node's gossip is served by a partitionedServer, so that
+// the simulation callback may split the network using p.
+func simulatePartitionedNetwork(nodeCount int, gossipInterval time.Duration, p *partition,
+	simCallback func(cycle int, nodes map[string]*Gossip) bool) {
+
+	rpcContext := rpc.NewContext(hlc.NewClock(hlc.UnixNano, 0), nil)
+	servers := make([]*rpc.Server, nodeCount)
+	addrs := make([]net.Addr, nodeCount)
+	nodes := make(map[string]*Gossip, nodeCount)
+	for i := 0; i < nodeCount; i++ {
+		addr, err := createSimAddr("tcp")
+		if err != nil {
+			log.Fatalf("failed to create address: %s", err)
+		}
+		// The node registers its gossip server with an rpc server
+		// which never listens; the listening server serves it
+		// through the partition.
+		node := New(rpcContext, rpc.NewServer(addr, rpcContext))
+		node.Name = fmt.Sprintf("Node%d", i)
+		node.SetInterval(gossipInterval)
+		servers[i] = rpc.NewServer(addr, rpcContext)
+		servers[i].RegisterName("Gossip", &partitionedServer{s: node.server, addr: addr, p: p})
+		servers[i].AddCloseCallback(node.onClose)
+		go servers[i].ListenAndServe()
+		addrs[i] = addr
+		nodes[addr.String()] = node
+	}
+	bootstrap := addrs
+	if nodeCount > 3 {
+		bootstrap = addrs[:3]
+	}
+	for i := 0; i < nodeCount; i++ {
+		node := nodes[addrs[i].String()]
+		node.SetBootstrap(bootstrap)
+		if i == 0 {
+			if err := node.AddInfo(KeyNodeCount, int64(nodeCount), time.Hour); err != nil {
+				log.Fatalf("unable to gossip node count: %s", err)
+			}
+		}
+		node.Start()
+	}
+
+	gossipTimeout := time.Tick(gossipInterval)
+	for cycle := 0; ; cycle++ {
+		<-gossipTimeout
+		if err := nodes[addrs[0].String()].AddInfo(KeySentinel, fmt.Sprintf("cycle-%d", cycle), time.Hour); err != nil {
+			log.Fatalf("unable to gossip sentinel: %s", err)
+		}
+		if !simCallback(cycle, nodes) {
+			break
+		}
+	}
+
+	for i := 0; i < nodeCount; i++ {
+		servers[i].Close()
+		nodes[addrs[i].String()].Stop()
+	}
+}
+
+// TestPartitionHealing splits a 100 node network in two, with the
+// sentinel's originator on one side, so that both sides keep the
+// sentinel alive. Once both sides detect the partition, the split is
+// lifted, and the network is verified to re-merge within a bounded
+// number of cycles. Nodes gossip nothing but heartbeats, which
+// suffice to measure reachability.
+func TestPartitionHealing(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping 100 node simulation in short mode")
+	}
+	const numNodes = 100
+	const maxMergeCycles = 100
+	const maxCycles = 2000
+	var splitAt, joinAt, mergedAt int
+	var joinTime int64
+	side := map[string]bool{}
+	p := &partition{}
+	simulatePartitionedNetwork(numNodes, 100*time.Millisecond, p, func(cycle int, nodes map[string]*Gossip) bool {
+		switch {
+		case cycle > maxCycles:
+			return false
+		case splitAt == 0:
+			if !isNetworkHeardSince(0, nodes) {
+				return true
+			}
+			// Split nodes by index; Node0 originates the sentinel. Each
+			// side bootstraps from its own first three nodes, so that
+			// neither relies on the other to reconnect.
+			bootstraps := map[bool][]net.Addr{}
+			for addr, node := range nodes {
+				var idx int
+				fmt.Sscanf(node.Name, "Node%d", &idx)
+				side[addr] = idx < numNodes/2
+				if idx%(numNodes/2) < 3 {
+					bootstraps[side[addr]] = append(bootstraps[side[addr]], node.is.NodeAddr)
+				}
+			}
+			for addr, node := range nodes {
+				node.mu.Lock()
+				node.bootstraps = newAddrSet(MaxPeers)
+				for _, bootstrap := range bootstraps[side[addr]] {
+					if bootstrap.String() != addr {
+						node.bootstraps.addAddr(bootstrap)
+					}
+				}
+				node.mu.Unlock()
+			}
+			p.split(side)
+			splitAt = cycle
+		case joinAt == 0:
+			if !isPartitionDetected(nodes, side) {
+				return true
+			}
+			p.split(nil)
+			joinAt = cycle
+			joinTime = time.Now().UnixNano()
+		case isNetworkHeardSince(joinTime, nodes):
+			mergedAt = cycle
+			return false
+		}
+		return true
+	})
+
+	if joinAt == 0 {
+		t.Fatalf("expected partition to be detected within %d cycles (split at cycle %d)", maxCycles, splitAt)
+	}
+	if mergedAt == 0 || mergedAt-joinAt > maxMergeCycles {
+		t.Errorf("expected network to re-merge within %d cycles of lifting split at cycle %d; merged at %d",
+			maxMergeCycles, joinAt, mergedAt)
+	}
+	log.Printf("split at cycle %d; detected and lifted at %d; merged at %d", splitAt, joinAt, mergedAt)
+}
@@ -0,0 +1,90 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package gossip
+
+import "time"
+
+// rateLimiter limits the bytes of gossip sent to a single peer. It's
+// a token bucket which refills at rate bytes per second up to a
+// burst of one second's worth of bytes. Sends which exceed the
+// available tokens leave the bucket in debt, deferring later sends
+// until it's repaid.
+//
+// rateLimiters are not thread safe.
+type rateLimiter struct {
+	rate   int64 // Bytes per second
+	tokens int64 // Available bytes; negative when in debt
+	last   int64 // Wall time of last refill (Unix-nanos)
+}
+
+// newRateLimiter returns a rate limiter allowing rate bytes per
+// second, or nil if rate isn't positive. A nil rateLimiter imposes
+// no limit.
+func newRateLimiter(rate int64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		rate:   rate,
+		tokens: rate,
+		last:   time.Now().UnixNano(),
+	}
+}
+
+// available refills the bucket as of now and returns the count of
+// bytes which may be sent. Returns -1 if there is no limit.
+func (rl *rateLimiter) available(now int64) int64 {
+	if rl == nil {
+		return -1
+	}
+	// Only advance the refill time once whole bytes accrue, so that
+	// frequent calls don't lose fractional bytes at low rates.
+	if refill := int64(float64(rl.rate) * float64(now-rl.last) / float64(time.Second)); refill > 0 {
+		rl.tokens += refill
+		if rl.tokens > rl.rate {
+			rl.tokens = rl.rate
+		}
+		rl.last = now
+	}
+	if rl.tokens < 0 {
+		return 0
+	}
+	return rl.tokens
+}
+
+// consume debits the bucket by the count of bytes sent.
+func (rl *rateLimiter) consume(bytes int) {
+	if rl != nil {
+		rl.tokens -= int64(bytes)
+	}
+}
+
+// deltaBudget returns the byte budget for the next delta sent to a
+// peer, given the per-exchange limit maxBytes (zero for no limit) and
+// the peer's rate limiter. Returns false if the peer's rate limit
+// allows nothing to be sent now.
+func deltaBudget(maxBytes int, rl *rateLimiter, now int64) (int, bool) {
+	avail := rl.available(now)
+	if avail == 0 {
+		return 0, false
+	}
+	if avail > 0 && (maxBytes == 0 || avail < int64(maxBytes)) {
+		maxBytes = int(avail)
+	}
+	return maxBytes, true
+}
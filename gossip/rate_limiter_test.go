@@ -0,0 +1,84 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package gossip
+
+import (
+	"testing"
+	"time"
+)
+
+// TestRateLimiter verifies the rate limiter's refill, burst and
+// debt accounting.
+func TestRateLimiter(t *testing.T) {
+	if rl := newRateLimiter(0); rl != nil {
+		t.Errorf("expected no limiter for zero rate; got %+v", rl)
+	}
+	var unlimited *rateLimiter
+	if avail := unlimited.available(0); avail != -1 {
+		t.Errorf("expected no limit; got %d", avail)
+	}
+
+	now := time.Now().UnixNano()
+	rl := &rateLimiter{rate: 1000, tokens: 1000, last: now}
+	if avail := rl.available(now); avail != 1000 {
+		t.Errorf("expected a full burst of 1000; got %d", avail)
+	}
+	// Sending more than is available leaves the limiter in debt.
+	rl.consume(1500)
+	if avail := rl.available(now); avail != 0 {
+		t.Errorf("expected nothing available in debt; got %d", avail)
+	}
+	// Repay the debt after half a second; then refill.
+	now += int64(500 * time.Millisecond)
+	if avail := rl.available(now); avail != 0 {
+		t.Errorf("expected nothing available after repaying debt; got %d", avail)
+	}
+	now += int64(250 * time.Millisecond)
+	if avail := rl.available(now); avail != 250 {
+		t.Errorf("expected 250 available; got %d", avail)
+	}
+	// The limiter never accrues more than one second's worth.
+	now += int64(time.Hour)
+	if avail := rl.available(now); avail != 1000 {
+		t.Errorf("expected burst capped at 1000; got %d", avail)
+	}
+}
+
+// TestDeltaBudget verifies the byte budget is the lesser of the
+// per-exchange limit and the rate limiter's available bytes.
+func TestDeltaBudget(t *testing.T) {
+	now := time.Now().UnixNano()
+	testCases := []struct {
+		maxBytes int
+		rl       *rateLimiter
+		expBytes int
+		expOK    bool
+	}{
+		{0, nil, 0, true},
+		{100, nil, 100, true},
+		{0, &rateLimiter{rate: 1000, tokens: 50, last: now}, 50, true},
+		{100, &rateLimiter{rate: 1000, tokens: 50, last: now}, 50, true},
+		{10, &rateLimiter{rate: 1000, tokens: 50, last: now}, 10, true},
+		{10, &rateLimiter{rate: 1000, tokens: -50, last: now}, 0, false},
+	}
+	for i, test := range testCases {
+		if budget, ok := deltaBudget(test.maxBytes, test.rl, now); budget != test.expBytes || ok != test.expOK {
+			t.Errorf("%d: expected (%d, %t); got (%d, %t)", i, test.expBytes, test.expOK, budget, ok)
+		}
+	}
+}
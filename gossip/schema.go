@@ -0,0 +1,126 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package gossip
+
+import (
+	"encoding/gob"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+
+	"gossipgo/util"
+)
+
+// infoTypes maps info key prefixes to the types registered for their
+// values. Keys without a registered prefix may hold values of any
+// type registered with gob.
+var infoTypes = struct {
+	sync.RWMutex
+	m map[string]reflect.Type
+}{m: map[string]reflect.Type{}}
+
+// init registers the value types of the gossip keys defined in this
+// package. Packages which gossip their own types register them
+// similarly.
+func init() {
+	RegisterInfoType(KeyClusterID, "")
+	RegisterInfoType(KeyNodeCount, int64(0))
+	RegisterInfoType(KeyNodeIDPrefix, (*net.Addr)(nil))
+	RegisterInfoType(KeyHeartbeatPrefix, (*net.Addr)(nil))
+}
+
+// RegisterInfoType registers the type of value for infos whose keys
+// begin with prefix. Where prefixes overlap, the longest matching
+// prefix applies. A nil pointer to an interface type, e.g.
+// (*net.Addr)(nil), registers the interface: values may be of any
+// type implementing it. Concrete types are registered with gob so
+// they may be gossiped.
+//
+// RegisterInfoType is intended to be called from init functions and
+// panics if prefix is already registered with a different type.
+func RegisterInfoType(prefix string, value interface{}) {
+	t := reflect.TypeOf(value)
+	if t == nil {
+		panic(fmt.Sprintf("gossip: nil value type registered for prefix %q", prefix))
+	}
+	if t.Kind() == reflect.Ptr && t.Elem().Kind() == reflect.Interface {
+		t = t.Elem()
+	} else {
+		gob.Register(value)
+	}
+	infoTypes.Lock()
+	defer infoTypes.Unlock()
+	if existing, ok := infoTypes.m[prefix]; ok && existing != t {
+		panic(fmt.Sprintf("gossip: prefix %q registered with type %s; can't register %s", prefix, existing, t))
+	}
+	infoTypes.m[prefix] = t
+}
+
+// infoType returns the type registered for values of the specified
+// key, or nil if none is.
+func infoType(key string) reflect.Type {
+	infoTypes.RLock()
+	defer infoTypes.RUnlock()
+	var t reflect.Type
+	var prefixLen = -1
+	for prefix, pt := range infoTypes.m {
+		if len(prefix) > prefixLen && strings.HasPrefix(key, prefix) {
+			t, prefixLen = pt, len(prefix)
+		}
+	}
+	return t
+}
+
+// checkInfoType returns an error if val isn't of the type registered
+// for key.
+func checkInfoType(key string, val interface{}) error {
+	if val == nil {
+		return util.Errorf("info %q has nil value", key)
+	}
+	t := infoType(key)
+	if t == nil {
+		return nil
+	}
+	vt := reflect.TypeOf(val)
+	if t.Kind() == reflect.Interface {
+		if !vt.Implements(t) {
+			return util.Errorf("info %q has type %s which doesn't implement %s", key, vt, t)
+		}
+	} else if vt != t {
+		return util.Errorf("info %q has type %s; expected %s", key, vt, t)
+	}
+	return nil
+}
+
+// assignInfo sets the value pointed to by ptr to val. Returns an
+// error if ptr isn't a non-nil pointer or val isn't assignable to
+// the value it points to.
+func assignInfo(key string, val interface{}, ptr interface{}) error {
+	pv := reflect.ValueOf(ptr)
+	if pv.Kind() != reflect.Ptr || pv.IsNil() {
+		return util.Errorf("expected non-nil pointer for info %q; got %T", key, ptr)
+	}
+	v := reflect.ValueOf(val)
+	if !v.IsValid() || !v.Type().AssignableTo(pv.Elem().Type()) {
+		return util.Errorf("info %q has type %T; not assignable to %s", key, val, pv.Elem().Type())
+	}
+	pv.Elem().Set(v)
+	return nil
+}
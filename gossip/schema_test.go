@@ -0,0 +1,80 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package gossip
+
+import (
+	"net"
+	"testing"
+)
+
+type testStruct struct {
+	A int64
+}
+
+type testPtrStruct struct {
+	A int64
+}
+
+func init() {
+	RegisterInfoType("test-struct-", testStruct{})
+	RegisterInfoType("test-struct-ptr-", &testPtrStruct{})
+}
+
+// TestCheckInfoType verifies values are checked against the type
+// registered for the longest matching key prefix.
+func TestCheckInfoType(t *testing.T) {
+	testCases := []struct {
+		key   string
+		val   interface{}
+		expOK bool
+	}{
+		{KeyClusterID, "cluster", true},
+		{KeyClusterID, int64(1), false},
+		{KeyNodeCount, int64(3), true},
+		{KeyNodeCount, 3, false},
+		{KeyNodeCount, "3", false},
+		{MakeNodeIDGossipKey(1), &net.TCPAddr{}, true},
+		{MakeNodeIDGossipKey(1), testAddr("host:8080"), true},
+		{MakeNodeIDGossipKey(1), "host:8080", false},
+		{"test-struct-a", testStruct{1}, true},
+		{"test-struct-a", &testStruct{1}, false},
+		{"test-struct-ptr-a", &testPtrStruct{1}, true},
+		{"test-struct-ptr-a", testPtrStruct{1}, false},
+		{"test-struct-ptr-a", testStruct{1}, false},
+		// Unregistered keys accept any non-nil value.
+		{"unregistered", testStruct{1}, true},
+		{"unregistered", nil, false},
+	}
+	for i, test := range testCases {
+		if err := checkInfoType(test.key, test.val); (err == nil) != test.expOK {
+			t.Errorf("%d: %q=%#v: expected ok=%t; got %v", i, test.key, test.val, test.expOK, err)
+		}
+	}
+}
+
+// TestRegisterInfoTypeConflict verifies registering a prefix twice
+// with the same type is allowed, but with a different type panics.
+func TestRegisterInfoTypeConflict(t *testing.T) {
+	RegisterInfoType(KeyNodeCount, int64(0))
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("expected panic registering conflicting type")
+		}
+	}()
+	RegisterInfoType(KeyNodeCount, float64(0))
+}
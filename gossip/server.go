@@ -23,6 +23,7 @@ import (
 	"sync"
 	"time"
 
+	"gossipgo/proto"
 	"gossipgo/rpc"
 	"gossipgo/util"
 )
@@ -30,13 +31,21 @@ import (
 // server maintains an array of connected peers to which it gossips
 // newly arrived information on a periodic basis.
 type server struct {
-	interval      time.Duration       // Interval at which to gossip fresh info
-	mu            sync.Mutex          // Mutex protects is (infostore) & incoming
-	ready         *sync.Cond          // Broadcasts wakeup to waiting gossip requests
-	is            *infoStore          // The backing infostore
-	closed        bool                // True if server was closed
-	incoming      *addrSet            // Incoming client addresses
-	clientAddrMap map[string]net.Addr // Incoming client's local address -> client's server address
+	interval      time.Duration           // Interval at which to gossip fresh info
+	mu            sync.Mutex              // Mutex protects is (infostore) & incoming
+	ready         *sync.Cond              // Broadcasts wakeup to waiting gossip requests
+	is            *infoStore              // The backing infostore
+	closed        bool                    // True if server was closed
+	incoming      *addrSet                // Incoming client addresses
+	clientAddrMap map[string]net.Addr     // Incoming client's local address -> client's server address
+	maxDeltaBytes int                     // Approximate byte budget per delta; 0 for no limit
+	compression   string                  // Compression codec requested by outgoing clients
+	peerRate      int64                   // Bytes per second sent to each peer; 0 for no limit
+	limiters      map[string]*rateLimiter // Incoming client's server address -> rate limiter
+	bytesSent     int64                   // Bytes of deltas sent to peers
+	bytesReceived int64                   // Bytes of deltas received from peers
+	infosDropped  int64                   // Infos received with values of unregistered types
+	incomingFresh map[string]int64        // Incoming client's server address -> last wall time it sent fresh info
 }
 
 // newServer creates and returns a server struct.
@@ -46,6 +55,8 @@ func newServer(rpcServer *rpc.Server, interval time.Duration) *server {
 		is:            newInfoStore(rpcServer.Addr),
 		incoming:      newAddrSet(MaxPeers),
 		clientAddrMap: make(map[string]net.Addr),
+		limiters:      make(map[string]*rateLimiter),
+		incomingFresh: make(map[string]int64),
 	}
 	rpcServer.RegisterName("Gossip", s)
 	rpcServer.AddCloseCallback(s.onClose)
@@ -56,27 +67,40 @@ func newServer(rpcServer *rpc.Server, interval time.Duration) *server {
 // Gossip receives gossipped information from a peer node.
 // The received delta is combined with the infostore, and this
 // node's own gossip is returned to requesting client.
-func (s *server) Gossip(args *GossipRequest, reply *GossipResponse) error {
+func (s *server) Gossip(args *proto.GossipRequest, reply *proto.GossipResponse) error {
+	addr, err := args.Addr.NetAddr()
+	if err != nil {
+		return util.Errorf("invalid gossip address: %s", err)
+	}
+	argsDelta, err := decodeDelta(args.Delta, args.Compression)
+	if err != nil {
+		return util.Errorf("invalid gossip delta: %s", err)
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	// If there is no more capacity to accept incoming clients, return
 	// a random already-being-serviced incoming client as an alternate.
-	if !s.incoming.hasAddr(args.Addr) {
+	if !s.incoming.hasAddr(addr) {
 		if !s.incoming.hasSpace() {
-			reply.Alternate = s.incoming.selectRandom()
+			reply.Alternate = proto.FromNetAddr(s.incoming.selectRandom())
 			return nil
 		}
-		s.incoming.addAddr(args.Addr)
+		s.incoming.addAddr(addr)
 		// This lookup map allows the incoming client to be removed from
 		// the incoming addr set when its connection is closed. See
 		// server.serveConn() below.
-		s.clientAddrMap[args.LAddr.String()] = args.Addr
+		s.clientAddrMap[args.LAddr.Address] = addr
 	}
 
 	// Update infostore with gossipped infos.
-	if args.Delta != nil {
-		s.is.combine(args.Delta)
+	s.bytesReceived += int64(len(args.Delta))
+	if argsDelta != nil {
+		s.infosDropped += int64(argsDelta.dropInvalid())
+		if s.is.combine(argsDelta) > 0 {
+			s.incomingFresh[addr.String()] = time.Now().UnixNano()
+		}
 	}
 	// If requested max sequence is not -1, wait for gossip interval to expire.
 	if args.MaxSeq != -1 {
@@ -86,12 +110,21 @@ func (s *server) Gossip(args *GossipRequest, reply *GossipResponse) error {
 	if s.closed {
 		return util.Errorf("gossip server shutdown")
 	}
-	// Return reciprocal delta.
-	delta := s.is.delta(args.Addr, args.MaxSeq)
-	if delta != nil {
-		reply.Delta = delta
+	// Return reciprocal delta, paged to fit the byte budget and the
+	// requesting peer's rate limit.
+	rl, ok := s.limiters[addr.String()]
+	if !ok {
+		rl = newRateLimiter(s.peerRate)
+		s.limiters[addr.String()] = rl
+	}
+	reply.Compression = negotiateCompression(args.AcceptCompression)
+	if budget, ok := deltaBudget(s.maxDeltaBytes, rl, time.Now().UnixNano()); ok {
+		if reply.Delta, err = encodeDelta(s.is.delta(addr, args.MaxSeq, budget), reply.Compression); err != nil {
+			return err
+		}
+		rl.consume(len(reply.Delta))
+		s.bytesSent += int64(len(reply.Delta))
 	}
-
 	return nil
 }
 
@@ -133,5 +166,7 @@ func (s *server) onClose(conn net.Conn) {
 	defer s.mu.Unlock()
 	if clientAddr, ok := s.clientAddrMap[conn.RemoteAddr().String()]; ok {
 		s.incoming.removeAddr(clientAddr)
+		delete(s.limiters, clientAddr.String())
+		delete(s.incomingFresh, clientAddr.String())
 	}
 }
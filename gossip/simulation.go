@@ -27,6 +27,7 @@ import (
 
 	"gossipgo/rpc"
 	"gossipgo/util"
+	"gossipgo/util/hlc"
 	"log"
 )
 
@@ -99,6 +100,8 @@ func SimulateNetwork(nodeCount int, network string, gossipInterval time.Duration
 	simCallback func(cycle int, nodes map[string]*Gossip) bool) {
 
 	log.Printf("simulating network with %d nodes", nodeCount)
+	// All simulated nodes share a clock.
+	rpcContext := rpc.NewContext(hlc.NewClock(hlc.UnixNano, 0), nil)
 	servers := make([]*rpc.Server, nodeCount)
 	addrs := make([]net.Addr, nodeCount)
 	for i := 0; i < nodeCount; i++ {
@@ -106,7 +109,7 @@ func SimulateNetwork(nodeCount int, network string, gossipInterval time.Duration
 		if err != nil {
 			log.Printf("failed to create address: %s", err)
 		}
-		servers[i] = rpc.NewServer(addr)
+		servers[i] = rpc.NewServer(addr, rpcContext)
 		go servers[i].ListenAndServe()
 		addrs[i] = addr
 	}
@@ -119,13 +122,15 @@ func SimulateNetwork(nodeCount int, network string, gossipInterval time.Duration
 
 	nodes := make(map[string]*Gossip, nodeCount)
 	for i := 0; i < nodeCount; i++ {
-		node := New(servers[i])
+		node := New(rpcContext, servers[i])
 		node.Name = fmt.Sprintf("Node%d", i)
 		node.SetBootstrap(bootstrap)
 		node.SetInterval(gossipInterval)
 		// Node 0 gossips node count.
 		if i == 0 {
-			node.AddInfo(KeyNodeCount, int64(nodeCount), time.Hour)
+			if err := node.AddInfo(KeyNodeCount, int64(nodeCount), time.Hour); err != nil {
+				log.Fatalf("unable to gossip node count: %s", err)
+			}
 		}
 		node.Start()
 		nodes[addrs[i].String()] = node
@@ -137,7 +142,9 @@ func SimulateNetwork(nodeCount int, network string, gossipInterval time.Duration
 		select {
 		case <-gossipTimeout:
 			// Node 0 gossips sentinel every cycle.
-			nodes[addrs[0].String()].AddInfo(KeySentinel, int64(cycle), time.Hour)
+			if err := nodes[addrs[0].String()].AddInfo(KeySentinel, fmt.Sprintf("cycle-%d", cycle), time.Hour); err != nil {
+				log.Fatalf("unable to gossip sentinel: %s", err)
+			}
 			if !simCallback(cycle, nodes) {
 				complete = true
 			}
@@ -0,0 +1,178 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package gossip
+
+import (
+	"math"
+	"net"
+	"sort"
+	"time"
+)
+
+// InfoStatus describes an info held by a gossip instance. Times are
+// unix nanoseconds.
+type InfoStatus struct {
+	Key          string        `json:"key"`
+	Value        interface{}   `json:"value"`
+	Group        string        `json:"group,omitempty"` // Prefix of group holding the info
+	NodeAddr     string        `json:"node_addr"`       // Originating node
+	PeerAddr     string        `json:"peer_addr"`       // Peer which passed the info
+	Hops         uint32        `json:"hops"`
+	Timestamp    int64         `json:"timestamp"`
+	TTLRemaining time.Duration `json:"ttl_remaining"` // -1 if the info never expires
+}
+
+// GroupStatus describes a group registered with a gossip instance.
+type GroupStatus struct {
+	Prefix     string      `json:"prefix"`
+	Limit      int         `json:"limit"`
+	Type       string      `json:"type"`
+	Count      int         `json:"count"`
+	Gatekeeper *InfoStatus `json:"gatekeeper,omitempty"` // Info first evicted, if any
+}
+
+// PeerStatus describes a connection to a gossip peer. LastFresh is
+// the last time the peer sent fresh infos, in unix nanoseconds, or
+// zero if it hasn't.
+type PeerStatus struct {
+	Addr      string `json:"addr"`
+	LastFresh int64  `json:"last_fresh"`
+}
+
+// PeersStatus describes a gossip instance's incoming and outgoing
+// peer connections.
+type PeersStatus struct {
+	Incoming []PeerStatus `json:"incoming"`
+	Outgoing []PeerStatus `json:"outgoing"`
+}
+
+// newInfoStatus returns the status of info i as of now.
+func newInfoStatus(i *info, group string, now int64) *InfoStatus {
+	status := &InfoStatus{
+		Key:          i.Key,
+		Value:        i.Val,
+		Group:        group,
+		NodeAddr:     addrString(i.NodeAddr),
+		PeerAddr:     addrString(i.peerAddr),
+		Hops:         i.Hops,
+		Timestamp:    i.Timestamp,
+		TTLRemaining: time.Duration(i.TTLStamp - now),
+	}
+	if i.TTLStamp == math.MaxInt64 {
+		status.TTLRemaining = -1
+	}
+	// Addresses are more legible in their string form.
+	if addr, ok := i.Val.(net.Addr); ok {
+		status.Value = addr.String()
+	}
+	return status
+}
+
+// Infos returns the status of every unexpired info held by the
+// gossip instance, ordered by key.
+func (g *Gossip) Infos() []*InfoStatus {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now().UnixNano()
+	infos := []*InfoStatus{}
+	g.is.visitInfos(nil, func(i *info) error {
+		var prefix string
+		if grp := g.is.belongsToGroup(i.Key); grp != nil {
+			prefix = grp.Prefix
+		}
+		infos = append(infos, newInfoStatus(i, prefix, now))
+		return nil
+	})
+	sort.Sort(infoStatusesByKey(infos))
+	return infos
+}
+
+// infoStatusesByKey implements sort.Interface, ordering info
+// statuses by key.
+type infoStatusesByKey []*InfoStatus
+
+func (a infoStatusesByKey) Len() int           { return len(a) }
+func (a infoStatusesByKey) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a infoStatusesByKey) Less(i, j int) bool { return a[i].Key < a[j].Key }
+
+// Groups returns the status of every group registered with the
+// gossip instance, ordered by prefix.
+func (g *Gossip) Groups() []*GroupStatus {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now().UnixNano()
+	groups := []*GroupStatus{}
+	g.is.visitInfos(func(grp *group) error {
+		status := &GroupStatus{
+			Prefix: grp.Prefix,
+			Limit:  grp.Limit,
+			Type:   grp.TypeOf.String(),
+			Count:  len(grp.Infos),
+		}
+		if grp.gatekeeper != nil {
+			status.Gatekeeper = newInfoStatus(grp.gatekeeper, grp.Prefix, now)
+		}
+		groups = append(groups, status)
+		return nil
+	}, nil)
+	sort.Sort(groupStatusesByPrefix(groups))
+	return groups
+}
+
+// groupStatusesByPrefix implements sort.Interface, ordering group
+// statuses by prefix.
+type groupStatusesByPrefix []*GroupStatus
+
+func (a groupStatusesByPrefix) Len() int           { return len(a) }
+func (a groupStatusesByPrefix) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a groupStatusesByPrefix) Less(i, j int) bool { return a[i].Prefix < a[j].Prefix }
+
+// Peers returns the status of the gossip instance's incoming and
+// outgoing peer connections, each ordered by address.
+func (g *Gossip) Peers() *PeersStatus {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	status := &PeersStatus{
+		Incoming: []PeerStatus{},
+		Outgoing: []PeerStatus{},
+	}
+	for _, addr := range g.incoming.asSlice() {
+		status.Incoming = append(status.Incoming, PeerStatus{
+			Addr:      addr.String(),
+			LastFresh: g.incomingFresh[addr.String()],
+		})
+	}
+	for _, addr := range g.outgoing.asSlice() {
+		peer := PeerStatus{Addr: addr.String()}
+		if c, ok := g.clients[addr.String()]; ok {
+			peer.LastFresh = c.lastFresh
+		}
+		status.Outgoing = append(status.Outgoing, peer)
+	}
+	sort.Sort(peerStatusesByAddr(status.Incoming))
+	sort.Sort(peerStatusesByAddr(status.Outgoing))
+	return status
+}
+
+// peerStatusesByAddr implements sort.Interface, ordering peer
+// statuses by address.
+type peerStatusesByAddr []PeerStatus
+
+func (a peerStatusesByAddr) Len() int           { return len(a) }
+func (a peerStatusesByAddr) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a peerStatusesByAddr) Less(i, j int) bool { return a[i].Addr < a[j].Addr }
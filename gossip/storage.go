@@ -0,0 +1,112 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package gossip
+
+import (
+	"log"
+	"time"
+)
+
+// Storage persists a checkpoint of the gossip info store so that a
+// restarted node needn't relearn the entire network from its peers
+// before becoming useful.
+type Storage interface {
+	// ReadGossip returns the most recently written checkpoint, or nil
+	// if none has been written.
+	ReadGossip() ([]byte, error)
+	// WriteGossip replaces the checkpoint with data.
+	WriteGossip(data []byte) error
+}
+
+// SetStorage sets the storage to which the info store is periodically
+// checkpointed and from which it's reloaded on Start. Must be called
+// before Start.
+func (g *Gossip) SetStorage(storage Storage) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.storage = storage
+}
+
+// restore reloads the info store from the checkpoint in storage, if
+// any. Reloaded infos are combined as a delta from a peer would be:
+// their hop counts are incremented and their originating node
+// address, timestamp and TTL are left as checkpointed. Unlike gossip
+// from a peer, reloaded infos don't mark their originating nodes as
+// recently heard from, so nodes which have since failed aren't
+// mistaken for reachable members. Infos
+// which have since expired or which are older than infos already
+// held are discarded, so the checkpoint never overrides fresher
+// state and this node never re-originates another node's info as
+// its own.
+func (g *Gossip) restore() error {
+	data, err := g.storage.ReadGossip()
+	if err != nil {
+		return err
+	}
+	snapshot, err := decodeDelta(data, CompressionNone)
+	if err != nil || snapshot == nil {
+		return err
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.infosDropped += int64(snapshot.dropInvalid())
+	freshCount := g.is.restore(snapshot)
+	log.Printf("reloaded %d gossip infos from storage", freshCount)
+	return nil
+}
+
+// checkpoint writes a snapshot of the non-expired infos to storage.
+// The snapshot is taken under lock and encoded and written outside
+// of it.
+func (g *Gossip) checkpoint() error {
+	g.mu.Lock()
+	snapshot := g.is.snapshot()
+	g.mu.Unlock()
+	data, err := encodeDelta(snapshot, CompressionNone)
+	if err != nil {
+		return err
+	}
+	return g.storage.WriteGossip(data)
+}
+
+// manageCheckpoints periodically checkpoints the info store to
+// storage when it has changed since the last checkpoint, until the
+// gossip instance is stopped.
+//
+// This method will block and should be run via goroutine.
+func (g *Gossip) manageCheckpoints(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var lastSeq int64
+	for range ticker.C {
+		g.mu.Lock()
+		closed, maxSeq := g.closed, g.is.MaxSeq
+		g.mu.Unlock()
+		if closed {
+			return
+		}
+		if maxSeq == lastSeq {
+			continue
+		}
+		if err := g.checkpoint(); err != nil {
+			log.Printf("unable to checkpoint gossip: %s", err)
+			continue
+		}
+		lastSeq = maxSeq
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package gossip
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"gossipgo/rpc"
+	"gossipgo/util/hlc"
+)
+
+// testStorage implements Storage in memory.
+type testStorage struct {
+	mu     sync.Mutex
+	data   []byte
+	writes int
+}
+
+func (ts *testStorage) ReadGossip() ([]byte, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.data, nil
+}
+
+func (ts *testStorage) WriteGossip(data []byte) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.data = data
+	ts.writes++
+	return nil
+}
+
+// numWrites returns the number of checkpoints written.
+func (ts *testStorage) numWrites() int {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.writes
+}
+
+func newTestGossip(t *testing.T, addr string) *Gossip {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rpcContext := rpc.NewContext(hlc.NewClock(hlc.UnixNano, 0), nil)
+	return New(rpcContext, rpc.NewServer(tcpAddr, rpcContext))
+}
+
+// TestGossipCheckpoint verifies that a checkpointed info store is
+// reloaded with hop counts incremented and originating node
+// addresses, timestamps and TTLs intact, and that the reloaded infos
+// neither override fresher infos nor include expired ones. Reloaded
+// infos don't mark their originating nodes as heard from.
+func TestGossipCheckpoint(t *testing.T) {
+	storage := &testStorage{}
+	g := newTestGossip(t, "127.0.0.1:8079")
+	g.SetStorage(storage)
+
+	// Gossip from a peer, as though received over the network.
+	peerAddr, err := net.ResolveTCPAddr("tcp", "127.0.0.1:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := newInfoStore(peerAddr)
+	peer.addInfo(peer.newInfo(KeyNodeCount, int64(3), time.Hour))
+	peer.addInfo(peer.newInfo(MakeNodeIDGossipKey(2), peerAddr, 50*time.Millisecond))
+	g.is.combine(peer.delta(g.is.NodeAddr, 0, 0))
+	// And this node's own gossip.
+	if err := g.AddInfo(KeyClusterID, "stale", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.RegisterGroup("max-", 10, MaxGroup); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.AddInfo("max-a", int64(1), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	orig := *g.is.getInfo(KeyNodeCount)
+
+	// Restart with a fresher cluster ID and after the node ID has expired.
+	time.Sleep(100 * time.Millisecond)
+	g = newTestGossip(t, "127.0.0.1:8079")
+	g.SetStorage(storage)
+	if err := g.AddInfo(KeyClusterID, "fresh", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.restore(); err != nil {
+		t.Fatal(err)
+	}
+
+	i := g.is.getInfo(KeyNodeCount)
+	if i == nil {
+		t.Fatalf("expected %s to be reloaded", KeyNodeCount)
+	}
+	if i.Val.(int64) != 3 || i.Hops != orig.Hops+1 || i.NodeAddr.String() != peerAddr.String() ||
+		i.Timestamp != orig.Timestamp || i.TTLStamp != orig.TTLStamp {
+		t.Errorf("expected reloaded info %+v to match %+v with hops incremented", i, orig)
+	}
+	if i := g.is.getInfo(KeyClusterID); i == nil || i.Val.(string) != "fresh" || i.Hops != 0 {
+		t.Errorf("expected fresh cluster ID to survive reload; got %+v", i)
+	}
+	if i := g.is.getInfo(MakeNodeIDGossipKey(2)); i != nil {
+		t.Errorf("expected expired info not to be reloaded; got %+v", i)
+	}
+	if i := g.is.getInfo("max-a"); i == nil || i.Val.(int64) != 1 || i.Hops != 1 {
+		t.Errorf("expected own group info reloaded with one hop; got %+v", i)
+	}
+	if h, ok := g.is.heard[peerAddr.String()]; ok {
+		t.Errorf("expected reloaded infos not to mark %s as heard from; got %+v", peerAddr, h)
+	}
+}
+
+// TestGossipCheckpointUnchanged verifies that the info store is
+// checkpointed periodically, but only when it has changed.
+func TestGossipCheckpointUnchanged(t *testing.T) {
+	storage := &testStorage{}
+	g := newTestGossip(t, "127.0.0.1:8079")
+	g.SetStorage(storage)
+	if err := g.AddInfo(KeyClusterID, "cluster", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	go g.manageCheckpoints(10 * time.Millisecond)
+	// Wait for the first checkpoint, then for several more intervals.
+	for deadline := time.Now().Add(5 * time.Second); storage.numWrites() == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for checkpoint")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	g.mu.Lock()
+	g.closed = true
+	g.mu.Unlock()
+	if writes := storage.numWrites(); writes != 1 {
+		t.Errorf("expected exactly one checkpoint; got %d", writes)
+	}
+}
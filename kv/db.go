@@ -2,13 +2,17 @@ package kv
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
 	"gossipgo/gossip"
+	"gossipgo/proto"
 	"gossipgo/rpc"
 	"gossipgo/storage"
 	"gossipgo/util"
+	"gossipgo/util/hlc"
 	net "net"
 	"reflect"
+	"sync"
 	"time"
 )
 
@@ -16,8 +20,11 @@ import (
 type DB interface {
 	Get(args *storage.GetRequest) <-chan *storage.GetResponse
 	Put(args *storage.PutRequest) <-chan *storage.PutResponse
+	Delete(args *storage.DeleteRequest) <-chan *storage.DeleteResponse
 	Scan(args *storage.ScanRequest) <-chan *storage.ScanResponse
 	Increment(args *storage.IncrementRequest) <-chan *storage.IncrementResponse
+	InternalMerge(args *storage.InternalMergeRequest) <-chan *storage.InternalMergeResponse
+	Batch(args *storage.BatchRequest) <-chan *storage.BatchResponse
 }
 
 // A DistDB provides methods to access Cockroach's monolithic,
@@ -29,14 +36,42 @@ type DistDB struct {
 	// key range, used to find the replica metadata for arbitrary key
 	// ranges.
 	gossip *gossip.Gossip
-	// rangeCache caches replica metadata for key ranges. The cache is
-	// filled while servicing read and write requests to the key value
-	// store.
-	rangeCache util.LRUCache
+	// rpcContext is used to create clients to other nodes.
+	rpcContext *rpc.Context
+	// clock is the node's hybrid logical clock. Requests are stamped
+	// with its time and it's updated with the timestamps of responses.
+	clock *hlc.Clock
+	// rangeCache caches replica metadata for key ranges, keyed by the
+	// ranges' end keys. The cache is filled while servicing read and
+	// write requests to the key value store. Ranges are evicted when a
+	// node reports that their metadata is stale.
+	rangeCache *rangeCache
+	// rpcTimeout bounds each request, including the lookups of replica
+	// metadata needed to address it.
+	rpcTimeout time.Duration
+}
+
+// defaultRPCTimeout is the default time allowed for a request to the
+// key value store to complete.
+const defaultRPCTimeout = 10 * time.Second
+
+// rangeCacheSize is the maximum number of ranges for which replica
+// metadata is cached.
+const rangeCacheSize = 1 << 16
+
+// sendRetryOptions govern retries of requests which fail with
+// retryable errors, such as those caused by stale range metadata.
+var sendRetryOptions = util.Options{
+	Backoff:     50 * time.Millisecond,
+	MaxBackoff:  1 * time.Second,
+	Constant:    2,
+	MaxAttempts: 5,
+	Jitter:      0.15,
 }
 
 // PutI sets the given key to the serialized byte string of the value
-// provided. Uses current time and default expiration.
+// provided. The value is stamped with the request timestamp and uses
+// default expiration.
 func PutI(db DB, key storage.Key, value interface{}) error {
 	var buf bytes.Buffer
 	if err := gob.NewEncoder(&buf).Encode(value); err != nil {
@@ -46,119 +81,269 @@ func PutI(db DB, key storage.Key, value interface{}) error {
 		Put(&storage.PutRequest{
 		Key: key,
 		Value: storage.Value{
-			Bytes:     buf.Bytes(),
-			Timestamp: time.Now().UnixNano(),
+			Bytes: buf.Bytes(),
 		},
 	})
 	return pr.Error
 }
 
 // NewDB returns a key-value datastore client which connects to the
-// Cockroach cluster via the supplied gossip instance.
-func NewDB(gossip *gossip.Gossip) *DistDB {
-	return &DistDB{gossip: gossip}
+// Cockroach cluster via the supplied gossip instance. Requests are
+// timestamped using the clock of the RPC context.
+func NewDB(rpcContext *rpc.Context, gossip *gossip.Gossip) *DistDB {
+	return &DistDB{
+		gossip:     gossip,
+		rpcContext: rpcContext,
+		clock:      rpcContext.LocalClock,
+		rangeCache: newRangeCache(rangeCacheSize),
+		rpcTimeout: defaultRPCTimeout,
+	}
+}
+
+// stampHeader sets the request timestamp from the clock if not already
+// set. MaxTimestamp is set to the request timestamp plus the maximum
+// clock offset; values with timestamps above it were certainly
+// written after the request was sent.
+func (db *DistDB) stampHeader(header *storage.RequestHeader) {
+	if header.Timestamp.IsEmpty() {
+		header.Timestamp = db.clock.Now()
+	}
+	if header.MaxTimestamp.IsEmpty() {
+		header.MaxTimestamp = header.Timestamp.Add(db.clock.MaxOffset().Nanoseconds(), 0)
+	}
+}
+
+// uncertaintyRestart returns the timestamp at which to restart a read
+// which encountered a value within its uncertainty interval, and true.
+// The restart is at the timestamp of the uncertain value. MaxTimestamp
+// remains unchanged, so the uncertainty interval shrinks with each
+// restart and restarts are bounded. Returns false if err isn't a
+// ReadWithinUncertaintyIntervalError.
+func uncertaintyRestart(err error) (hlc.Timestamp, bool) {
+	if uErr, ok := err.(*proto.ReadWithinUncertaintyIntervalError); ok {
+		return storage.FromProtoTimestamp(uErr.ExistingTimestamp), true
+	}
+	return hlc.Timestamp{}, false
+}
+
+// updateClock forwards the clock to the timestamp of the response,
+// preserving causality with the node which served it.
+func (db *DistDB) updateClock(header *storage.ResponseHeader) {
+	if !header.Timestamp.IsEmpty() {
+		db.clock.Update(header.Timestamp)
+	}
 }
 
 func (db *DistDB) nodeIDToAddr(nodeID int32) (net.Addr, error) {
 	nodeIDKey := gossip.MakeNodeIDGossipKey(nodeID)
-	info, err := db.gossip.GetInfo(nodeIDKey)
-	if info == nil || err != nil {
+	var addr net.Addr
+	if err := db.gossip.GetInfoAs(nodeIDKey, &addr); err != nil {
 		return nil, util.Errorf("Unable to lookup address for node: %v. Error: %v", nodeID, err)
 	}
-	return info.(net.Addr), nil
+	return addr, nil
 }
 
-func (db *DistDB) lookupMetadata(metadataKey storage.Key, replicas []storage.Replica) (*storage.RangeLocations, error) {
+// lookupMetadata looks up the range metadata for metadataKey on one
+// of the replicas. Returns the metadata key under which the range
+// metadata is stored, which encodes the end key of the range.
+func (db *DistDB) lookupMetadata(ctx context.Context, metadataKey storage.Key, replicas []storage.Replica) (storage.Key, *storage.RangeLocations, error) {
 	replica := storage.ChooseRandomReplica(replicas)
 	if replica == nil {
-		return nil, util.Errorf("No replica to choose for metadata key: %q", metadataKey)
+		return nil, nil, util.Errorf("No replica to choose for metadata key: %q", metadataKey)
 	}
 
 	addr, err := db.nodeIDToAddr(replica.NodeID)
 	if err != nil {
 		// TODO(harshit): May be retry a different replica.
-		return nil, err
+		return nil, nil, err
 	}
-	client := rpc.NewClient(addr)
+	client := rpc.NewClient(addr, db.rpcContext)
+	defer client.Close()
 	arg := &storage.InternalRangeLookupRequest{
 		RequestHeader: storage.RequestHeader{
 			Replica: *replica,
 		},
 		Key: metadataKey,
 	}
+	db.stampHeader(&arg.RequestHeader)
 	var reply storage.InternalRangeLookupResponse
-	err = client.Call("Node.InternalRangeLookup", arg, &reply)
+	err = call(ctx, client, arg, &reply)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	db.updateClock(&reply.ResponseHeader)
 	if reply.Error != nil {
-		return nil, reply.Error
+		return nil, nil, reply.Error
 	}
-	return &reply.Locations, nil
+	return reply.EndKey, &reply.Locations, nil
 }
 
 // TODO(harshit): Consider caching returned metadata info.
-func (db *DistDB) lookupMeta1(key storage.Key) (*storage.RangeLocations, error) {
-	info, err := db.gossip.GetInfo(gossip.KeyFirstRangeMetadata)
-	if err != nil {
+func (db *DistDB) lookupMeta1(ctx context.Context, key storage.Key) (*storage.RangeLocations, error) {
+	var locations storage.RangeLocations
+	if err := db.gossip.GetInfoAs(gossip.KeyFirstRangeMetadata, &locations); err != nil {
 		return nil, err
 	}
 	metadataKey := storage.MakeKey(storage.KeyMeta1Prefix, key)
-	return db.lookupMetadata(metadataKey, info.(storage.RangeLocations).Replicas)
+	_, meta1Val, err := db.lookupMetadata(ctx, metadataKey, locations.Replicas)
+	return meta1Val, err
 }
 
-func (db *DistDB) lookupMeta2(key storage.Key) (*storage.RangeLocations, error) {
-	meta1Val, err := db.lookupMeta1(key)
+// lookupMeta2 returns the meta2 key and range metadata of the range
+// containing key.
+func (db *DistDB) lookupMeta2(ctx context.Context, key storage.Key) (storage.Key, *storage.RangeLocations, error) {
+	meta1Val, err := db.lookupMeta1(ctx, key)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	metadataKey := storage.MakeKey(storage.KeyMeta2Prefix, key)
-	return db.lookupMetadata(metadataKey, meta1Val.Replicas)
+	return db.lookupMetadata(ctx, metadataKey, meta1Val.Replicas)
 }
 
-// getNode gets an RPC client to the node where the requested
-// key is located. The range cache may be updated. The bi-level range
-// metadata for the cluster is consulted in the event that the local
-// cache doesn't contain range metadata corresponding to the specified
-// key.
-func (db *DistDB) getNode(key storage.Key) (*rpc.Client, *storage.Replica, error) {
-	meta2Val, err := db.lookupMeta2(key)
+// call sends the request to the node in its wire representation and
+// converts the node's response into reply.
+func call(ctx context.Context, node *rpc.Client, args storage.Request, reply storage.Response) error {
+	method, protoArgs, err := storage.ToProtoRequest(args)
 	if err != nil {
-		return nil, nil, err
+		return err
+	}
+	protoReply, err := proto.CreateReply(method)
+	if err != nil {
+		return err
 	}
-	replica := storage.ChooseRandomReplica(meta2Val.Replicas)
+	if err := node.CallWithContext(ctx, "Node."+method, protoArgs, protoReply); err != nil {
+		return err
+	}
+	return storage.FromProtoResponse(protoReply, reply)
+}
+
+// getReplica returns a replica of the range containing the requested
+// key. The range cache is consulted first; if it doesn't contain the
+// range, the bi-level range metadata for the cluster is looked up and
+// the range is cached.
+func (db *DistDB) getReplica(ctx context.Context, key storage.Key) (*storage.Replica, error) {
+	locations, ok := db.rangeCache.lookup(key)
+	if !ok {
+		metaKey, l, err := db.lookupMeta2(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		db.rangeCache.add(metaKey, l)
+		locations = l
+	}
+	replica := storage.ChooseRandomReplica(locations.Replicas)
 	if replica == nil {
-		return nil, nil, util.Errorf("No node found for key: %q", key)
+		return nil, util.Errorf("No node found for key: %q", key)
 	}
+	return replica, nil
+}
+
+// evictRange removes the cached metadata of the range containing the
+// key. It's called when a node reports that the metadata is stale.
+func (db *DistDB) evictRange(key storage.Key) {
+	db.rangeCache.evict(key)
+}
+
+// getNode gets an RPC client to the node of the replica. The client
+// must be released with Close.
+func (db *DistDB) getNode(replica *storage.Replica) (*rpc.Client, error) {
 	addr, err := db.nodeIDToAddr(replica.NodeID)
 	if err != nil {
 		// TODO(harshit): May be retry a different replica.
-		return nil, nil, err
+		return nil, err
+	}
+	return rpc.NewClient(addr, db.rpcContext), nil
+}
+
+// send sends the request to a replica of the range containing key,
+// with the response decoded into reply. Failed requests are retried
+// according to the type of error in the reply:
+//
+//   - RangeNotFoundError, RangeKeyMismatchError: the cached metadata
+//     of the range containing key is stale. The range is evicted and
+//     looked up again.
+//   - NotLeaderError: the request is redirected to the leader.
+//   - Other errors are retried if they implement util.Retryable and
+//     can be retried.
+//
+// Errors which can't be retried, or the last error once retries are
+// exhausted, are left in the reply header. Returns an error if the
+// request couldn't be sent.
+func (db *DistDB) send(ctx context.Context, key storage.Key, args storage.Request, reply storage.Response) error {
+	header := args.Header()
+	db.stampHeader(header)
+	opts := sendRetryOptions
+	opts.Stopper = ctx.Done()
+	var leader *storage.Replica
+	var err error
+	util.RetryWithBackoffOptions(opts, func() bool {
+		replica := leader
+		if replica == nil {
+			if replica, err = db.getReplica(ctx, key); err != nil {
+				return true
+			}
+		}
+		header.Replica = *replica
+		if err = db.sendOnce(ctx, args, reply); err != nil {
+			return true
+		}
+		switch t := reply.Header().Error.(type) {
+		case nil:
+			return true
+		case *proto.RangeNotFoundError, *proto.RangeKeyMismatchError:
+			db.evictRange(key)
+			leader = nil
+		case *proto.NotLeaderError:
+			l := storage.FromProtoReplica(t.Leader, replica.RangeID)
+			leader = &l
+		default:
+			if r, ok := t.(util.Retryable); !ok || !r.CanRetry() {
+				return true
+			}
+		}
+		return false
+	})
+	return err
+}
+
+// sendOnce sends the request to the replica in its header. Reads which
+// encounter a value within their uncertainty interval are restarted;
+// a failed batch is rolled back, so it's restarted as a whole.
+func (db *DistDB) sendOnce(ctx context.Context, args storage.Request, reply storage.Response) error {
+	node, err := db.getNode(&args.Header().Replica)
+	if err != nil {
+		return err
+	}
+	defer node.Close()
+	replyVal := reflect.ValueOf(reply)
+	for {
+		replyVal.Elem().Set(reflect.Zero(replyVal.Elem().Type()))
+		if err := call(ctx, node, args, reply); err != nil {
+			return err
+		}
+		db.updateClock(reply.Header())
+		ts, ok := uncertaintyRestart(reply.Header().Error)
+		if !ok {
+			return nil
+		}
+		args.Header().Timestamp = ts
 	}
-	return rpc.NewClient(addr), replica, nil
 }
 
 // sendRPC sends the specified RPC asynchronously and returns a
 // channel which receives the reply struct when the call is
-// complete. Returns a channel of the same type as "reply".
-func (db *DistDB) sendRPC(key storage.Key, method string, args, reply interface{}) interface{} {
+// complete. Returns a channel of the same type as "reply". The RPC is
+// abandoned with an error if it doesn't complete within rpcTimeout.
+func (db *DistDB) sendRPC(key storage.Key, args storage.Request, reply storage.Response) interface{} {
 	chanVal := reflect.MakeChan(reflect.ChanOf(reflect.BothDir, reflect.TypeOf(reply)), 1)
 
 	go func() {
-		replyVal := reflect.ValueOf(reply)
-		node, replica, err := db.getNode(key)
-		if err == nil {
-			argsHeader := args.(*storage.RequestHeader)
-			argsHeader.Replica = *replica
-			err = node.Call(method, args, reply)
+		ctx, cancel := context.WithTimeout(context.Background(), db.rpcTimeout)
+		defer cancel()
+		if err := db.send(ctx, key, args, reply); err != nil {
+			reply.Header().Error = err
 		}
-		if err != nil {
-			// TODO(spencer): check error here; we need to clear this
-			// segment of range cache and retry getNode() if the range
-			// wasn't found.
-			reflect.Indirect(replyVal).FieldByName("Error").Set(reflect.ValueOf(err))
-		}
-		chanVal.Send(replyVal)
+		chanVal.Send(reflect.ValueOf(reply))
 	}()
 
 	return chanVal.Interface()
@@ -166,28 +351,133 @@ func (db *DistDB) sendRPC(key storage.Key, method string, args, reply interface{
 
 // Get .
 func (db *DistDB) Get(args *storage.GetRequest) <-chan *storage.GetResponse {
-	return db.sendRPC(args.Key, "Node.Get",
-		args, &storage.GetResponse{}).(chan *storage.GetResponse)
+	return db.sendRPC(args.Key, args, &storage.GetResponse{}).(chan *storage.GetResponse)
 }
 
 // Put .
 func (db *DistDB) Put(args *storage.PutRequest) <-chan *storage.PutResponse {
-	return db.sendRPC(args.Key, "Node.Put",
-		args, &storage.PutResponse{}).(chan *storage.PutResponse)
+	return db.sendRPC(args.Key, args, &storage.PutResponse{}).(chan *storage.PutResponse)
+}
+
+// Delete .
+func (db *DistDB) Delete(args *storage.DeleteRequest) <-chan *storage.DeleteResponse {
+	return db.sendRPC(args.Key, args, &storage.DeleteResponse{}).(chan *storage.DeleteResponse)
 }
 
-// Scan .
+// Scan is sent to the range containing the start key.
 func (db *DistDB) Scan(args *storage.ScanRequest) <-chan *storage.ScanResponse {
-	// TODO(spencer): range of keys.
-	return nil
+	// TODO(spencer): scans which span multiple ranges.
+	return db.sendRPC(args.StartKey, args, &storage.ScanResponse{}).(chan *storage.ScanResponse)
 }
 
 // Increment .
 func (db *DistDB) Increment(args *storage.IncrementRequest) <-chan *storage.IncrementResponse {
-	return db.sendRPC(args.Key, "Node.Increment",
-		args, &storage.IncrementResponse{}).(chan *storage.IncrementResponse)
+	return db.sendRPC(args.Key, args, &storage.IncrementResponse{}).(chan *storage.IncrementResponse)
+}
+
+// InternalMerge .
+func (db *DistDB) InternalMerge(args *storage.InternalMergeRequest) <-chan *storage.InternalMergeResponse {
+	return db.sendRPC(args.Key, args, &storage.InternalMergeResponse{}).(chan *storage.InternalMergeResponse)
+}
+
+// A subBatch holds the commands of a batch which address a single
+// range, along with their indexes in the original batch. The
+// sub-batch is addressed by the key of its first command.
+type subBatch struct {
+	key     storage.Key
+	args    storage.BatchRequest
+	reply   storage.BatchResponse
+	indexes []int
 }
 
+// Batch splits the batch by range and sends the per-range sub-batches
+// concurrently. Each sub-batch is applied atomically on its range.
+// Responses are returned in request order; commands which could not
+// be sent carry their own errors. The batch response header error is
+// set to the first error in request order, if any. All sub-batches
+// share a single rpcTimeout.
+func (db *DistDB) Batch(args *storage.BatchRequest) <-chan *storage.BatchResponse {
+	replyChan := make(chan *storage.BatchResponse, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), db.rpcTimeout)
+		defer cancel()
+		reply := &storage.BatchResponse{
+			Responses: make([]storage.ResponseUnion, len(args.Requests)),
+		}
+		// All sub-batches share the batch timestamp.
+		db.stampHeader(&args.RequestHeader)
+		// Group requests by the range containing their keys.
+		batches := map[int64]*subBatch{}
+		for i := range args.Requests {
+			cmdArgs := args.Requests[i].GetValue()
+			if cmdArgs == nil {
+				setBatchError(reply, i, nil, util.Errorf("empty batch command %d", i))
+				continue
+			}
+			key := args.Requests[i].Key()
+			replica, err := db.getReplica(ctx, key)
+			if err != nil {
+				setBatchError(reply, i, cmdArgs, err)
+				continue
+			}
+			sb, ok := batches[replica.RangeID]
+			if !ok {
+				sb = &subBatch{key: key}
+				sb.args.RequestHeader = args.RequestHeader
+				batches[replica.RangeID] = sb
+			}
+			sb.args.Add(cmdArgs)
+			sb.indexes = append(sb.indexes, i)
+		}
+
+		// Send sub-batches concurrently and wait for all to complete.
+		var wg sync.WaitGroup
+		for _, sb := range batches {
+			wg.Add(1)
+			go func(sb *subBatch) {
+				defer wg.Done()
+				if err := db.send(ctx, sb.key, &sb.args, &sb.reply); err != nil {
+					sb.reply.Error = err
+				}
+			}(sb)
+		}
+		wg.Wait()
+
+		// Reassemble responses in request order.
+		for _, sb := range batches {
+			for j, i := range sb.indexes {
+				if j < len(sb.reply.Responses) {
+					reply.Responses[i] = sb.reply.Responses[j]
+				} else {
+					setBatchError(reply, i, args.Requests[i].GetValue(), sb.reply.Error)
+				}
+			}
+		}
+		for i := range reply.Responses {
+			if resp := reply.Responses[i].GetValue(); resp != nil && resp.Header().Error != nil {
+				reply.Error = resp.Header().Error
+				break
+			}
+		}
+		replyChan <- reply
+	}()
+	return replyChan
+}
+
+// setBatchError sets an error response at index i of the batch reply
+// for the specified command.
+func setBatchError(reply *storage.BatchResponse, i int, args storage.Request, err error) {
+	if err == nil {
+		err = util.Errorf("no response for batch command %d", i)
+	}
+	method := "Get" // Placeholder response for an empty request.
+	if args != nil {
+		method, _ = storage.MethodForRequest(args)
+	}
+	cmdReply, _ := storage.CreateReply(method)
+	cmdReply.Header().Error = err
+	reply.Responses[i].SetValue(cmdReply)
+}
 
 // BootstrapRangeLocations sets meta1 and meta2 values for KeyMax,
 // using the provided replica.
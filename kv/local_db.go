@@ -35,16 +35,23 @@ func NewLocalDB(rng *storage.Range) *LocalDB {
 	return &LocalDB{rng: rng}
 }
 
-// invokeMethod sends the specified RPC asynchronously and returns a
-// channel which receives the reply struct when the call is
-// complete. Returns a channel of the same type as "reply".
+// invokeMethod executes the specified command against the range and
+// returns a channel which receives the reply struct when the command
+// is complete. Returns a channel of the same type as "reply".
 func (db *LocalDB) invokeMethod(method string, args, reply interface{}) interface{} {
 	chanVal := reflect.MakeChan(reflect.ChanOf(reflect.BothDir, reflect.TypeOf(reply)), 1)
 	replyVal := reflect.ValueOf(reply)
-	reflect.ValueOf(db.rng).MethodByName(method).Call([]reflect.Value{
-		reflect.ValueOf(args),
-		replyVal,
-	})
+	ctx, cancel := args.(storage.Request).Header().Context()
+	defer cancel()
+	var err error
+	if storage.IsReadOnly(method) {
+		err = db.rng.ReadOnlyCmd(ctx, method, args, reply)
+	} else {
+		err = <-db.rng.ReadWriteCmd(ctx, method, args, reply)
+	}
+	if err != nil {
+		reply.(storage.Response).Header().Error = err
+	}
 	chanVal.Send(replyVal)
 
 	return chanVal.Interface()
@@ -62,7 +69,11 @@ func (db *LocalDB) Put(args *storage.PutRequest) <-chan *storage.PutResponse {
 		args, &storage.PutResponse{}).(chan *storage.PutResponse)
 }
 
-
+// Delete passes through to local range.
+func (db *LocalDB) Delete(args *storage.DeleteRequest) <-chan *storage.DeleteResponse {
+	return db.invokeMethod("Delete",
+		args, &storage.DeleteResponse{}).(chan *storage.DeleteResponse)
+}
 
 // Increment passes through to local range.
 func (db *LocalDB) Increment(args *storage.IncrementRequest) <-chan *storage.IncrementResponse {
@@ -70,9 +81,20 @@ func (db *LocalDB) Increment(args *storage.IncrementRequest) <-chan *storage.Inc
 		args, &storage.IncrementResponse{}).(chan *storage.IncrementResponse)
 }
 
+// InternalMerge passes through to local range.
+func (db *LocalDB) InternalMerge(args *storage.InternalMergeRequest) <-chan *storage.InternalMergeResponse {
+	return db.invokeMethod("InternalMerge",
+		args, &storage.InternalMergeResponse{}).(chan *storage.InternalMergeResponse)
+}
 
 // Scan passes through to local range.
 func (db *LocalDB) Scan(args *storage.ScanRequest) <-chan *storage.ScanResponse {
 	return db.invokeMethod("Scan",
 		args, &storage.ScanResponse{}).(chan *storage.ScanResponse)
 }
+
+// Batch passes through to local range.
+func (db *LocalDB) Batch(args *storage.BatchRequest) <-chan *storage.BatchResponse {
+	return db.invokeMethod("Batch",
+		args, &storage.BatchResponse{}).(chan *storage.BatchResponse)
+}
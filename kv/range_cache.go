@@ -0,0 +1,115 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package kv
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/biogo/store/llrb"
+	"gossipgo/storage"
+	"gossipgo/util"
+)
+
+// A cachedRange holds the replica metadata of a range along with its
+// meta2 key, which encodes the range's end key.
+type cachedRange struct {
+	metaKey   storage.Key
+	locations *storage.RangeLocations
+}
+
+// Compare implements the llrb.Comparable interface for tree nodes.
+func (cr *cachedRange) Compare(b llrb.Comparable) int {
+	return bytes.Compare(cr.metaKey, b.(*cachedRange).metaKey)
+}
+
+// A rangeCache caches replica metadata by range. Ranges are ordered
+// by their meta2 keys; as with the lookup of the meta2 records
+// themselves, the range containing a key is the first range whose
+// meta2 key is greater than the key's. Once the cache is full, the
+// least recently used range is evicted. It is safe for concurrent
+// access.
+type rangeCache struct {
+	mu     sync.Mutex
+	ranges llrb.Tree      // *cachedRange ordered by meta2 key
+	lru    *util.LRUCache // *cachedRange by string(metaKey)
+}
+
+// newRangeCache returns a cache which holds the metadata of at most
+// maxRanges ranges.
+func newRangeCache(maxRanges int) *rangeCache {
+	rc := &rangeCache{lru: util.NewLRUCache(maxRanges)}
+	rc.lru.OnEvicted = func(_ util.Key, value interface{}) {
+		rc.ranges.Delete(value.(*cachedRange))
+	}
+	return rc
+}
+
+// find returns the cached range containing key, or nil if there's
+// none. Must be called with the cache locked.
+func (rc *rangeCache) find(key storage.Key) *cachedRange {
+	metaKey := storage.MakeKey(storage.KeyMeta2Prefix, key)
+	c := rc.ranges.Ceil(&cachedRange{metaKey: storage.MakeKey(metaKey, storage.Key{0})})
+	if c == nil {
+		return nil
+	}
+	cr := c.(*cachedRange)
+	if bytes.Compare(metaKey, cr.locations.StartKey) < 0 {
+		return nil
+	}
+	return cr
+}
+
+// lookup returns the metadata of the cached range containing key and
+// whether it was found.
+func (rc *rangeCache) lookup(key storage.Key) (*storage.RangeLocations, bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	cr := rc.find(key)
+	if cr == nil {
+		return nil, false
+	}
+	rc.lru.Get(string(cr.metaKey))
+	return cr.locations, true
+}
+
+// add caches the metadata of the range with the given meta2 key,
+// replacing any metadata cached for it.
+func (rc *rangeCache) add(metaKey storage.Key, locations *storage.RangeLocations) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	cr := &cachedRange{metaKey: metaKey, locations: locations}
+	rc.ranges.Insert(cr)
+	rc.lru.Add(string(metaKey), cr)
+}
+
+// evict removes the cached range containing key, if any.
+func (rc *rangeCache) evict(key storage.Key) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if cr := rc.find(key); cr != nil {
+		rc.lru.Remove(string(cr.metaKey))
+	}
+}
+
+// len returns the number of cached ranges.
+func (rc *rangeCache) len() int {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.lru.Len()
+}
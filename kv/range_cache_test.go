@@ -0,0 +1,99 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package kv
+
+import (
+	"testing"
+
+	"gossipgo/storage"
+)
+
+func metaKey(key string) storage.Key {
+	return storage.MakeKey(storage.KeyMeta2Prefix, storage.Key(key))
+}
+
+// TestRangeCacheLookup verifies that keys are found in the cached
+// range with the first end key greater than the key.
+func TestRangeCacheLookup(t *testing.T) {
+	rc := newRangeCache(10)
+	ab := &storage.RangeLocations{StartKey: metaKey("a")}
+	bd := &storage.RangeLocations{StartKey: metaKey("b")}
+	rc.add(metaKey("b"), ab)
+	rc.add(metaKey("d"), bd)
+
+	testCases := []struct {
+		key      string
+		expected *storage.RangeLocations
+	}{
+		{"", nil},
+		{"a", ab},
+		{"aaa", ab},
+		{"b", bd},
+		{"c", bd},
+		{"d", nil},
+		{"e", nil},
+	}
+	for i, test := range testCases {
+		locations, ok := rc.lookup(storage.Key(test.key))
+		if ok != (test.expected != nil) || locations != test.expected {
+			t.Errorf("%d: expected %+v for key %q; got %+v", i, test.expected, test.key, locations)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		rc.lookup(storage.Key("c"))
+	}
+	if rc.len() != 2 {
+		t.Errorf("expected 2 cached ranges; got %d", rc.len())
+	}
+}
+
+// TestRangeCacheEvict verifies that evicting a key evicts the whole
+// range containing it.
+func TestRangeCacheEvict(t *testing.T) {
+	rc := newRangeCache(10)
+	rc.add(metaKey("b"), &storage.RangeLocations{StartKey: metaKey("a")})
+	rc.add(metaKey("d"), &storage.RangeLocations{StartKey: metaKey("b")})
+	rc.evict(storage.Key("c"))
+	if _, ok := rc.lookup(storage.Key("b")); ok {
+		t.Error("expected range [b, d) to be evicted")
+	}
+	if _, ok := rc.lookup(storage.Key("a")); !ok {
+		t.Error("expected range [a, b) to remain cached")
+	}
+}
+
+// TestRangeCacheLRU verifies that the least recently used range is
+// evicted once the cache is full.
+func TestRangeCacheLRU(t *testing.T) {
+	rc := newRangeCache(2)
+	rc.add(metaKey("b"), &storage.RangeLocations{StartKey: metaKey("a")})
+	rc.add(metaKey("c"), &storage.RangeLocations{StartKey: metaKey("b")})
+	rc.lookup(storage.Key("a"))
+	rc.add(metaKey("d"), &storage.RangeLocations{StartKey: metaKey("c")})
+	if _, ok := rc.lookup(storage.Key("b")); ok {
+		t.Error("expected range [b, c) to be evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := rc.lookup(storage.Key(key)); !ok {
+			t.Errorf("expected range containing %q to remain cached", key)
+		}
+	}
+	if rc.len() != 2 {
+		t.Errorf("expected 2 cached ranges; got %d", rc.len())
+	}
+}
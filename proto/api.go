@@ -341,6 +341,8 @@ func MethodForRequest(req Request) (string, error) {
 		return Batch, nil
 	case *AdminSplitRequest:
 		return AdminSplit, nil
+	case *InternalRangeLookupRequest:
+		return InternalRangeLookup, nil
 	case *InternalHeartbeatTxnRequest:
 		return InternalHeartbeatTxn, nil
 	case *InternalPushTxnRequest:
@@ -396,6 +398,8 @@ func CreateArgs(method string) (Request, error) {
 		return &BatchRequest{}, nil
 	case AdminSplit:
 		return &AdminSplitRequest{}, nil
+	case InternalRangeLookup:
+		return &InternalRangeLookupRequest{}, nil
 	case InternalHeartbeatTxn:
 		return &InternalHeartbeatTxnRequest{}, nil
 	case InternalPushTxn:
@@ -441,6 +445,8 @@ func CreateReply(method string) (Response, error) {
 		return &BatchResponse{}, nil
 	case AdminSplit:
 		return &AdminSplitResponse{}, nil
+	case InternalRangeLookup:
+		return &InternalRangeLookupResponse{}, nil
 	case InternalHeartbeatTxn:
 		return &InternalHeartbeatTxnResponse{}, nil
 	case InternalPushTxn:
@@ -531,6 +537,12 @@ func (rh *RequestHeader) Header() *RequestHeader {
 	return rh
 }
 
+// SetDeadline implements the rpc.DeadlineSetter interface for
+// RequestHeader.
+func (rh *RequestHeader) SetDeadline(deadline int64) {
+	rh.Deadline = deadline
+}
+
 // Header implements the Response interface for ResponseHeader.
 func (rh *ResponseHeader) Header() *ResponseHeader {
 	return rh
@@ -562,11 +574,10 @@ func (rh *ResponseHeader) SetGoError(err error) {
 		rh.Error = &Error{}
 	}
 	if !rh.Error.SetValue(err) {
-		//TODO
-		var canRetry bool = false
-		//if r, ok := err.(util.Retryable); ok {
-		//	canRetry = r.CanRetry()
-		//}
+		var canRetry bool
+		if r, ok := err.(util.Retryable); ok {
+			canRetry = r.CanRetry()
+		}
 		rh.Error.SetValue(&GenericError{
 			Message:   err.Error(),
 			Retryable: canRetry,
@@ -122,10 +122,16 @@ type RequestHeader struct {
 	// isolation level set as desired. The response will contain the
 	// fully-initialized transaction with txn ID, priority, initial
 	// timestamp, and maximum timestamp.
-	Txn                  *Transaction `protobuf:"bytes,9,opt,name=txn" json:"txn,omitempty"`
-	XXX_NoUnkeyedLiteral struct{}     `json:"-"`
-	XXX_unrecognized     []byte       `json:"-"`
-	XXX_sizecache        int32        `json:"-"`
+	Txn *Transaction `protobuf:"bytes,9,opt,name=txn" json:"txn,omitempty"`
+	// MaxTimestamp is the upper bound of the uncertainty interval of
+	// reads: Timestamp plus the maximum clock offset of the cluster.
+	MaxTimestamp Timestamp `protobuf:"bytes,10,opt,name=max_timestamp,json=maxTimestamp" json:"max_timestamp"`
+	// Deadline is the wall time in Unix nanoseconds after which the
+	// client abandons the request. Zero means no deadline.
+	Deadline             int64    `protobuf:"varint,11,opt,name=deadline" json:"deadline"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
 }
 
 func (m *RequestHeader) Reset()         { *m = RequestHeader{} }
@@ -203,6 +209,20 @@ func (m *RequestHeader) GetTxn() *Transaction {
 	return nil
 }
 
+func (m *RequestHeader) GetMaxTimestamp() Timestamp {
+	if m != nil {
+		return m.MaxTimestamp
+	}
+	return Timestamp{}
+}
+
+func (m *RequestHeader) GetDeadline() int64 {
+	if m != nil {
+		return m.Deadline
+	}
+	return 0
+}
+
 // ResponseHeader is returned with every storage node response.
 type ResponseHeader struct {
 	// Error is non-nil if an error occurred.
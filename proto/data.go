@@ -197,6 +197,16 @@ func (k EncodedKey) Marshal() ([]byte, error) {
 	return []byte(k), nil
 }
 
+// Size implements the gogoproto custom type interface.
+func (k Key) Size() int {
+	return len(k)
+}
+
+// Size implements the gogoproto custom type interface.
+func (k EncodedKey) Size() int {
+	return len(k)
+}
+
 // Unmarshal implements the gogoproto Unmarshaler interface.
 func (k *Key) Unmarshal(bytes []byte) error {
 	*k = Key(append([]byte(nil), bytes...))
@@ -31,7 +31,13 @@ func (ge *GenericError) CanRetry() bool {
 
 // Error formats error.
 func (e *NotLeaderError) Error() string {
-	return fmt.Sprintf("range not leader; leader is %+v", e.Leader)
+	return fmt.Sprintf("range not leader; leader is %s", e.Leader.String())
+}
+
+// CanRetry indicates whether or not this NotLeaderError can be
+// retried. The request should be redirected to the leader.
+func (e *NotLeaderError) CanRetry() bool {
+	return true
 }
 
 // NewRangeNotFoundError initializes a new RangeNotFoundError.
@@ -64,7 +70,7 @@ func NewRangeKeyMismatchError(start, end Key, desc *RangeDescriptor) *RangeKeyMi
 func (e *RangeKeyMismatchError) Error() string {
 	if e.Range != nil {
 		return fmt.Sprintf("key range %q-%q outside of bounds of range %q-%q (%+v)",
-			e.RequestStartKey, e.RequestEndKey, e.Range.StartKey, e.Range.EndKey, e.Range.Replicas[0])
+			e.RequestStartKey, e.RequestEndKey, e.Range.StartKey, e.Range.EndKey, e.Range.Replicas)
 	}
 	return fmt.Sprintf("key range %q-%q could not be located within a range on store", e.RequestStartKey, e.RequestEndKey)
 }
@@ -110,6 +116,12 @@ func (e *TransactionRetryError) Error() string {
 	return fmt.Sprintf("retry txn %s", e.Txn)
 }
 
+// CanRetry indicates whether or not this TransactionRetryError can be
+// retried.
+func (e *TransactionRetryError) CanRetry() bool {
+	return true
+}
+
 // NewTransactionStatusError initializes a new TransactionStatusError.
 func NewTransactionStatusError(txn *Transaction, msg string) *TransactionStatusError {
 	return &TransactionStatusError{
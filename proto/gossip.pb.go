@@ -76,7 +76,12 @@ type GossipRequest struct {
 	// Maximum sequence number of gossip from this peer.
 	MaxSeq int64 `protobuf:"varint,3,opt,name=max_seq,json=maxSeq" json:"max_seq"`
 	// Reciprocal delta of new info since last gossip.
-	Delta                []byte   `protobuf:"bytes,4,opt,name=delta" json:"delta"`
+	Delta []byte `protobuf:"bytes,4,opt,name=delta" json:"delta"`
+	// Compression codec of delta; empty if uncompressed.
+	Compression string `protobuf:"bytes,5,opt,name=compression" json:"compression"`
+	// Compression codecs accepted for the response delta, in order of
+	// preference.
+	AcceptCompression    []string `protobuf:"bytes,6,rep,name=accept_compression,json=acceptCompression" json:"accept_compression,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -134,13 +139,29 @@ func (m *GossipRequest) GetDelta() []byte {
 	return nil
 }
 
+func (m *GossipRequest) GetCompression() string {
+	if m != nil {
+		return m.Compression
+	}
+	return ""
+}
+
+func (m *GossipRequest) GetAcceptCompression() []string {
+	if m != nil {
+		return m.AcceptCompression
+	}
+	return nil
+}
+
 // GossipResponse is returned from the Gossip.Gossip RPC.
 // Delta will be nil in the event that Alternate is set.
 type GossipResponse struct {
 	// Requested delta of server's infostore.
 	Delta []byte `protobuf:"bytes,1,opt,name=delta" json:"delta"`
 	// Non-nil means client should retry with this address.
-	Alternate            *Addr    `protobuf:"bytes,2,opt,name=alternate" json:"alternate,omitempty"`
+	Alternate *Addr `protobuf:"bytes,2,opt,name=alternate" json:"alternate,omitempty"`
+	// Compression codec of delta; empty if uncompressed.
+	Compression          string   `protobuf:"bytes,3,opt,name=compression" json:"compression"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -184,6 +205,13 @@ func (m *GossipResponse) GetAlternate() *Addr {
 	return nil
 }
 
+func (m *GossipResponse) GetCompression() string {
+	if m != nil {
+		return m.Compression
+	}
+	return ""
+}
+
 func init() {
 	proto.RegisterType((*Addr)(nil), "proto.Addr")
 	proto.RegisterType((*GossipRequest)(nil), "proto.GossipRequest")
@@ -18,111 +18,364 @@
 package rpc
 
 import (
-	"gossipgo/util"
-	"log"
+	"context"
+	"crypto/tls"
 	"net"
 	"net/rpc"
+	"reflect"
 	"sync"
 	"time"
+
+	"gossipgo/proto"
+	"gossipgo/util"
+	"log"
 )
 
 const (
 	defaultHeartbeatInterval = 3 * time.Second // 3s
+	// dialTimeout is the deadline for each attempt to dial a server.
+	dialTimeout = 5 * time.Second
 )
 
 var (
-	clientMu          sync.Mutex         // Protects access to the client cache.
-	clients           map[string]*Client // Cache of RPC clients by server address.
-	heartbeatInterval time.Duration
+	heartbeatInterval = defaultHeartbeatInterval
+	// clientIdleTimeout is how long a client without references remains
+	// cached before it's closed.
+	clientIdleTimeout = 1 * time.Minute
 )
 
-// init creates a new client RPC cache.
-func init() {
-	clients = make(map[string]*Client)
-	heartbeatInterval = defaultHeartbeatInterval
+// ClientState is the health state of an RPC client.
+type ClientState int
+
+const (
+	// Connecting clients are dialing the initial connection.
+	Connecting ClientState = iota
+	// Ready clients are connected and their heartbeats are succeeding.
+	Ready
+	// Unhealthy clients' last heartbeat failed or timed out. If the
+	// heartbeat failed because the connection was lost, the client is
+	// redialing it.
+	Unhealthy
+	// Closed clients were closed, either because no references
+	// remained or because the context was closed. A closed client is
+	// removed from the context's cache and can't be used again.
+	Closed
+)
+
+// String implements the fmt.Stringer interface.
+func (s ClientState) String() string {
+	switch s {
+	case Connecting:
+		return "connecting"
+	case Ready:
+		return "ready"
+	case Unhealthy:
+		return "unhealthy"
+	case Closed:
+		return "closed"
+	}
+	return "unknown"
 }
 
-// Client is a Cockroach-specific RPC client with an embedded go
-// rpc.Client struct.
+// Client is a Cockroach-specific RPC client wrapping a go rpc.Client,
+// which is replaced when the connection is redialed.
 type Client struct {
-	*rpc.Client               // Embedded RPC client
-	Addr        net.Addr      // Remove address of client
-	LAddr       net.Addr      // Local address of client
-	Ready       chan struct{} // Closed when client is connected
+	Addr   net.Addr      // Remote address of client
+	Ready  chan struct{} // Closed when client is first connected
+	Closed chan struct{} // Closed when client is closed
+
+	context   *Context    // Owns the client cache; records clock offsets
+	refs      int         // Count of references; protected by context.clientMu
+	idleTimer *time.Timer // Closes the client when idle; protected by context.clientMu
+
+	mu      sync.Mutex    // Protects client, lAddr, state and changed
+	client  *rpc.Client   // Current connection; nil until connected
+	lAddr   net.Addr      // Local address of the current connection
+	state   ClientState   // Current health state
+	changed chan struct{} // Closed and replaced on each state change
 }
 
 // NewClient returns a client RPC stub for the specified address
 // (usually a TCP host:port, but for testing may be a unix domain
-// socket). The process-wide client RPC cache is consulted first; if
-// the requested client is not present, it's created and the cache is
+// socket). The context's client cache is consulted first; if the
+// requested client is not present, it's created and the cache is
 // updated. The returned client is returned immediately and may not be
-// healthy.
-func NewClient(addr net.Addr) *Client {
-	clientMu.Lock()
-	if c, ok := clients[addr.String()]; ok {
-		clientMu.Unlock()
+// healthy. Offsets to the remote clock measured by the client's
+// heartbeat are recorded in the context.
+//
+// Each call to NewClient acquires a reference to the client which
+// must be released with Close.
+func NewClient(addr net.Addr, context *Context) *Client {
+	context.clientMu.Lock()
+	defer context.clientMu.Unlock()
+	if c, ok := context.clients[addr.String()]; ok {
+		c.refs++
+		if c.idleTimer != nil {
+			c.idleTimer.Stop()
+			c.idleTimer = nil
+		}
 		return c
 	}
 	c := &Client{
-		Addr:  addr,
-		Ready: make(chan struct{}),
+		Addr:    addr,
+		Ready:   make(chan struct{}),
+		Closed:  make(chan struct{}),
+		context: context,
+		refs:    1,
+		state:   Connecting,
+		changed: make(chan struct{}),
+	}
+	context.clients[addr.String()] = c
+	go c.connect()
+	return c
+}
+
+// conn returns the client's current connection.
+func (c *Client) conn() *rpc.Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.client
+}
+
+// LocalAddr returns the local address of the client's current
+// connection, or nil if it isn't connected yet.
+func (c *Client) LocalAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lAddr
+}
+
+// State returns the current health state of the client.
+func (c *Client) State() ClientState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+// StateChanged returns a channel which is closed on the client's next
+// change of state. Callers may subscribe to health changes by waiting
+// on the channel and then calling State.
+func (c *Client) StateChanged() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.changed
+}
+
+// setState sets the client's state, notifying subscribers on change.
+// Closed is a terminal state.
+func (c *Client) setState(state ClientState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == state || c.state == Closed {
+		return
+	}
+	c.state = state
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// Close releases a reference to the client. When no references
+// remain, the client is closed after idling for clientIdleTimeout,
+// unless it's acquired again by NewClient in the meantime.
+func (c *Client) Close() {
+	c.context.clientMu.Lock()
+	defer c.context.clientMu.Unlock()
+	if c.refs == 0 {
+		return
+	}
+	c.refs--
+	if c.refs == 0 && c.idleTimer == nil {
+		c.idleTimer = time.AfterFunc(clientIdleTimeout, c.closeIdle)
+	}
+}
+
+// closeIdle closes the client if it has remained without references.
+func (c *Client) closeIdle() {
+	c.context.clientMu.Lock()
+	defer c.context.clientMu.Unlock()
+	c.idleTimer = nil
+	if c.refs == 0 {
+		c.closeLocked()
 	}
-	clients[addr.String()] = c
-	clientMu.Unlock()
+}
+
+// closeLocked closes the connection and removes the client from the
+// context's cache. A new client to the same address will be created
+// on the next call to NewClient. Requires context.clientMu.
+func (c *Client) closeLocked() {
+	if c.State() == Closed {
+		return
+	}
+	if cached, ok := c.context.clients[c.Addr.String()]; ok && cached == c {
+		delete(c.context.clients, c.Addr.String())
+	}
+	if c.idleTimer != nil {
+		c.idleTimer.Stop()
+		c.idleTimer = nil
+	}
+	c.setState(Closed)
+	close(c.Closed)
+	if conn := c.conn(); conn != nil {
+		conn.Close()
+	}
+}
+
+// A DeadlineSetter is implemented by requests which carry the
+// client's deadline to the server, allowing the server to abandon
+// work the client has given up on.
+type DeadlineSetter interface {
+	// SetDeadline sets the request deadline in Unix nanoseconds.
+	SetDeadline(deadline int64)
+}
 
-	// Attempt to dial connection with exponential backoff starting
-	// at 1s and ending at 30s with indefinite retries.
+// CallWithContext waits for the client to be ready, invokes the named
+// function and waits for it to complete. Returns ctx.Err() if ctx is
+// done first, or an error if the client is closed. If ctx has a
+// deadline and args implements DeadlineSetter, the deadline is sent
+// to the server with the request. The response is decoded into a
+// separate reply which is copied into reply only on success, so a
+// late response to an abandoned call never modifies reply. Calls made
+// while the connection is being redialed fail.
+func (c *Client) CallWithContext(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	select {
+	case <-c.Ready:
+	case <-c.Closed:
+		return util.Errorf("client to %s closed", c.Addr)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if ds, ok := args.(DeadlineSetter); ok {
+			ds.SetDeadline(deadline.UnixNano())
+		}
+	}
+	replyVal := reflect.ValueOf(reply)
+	callReply := reflect.New(replyVal.Elem().Type())
+	call := c.conn().Go(serviceMethod, args, callReply.Interface(), make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			return call.Error
+		}
+		replyVal.Elem().Set(callReply.Elem())
+		return nil
+	case <-c.Closed:
+		return util.Errorf("client to %s closed", c.Addr)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// dial connects to the client's address, using TLS unless the context
+// is insecure. Each attempt is bounded by dialTimeout.
+func (c *Client) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	if c.context.Insecure() {
+		return dialer.Dial(c.Addr.Network(), c.Addr.String())
+	}
+	return tls.DialWithDialer(dialer, c.Addr.Network(), c.Addr.String(), c.context.tlsConfig)
+}
+
+// connect dials the connection. On success, the client is ready and
+// heartbeats are started.
+func (c *Client) connect() {
+	if !c.redial() {
+		return
+	}
+	log.Printf("client connected: %s", c.Addr)
+	c.setState(Ready)
+	close(c.Ready)
+
+	// Launch heartbeat.
+	go c.heartbeat()
+}
+
+// redial closes the current connection, if any, and dials a new one
+// with jittered exponential backoff starting at 1s and ending at 30s.
+// Dialing is retried until it succeeds or the client is closed.
+// Returns whether the client was connected.
+func (c *Client) redial() bool {
+	if conn := c.conn(); conn != nil {
+		conn.Close()
+	}
 	opts := util.Options{
-		Backoff:     1 * time.Second,  // first backoff at 1s
-		MaxBackoff:  30 * time.Second, // max backoff is 30s
-		Constant:    2,                // doubles
-		MaxAttempts: 0,                // indefinite retries
-	}
-	go util.RetryWithBackoffOptions(opts, func() bool {
-		// TODO(spencer): use crypto.tls.
-		conn, err := net.Dial(addr.Network(), addr.String())
+		Backoff:    1 * time.Second,  // first backoff at 1s
+		MaxBackoff: 30 * time.Second, // max backoff is 30s
+		Constant:   2,                // doubles
+		Jitter:     0.15,             // avoids reconnecting in lockstep
+		Stopper:    c.Closed,         // stop retrying when closed
+	}
+	err := util.RetryWithBackoffOptions(opts, func() bool {
+		conn, err := c.dial()
 		if err != nil {
 			log.Print(err)
 			return false
 		}
-		c.Client = rpc.NewClient(conn)
-		c.LAddr = conn.LocalAddr()
-		log.Printf("client connected: %s", addr)
-		close(c.Ready)
-
-		// Launch heartbeat.
-		go c.heartbeat()
-
+		c.context.clientMu.Lock()
+		defer c.context.clientMu.Unlock()
+		if c.State() == Closed {
+			conn.Close()
+			return true
+		}
+		c.mu.Lock()
+		c.client = rpc.NewClientWithCodec(NewClientCodec(conn))
+		c.lAddr = conn.LocalAddr()
+		c.mu.Unlock()
 		return true
 	})
-
-	return c
+	return err == nil && c.State() != Closed
 }
 
-// heartbeat sends periodic heartbeats to client. Closes the
-// connection on error. This method loops indefinitely until an error
-// is encountered.
+// heartbeat sends periodic heartbeats to client. This method loops
+// until the client is closed. Each heartbeat measures the offset of
+// the remote clock from the local clock. The client is unhealthy
+// while heartbeats fail or time out; if the connection is lost, it's
+// redialed and heartbeats resume once connected.
 func (c *Client) heartbeat() {
 	for {
-		log.Print(c)
-		call := c.Go("Heartbeat.Ping", &PingRequest{}, &PingResponse{}, nil)
+		response := &proto.PingResponse{}
+		sendTime := c.context.LocalClock.PhysicalNow()
+		call := c.conn().Go("Heartbeat.Ping", &proto.PingRequest{}, response, nil)
 		select {
 		case <-call.Done:
-			// On heartbeat failure, remove this client from cache. A new
-			// client to this address will be created on the next call to
-			// NewClient().
 			if call.Error != nil {
-				log.Printf("heartbeat failed: %v; recycling client", call.Error)
-				clientMu.Lock()
-				delete(clients, c.Addr.String())
-				clientMu.Unlock()
-				c.Close()
-				break
+				log.Printf("heartbeat to client %s failed: %v", c.Addr, call.Error)
+				c.markUnhealthy()
+				if _, ok := call.Error.(rpc.ServerError); ok {
+					break
+				}
+				// The connection was lost.
+				if !c.redial() {
+					return
+				}
+				log.Printf("client reconnected: %s", c.Addr)
+				continue
 			}
-			time.Sleep(heartbeatInterval)
+			receiveTime := c.context.LocalClock.PhysicalNow()
+			c.context.RemoteClocks.UpdateOffset(c.Addr.String(),
+				measureOffset(sendTime, receiveTime, response.ServerTime))
+			c.setState(Ready)
 		case <-time.After(heartbeatInterval * 2):
-			// Allowed twice gossip interval.
+			// Allowed twice heartbeat interval.
 			log.Printf("client %s unhealthy after %v", c.Addr, heartbeatInterval*2)
+			c.markUnhealthy()
+		case <-c.Closed:
+			return
+		}
+
+		select {
+		case <-time.After(heartbeatInterval):
+		case <-c.Closed:
+			return
 		}
 	}
 }
+
+// markUnhealthy sets the client's state to unhealthy. The offset to
+// the remote clock is recorded as infinite, as it can't be measured.
+func (c *Client) markUnhealthy() {
+	offset := proto.InfiniteOffset
+	offset.MeasuredAt = c.context.LocalClock.PhysicalNow()
+	c.context.RemoteClocks.UpdateOffset(c.Addr.String(), offset)
+	c.setState(Unhealthy)
+}
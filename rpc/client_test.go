@@ -0,0 +1,259 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package rpc
+
+import (
+	gocontext "context"
+	"net"
+	"testing"
+	"time"
+
+	gogoproto "github.com/gogo/protobuf/proto"
+
+	"gossipgo/proto"
+	"gossipgo/util/hlc"
+)
+
+// startTestServer starts an insecure RPC server on a free local port
+// and returns the server along with a context for clients.
+func startTestServer(t *testing.T) (*Server, *Context) {
+	context := NewContext(hlc.NewClock(hlc.UnixNano, 0), nil)
+	addr, err := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(addr, context)
+	go s.ListenAndServe()
+	<-s.listening
+	// Wait for the server address to be updated to the chosen port.
+	for i := 0; s.Addr.String() == addr.String() && i < 100; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	return s, context
+}
+
+// contextWithDeadline returns a context which is done at deadline.
+func contextWithDeadline(deadline time.Time) (gocontext.Context, gocontext.CancelFunc) {
+	return gocontext.WithDeadline(gocontext.Background(), deadline)
+}
+
+// waitState waits for the client to reach the specified state.
+func waitState(t *testing.T, c *Client, state ClientState) {
+	for c.State() != state {
+		select {
+		case <-c.StateChanged():
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for client state %s; got %s", state, c.State())
+		}
+	}
+}
+
+// TestClientCache verifies clients are shared by address and closed
+// once all references are released and the idle timeout expires.
+func TestClientCache(t *testing.T) {
+	defer func(d time.Duration) { clientIdleTimeout = d }(clientIdleTimeout)
+	clientIdleTimeout = 10 * time.Millisecond
+
+	s, context := startTestServer(t)
+	defer s.Close()
+
+	c1 := NewClient(s.Addr, context)
+	c2 := NewClient(s.Addr, context)
+	if c1 != c2 {
+		t.Fatal("expected cached client")
+	}
+	<-c1.Ready
+	waitState(t, c1, Ready)
+
+	c1.Close()
+	time.Sleep(5 * clientIdleTimeout)
+	if c1.State() != Ready {
+		t.Fatalf("expected referenced client to remain ready; got %s", c1.State())
+	}
+	c2.Close()
+	select {
+	case <-c1.Closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected idle client to be closed")
+	}
+	if c1.State() != Closed {
+		t.Errorf("expected closed state; got %s", c1.State())
+	}
+
+	c3 := NewClient(s.Addr, context)
+	defer c3.Close()
+	if c3 == c1 {
+		t.Error("expected closed client to be replaced in cache")
+	}
+}
+
+// TestClientReacquired verifies releasing and re-acquiring a client
+// before the idle timeout keeps it open.
+func TestClientReacquired(t *testing.T) {
+	defer func(d time.Duration) { clientIdleTimeout = d }(clientIdleTimeout)
+	clientIdleTimeout = 50 * time.Millisecond
+
+	s, context := startTestServer(t)
+	defer s.Close()
+	defer context.Close()
+
+	c := NewClient(s.Addr, context)
+	<-c.Ready
+	c.Close()
+	if NewClient(s.Addr, context) != c {
+		t.Fatal("expected cached client")
+	}
+	time.Sleep(2 * clientIdleTimeout)
+	if c.State() == Closed {
+		t.Error("expected re-acquired client to remain open")
+	}
+	c.Close()
+}
+
+// TestContextClose verifies closing the context closes all clients,
+// including those still dialing an unreachable address.
+func TestContextClose(t *testing.T) {
+	s, context := startTestServer(t)
+	defer s.Close()
+
+	c := NewClient(s.Addr, context)
+	<-c.Ready
+	// Nothing listens at port 1, so this client keeps retrying.
+	unreachable, err := net.ResolveTCPAddr("tcp", "127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := NewClient(unreachable, context)
+	if u.State() != Connecting {
+		t.Errorf("expected connecting state; got %s", u.State())
+	}
+
+	context.Close()
+	for _, client := range []*Client{c, u} {
+		select {
+		case <-client.Closed:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected client %s to be closed", client.Addr)
+		}
+	}
+	if len(context.clients) != 0 {
+		t.Errorf("expected empty client cache; got %d clients", len(context.clients))
+	}
+}
+
+// TestClientRedial verifies a client whose connection is lost
+// remains open and redials the connection.
+func TestClientRedial(t *testing.T) {
+	s, context := startTestServer(t)
+	defer s.Close()
+	defer context.Close()
+
+	c := NewClient(s.Addr, context)
+	defer c.Close()
+	waitState(t, c, Ready)
+
+	conn := c.conn()
+	conn.Close()
+	// The next heartbeat fails and the connection is redialed.
+	for deadline := time.Now().Add(3 * heartbeatInterval); c.conn() == conn || c.State() != Ready; {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for client to redial; state %s", c.State())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case <-c.Closed:
+		t.Fatal("expected client to remain open")
+	default:
+	}
+	ctx, cancel := contextWithDeadline(time.Now().Add(5 * time.Second))
+	defer cancel()
+	if err := c.CallWithContext(ctx, "Heartbeat.Ping", &proto.PingRequest{}, &proto.PingResponse{}); err != nil {
+		t.Errorf("expected call on redialed connection to succeed; got %v", err)
+	}
+}
+
+// SlowArgs is a request which records the deadline sent by the client.
+type SlowArgs struct {
+	Delay    int64 `protobuf:"varint,1,opt,name=delay" json:"delay"`
+	Deadline int64 `protobuf:"varint,2,opt,name=deadline" json:"deadline"`
+}
+
+func (m *SlowArgs) Reset()         { *m = SlowArgs{} }
+func (m *SlowArgs) String() string { return gogoproto.CompactTextString(m) }
+func (*SlowArgs) ProtoMessage()    {}
+
+// SetDeadline implements the DeadlineSetter interface.
+func (m *SlowArgs) SetDeadline(deadline int64) {
+	m.Deadline = deadline
+}
+
+// SlowReply holds the deadline received by the server.
+type SlowReply struct {
+	Deadline int64 `protobuf:"varint,1,opt,name=deadline" json:"deadline"`
+}
+
+func (m *SlowReply) Reset()         { *m = SlowReply{} }
+func (m *SlowReply) String() string { return gogoproto.CompactTextString(m) }
+func (*SlowReply) ProtoMessage()    {}
+
+// SlowService replies with the received deadline after a delay.
+type SlowService struct{}
+
+func (s *SlowService) Wait(args *SlowArgs, reply *SlowReply) error {
+	time.Sleep(time.Duration(args.Delay))
+	reply.Deadline = args.Deadline
+	return nil
+}
+
+// TestCallWithContext verifies the deadline is propagated to the
+// server and that calls are abandoned when the context is done.
+func TestCallWithContext(t *testing.T) {
+	s, context := startTestServer(t)
+	s.RegisterName("Slow", &SlowService{})
+	defer s.Close()
+	defer context.Close()
+
+	c := NewClient(s.Addr, context)
+	defer c.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	ctx, cancel := contextWithDeadline(deadline)
+	defer cancel()
+	reply := &SlowReply{}
+	if err := c.CallWithContext(ctx, "Slow.Wait", &SlowArgs{}, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Deadline != deadline.UnixNano() {
+		t.Errorf("expected server to receive deadline %d; got %d", deadline.UnixNano(), reply.Deadline)
+	}
+
+	// A call which outlasts its deadline is abandoned and its reply
+	// left unmodified.
+	ctx, cancel = contextWithDeadline(time.Now().Add(10 * time.Millisecond))
+	defer cancel()
+	reply = &SlowReply{}
+	args := &SlowArgs{Delay: int64(100 * time.Millisecond)}
+	if err := c.CallWithContext(ctx, "Slow.Wait", args, reply); err != ctx.Err() || err == nil {
+		t.Errorf("expected deadline exceeded; got %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if reply.Deadline != 0 {
+		t.Errorf("expected abandoned reply to remain unset; got %d", reply.Deadline)
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package rpc
+
+import (
+	"sync"
+	"time"
+
+	"gossipgo/proto"
+	"gossipgo/util"
+	"gossipgo/util/hlc"
+)
+
+// maxOffsetAge is the age after which a measured remote offset is
+// considered stale and is no longer used to verify the local clock.
+const maxOffsetAge = 10 * defaultHeartbeatInterval
+
+// RemoteClockMonitor keeps track of the most recent measurements of
+// remote offsets from this node to connected nodes.
+type RemoteClockMonitor struct {
+	mu      sync.Mutex
+	offsets map[string]proto.RemoteOffset // Maps remote address to offset
+	lClock  *hlc.Clock                    // The local clock
+}
+
+// newRemoteClockMonitor returns a monitor with the given local clock.
+func newRemoteClockMonitor(clock *hlc.Clock) *RemoteClockMonitor {
+	return &RemoteClockMonitor{
+		offsets: map[string]proto.RemoteOffset{},
+		lClock:  clock,
+	}
+}
+
+// UpdateOffset records the offset measured to the remote clock at
+// addr. The offset is only recorded if it's more recent than the
+// existing measurement.
+func (r *RemoteClockMonitor) UpdateOffset(addr string, offset proto.RemoteOffset) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if old, ok := r.offsets[addr]; !ok || old.MeasuredAt <= offset.MeasuredAt {
+		r.offsets[addr] = offset
+	}
+}
+
+// Offsets returns a copy of the most recently measured offsets, keyed
+// by remote address.
+func (r *RemoteClockMonitor) Offsets() map[string]proto.RemoteOffset {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	offsets := make(map[string]proto.RemoteOffset, len(r.offsets))
+	for addr, offset := range r.offsets {
+		offsets[addr] = offset
+	}
+	return offsets
+}
+
+// VerifyClockOffset returns an error if a majority of the remote
+// clocks with recent offset measurements are certain to be more than
+// MaxOffset from the local clock. That is, the interval [Offset-Error,
+// Offset+Error] lies entirely outside [-MaxOffset, MaxOffset]. Offset
+// checking is disabled if the local clock's MaxOffset is zero.
+func (r *RemoteClockMonitor) VerifyClockOffset() error {
+	maxOffset := r.lClock.MaxOffset().Nanoseconds()
+	if maxOffset == 0 {
+		return nil
+	}
+	now := r.lClock.PhysicalNow()
+	var measured, outOfBounds int
+	for _, offset := range r.Offsets() {
+		// Skip stale measurements and timed out heartbeats.
+		if now-offset.MeasuredAt > maxOffsetAge.Nanoseconds() || offset.Offset == proto.InfiniteOffset.Offset {
+			continue
+		}
+		measured++
+		if offset.Offset-offset.Error > maxOffset || offset.Offset+offset.Error < -maxOffset {
+			outOfBounds++
+		}
+	}
+	if outOfBounds*2 > measured {
+		return util.Errorf("local clock is more than %s from %d of %d remote clocks",
+			time.Duration(maxOffset), outOfBounds, measured)
+	}
+	return nil
+}
+
+// measureOffset estimates the offset of the remote clock from the
+// local clock given the local send and receive times of a heartbeat
+// and the remote time in the heartbeat response. The remote time was
+// read at some point during the round trip, so the estimate is taken
+// at its midpoint with an error of half the round trip time.
+func measureOffset(sendTime, receiveTime, remoteTime int64) proto.RemoteOffset {
+	return proto.RemoteOffset{
+		Offset:     remoteTime - (sendTime+receiveTime)/2,
+		Error:      (receiveTime - sendTime) / 2,
+		MeasuredAt: receiveTime,
+	}
+}
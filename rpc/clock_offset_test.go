@@ -0,0 +1,86 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package rpc
+
+import (
+	"testing"
+	"time"
+
+	"gossipgo/proto"
+	"gossipgo/util/hlc"
+)
+
+// TestMeasureOffset verifies offset and error are computed from the
+// midpoint of the heartbeat round trip.
+func TestMeasureOffset(t *testing.T) {
+	offset := measureOffset(100, 120, 150)
+	expected := proto.RemoteOffset{Offset: 40, Error: 10, MeasuredAt: 120}
+	if !offset.Equal(expected) {
+		t.Errorf("expected offset %+v; got %+v", expected, offset)
+	}
+}
+
+// TestVerifyClockOffset verifies the local clock is reported out of
+// bounds only when a majority of recently measured remote clocks are
+// certain to be more than MaxOffset away.
+func TestVerifyClockOffset(t *testing.T) {
+	manual := hlc.NewManualClock(int64(time.Hour))
+	clock := hlc.NewClock(manual.UnixNano, 50*time.Nanosecond)
+	now := manual.UnixNano()
+	stale := now - maxOffsetAge.Nanoseconds() - 1
+
+	testCases := []struct {
+		offsets []proto.RemoteOffset
+		healthy bool
+	}{
+		// No measurements.
+		{nil, true},
+		// All within bounds.
+		{[]proto.RemoteOffset{{Offset: 20, Error: 10, MeasuredAt: now}, {Offset: -40, Error: 5, MeasuredAt: now}}, true},
+		// Out of bounds only within error.
+		{[]proto.RemoteOffset{{Offset: 70, Error: 30, MeasuredAt: now}}, true},
+		// Minority out of bounds.
+		{[]proto.RemoteOffset{{Offset: 100, MeasuredAt: now}, {Offset: 0, MeasuredAt: now}, {Offset: 10, MeasuredAt: now}}, true},
+		// Majority out of bounds.
+		{[]proto.RemoteOffset{{Offset: 100, MeasuredAt: now}, {Offset: -100, MeasuredAt: now}, {Offset: 10, MeasuredAt: now}}, false},
+		// Half out of bounds isn't a majority.
+		{[]proto.RemoteOffset{{Offset: 100, MeasuredAt: now}, {Offset: 10, MeasuredAt: now}}, true},
+		// Stale and infinite offsets are ignored.
+		{[]proto.RemoteOffset{{Offset: 100, MeasuredAt: stale}, {Offset: proto.InfiniteOffset.Offset, MeasuredAt: now}, {Offset: 10, MeasuredAt: now}}, true},
+	}
+	for i, test := range testCases {
+		monitor := newRemoteClockMonitor(clock)
+		for j, offset := range test.offsets {
+			monitor.UpdateOffset(string(rune('a'+j)), offset)
+		}
+		if err := monitor.VerifyClockOffset(); (err == nil) != test.healthy {
+			t.Errorf("%d: expected healthy=%t; got error %v", i, test.healthy, err)
+		}
+	}
+}
+
+// TestUpdateOffsetKeepsLatest verifies an older measurement doesn't
+// replace a newer one.
+func TestUpdateOffsetKeepsLatest(t *testing.T) {
+	monitor := newRemoteClockMonitor(hlc.NewClock(hlc.UnixNano, 0))
+	monitor.UpdateOffset("a", proto.RemoteOffset{Offset: 1, MeasuredAt: 2})
+	monitor.UpdateOffset("a", proto.RemoteOffset{Offset: 2, MeasuredAt: 1})
+	if offset := monitor.Offsets()["a"]; offset.Offset != 1 {
+		t.Errorf("expected latest offset 1; got %d", offset.Offset)
+	}
+}
@@ -0,0 +1,256 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package rpc
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net/rpc"
+	"sync"
+
+	gogoproto "github.com/gogo/protobuf/proto"
+
+	"gossipgo/proto"
+	"gossipgo/util"
+)
+
+// maxFrameSize bounds the size of a single frame to guard against
+// corrupt or malicious length prefixes.
+const maxFrameSize = 64 << 20 // 64M
+
+// The wire format of the protobuf codec is a sequence of frames, each
+// a uvarint length followed by that many bytes of an encoded protobuf
+// message. Every request and response is sent as two frames: a header
+// frame followed by a body frame. Request headers carry the sequence
+// number and "Service.Method" name of the call. Response headers echo
+// both and carry a proto.Error if the call failed, in which case the
+// body frame is empty.
+
+// requestHeader precedes each request body.
+type requestHeader struct {
+	Seq                  uint64   `protobuf:"varint,1,opt,name=seq" json:"seq"`
+	Method               string   `protobuf:"bytes,2,opt,name=method" json:"method"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *requestHeader) Reset()         { *m = requestHeader{} }
+func (m *requestHeader) String() string { return gogoproto.CompactTextString(m) }
+func (*requestHeader) ProtoMessage()    {}
+
+// responseHeader precedes each response body.
+type responseHeader struct {
+	Seq                  uint64       `protobuf:"varint,1,opt,name=seq" json:"seq"`
+	Method               string       `protobuf:"bytes,2,opt,name=method" json:"method"`
+	Error                *proto.Error `protobuf:"bytes,3,opt,name=error" json:"error,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}     `json:"-"`
+	XXX_unrecognized     []byte       `json:"-"`
+	XXX_sizecache        int32        `json:"-"`
+}
+
+func (m *responseHeader) Reset()         { *m = responseHeader{} }
+func (m *responseHeader) String() string { return gogoproto.CompactTextString(m) }
+func (*responseHeader) ProtoMessage()    {}
+
+// baseCodec reads and writes length-prefixed protobuf frames.
+type baseCodec struct {
+	rwc io.ReadWriteCloser
+	r   *bufio.Reader
+	w   *bufio.Writer
+
+	mu sync.Mutex // Serializes writes of header and body frames
+}
+
+func newBaseCodec(rwc io.ReadWriteCloser) baseCodec {
+	return baseCodec{
+		rwc: rwc,
+		r:   bufio.NewReader(rwc),
+		w:   bufio.NewWriter(rwc),
+	}
+}
+
+// writeFrames writes the header and body messages as consecutive
+// frames. A nil body is written as an empty frame.
+func (c *baseCodec) writeFrames(header, body gogoproto.Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, m := range []gogoproto.Message{header, body} {
+		var data []byte
+		if m != nil {
+			var err error
+			if data, err = gogoproto.Marshal(m); err != nil {
+				return err
+			}
+		}
+		var lenBuf [binary.MaxVarintLen64]byte
+		n := binary.PutUvarint(lenBuf[:], uint64(len(data)))
+		if _, err := c.w.Write(lenBuf[:n]); err != nil {
+			return err
+		}
+		if _, err := c.w.Write(data); err != nil {
+			return err
+		}
+	}
+	return c.w.Flush()
+}
+
+// readFrame reads the next frame and decodes it into m. If m is nil,
+// the frame is discarded.
+func (c *baseCodec) readFrame(m gogoproto.Message) error {
+	size, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		return err
+	}
+	if size > maxFrameSize {
+		return util.Errorf("rpc frame size %d exceeds maximum %d", size, maxFrameSize)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return err
+	}
+	if m == nil {
+		return nil
+	}
+	return gogoproto.Unmarshal(data, m)
+}
+
+// Close closes the underlying connection.
+func (c *baseCodec) Close() error {
+	return c.rwc.Close()
+}
+
+// toMessage returns v as a protobuf message. A nil v is returned as a
+// nil message.
+func toMessage(v interface{}) (gogoproto.Message, error) {
+	if v == nil {
+		return nil, nil
+	}
+	m, ok := v.(gogoproto.Message)
+	if !ok {
+		return nil, util.Errorf("rpc: %T is not a protobuf message", v)
+	}
+	return m, nil
+}
+
+// serverCodec implements rpc.ServerCodec using protobuf frames.
+type serverCodec struct {
+	baseCodec
+}
+
+// NewServerCodec returns a net/rpc ServerCodec which reads requests
+// and writes responses as protobuf frames on rwc.
+func NewServerCodec(rwc io.ReadWriteCloser) rpc.ServerCodec {
+	return &serverCodec{newBaseCodec(rwc)}
+}
+
+// ReadRequestHeader implements rpc.ServerCodec.
+func (c *serverCodec) ReadRequestHeader(r *rpc.Request) error {
+	header := &requestHeader{}
+	if err := c.readFrame(header); err != nil {
+		return err
+	}
+	r.Seq = header.Seq
+	r.ServiceMethod = header.Method
+	return nil
+}
+
+// ReadRequestBody implements rpc.ServerCodec. A nil body discards the
+// request, as net/rpc does for requests to unknown methods.
+func (c *serverCodec) ReadRequestBody(body interface{}) error {
+	m, err := toMessage(body)
+	if err != nil {
+		// Consume the frame to stay in sync with the stream.
+		c.readFrame(nil)
+		return err
+	}
+	return c.readFrame(m)
+}
+
+// WriteResponse implements rpc.ServerCodec. A failed call is written
+// with its error in the header and an empty body.
+func (c *serverCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	header := &responseHeader{
+		Seq:    r.Seq,
+		Method: r.ServiceMethod,
+	}
+	if r.Error != "" {
+		header.Error = &proto.Error{}
+		header.Error.SetValue(&proto.GenericError{Message: r.Error})
+		return c.writeFrames(header, nil)
+	}
+	m, err := toMessage(body)
+	if err != nil {
+		header.Error = &proto.Error{}
+		header.Error.SetValue(&proto.GenericError{Message: err.Error()})
+		return c.writeFrames(header, nil)
+	}
+	return c.writeFrames(header, m)
+}
+
+// clientCodec implements rpc.ClientCodec using protobuf frames.
+type clientCodec struct {
+	baseCodec
+}
+
+// NewClientCodec returns a net/rpc ClientCodec which writes requests
+// and reads responses as protobuf frames on rwc.
+func NewClientCodec(rwc io.ReadWriteCloser) rpc.ClientCodec {
+	return &clientCodec{newBaseCodec(rwc)}
+}
+
+// WriteRequest implements rpc.ClientCodec.
+func (c *clientCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	m, err := toMessage(body)
+	if err != nil {
+		return err
+	}
+	return c.writeFrames(&requestHeader{Seq: r.Seq, Method: r.ServiceMethod}, m)
+}
+
+// ReadResponseHeader implements rpc.ClientCodec. The error in the
+// response header, if any, is returned to the caller of the RPC as an
+// rpc.ServerError.
+func (c *clientCodec) ReadResponseHeader(r *rpc.Response) error {
+	header := &responseHeader{}
+	if err := c.readFrame(header); err != nil {
+		return err
+	}
+	r.Seq = header.Seq
+	r.ServiceMethod = header.Method
+	if header.Error != nil {
+		if err, ok := header.Error.GetValue().(error); ok {
+			r.Error = err.Error()
+		} else {
+			r.Error = "rpc: unknown error"
+		}
+	}
+	return nil
+}
+
+// ReadResponseBody implements rpc.ClientCodec. A nil body discards
+// the response, as net/rpc does for failed calls.
+func (c *clientCodec) ReadResponseBody(body interface{}) error {
+	m, err := toMessage(body)
+	if err != nil {
+		c.readFrame(nil)
+		return err
+	}
+	return c.readFrame(m)
+}
@@ -0,0 +1,94 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package rpc
+
+import (
+	"net"
+	"net/rpc"
+	"strings"
+	"testing"
+
+	"gossipgo/proto"
+	"gossipgo/util"
+	"gossipgo/util/hlc"
+)
+
+// FailService always fails.
+type FailService struct{}
+
+func (fs *FailService) Fail(args *proto.PingRequest, reply *proto.PingResponse) error {
+	return util.Errorf("failed ping %q", args.Ping)
+}
+
+// newCodecPair returns a net/rpc client and server connected by a
+// pipe using the protobuf codec.
+func newCodecPair(t *testing.T) *rpc.Client {
+	server := rpc.NewServer()
+	server.RegisterName("Heartbeat", &HeartbeatService{clock: hlc.NewClock(hlc.NewManualClock(5).UnixNano, 0)})
+	server.RegisterName("Fail", &FailService{})
+	clientConn, serverConn := net.Pipe()
+	go server.ServeCodec(NewServerCodec(serverConn))
+	return rpc.NewClientWithCodec(NewClientCodec(clientConn))
+}
+
+// TestCodecRoundTrip verifies protobuf requests and responses are
+// exchanged by the codec, including concurrent calls.
+func TestCodecRoundTrip(t *testing.T) {
+	client := newCodecPair(t)
+	defer client.Close()
+
+	var calls []*rpc.Call
+	for _, ping := range []string{"a", "b", "c"} {
+		calls = append(calls, client.Go("Heartbeat.Ping", &proto.PingRequest{Ping: ping}, &proto.PingResponse{}, nil))
+	}
+	for i, call := range calls {
+		<-call.Done
+		if call.Error != nil {
+			t.Fatal(call.Error)
+		}
+		reply := call.Reply.(*proto.PingResponse)
+		if expected := call.Args.(*proto.PingRequest).Ping; reply.Pong != expected || reply.ServerTime != 5 {
+			t.Errorf("%d: expected pong %q at 5; got %+v", i, expected, reply)
+		}
+	}
+}
+
+// TestCodecErrors verifies errors returned by services reach the
+// client and that the connection remains usable afterwards.
+func TestCodecErrors(t *testing.T) {
+	client := newCodecPair(t)
+	defer client.Close()
+
+	err := client.Call("Fail.Fail", &proto.PingRequest{Ping: "a"}, &proto.PingResponse{})
+	if _, ok := err.(rpc.ServerError); !ok || !strings.HasSuffix(err.Error(), `failed ping "a"`) {
+		t.Errorf("expected server error; got %v", err)
+	}
+	err = client.Call("Heartbeat.Unknown", &proto.PingRequest{}, &proto.PingResponse{})
+	if _, ok := err.(rpc.ServerError); !ok {
+		t.Errorf("expected server error for unknown method; got %v", err)
+	}
+	// Requests which aren't protobuf messages can't be sent.
+	var notProto int
+	if err := client.Call("Heartbeat.Ping", &notProto, &proto.PingResponse{}); err == nil {
+		t.Error("expected error sending non-protobuf request")
+	}
+	reply := &proto.PingResponse{}
+	if err := client.Call("Heartbeat.Ping", &proto.PingRequest{Ping: "b"}, reply); err != nil || reply.Pong != "b" {
+		t.Errorf("expected pong after errors; got %+v, %v", reply, err)
+	}
+}
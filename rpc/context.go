@@ -0,0 +1,65 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package rpc
+
+import (
+	"crypto/tls"
+	"sync"
+
+	"gossipgo/util/hlc"
+)
+
+// Context contains the fields required by the rpc framework. It owns
+// the cache of clients created with NewClient.
+type Context struct {
+	LocalClock   *hlc.Clock
+	RemoteClocks *RemoteClockMonitor
+	tlsConfig    *tls.Config // nil if insecure
+
+	clientMu sync.Mutex         // Protects the client cache
+	clients  map[string]*Client // Cache of RPC clients by server address
+}
+
+// NewContext creates an rpc Context with the supplied clock. Offsets
+// of remote clocks from the local clock are tracked by RemoteClocks.
+// Servers and clients use TLS with the supplied config; if tlsConfig
+// is nil, connections are insecure. Insecure mode is intended for
+// testing only.
+func NewContext(clock *hlc.Clock, tlsConfig *tls.Config) *Context {
+	return &Context{
+		LocalClock:   clock,
+		RemoteClocks: newRemoteClockMonitor(clock),
+		tlsConfig:    tlsConfig,
+		clients:      map[string]*Client{},
+	}
+}
+
+// Close closes all cached clients, regardless of outstanding
+// references.
+func (c *Context) Close() {
+	c.clientMu.Lock()
+	defer c.clientMu.Unlock()
+	for _, client := range c.clients {
+		client.closeLocked()
+	}
+}
+
+// Insecure returns true if the context doesn't use TLS.
+func (c *Context) Insecure() bool {
+	return c.tlsConfig == nil
+}
@@ -17,21 +17,22 @@
 
 package rpc
 
-// A PingRequest specifies the string to echo in response.
-type PingRequest struct {
-	Ping string // Echo this string with PingResponse.
-}
+import (
+	"gossipgo/proto"
+	"gossipgo/util/hlc"
+)
 
-// A PingResponse contains the echoed ping request string.
-type PingResponse struct {
-	Pong string // An echo of value sent with PingRequest.
+// A HeartbeatService exposes a method to echo its request params. It
+// also replies with the server's clock time so that clients may
+// measure the offset of the server's clock from their own.
+type HeartbeatService struct {
+	clock *hlc.Clock // The server's clock
 }
 
-// A HeartbeatService exposes a method to echo its request params.
-type HeartbeatService struct{}
-
-// Ping echos the contents of the request to the response.
-func (hs *HeartbeatService) Ping(args *PingRequest, reply *PingResponse) error {
+// Ping echos the contents of the request to the response and returns
+// the server's physical clock time.
+func (hs *HeartbeatService) Ping(args *proto.PingRequest, reply *proto.PingResponse) error {
 	reply.Pong = args.Ping
+	reply.ServerTime = hs.clock.PhysicalNow()
 	return nil
 }
@@ -1,6 +1,7 @@
 package rpc
 
 import (
+	"crypto/tls"
 	"net"
 	"net/rpc"
 	"sync"
@@ -12,6 +13,7 @@ import (
 type Server struct {
 	*rpc.Server                          // Embedded RPC server instance
 	Addr           net.Addr              // Server address; may change if picking unused port
+	context        *Context              // Supplies TLS config, if secure
 	listener       net.Listener          // Server listener
 	listening      chan struct{}         // signaled when the server is listening
 	mu             sync.Mutex            // Mutex protects closed bool & closeCallbacks slice
@@ -19,15 +21,17 @@ type Server struct {
 	closeCallbacks []func(conn net.Conn) // Slice of callbacks to invoke on conn close
 }
 
-// NewServer creates a new instance of Server.
-func NewServer(addr net.Addr) *Server {
+// NewServer creates a new instance of Server. The heartbeat service
+// replies with the time of the context's clock.
+func NewServer(addr net.Addr, context *Context) *Server {
 	s := &Server{
 		Server:         rpc.NewServer(),
 		Addr:           addr,
+		context:        context,
 		listening:      make(chan struct{}, 1),
 		closeCallbacks: make([]func(conn net.Conn), 0, 1),
 	}
-	heartbeat := &HeartbeatService{}
+	heartbeat := &HeartbeatService{clock: context.LocalClock}
 	s.RegisterName("Heartbeat", heartbeat)
 	return s
 }
@@ -49,8 +53,11 @@ func (s *Server) ListenAndServe() {
 		log.Printf("unable to start gossip node: %s", err)
 	}
 	s.listening <- struct{}{} // signal that we are now listening.
-	s.listener = ln
 	s.Addr = ln.Addr()
+	if !s.context.Insecure() {
+		ln = tls.NewListener(ln, s.context.tlsConfig)
+	}
+	s.listener = ln
 
 	// Start serving gossip protocol in a loop until listener is closed.
 	log.Printf("serving on %+v...", s.Addr)
@@ -81,7 +88,7 @@ func (s *Server) Close() {
 // connection is closed, the client address is removed from the
 // incoming set.
 func (s *Server) serveConn(conn net.Conn) {
-	s.ServeConn(conn)
+	s.ServeCodec(NewServerCodec(conn))
 	s.mu.Lock()
 	for _, cb := range s.closeCallbacks {
 		cb(conn)
@@ -0,0 +1,214 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package security
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gossipgo/util"
+)
+
+const (
+	// caValidFor is the validity period of a newly created CA.
+	caValidFor = 5 * 365 * 24 * time.Hour
+	// certValidFor is the validity period of node and client certs.
+	certValidFor = 365 * 24 * time.Hour
+	// NodeUser is the common name of node certificates.
+	NodeUser = "node"
+)
+
+// caFile returns the path of the CA certificate.
+func caFile(certsDir string) string {
+	return filepath.Join(certsDir, "ca.crt")
+}
+
+// caKeyFile returns the path of the CA key.
+func caKeyFile(certsDir string) string {
+	return filepath.Join(certsDir, "ca.key")
+}
+
+// certFile returns the path of the named certificate.
+func certFile(certsDir, name string) string {
+	return filepath.Join(certsDir, name+".crt")
+}
+
+// keyFile returns the path of the named key.
+func keyFile(certsDir, name string) string {
+	return filepath.Join(certsDir, name+".key")
+}
+
+// clientName returns the file name prefix for a client cert.
+func clientName(user string) string {
+	return "client." + user
+}
+
+// newTemplate returns a certificate template with a random serial
+// number, the given common name and validity period starting now.
+func newTemplate(commonName string, validFor time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	notBefore := time.Now().Add(-time.Hour) // Allow for clock offset
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"Cockroach"},
+			CommonName:   commonName,
+		},
+		NotBefore: notBefore,
+		NotAfter:  notBefore.Add(validFor),
+		KeyUsage:  x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+	}, nil
+}
+
+// GenerateCA creates a new CA key and self-signed certificate in
+// certsDir. Fails if a CA already exists there.
+func GenerateCA(certsDir string) error {
+	if _, err := os.Stat(caFile(certsDir)); err == nil {
+		return util.Errorf("CA certificate %s already exists", caFile(certsDir))
+	}
+	template, err := newTemplate("Cockroach CA", caValidFor)
+	if err != nil {
+		return err
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage |= x509.KeyUsageCertSign
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	return writeCertAndKey(certsDir, caFile(certsDir), caKeyFile(certsDir), der, key)
+}
+
+// GenerateNodeCert creates a node key and certificate signed by the
+// CA in certsDir. The certificate is valid for the given hosts, which
+// may be IP addresses or DNS names. Nodes are both servers and
+// clients of each other, so the certificate is usable for both.
+func GenerateNodeCert(certsDir string, hosts []string) error {
+	if len(hosts) == 0 {
+		return util.Error("no hosts specified for node certificate")
+	}
+	template, err := newTemplate(NodeUser, certValidFor)
+	if err != nil {
+		return err
+	}
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+	return generateSignedCert(certsDir, NodeUser, template)
+}
+
+// GenerateClientCert creates a key and certificate for the named user
+// signed by the CA in certsDir. The certificate is only usable for
+// client authentication.
+func GenerateClientCert(certsDir, user string) error {
+	if user == "" || user == NodeUser {
+		return util.Errorf("invalid client user name %q", user)
+	}
+	template, err := newTemplate(user, certValidFor)
+	if err != nil {
+		return err
+	}
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	return generateSignedCert(certsDir, clientName(user), template)
+}
+
+// generateSignedCert creates a new key and a certificate from the
+// template signed by the CA in certsDir, writing both as name.crt and
+// name.key.
+func generateSignedCert(certsDir, name string, template *x509.Certificate) error {
+	caCert, caKey, err := loadCA(certsDir)
+	if err != nil {
+		return err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	return writeCertAndKey(certsDir, certFile(certsDir, name), keyFile(certsDir, name), der, key)
+}
+
+// loadCA reads the CA certificate and key from certsDir.
+func loadCA(certsDir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certPEM, err := os.ReadFile(caFile(certsDir))
+	if err != nil {
+		return nil, nil, util.Errorf("unable to read CA certificate: %v", err)
+	}
+	keyPEM, err := os.ReadFile(caKeyFile(certsDir))
+	if err != nil {
+		return nil, nil, util.Errorf("unable to read CA key: %v", err)
+	}
+	certBlock, _ := pem.Decode(certPEM)
+	keyBlock, _ := pem.Decode(keyPEM)
+	if certBlock == nil || keyBlock == nil {
+		return nil, nil, util.Errorf("no PEM data found in CA files in %s", certsDir)
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+// writeCertAndKey writes the DER-encoded certificate and the key as
+// PEM files. The key file is readable only by the owner.
+func writeCertAndKey(certsDir, certPath, keyPath string, der []byte, key *ecdsa.PrivateKey) error {
+	if err := os.MkdirAll(certsDir, 0700); err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := os.WriteFile(certPath, certPEM, 0644); err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return os.WriteFile(keyPath, keyPEM, 0600)
+}
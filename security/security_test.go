@@ -0,0 +1,137 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package security
+
+import (
+	"crypto/tls"
+	"io"
+	"os"
+	"testing"
+)
+
+// createTestCerts creates a CA, a node cert for localhost and a client
+// cert for user "test" in a temporary directory.
+func createTestCerts(t *testing.T) string {
+	dir, err := os.MkdirTemp("", "test-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := GenerateCA(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := GenerateNodeCert(dir, []string{"localhost", "127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := GenerateClientCert(dir, "test"); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// handshake serves a single TLS connection with the server config and
+// dials it with the client config. Returns the dial or read error.
+func handshake(t *testing.T, serverConfig, clientConfig *tls.Config) error {
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("ok"))
+	}()
+	conn, err := tls.Dial("tcp", ln.Addr().String(), clientConfig)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// With TLS 1.3, the client cert is verified after the client
+	// handshake completes; a read surfaces a rejection.
+	_, err = io.ReadFull(conn, make([]byte, 2))
+	return err
+}
+
+// TestGenerateCA verifies that a second CA can't overwrite the first.
+func TestGenerateCA(t *testing.T) {
+	dir := createTestCerts(t)
+	defer os.RemoveAll(dir)
+	if err := GenerateCA(dir); err == nil {
+		t.Error("expected failure generating a second CA")
+	}
+}
+
+// TestMutualTLS verifies nodes and clients with certs signed by the CA
+// can connect and that peers without a valid cert are rejected.
+func TestMutualTLS(t *testing.T) {
+	dir := createTestCerts(t)
+	defer os.RemoveAll(dir)
+	nodeConfig, err := LoadTLSConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConfig, err := LoadClientTLSConfig(dir, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Node to node.
+	if err := handshake(t, nodeConfig, nodeConfig); err != nil {
+		t.Errorf("node failed to connect to node: %v", err)
+	}
+	// Client to node.
+	if err := handshake(t, nodeConfig, clientConfig); err != nil {
+		t.Errorf("client failed to connect to node: %v", err)
+	}
+	// A client cert can't be used to serve.
+	if err := handshake(t, clientConfig, nodeConfig); err == nil {
+		t.Error("expected failure connecting to server with client cert")
+	}
+	// Client without a certificate.
+	noCertConfig := &tls.Config{RootCAs: nodeConfig.RootCAs}
+	if err := handshake(t, nodeConfig, noCertConfig); err == nil {
+		t.Error("expected failure connecting without client cert")
+	}
+
+	// Node cert signed by a different CA.
+	otherDir := createTestCerts(t)
+	defer os.RemoveAll(otherDir)
+	otherConfig, err := LoadTLSConfig(otherDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := handshake(t, nodeConfig, otherConfig); err == nil {
+		t.Error("expected failure connecting with cert from another CA")
+	}
+}
+
+// TestLoadTLSConfigMissingCerts verifies an error is returned if the
+// certs directory doesn't contain certs.
+func TestLoadTLSConfigMissingCerts(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if _, err := LoadTLSConfig(dir); err == nil {
+		t.Error("expected error loading TLS config from empty directory")
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package security
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+
+	"gossipgo/util"
+)
+
+// LoadTLSConfig returns the TLS configuration used by nodes for both
+// serving and dialing RPC connections. It loads the CA certificate and
+// the node certificate and key from certsDir. Peers on either end of a
+// connection must present a certificate signed by the CA.
+func LoadTLSConfig(certsDir string) (*tls.Config, error) {
+	return loadTLSConfig(certsDir, NodeUser)
+}
+
+// LoadClientTLSConfig returns the TLS configuration for a client
+// connecting as user. It loads the CA certificate and the user's
+// client certificate and key from certsDir.
+func LoadClientTLSConfig(certsDir, user string) (*tls.Config, error) {
+	return loadTLSConfig(certsDir, clientName(user))
+}
+
+// loadTLSConfig loads the CA certificate and the named certificate and
+// key, and requires verified certificates from peers.
+func loadTLSConfig(certsDir, name string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile(certsDir, name), keyFile(certsDir, name))
+	if err != nil {
+		return nil, util.Errorf("unable to load %s certificate: %v", name, err)
+	}
+	caPEM, err := os.ReadFile(caFile(certsDir))
+	if err != nil {
+		return nil, util.Errorf("unable to read CA certificate: %v", err)
+	}
+	certPool := x509.NewCertPool()
+	if !certPool.AppendCertsFromPEM(caPEM) {
+		return nil, util.Errorf("failed to parse CA certificate %s", caFile(certsDir))
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		// Verify server certificates when dialing.
+		RootCAs: certPool,
+		// Require and verify client certificates when serving.
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  certPool,
+		MinVersion: tls.VersionTLS12,
+	}, nil
+}
@@ -0,0 +1,86 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package server
+
+import (
+	"log"
+
+	commander "github.com/nictuku/go-commander"
+	"gossipgo/security"
+)
+
+// A CmdCert command creates certificates.
+var CmdCert = &commander.Command{
+	UsageLine: "cert [ca | node <host>... | client <user>]",
+	Short:     "create CA, node and client certificates",
+	Long: `
+Create certificates for secure communication between nodes and
+clients. Certificates and keys are written to the directory specified
+by the -certs command line flag.
+
+  ca                  create a new certificate authority. Fails if a CA
+                      already exists in the -certs directory.
+  node <host>...      create a node certificate signed by the CA, valid
+                      for the specified hosts (names or IP addresses).
+  client <user>       create a client certificate for the specified
+                      user, signed by the CA.
+
+Every node of a cluster must be started with a node certificate signed
+by the same CA. Copy ca.crt, node.crt and node.key to the -certs
+directory of each node, but keep ca.key private.
+`,
+	Run: runCert,
+}
+
+// runCert dispatches to the certificate creation function specified
+// by the first argument.
+func runCert(cmd *commander.Command, args []string) {
+	if len(args) == 0 {
+		cmd.Usage()
+		return
+	}
+	var err error
+	switch args[0] {
+	case "ca":
+		if len(args) != 1 {
+			cmd.Usage()
+			return
+		}
+		err = security.GenerateCA(*certDir)
+	case "node":
+		if len(args) < 2 {
+			cmd.Usage()
+			return
+		}
+		err = security.GenerateNodeCert(*certDir, args[1:])
+	case "client":
+		if len(args) != 2 {
+			cmd.Usage()
+			return
+		}
+		err = security.GenerateClientCert(*certDir, args[1])
+	default:
+		cmd.Usage()
+		return
+	}
+	if err != nil {
+		log.Printf("failed to create %s certificate: %v", args[0], err)
+		return
+	}
+	log.Printf("created %s certificate in %s", args[0], *certDir)
+}
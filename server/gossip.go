@@ -0,0 +1,169 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	commander "github.com/nictuku/go-commander"
+	"gossipgo/gossip"
+	"gossipgo/util"
+	"log"
+)
+
+// A CmdGossip command displays the gossip state of a node.
+var CmdGossip = &commander.Command{
+	UsageLine: "gossip [infos | groups | peers]",
+	Short:     "display a node's gossip infos, groups or peers",
+	Long: fmt.Sprintf(`
+Fetch and display what the node serving HTTP at -http_addr currently
+believes about the gossip network.
+
+  infos               every info held, with its originating node, the
+                      peer which passed it, hops, age and remaining TTL.
+                      This is the default.
+  groups              the registered info groups, with their type,
+                      limit, size and gatekeeper.
+  peers               incoming and outgoing gossip connections, with
+                      the last time each sent fresh infos.
+
+The same information is available as JSON at http://<http_addr>%s,
+%s and %s.
+`, statusGossipPath, statusGossipGroupsPath, statusGossipPeersPath),
+	Run: runGossip,
+}
+
+// runGossip fetches the gossip status specified by the first
+// argument and prints it to stdout.
+func runGossip(cmd *commander.Command, args []string) {
+	what := "infos"
+	if len(args) > 1 {
+		cmd.Usage()
+		return
+	} else if len(args) == 1 {
+		what = args[0]
+	}
+	baseURL := "http://" + *httpAddr
+	var err error
+	switch what {
+	case "infos":
+		var infos []*gossip.InfoStatus
+		if err = fetchStatus(baseURL+statusGossipPath, &infos); err == nil {
+			printGossipInfos(os.Stdout, infos, time.Now())
+		}
+	case "groups":
+		var groups []*gossip.GroupStatus
+		if err = fetchStatus(baseURL+statusGossipGroupsPath, &groups); err == nil {
+			printGossipGroups(os.Stdout, groups)
+		}
+	case "peers":
+		var peers gossip.PeersStatus
+		if err = fetchStatus(baseURL+statusGossipPeersPath, &peers); err == nil {
+			printGossipPeers(os.Stdout, &peers, time.Now())
+		}
+	default:
+		cmd.Usage()
+		return
+	}
+	if err != nil {
+		log.Printf("failed to fetch gossip %s: %v", what, err)
+	}
+}
+
+// fetchStatus gets the JSON status at url and decodes it into v.
+func fetchStatus(url string, v interface{}) error {
+	resp, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return util.Errorf("%s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// printGossipInfos prints a table of gossip infos.
+func printGossipInfos(out io.Writer, infos []*gossip.InfoStatus, now time.Time) {
+	w := tabwriter.NewWriter(out, 2, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tVALUE\tORIGIN\tPEER\tHOPS\tAGE\tTTL")
+	for _, i := range infos {
+		ttl := "never"
+		if i.TTLRemaining >= 0 {
+			ttl = i.TTLRemaining.Round(time.Second).String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n", i.Key, formatGossipValue(i.Value),
+			i.NodeAddr, i.PeerAddr, i.Hops, formatAge(i.Timestamp, now), ttl)
+	}
+	w.Flush()
+}
+
+// printGossipGroups prints a table of gossip groups.
+func printGossipGroups(out io.Writer, groups []*gossip.GroupStatus) {
+	w := tabwriter.NewWriter(out, 2, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PREFIX\tTYPE\tLIMIT\tCOUNT\tGATEKEEPER")
+	for _, g := range groups {
+		gatekeeper := "-"
+		if g.Gatekeeper != nil {
+			gatekeeper = g.Gatekeeper.Key + "=" + formatGossipValue(g.Gatekeeper.Value)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\n", g.Prefix, g.Type, g.Limit, g.Count, gatekeeper)
+	}
+	w.Flush()
+}
+
+// printGossipPeers prints a table of gossip peer connections.
+func printGossipPeers(out io.Writer, peers *gossip.PeersStatus, now time.Time) {
+	w := tabwriter.NewWriter(out, 2, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "DIRECTION\tADDRESS\tLAST FRESH")
+	for _, p := range peers.Incoming {
+		fmt.Fprintf(w, "incoming\t%s\t%s\n", p.Addr, formatAge(p.LastFresh, now))
+	}
+	for _, p := range peers.Outgoing {
+		fmt.Fprintf(w, "outgoing\t%s\t%s\n", p.Addr, formatAge(p.LastFresh, now))
+	}
+	w.Flush()
+}
+
+// formatGossipValue formats a decoded info value: strings as is and
+// anything else as compact JSON.
+func formatGossipValue(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
+
+// formatAge formats the time elapsed since the unix nanosecond
+// timestamp ts, or "never" if ts is zero.
+func formatAge(ts int64, now time.Time) string {
+	if ts == 0 {
+		return "never"
+	}
+	return now.Sub(time.Unix(0, ts)).Round(time.Second).String() + " ago"
+}
@@ -0,0 +1,118 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package server
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gossipgo/gossip"
+	"gossipgo/rpc"
+	"gossipgo/util/hlc"
+)
+
+// TestGossipStatus verifies the gossip status endpoints serve the
+// infos, groups and peers of the node's gossip instance, and that
+// they're printed legibly.
+func TestGossipStatus(t *testing.T) {
+	addr, err := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rpcContext := rpc.NewContext(hlc.NewClock(hlc.UnixNano, 0), nil)
+	g := gossip.New(rpcContext, rpc.NewServer(addr, rpcContext))
+	if err := g.AddInfo(gossip.KeyClusterID, "cluster-1", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.AddInfo(gossip.KeyNodeCount, int64(3), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.RegisterGroup("load", 10, gossip.MaxGroup); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.AddInfo("load.a", 0.5, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.AddInfo("load.b", 0.25, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &server{mux: http.NewServeMux(), gossip: g}
+	s.mux.HandleFunc(statusGossipPath, s.handleGossipInfos)
+	s.mux.HandleFunc(statusGossipGroupsPath, s.handleGossipGroups)
+	s.mux.HandleFunc(statusGossipPeersPath, s.handleGossipPeers)
+	srv := httptest.NewServer(s.mux)
+	defer srv.Close()
+
+	var infos []*gossip.InfoStatus
+	if err := fetchStatus(srv.URL+statusGossipPath, &infos); err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, i := range infos {
+		keys = append(keys, i.Key)
+	}
+	if exp := "cluster-id,load.a,load.b,node-count"; strings.Join(keys, ",") != exp {
+		t.Errorf("expected infos %s; got %s", exp, strings.Join(keys, ","))
+	}
+	if i := infos[0]; i.Value != "cluster-1" || i.TTLRemaining != -1 || i.NodeAddr != addr.String() || i.Hops != 0 {
+		t.Errorf("unexpected cluster ID info %+v", i)
+	}
+	if i := infos[1]; i.Group != "load" || i.Value != 0.5 || i.TTLRemaining <= 0 || i.TTLRemaining > time.Hour {
+		t.Errorf("unexpected group info %+v", i)
+	}
+
+	var groups []*gossip.GroupStatus
+	if err := fetchStatus(srv.URL+statusGossipGroupsPath, &groups); err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 1 || groups[0].Prefix != "load" || groups[0].Type != "max" ||
+		groups[0].Limit != 10 || groups[0].Count != 2 ||
+		groups[0].Gatekeeper == nil || groups[0].Gatekeeper.Key != "load.b" {
+		t.Errorf("unexpected groups %+v", groups)
+	}
+
+	var peers gossip.PeersStatus
+	if err := fetchStatus(srv.URL+statusGossipPeersPath, &peers); err != nil {
+		t.Fatal(err)
+	}
+	if len(peers.Incoming) != 0 || len(peers.Outgoing) != 0 {
+		t.Errorf("expected no peers; got %+v", peers)
+	}
+
+	var buf bytes.Buffer
+	printGossipInfos(&buf, infos, time.Now())
+	printGossipGroups(&buf, groups)
+	printGossipPeers(&buf, &gossip.PeersStatus{
+		Outgoing: []gossip.PeerStatus{{Addr: "127.0.0.1:8081"}},
+	}, time.Now())
+	for _, exp := range []string{
+		"KEY", "cluster-1", "never", "load.a", "0.5",
+		"PREFIX", "max", "load.b=0.25",
+		"outgoing", "127.0.0.1:8081",
+	} {
+		if !strings.Contains(buf.String(), exp) {
+			t.Errorf("expected output to contain %q:\n%s", exp, buf.String())
+		}
+	}
+}
@@ -21,6 +21,7 @@ import (
 	commander "github.com/nictuku/go-commander"
 	"github.com/google/uuid"
 	"gossipgo/storage"
+	"gossipgo/util/hlc"
 	"log"
 )
 
@@ -65,7 +66,8 @@ func runInit(cmd *commander.Command, args []string) {
 	}
 	// Generate a new cluster UUID.
 	clusterID := uuid.New()
-	if _, err := BootstrapCluster(clusterID.String(), engine); err != nil {
+	clock := hlc.NewClock(hlc.UnixNano, *maxOffset)
+	if _, err := BootstrapCluster(clusterID.String(), engine, clock); err != nil {
 		log.Print(err)
 	}
 	// TODO(spencer): install the default zone config.
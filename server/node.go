@@ -18,16 +18,21 @@
 package server
 
 import (
+	"bytes"
 	"container/list"
 	"net"
+	"sort"
 	"strconv"
+	"sync"
 	"time"
 
 	"gossipgo/gossip"
 	"gossipgo/kv"
+	"gossipgo/proto"
 	"gossipgo/rpc"
 	"gossipgo/storage"
 	"gossipgo/util"
+	"gossipgo/util/hlc"
 	"log"
 )
 
@@ -41,18 +46,29 @@ const (
 	ttlCapacityGossip = 2 * time.Minute
 	// ttlClusterIDGossip is time-to-live for cluster ID
 	ttlClusterIDGossip = 0 * time.Second
-	// ttlNodeIDGossip is time-to-live for node ID -> address.
-	ttlNodeIDGossip = 0 * time.Second
+	// ttlNodeIDGossip is time-to-live for node ID -> address. Nodes
+	// refresh it every gossipInterval, so it expires only once the
+	// node has left the cluster.
+	ttlNodeIDGossip = 2 * time.Minute
+	// ttlNodeCountGossip is time-to-live for the cluster node count.
+	ttlNodeCountGossip = 2 * time.Minute
+	// statusInterval is the interval for recording node status.
+	statusInterval = 10 * time.Second
 )
 
 // Node manages a map of stores (by store ID) for which it serves traffic.
 type Node struct {
 	ClusterID  string                   // UUID for Cockroach cluster
 	Attributes storage.NodeAttributes   // Node ID, network/physical topology
+	clock      *hlc.Clock               // Hybrid logical clock shared by stores
 	gossip     *gossip.Gossip           // Nodes gossip cluster ID, node ID -> host:port
 	kvDB       kv.DB                    // Used to access global id generators
+	storeMu    sync.RWMutex             // Protects storeMap
 	storeMap   map[int32]*storage.Store // Map from StoreID to Store
 	closer     chan struct{}
+	startedAt  int64                 // Unix nanos at which the node was started
+	rpcMu      sync.Mutex            // Protects rpcCounts
+	rpcCounts  map[string]*RPCCounts // Counts of RPCs served, by method
 
 	maxAvailPrefix string // Prefix for max avail capacity gossip topic
 }
@@ -90,13 +106,13 @@ func allocateStoreIDs(nodeID int32, inc int64, db kv.DB) (int32, error) {
 // cluster ID. The bootstrapped store contains a single range spanning
 // all keys. Initial range lookup metadata is populated for the range.
 // Returns a direct-access kv.LocalDB for unittest purposes only.
-func BootstrapCluster(clusterID string, engine storage.Engine) (*kv.LocalDB, error) {
+func BootstrapCluster(clusterID string, engine storage.Engine, clock *hlc.Clock) (*kv.LocalDB, error) {
 	sIdent := storage.StoreIdent{
 		ClusterID: clusterID,
 		NodeID:    1,
 		StoreID:   1,
 	}
-	s := storage.NewStore(engine, nil)
+	s := storage.NewStore(clock, engine, nil)
 
 	// Verify the store isn't already part of a cluster.
 	if s.Ident.ClusterID != "" {
@@ -151,12 +167,15 @@ func BootstrapCluster(clusterID string, engine storage.Engine) (*kv.LocalDB, err
 // NewNode returns a new instance of Node, interpreting command line
 // flags to initialize the appropriate Store or set of
 // Stores. Registers the storage instance for the RPC service "Node".
-func NewNode(rpcServer *rpc.Server, kvDB kv.DB, gossip *gossip.Gossip) *Node {
+// All stores share the node's clock.
+func NewNode(rpcServer *rpc.Server, clock *hlc.Clock, kvDB kv.DB, gossip *gossip.Gossip) *Node {
 	n := &Node{
-		gossip:   gossip,
-		kvDB:     kvDB,
-		storeMap: make(map[int32]*storage.Store),
-		closer:   make(chan struct{}, 1),
+		clock:     clock,
+		gossip:    gossip,
+		kvDB:      kvDB,
+		storeMap:  make(map[int32]*storage.Store),
+		closer:    make(chan struct{}, 1),
+		rpcCounts: map[string]*RPCCounts{},
 	}
 	n.initAttributes(rpcServer.Addr)
 	rpcServer.RegisterName("Node", n)
@@ -178,13 +197,15 @@ func (n *Node) initAttributes(addr net.Addr) {
 
 // start starts the node by initializing network/physical topology
 // attributes gleaned from the environment and initializing stores
-// for each specified engine. Launches periodic store gossipping
-// in a goroutine.
+// for each specified engine. Launches periodic store gossipping and
+// status recording in goroutines.
 func (n *Node) start(engines []storage.Engine) error {
+	n.startedAt = n.clock.PhysicalNow()
 	if err := n.initStoreMap(engines); err != nil {
 		return err
 	}
 	go n.startGossip()
+	go n.startStatusRecorder()
 	return nil
 }
 
@@ -203,7 +224,7 @@ func (n *Node) initStoreMap(engines []storage.Engine) error {
 	bootstraps := list.New()
 
 	for _, engine := range engines {
-		s := storage.NewStore(engine, n.gossip)
+		s := storage.NewStore(n.clock, engine, n.gossip)
 		if err := s.Init(); err != nil {
 			return err
 		}
@@ -219,7 +240,7 @@ func (n *Node) initStoreMap(engines []storage.Engine) error {
 				return err
 			}
 			log.Printf("Initialized store %v: %d", s.Ident, capacity)
-			n.storeMap[s.Ident.StoreID] = s
+			n.addStore(s)
 		} else {
 			bootstraps.PushBack(s)
 		}
@@ -243,7 +264,7 @@ func (n *Node) initStoreMap(engines []storage.Engine) error {
 // cluster ID and node ID. The node's ident is initialized based on
 // the agreed-upon cluster and node IDs.
 func (n *Node) validateStores() error {
-	for _, s := range n.storeMap {
+	for _, s := range n.getStores() {
 		if s.Ident.ClusterID == "" || s.Ident.NodeID == 0 {
 			return util.Errorf("unidentified store in store map: %+v", s.Ident)
 		}
@@ -269,13 +290,12 @@ func (n *Node) bootstrapStores(bootstraps *list.List) {
 	if n.ClusterID == "" {
 		// Connect to network and read cluster ID.
 		<-n.gossip.Connected
-		val, err := n.gossip.GetInfo(gossip.KeyClusterID)
-		if err != nil || val == nil {
+		if err := n.gossip.GetInfoAs(gossip.KeyClusterID, &n.ClusterID); err != nil {
 			log.Printf("unable to ascertain cluster ID from gossip network: %v", err)
 		}
-		n.ClusterID = val.(string)
 
 		// Allocate a new node ID.
+		var err error
 		n.Attributes.NodeID, err = allocateNodeID(n.kvDB)
 		if err != nil {
 			log.Print(err)
@@ -297,11 +317,30 @@ func (n *Node) bootstrapStores(bootstraps *list.List) {
 	for e := bootstraps.Front(); e != nil; e = e.Next() {
 		s := e.Value.(*storage.Store)
 		s.Bootstrap(sIdent)
-		n.storeMap[s.Ident.StoreID] = s
+		n.addStore(s)
 		sIdent.StoreID++
 	}
 }
 
+// addStore adds the bootstrapped store to the store map.
+func (n *Node) addStore(s *storage.Store) {
+	n.storeMu.Lock()
+	defer n.storeMu.Unlock()
+	n.storeMap[s.Ident.StoreID] = s
+}
+
+// getStores returns the stores in the store map. Stores may be added
+// concurrently while uninitialized stores are bootstrapped.
+func (n *Node) getStores() []*storage.Store {
+	n.storeMu.RLock()
+	defer n.storeMu.RUnlock()
+	stores := make([]*storage.Store, 0, len(n.storeMap))
+	for _, s := range n.storeMap {
+		stores = append(stores, s)
+	}
+	return stores
+}
+
 // startGossip loops on a periodic ticker to gossip node-related
 // information. Loops until the node is closed and should be
 // invoked via goroutin.
@@ -318,14 +357,16 @@ func (n *Node) startGossip() {
 	}
 
 	// Always gossip node ID at startup.
-	nodeIDKey := gossip.MakeNodeIDGossipKey(n.Attributes.NodeID)
-	n.gossip.AddInfo(nodeIDKey, n.Attributes.Address, ttlNodeIDGossip)
+	n.gossipNodeID()
+	n.gossipNodeCount()
 
 	ticker := time.NewTicker(gossipInterval)
 	for {
 		select {
 		case <-ticker.C:
+			n.gossipNodeID()
 			n.gossipCapacities()
+			n.gossipNodeCount()
 		case <-n.closer:
 			ticker.Stop()
 			return
@@ -333,10 +374,17 @@ func (n *Node) startGossip() {
 	}
 }
 
+// gossipNodeID gossips the node's address under its node ID. The
+// info is refreshed before it expires for as long as the node runs.
+func (n *Node) gossipNodeID() {
+	nodeIDKey := gossip.MakeNodeIDGossipKey(n.Attributes.NodeID)
+	n.gossip.AddInfo(nodeIDKey, n.Attributes.Address, ttlNodeIDGossip)
+}
+
 // gossipCapacities calls capacity on each store and adds it to the
 // gossip network.
 func (n *Node) gossipCapacities() {
-	for _, store := range n.storeMap {
+	for _, store := range n.getStores() {
 		capacity, err := store.Capacity()
 		if err != nil {
 			log.Printf("Problem getting capacity: %v", err)
@@ -354,12 +402,173 @@ func (n *Node) gossipCapacities() {
 	}
 }
 
+// gossipNodeCount gossips the count of node IDs known to this node's
+// gossip instance if one of its stores holds the first range. Holding
+// the first range stands in for a cluster-wide lease, so that a
+// single node maintains the count used to tighten the gossip network.
+//
+// TODO(spencer): only do this if we're the leader of the first
+// range's consensus group.
+func (n *Node) gossipNodeCount() {
+	if !n.holdsFirstRange() {
+		return
+	}
+	if count := n.gossip.NodeCount(); count > 0 {
+		n.gossip.AddInfo(gossip.KeyNodeCount, count, ttlNodeCountGossip)
+	}
+}
+
+// holdsFirstRange returns true if one of the node's stores holds a
+// replica of the range starting at storage.KeyMin.
+func (n *Node) holdsFirstRange() bool {
+	for _, store := range n.getStores() {
+		for _, rng := range store.GetRanges() {
+			if bytes.Equal(rng.Meta.StartKey, storage.KeyMin) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// startStatusRecorder records the node's status at startup and then
+// on a periodic ticker. Loops until the node is closed and should be
+// invoked via goroutine.
+func (n *Node) startStatusRecorder() {
+	ticker := time.NewTicker(statusInterval)
+	defer ticker.Stop()
+	for {
+		if err := n.recordStatus(); err != nil {
+			log.Printf("Problem recording node status: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-n.closer:
+			return
+		}
+	}
+}
+
+// recordStatus writes the node's status to the key value store. The
+// status isn't recorded until the node has been assigned an ID.
+func (n *Node) recordStatus() error {
+	if n.Attributes.NodeID == 0 {
+		return nil
+	}
+	status, err := n.status()
+	if err != nil {
+		return err
+	}
+	return putNodeStatus(n.kvDB, status)
+}
+
+// status returns the node's current status.
+func (n *Node) status() (*NodeStatus, error) {
+	status := &NodeStatus{
+		NodeID:     n.Attributes.NodeID,
+		Build:      newBuildInfo(),
+		StartedAt:  n.startedAt,
+		UpdatedAt:  n.clock.PhysicalNow(),
+		Datacenter: n.Attributes.Datacenter,
+		PDU:        n.Attributes.PDU,
+		Rack:       n.Attributes.Rack,
+		RPCs:       map[string]RPCCounts{},
+	}
+	if n.Attributes.Address != nil {
+		status.Address = n.Attributes.Address.String()
+	}
+	stores := map[int32]*storage.Store{}
+	for _, store := range n.getStores() {
+		stores[store.Ident.StoreID] = store
+		status.StoreIDs = append(status.StoreIDs, store.Ident.StoreID)
+	}
+	sort.Sort(int32Slice(status.StoreIDs))
+	for _, storeID := range status.StoreIDs {
+		store := stores[storeID]
+		capacity, err := store.Capacity()
+		if err != nil {
+			return nil, err
+		}
+		storeStatus := StoreStatus{
+			StoreID:   storeID,
+			Capacity:  capacity.Capacity,
+			Available: capacity.Available,
+			Ranges:    []RangeStatus{},
+		}
+		for _, rng := range store.GetRanges() {
+			stats, err := rng.Stats()
+			if err != nil {
+				return nil, err
+			}
+			storeStatus.Ranges = append(storeStatus.Ranges, RangeStatus{
+				RangeID:   rng.Meta.RangeID,
+				StartKey:  strconv.Quote(string(rng.Meta.StartKey)),
+				EndKey:    strconv.Quote(string(rng.Meta.EndKey)),
+				KeyCount:  stats.KeyCount,
+				ByteCount: stats.ByteCount,
+			})
+		}
+		storeStatus.RangeCount = len(storeStatus.Ranges)
+		status.RangeCount += storeStatus.RangeCount
+		status.Stores = append(status.Stores, storeStatus)
+	}
+	n.rpcMu.Lock()
+	for method, counts := range n.rpcCounts {
+		status.RPCs[method] = *counts
+	}
+	n.rpcMu.Unlock()
+	return status, nil
+}
+
+// int32Slice implements sort.Interface.
+type int32Slice []int32
+
+func (s int32Slice) Len() int           { return len(s) }
+func (s int32Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s int32Slice) Less(i, j int) bool { return s[i] < s[j] }
+
+// GetTimeSeriesData implements the ts.Source interface, returning the
+// capacity and available bytes of each store as metrics named
+// cr.store.<store ID>.capacity and cr.store.<store ID>.available.
+func (n *Node) GetTimeSeriesData() []proto.TimeSeriesData {
+	now := n.clock.Now().WallTime
+	var data []proto.TimeSeriesData
+	for _, store := range n.getStores() {
+		capacity, err := store.Capacity()
+		if err != nil {
+			log.Printf("Problem getting capacity: %v", err)
+			continue
+		}
+		prefix := "cr.store." + strconv.FormatInt(int64(store.Ident.StoreID), 10) + "."
+		for suffix, value := range map[string]int64{
+			"capacity":  capacity.Capacity,
+			"available": capacity.Available,
+		} {
+			v := value
+			data = append(data, proto.TimeSeriesData{
+				Name:       prefix + suffix,
+				Datapoints: []*proto.TimeSeriesDatapoint{{TimestampNanos: now, IntValue: &v}},
+			})
+		}
+	}
+	return data
+}
+
+// RollsUp implements the ts.Source interface. Only the node holding
+// the first range rolls up time series data.
+func (n *Node) RollsUp() bool {
+	return n.holdsFirstRange()
+}
+
 // getRange looks up the store by Replica.StoreID and then queries it for
-// the range specified by Replica.RangeID.
+// the range specified by Replica.RangeID. Returns a RangeNotFoundError
+// if either isn't found on this node.
 func (n *Node) getRange(r *storage.Replica) (*storage.Range, error) {
+	n.storeMu.RLock()
 	store, ok := n.storeMap[r.StoreID]
+	n.storeMu.RUnlock()
 	if !ok {
-		return nil, util.Errorf("store %d not found", r.StoreID)
+		return nil, proto.NewRangeNotFoundError(r.RangeID)
 	}
 	rng, err := store.GetRange(r.RangeID)
 	if err != nil {
@@ -368,125 +577,160 @@ func (n *Node) getRange(r *storage.Replica) (*storage.Range, error) {
 	return rng, nil
 }
 
-// All methods to satisfy the Node RPC service fetch the range
-// based on the Replica target provided in the argument header.
-// Commands are broken down into read-only and read-write and
-// sent along to the range via either Range.readOnlyCmd() or
-// Range.readWriteCmd().
+// executeCmd executes the command and sets any error in the reply
+// header, where it's carried to the client with its type intact. The
+// RPC itself fails only if the request or response can't be sent.
+func (n *Node) executeCmd(protoArgs proto.Request, protoReply proto.Response) error {
+	if err := n.execute(protoArgs, protoReply); err != nil {
+		protoReply.Header().SetGoError(err)
+	}
+	n.countRPC(protoArgs, protoReply.Header().GoError() != nil)
+	return nil
+}
 
-// Contains .
-func (n *Node) Contains(args *storage.ContainsRequest, reply *storage.ContainsResponse) error {
-	rng, err := n.getRange(&args.Replica)
+// countRPC counts a call of the request's method and whether it
+// returned an error.
+func (n *Node) countRPC(protoArgs proto.Request, failed bool) {
+	method, err := proto.MethodForRequest(protoArgs)
 	if err != nil {
-		return err
+		return
+	}
+	n.rpcMu.Lock()
+	defer n.rpcMu.Unlock()
+	counts, ok := n.rpcCounts[method]
+	if !ok {
+		counts = &RPCCounts{}
+		n.rpcCounts[method] = counts
+	}
+	counts.Calls++
+	if failed {
+		counts.Errors++
 	}
-	return rng.ReadOnlyCmd("Contains", args, reply)
 }
 
-// Get .
-func (n *Node) Get(args *storage.GetRequest, reply *storage.GetResponse) error {
-	rng, err := n.getRange(&args.Replica)
+// execute converts the request from its wire representation and
+// fetches the range based on the Replica target provided in the
+// argument header. Commands are broken down into read-only and
+// read-write and sent along to the range via either
+// Range.ReadOnlyCmd() or Range.ReadWriteCmd(). The result is
+// converted into reply. If the client's deadline passes or the node is
+// stopped before the command completes, execute stops waiting and
+// returns an error. The command's context is then done, so the range
+// skips it if it hasn't started; a batch stops before its next
+// command and rolls back.
+func (n *Node) execute(protoArgs proto.Request, protoReply proto.Response) error {
+	method, args, err := storage.FromProtoRequest(protoArgs)
 	if err != nil {
 		return err
 	}
-	return rng.ReadOnlyCmd("Get", args, reply)
-}
-
-// Put .
-func (n *Node) Put(args *storage.PutRequest, reply *storage.PutResponse) error {
-	rng, err := n.getRange(&args.Replica)
+	reply, err := storage.CreateReply(method)
 	if err != nil {
 		return err
 	}
-	return <-rng.ReadWriteCmd("Put", args, reply)
-}
-
-// Increment .
-func (n *Node) Increment(args *storage.IncrementRequest, reply *storage.IncrementResponse) error {
-	rng, err := n.getRange(&args.Replica)
+	header := args.Header()
+	rng, err := n.getRange(&header.Replica)
 	if err != nil {
 		return err
 	}
-	return <-rng.ReadWriteCmd("Increment", args, reply)
+	ctx, cancel := header.Context()
+	defer cancel()
+
+	var done <-chan error
+	if storage.IsReadOnly(method) {
+		c := make(chan error, 1)
+		go func() { c <- rng.ReadOnlyCmd(ctx, method, args, reply) }()
+		done = c
+	} else {
+		done = rng.ReadWriteCmd(ctx, method, args, reply)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			return err
+		}
+		return storage.ToProtoResponse(reply, protoReply)
+	case <-ctx.Done():
+		return util.Errorf("%s abandoned: %s", method, ctx.Err())
+	case <-n.closer:
+		return util.Errorf("%s abandoned: node stopped", method)
+	}
+}
+
+// All methods to satisfy the Node RPC service are executed via
+// executeCmd. The service serves the request and response types of
+// the proto package.
+
+// Contains .
+func (n *Node) Contains(args *proto.ContainsRequest, reply *proto.ContainsResponse) error {
+	return n.executeCmd(args, reply)
+}
+
+// Get .
+func (n *Node) Get(args *proto.GetRequest, reply *proto.GetResponse) error {
+	return n.executeCmd(args, reply)
+}
+
+// Put .
+func (n *Node) Put(args *proto.PutRequest, reply *proto.PutResponse) error {
+	return n.executeCmd(args, reply)
+}
+
+// ConditionalPut .
+func (n *Node) ConditionalPut(args *proto.ConditionalPutRequest, reply *proto.ConditionalPutResponse) error {
+	return n.executeCmd(args, reply)
+}
+
+// Increment .
+func (n *Node) Increment(args *proto.IncrementRequest, reply *proto.IncrementResponse) error {
+	return n.executeCmd(args, reply)
 }
 
 // Delete .
-func (n *Node) Delete(args *storage.DeleteRequest, reply *storage.DeleteResponse) error {
-	rng, err := n.getRange(&args.Replica)
-	if err != nil {
-		return err
-	}
-	return <-rng.ReadWriteCmd("Delete", args, reply)
+func (n *Node) Delete(args *proto.DeleteRequest, reply *proto.DeleteResponse) error {
+	return n.executeCmd(args, reply)
 }
 
 // DeleteRange .
-func (n *Node) DeleteRange(args *storage.DeleteRangeRequest, reply *storage.DeleteRangeResponse) error {
-	rng, err := n.getRange(&args.Replica)
-	if err != nil {
-		return err
-	}
-	return <-rng.ReadWriteCmd("DeleteRange", args, reply)
+func (n *Node) DeleteRange(args *proto.DeleteRangeRequest, reply *proto.DeleteRangeResponse) error {
+	return n.executeCmd(args, reply)
 }
 
 // Scan .
-func (n *Node) Scan(args *storage.ScanRequest, reply *storage.ScanResponse) error {
-	rng, err := n.getRange(&args.Replica)
-	if err != nil {
-		return err
-	}
-	return rng.ReadOnlyCmd("Scan", args, reply)
+func (n *Node) Scan(args *proto.ScanRequest, reply *proto.ScanResponse) error {
+	return n.executeCmd(args, reply)
 }
 
 // EndTransaction .
-func (n *Node) EndTransaction(args *storage.EndTransactionRequest, reply *storage.EndTransactionResponse) error {
-	rng, err := n.getRange(&args.Replica)
-	if err != nil {
-		return err
-	}
-	return <-rng.ReadWriteCmd("EndTransaction", args, reply)
-}
-
-// AccumulateTS .
-func (n *Node) AccumulateTS(args *storage.AccumulateTSRequest, reply *storage.AccumulateTSResponse) error {
-	rng, err := n.getRange(&args.Replica)
-	if err != nil {
-		return err
-	}
-	return <-rng.ReadWriteCmd("AccumulateTS", args, reply)
+func (n *Node) EndTransaction(args *proto.EndTransactionRequest, reply *proto.EndTransactionResponse) error {
+	return n.executeCmd(args, reply)
 }
 
 // ReapQueue .
-func (n *Node) ReapQueue(args *storage.ReapQueueRequest, reply *storage.ReapQueueResponse) error {
-	rng, err := n.getRange(&args.Replica)
-	if err != nil {
-		return err
-	}
-	return <-rng.ReadWriteCmd("ReapQueue", args, reply)
+func (n *Node) ReapQueue(args *proto.ReapQueueRequest, reply *proto.ReapQueueResponse) error {
+	return n.executeCmd(args, reply)
 }
 
 // EnqueueUpdate .
-func (n *Node) EnqueueUpdate(args *storage.EnqueueUpdateRequest, reply *storage.EnqueueUpdateResponse) error {
-	rng, err := n.getRange(&args.Replica)
-	if err != nil {
-		return err
-	}
-	return <-rng.ReadWriteCmd("EnqueueUpdate", args, reply)
+func (n *Node) EnqueueUpdate(args *proto.EnqueueUpdateRequest, reply *proto.EnqueueUpdateResponse) error {
+	return n.executeCmd(args, reply)
 }
 
 // EnqueueMessage .
-func (n *Node) EnqueueMessage(args *storage.EnqueueMessageRequest, reply *storage.EnqueueMessageResponse) error {
-	rng, err := n.getRange(&args.Replica)
-	if err != nil {
-		return err
-	}
-	return <-rng.ReadWriteCmd("EnqueueMessage", args, reply)
+func (n *Node) EnqueueMessage(args *proto.EnqueueMessageRequest, reply *proto.EnqueueMessageResponse) error {
+	return n.executeCmd(args, reply)
 }
 
 // InternalRangeLookup .
-func (n *Node) InternalRangeLookup(args *storage.InternalRangeLookupRequest, reply *storage.InternalRangeLookupResponse) error {
-	rng, err := n.getRange(&args.Replica)
-	if err != nil {
-		return err
-	}
-	return rng.ReadOnlyCmd("InternalRangeLookup", args, reply)
+func (n *Node) InternalRangeLookup(args *proto.InternalRangeLookupRequest, reply *proto.InternalRangeLookupResponse) error {
+	return n.executeCmd(args, reply)
+}
+
+// InternalMerge .
+func (n *Node) InternalMerge(args *proto.InternalMergeRequest, reply *proto.InternalMergeResponse) error {
+	return n.executeCmd(args, reply)
+}
+
+// Batch .
+func (n *Node) Batch(args *proto.BatchRequest, reply *proto.BatchResponse) error {
+	return n.executeCmd(args, reply)
 }
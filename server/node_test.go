@@ -19,12 +19,19 @@ package server
 
 import (
 	"bytes"
+	"container/list"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"math"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"testing"
 
+	"gossipgo/proto"
 	"gossipgo/storage"
+	"gossipgo/util/hlc"
 )
 
 func formatKeys(keys []storage.Key) string {
@@ -39,7 +46,7 @@ func formatKeys(keys []storage.Key) string {
 // an in memory engine.
 func TestBootstrapCluster(t *testing.T) {
 	engine := storage.NewInMem(1 << 20)
-	localDB, err := BootstrapCluster("cluster-1", engine)
+	localDB, err := BootstrapCluster("cluster-1", engine, hlc.NewClock(hlc.UnixNano, 0))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -74,3 +81,134 @@ func TestBootstrapCluster(t *testing.T) {
 
 	// TODO(spencer): check values.
 }
+
+// TestNodeStatus verifies that a node records its status, including
+// its stores, ranges and RPC counts, and that the status endpoints
+// read it back.
+func TestNodeStatus(t *testing.T) {
+	clock := hlc.NewClock(hlc.UnixNano, 0)
+	engine := storage.NewInMem(1 << 20)
+	localDB, err := BootstrapCluster("cluster-1", engine, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := storage.NewStore(clock, engine, nil)
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+	n := &Node{
+		Attributes: storage.NodeAttributes{NodeID: 1, Datacenter: "us-east"},
+		clock:      clock,
+		kvDB:       localDB,
+		storeMap:   map[int32]*storage.Store{1: store},
+		startedAt:  clock.PhysicalNow(),
+		rpcCounts:  map[string]*RPCCounts{},
+	}
+	n.countRPC(&proto.GetRequest{}, false)
+	n.countRPC(&proto.GetRequest{}, true)
+	if err := n.recordStatus(); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &server{kvDB: localDB}
+	srv := httptest.NewServer(http.HandlerFunc(s.handleNodeStatus))
+	defer srv.Close()
+	get := func(path string, expStatus int, v interface{}) {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != expStatus {
+			t.Fatalf("GET %s: expected status %d; got %d: %s", path, expStatus, resp.StatusCode, b)
+		}
+		if v != nil {
+			if err := json.Unmarshal(b, v); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	var status NodeStatus
+	get(statusNodesPath+"/1", http.StatusOK, &status)
+	if status.NodeID != 1 || status.Datacenter != "us-east" || status.StartedAt != n.startedAt ||
+		status.Build.GoVersion == "" || !reflect.DeepEqual(status.StoreIDs, []int32{1}) {
+		t.Errorf("unexpected node status %+v", status)
+	}
+	if status.RangeCount != 1 || len(status.Stores) != 1 || len(status.Stores[0].Ranges) != 1 {
+		t.Fatalf("expected a single store with a single range; got %+v", status.Stores)
+	}
+	if rs := status.Stores[0].Ranges[0]; rs.RangeID != 1 || rs.KeyCount == 0 || rs.ByteCount == 0 {
+		t.Errorf("unexpected range status %+v", rs)
+	}
+	if counts := status.RPCs[proto.Get]; counts != (RPCCounts{Calls: 2, Errors: 1}) {
+		t.Errorf("expected 2 Get calls and 1 error; got %+v", counts)
+	}
+
+	var statuses []NodeStatus
+	get(statusNodesPath, http.StatusOK, &statuses)
+	if len(statuses) != 1 || statuses[0].NodeID != 1 {
+		t.Errorf("expected the status of node 1; got %+v", statuses)
+	}
+	get(statusNodesPath+"/2", http.StatusNotFound, nil)
+	get(statusNodesPath+"/x", http.StatusBadRequest, nil)
+}
+
+// TestNodeStatusDuringBootstrap verifies that the node's status can
+// be read while uninitialized stores are bootstrapped and added to
+// the store map.
+func TestNodeStatusDuringBootstrap(t *testing.T) {
+	clock := hlc.NewClock(hlc.UnixNano, 0)
+	engine := storage.NewInMem(1 << 20)
+	localDB, err := BootstrapCluster("cluster-1", engine, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := storage.NewStore(clock, engine, nil)
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+	n := &Node{
+		ClusterID:  "cluster-1",
+		Attributes: storage.NodeAttributes{NodeID: 1},
+		clock:      clock,
+		kvDB:       localDB,
+		storeMap:   map[int32]*storage.Store{1: store},
+		rpcCounts:  map[string]*RPCCounts{},
+	}
+	const numBootstraps = 10
+	bootstraps := list.New()
+	for i := 0; i < numBootstraps; i++ {
+		bootstraps.PushBack(storage.NewStore(clock, storage.NewInMem(1<<20), nil))
+	}
+	done := make(chan struct{})
+	go func() {
+		n.bootstrapStores(bootstraps)
+		close(done)
+	}()
+	for bootstrapping := true; bootstrapping; {
+		select {
+		case <-done:
+			bootstrapping = false
+		default:
+		}
+		if _, err := n.status(); err != nil {
+			t.Fatal(err)
+		}
+		n.GetTimeSeriesData()
+		if !n.RollsUp() {
+			t.Error("expected node holding the first range to roll up")
+		}
+	}
+	status, err := n.status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.StoreIDs) != numBootstraps+1 {
+		t.Errorf("expected %d stores; got %v", numBootstraps+1, status.StoreIDs)
+	}
+}
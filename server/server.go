@@ -21,6 +21,7 @@ package server
 
 import (
 	"compress/gzip"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"io"
@@ -34,16 +35,37 @@ import (
 	"gossipgo/gossip"
 	"gossipgo/kv"
 	"gossipgo/rpc"
+	"gossipgo/security"
 	"gossipgo/storage"
 	"gossipgo/structured"
+	"gossipgo/ts"
 	"gossipgo/util"
+	"gossipgo/util/hlc"
 	"log"
+	"time"
 )
 
 var (
 	httpAddr = flag.String("http_addr", "localhost:8080", "TCP network address to bind to for HTTP traffic")
 	rpcAddr  = flag.String("rpc_addr", "localhost:8081", "TCP network address to bind to for RPC traffic")
 
+	// certDir is the directory containing the CA certificate and the
+	// node certificate and key used for TLS on RPC connections.
+	certDir = flag.String("certs", "certs", "directory containing the CA "+
+		"certificate (ca.crt) and the node certificate and key (node.crt, node.key). "+
+		"Create these with the cert command.")
+	insecure = flag.Bool("insecure", false, "run RPC over plain TCP without TLS "+
+		"or authentication. Intended for testing only.")
+
+	// maxOffset is the maximum clock offset between any two nodes in
+	// the cluster.
+	maxOffset = flag.Duration("max_offset", 250*time.Millisecond, "specify "+
+		"the maximum clock offset for the cluster. Clock offset is measured on all "+
+		"node-to-node links and if a node's clock is more than -max_offset from a "+
+		"majority of the clocks it measures, it reports itself unhealthy via "+
+		"/_admin/healthz and "+statusClocksPath+". Setting this value too high may "+
+		"decrease transaction performance in the presence of contention.")
+
 	// dataDirs is specified to enable durable storage via
 	// RocksDB-backed key-value stores. Memory-backed key value stores
 	// may be optionally specified via a comma-separated list of integer
@@ -76,17 +98,34 @@ comma-separated list of paths to storage directories. Although the
 paths should be specified to correspond uniquely to physical devices,
 this requirement isn't strictly enforced.
 
+RPC traffic between nodes is encrypted and mutually authenticated
+using TLS. The CA certificate and this node's certificate and key are
+read from the directory specified by the -certs command line flag;
+create them with the cert command. Specify -insecure to disable TLS
+for testing.
+
 A node exports an HTTP API with the following endpoints:
 
   Health check:           http://%s/healthz
+  Clock offsets:          http://%s%s
+  Node status:            http://%s%s[/<node ID>]
+  Gossip infos:           http://%s%s
+  Gossip groups:          http://%s%s
+  Gossip peers:           http://%s%s
   Key-value REST:         http://%s%s
   Structured Schema REST: http://%s%s
-`, *httpAddr, *httpAddr, kv.KVKeyPrefix, *httpAddr, structured.StructuredKeyPrefix),
+  Time series query:      http://%s%s<name>
+`, *httpAddr, *httpAddr, statusClocksPath, *httpAddr, statusNodesPath,
+		*httpAddr, statusGossipPath, *httpAddr, statusGossipGroupsPath, *httpAddr, statusGossipPeersPath,
+		*httpAddr, kv.KVKeyPrefix,
+		*httpAddr, structured.StructuredKeyPrefix, *httpAddr, ts.TimeSeriesKeyPrefix),
 	Run: runStart,
 }
 
 type server struct {
 	mux            *http.ServeMux
+	clock          *hlc.Clock
+	rpcContext     *rpc.Context
 	rpc            *rpc.Server
 	gossip         *gossip.Gossip
 	kvDB           kv.DB
@@ -94,6 +133,9 @@ type server struct {
 	node           *Node
 	structuredDB   *structured.DB
 	structuredREST *structured.RESTServer
+	tsDB           *ts.DB
+	tsREST         *ts.RESTServer
+	tsPoller       *ts.Poller
 }
 
 // ListenAndServe starts an HTTP server at -http_addr and an RPC server
@@ -164,6 +206,15 @@ func initEngine(spec string) (storage.Engine, error) {
 	return engine, nil
 }
 
+// loadTLSConfig loads the node TLS config from -certs. Returns nil if
+// -insecure is specified.
+func loadTLSConfig() (*tls.Config, error) {
+	if *insecure {
+		log.Print("running in insecure mode; RPC traffic is neither encrypted nor authenticated")
+		return nil, nil
+	}
+	return security.LoadTLSConfig(*certDir)
+}
 
 func newServer() (*server, error) {
 	addr, err := net.ResolveTCPAddr("tcp", *rpcAddr)
@@ -171,16 +222,25 @@ func newServer() (*server, error) {
 		return nil, err
 	}
 	s := &server{
-		mux: http.NewServeMux(),
-		rpc: rpc.NewServer(addr),
+		mux:   http.NewServeMux(),
+		clock: hlc.NewClock(hlc.UnixNano, *maxOffset),
 	}
+	tlsConfig, err := loadTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	s.rpcContext = rpc.NewContext(s.clock, tlsConfig)
+	s.rpc = rpc.NewServer(addr, s.rpcContext)
 
-	s.gossip = gossip.New(s.rpc)
-	s.kvDB = kv.NewDB(s.gossip)
+	s.gossip = gossip.New(s.rpcContext, s.rpc)
+	s.kvDB = kv.NewDB(s.rpcContext, s.gossip)
 	s.kvREST = kv.NewRESTServer(s.kvDB)
-	s.node = NewNode(s.rpc, s.kvDB, s.gossip)
+	s.node = NewNode(s.rpc, s.clock, s.kvDB, s.gossip)
 	s.structuredDB = structured.NewDB(s.kvDB)
 	s.structuredREST = structured.NewRESTServer(s.structuredDB)
+	s.tsDB = ts.NewDB(s.kvDB)
+	s.tsREST = ts.NewRESTServer(s.tsDB)
+	s.tsPoller = ts.NewPoller(s.tsDB, s.node)
 
 	return s, nil
 }
@@ -189,9 +249,6 @@ func (s *server) start(engines []storage.Engine) error {
 	go s.rpc.ListenAndServe() // blocks, so launch in a goroutine
 	log.Print("Started RPC server at", *rpcAddr)
 
-	s.gossip.Start()
-	log.Printf("Started gossip instance")
-
 	// Init the engines specified via command line flags if not supplied.
 	if engines == nil {
 		var err error
@@ -200,11 +257,23 @@ func (s *server) start(engines []storage.Engine) error {
 			return err
 		}
 	}
+
+	// Checkpoint gossip to the first store so that it may be reloaded
+	// on restart.
+	if len(engines) > 0 {
+		s.gossip.SetStorage(storage.NewGossipStorage(engines[0]))
+	}
+	s.gossip.Start()
+	log.Printf("Started gossip instance")
+
 	if err := s.node.start(engines); err != nil {
 		return err
 	}
 	log.Printf("Initialized %d storage engines", len(engines))
 
+	s.tsPoller.Start()
+	log.Printf("Started time series poller")
+
 	s.initHTTP()
 	return http.ListenAndServe(*httpAddr, s)
 }
@@ -212,16 +281,25 @@ func (s *server) start(engines []storage.Engine) error {
 func (s *server) initHTTP() {
 	log.Print("Starting HTTP server at", *httpAddr)
 	s.mux.HandleFunc("/_admin/healthz", s.handleHealthz)
+	s.mux.HandleFunc(statusClocksPath, s.handleClocks)
+	s.mux.HandleFunc(statusNodesPath, s.handleNodeStatus)
+	s.mux.HandleFunc(statusNodesPath+"/", s.handleNodeStatus)
+	s.mux.HandleFunc(statusGossipPath, s.handleGossipInfos)
+	s.mux.HandleFunc(statusGossipGroupsPath, s.handleGossipGroups)
+	s.mux.HandleFunc(statusGossipPeersPath, s.handleGossipPeers)
 	s.mux.HandleFunc(kv.KVKeyPrefix, s.kvREST.HandleAction)
 	s.mux.HandleFunc(structured.StructuredKeyPrefix, s.structuredREST.HandleAction)
+	s.mux.HandleFunc(ts.TimeSeriesKeyPrefix, s.tsREST.HandleAction)
 }
 
 func (s *server) stop() {
 	// TODO(spencer): the http server should exit; this functionality is
 	// slated for go 1.3.
+	s.tsPoller.Stop()
 	s.node.stop()
 	s.gossip.Stop()
 	s.rpc.Close()
+	s.rpcContext.Close()
 }
 
 type gzipResponseWriter struct {
@@ -251,7 +329,15 @@ func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	s.mux.ServeHTTP(gzw, r)
 }
 
+// handleHealthz replies "ok" if the node is healthy. The node is
+// unhealthy if its clock is out of bounds with a majority of the
+// remote clocks it has measured.
 func (s *server) handleHealthz(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain")
+	if err := s.rpcContext.RemoteClocks.VerifyClockOffset(); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, err)
+		return
+	}
 	fmt.Fprintln(w, "ok")
 }
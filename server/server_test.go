@@ -22,11 +22,13 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"os"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"gossipgo/security"
 	"gossipgo/storage"
 	"log"
 )
@@ -39,12 +41,15 @@ var (
 func startServer() *server {
 	once.Do(func() {
 		resetTestData()
+		if err := createTestCerts(); err != nil {
+			log.Print(err)
+		}
 		s, err := newServer()
 		if err != nil {
 			log.Print(err)
 		}
 		engines := []storage.Engine{storage.NewInMem(1 << 20)}
-		if _, err := BootstrapCluster("cluster-1", engines[0]); err != nil {
+		if _, err := BootstrapCluster("cluster-1", engines[0], s.clock); err != nil {
 			log.Print(err)
 		}
 		s.gossip.SetBootstrap([]net.Addr{s.rpc.Addr})
@@ -57,6 +62,23 @@ func startServer() *server {
 	return s
 }
 
+// createTestCerts creates a CA and a node certificate for localhost
+// in a temporary directory and points -certs at it.
+func createTestCerts() error {
+	dir, err := os.MkdirTemp("", "test-certs")
+	if err != nil {
+		return err
+	}
+	if err := security.GenerateCA(dir); err != nil {
+		return err
+	}
+	if err := security.GenerateNodeCert(dir, []string{"localhost", "127.0.0.1"}); err != nil {
+		return err
+	}
+	*certDir = dir
+	return nil
+}
+
 func resetTestData() {
 	// TODO(spencer): remove all data files once rocksdb is hooked up.
 }
@@ -0,0 +1,269 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gossipgo/kv"
+	"gossipgo/storage"
+	"gossipgo/util"
+)
+
+const (
+	// statusClocksPath is the status endpoint for remote clock offsets.
+	statusClocksPath = "/_status/clocks"
+	// statusNodesPath is the status endpoint for node status records.
+	statusNodesPath = "/_status/nodes"
+	// statusGossipPath is the status endpoint for the infos held by
+	// the node's gossip instance.
+	statusGossipPath = "/_status/gossip"
+	// statusGossipGroupsPath is the status endpoint for the groups
+	// registered with the node's gossip instance.
+	statusGossipGroupsPath = statusGossipPath + "/groups"
+	// statusGossipPeersPath is the status endpoint for the node's
+	// gossip peer connections.
+	statusGossipPeersPath = statusGossipPath + "/peers"
+)
+
+// buildTag and buildTime describe the binary. They're set at link
+// time, e.g. -ldflags "-X gossipgo/server.buildTag=v0.1".
+var buildTag, buildTime string
+
+// BuildInfo describes the binary a node is running.
+type BuildInfo struct {
+	GoVersion string `json:"go_version"`
+	Tag       string `json:"tag"`
+	Time      string `json:"time"`
+}
+
+// newBuildInfo returns the build information of this binary.
+func newBuildInfo() BuildInfo {
+	return BuildInfo{GoVersion: runtime.Version(), Tag: buildTag, Time: buildTime}
+}
+
+// RangeStatus holds the key and byte counts of a range.
+type RangeStatus struct {
+	RangeID   int64  `json:"range_id"`
+	StartKey  string `json:"start_key"` // Quoted key
+	EndKey    string `json:"end_key"`   // Quoted key
+	KeyCount  int64  `json:"key_count"`
+	ByteCount int64  `json:"byte_count"`
+}
+
+// StoreStatus holds the capacity and ranges of a store.
+type StoreStatus struct {
+	StoreID    int32         `json:"store_id"`
+	Capacity   int64         `json:"capacity"`
+	Available  int64         `json:"available"`
+	RangeCount int           `json:"range_count"`
+	Ranges     []RangeStatus `json:"ranges"`
+}
+
+// RPCCounts holds the number of calls of an RPC method served by a
+// node and the number which returned an error.
+type RPCCounts struct {
+	Calls  int64 `json:"calls"`
+	Errors int64 `json:"errors"`
+}
+
+// NodeStatus is the status periodically recorded by each node under
+// storage.KeyStatusNodePrefix. Times are unix nanoseconds.
+type NodeStatus struct {
+	NodeID     int32                `json:"node_id"`
+	Build      BuildInfo            `json:"build"`
+	StartedAt  int64                `json:"started_at"`
+	UpdatedAt  int64                `json:"updated_at"`
+	Address    string               `json:"address"`
+	Datacenter string               `json:"datacenter"`
+	PDU        string               `json:"pdu"`
+	Rack       string               `json:"rack"`
+	StoreIDs   []int32              `json:"store_ids"`
+	Stores     []StoreStatus        `json:"stores"`
+	RangeCount int                  `json:"range_count"`
+	RPCs       map[string]RPCCounts `json:"rpcs"`
+}
+
+// nodeStatusKey returns the key of the status record of the node.
+func nodeStatusKey(nodeID int32) storage.Key {
+	return storage.MakeKey(storage.KeyStatusNodePrefix, storage.Key(strconv.FormatInt(int64(nodeID), 10)))
+}
+
+// putNodeStatus records the status of a node.
+func putNodeStatus(db kv.DB, status *NodeStatus) error {
+	b, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	pr := <-db.Put(&storage.PutRequest{
+		Key:   nodeStatusKey(status.NodeID),
+		Value: storage.Value{Bytes: b},
+	})
+	return pr.Error
+}
+
+// getNodeStatus returns the status recorded by the node, or nil if
+// the node hasn't recorded its status.
+func getNodeStatus(db kv.DB, nodeID int32) (*NodeStatus, error) {
+	gr := <-db.Get(&storage.GetRequest{Key: nodeStatusKey(nodeID)})
+	if gr.Error != nil || gr.Value.Bytes == nil {
+		return nil, gr.Error
+	}
+	status := &NodeStatus{}
+	if err := json.Unmarshal(gr.Value.Bytes, status); err != nil {
+		return nil, util.Errorf("invalid status of node %d: %s", nodeID, err)
+	}
+	return status, nil
+}
+
+// getNodeStatuses returns the status records of all nodes, ordered by
+// node ID.
+func getNodeStatuses(db kv.DB) ([]*NodeStatus, error) {
+	sr := <-db.Scan(&storage.ScanRequest{
+		StartKey: storage.KeyStatusNodePrefix,
+		EndKey:   storage.KeyStatusNodePrefix.PrefixEnd(),
+		// TODO(spencer): page through the records of large clusters.
+		MaxResults: 10000,
+	})
+	if sr.Error != nil {
+		return nil, sr.Error
+	}
+	statuses := []*NodeStatus{}
+	for _, kv := range sr.Rows {
+		status := &NodeStatus{}
+		if err := json.Unmarshal(kv.Value.Bytes, status); err != nil {
+			return nil, util.Errorf("invalid node status at key %q: %s", kv.Key, err)
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Sort(nodeStatusesByID(statuses))
+	return statuses, nil
+}
+
+// nodeStatusesByID implements sort.Interface, ordering statuses by
+// node ID.
+type nodeStatusesByID []*NodeStatus
+
+func (s nodeStatusesByID) Len() int           { return len(s) }
+func (s nodeStatusesByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s nodeStatusesByID) Less(i, j int) bool { return s[i].NodeID < s[j].NodeID }
+
+// handleNodeStatus responds with the status records of all nodes at
+// statusNodesPath, or with the record of a single node at
+// statusNodesPath/<node ID>.
+func (s *server) handleNodeStatus(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, statusNodesPath), "/")
+	if id == "" {
+		statuses, err := getNodeStatuses(s.kvDB)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeStatusJSON(w, statuses)
+		return
+	}
+	nodeID, err := strconv.ParseInt(id, 10, 32)
+	if err != nil {
+		http.Error(w, "invalid node ID "+strconv.Quote(id), http.StatusBadRequest)
+		return
+	}
+	status, err := getNodeStatus(s.kvDB, int32(nodeID))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if status == nil {
+		http.Error(w, "node "+id+" has no status", http.StatusNotFound)
+		return
+	}
+	writeStatusJSON(w, status)
+}
+
+// writeStatusJSON writes v as indented JSON.
+func writeStatusJSON(w http.ResponseWriter, v interface{}) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// handleGossipInfos responds with every info held by the node's
+// gossip instance.
+func (s *server) handleGossipInfos(w http.ResponseWriter, r *http.Request) {
+	writeStatusJSON(w, s.gossip.Infos())
+}
+
+// handleGossipGroups responds with the groups registered with the
+// node's gossip instance.
+func (s *server) handleGossipGroups(w http.ResponseWriter, r *http.Request) {
+	writeStatusJSON(w, s.gossip.Groups())
+}
+
+// handleGossipPeers responds with the node's incoming and outgoing
+// gossip peer connections.
+func (s *server) handleGossipPeers(w http.ResponseWriter, r *http.Request) {
+	writeStatusJSON(w, s.gossip.Peers())
+}
+
+// clockOffset is the JSON representation of the offset of a remote
+// clock from the local clock.
+type clockOffset struct {
+	Offset     time.Duration `json:"offset"`
+	Error      time.Duration `json:"error"`
+	MeasuredAt time.Time     `json:"measured_at"`
+}
+
+// clockStatus is the JSON response of the clock offsets endpoint.
+type clockStatus struct {
+	MaxOffset time.Duration          `json:"max_offset"`
+	Healthy   bool                   `json:"healthy"`
+	Error     string                 `json:"error,omitempty"`
+	Offsets   map[string]clockOffset `json:"offsets"`
+}
+
+// handleClocks responds with the most recently measured offsets of
+// remote clocks, keyed by remote address, and whether the local clock
+// is within bounds.
+func (s *server) handleClocks(w http.ResponseWriter, r *http.Request) {
+	status := clockStatus{
+		MaxOffset: s.clock.MaxOffset(),
+		Healthy:   true,
+		Offsets:   map[string]clockOffset{},
+	}
+	if err := s.rpcContext.RemoteClocks.VerifyClockOffset(); err != nil {
+		status.Healthy = false
+		status.Error = err.Error()
+	}
+	for addr, offset := range s.rpcContext.RemoteClocks.Offsets() {
+		status.Offsets[addr] = clockOffset{
+			Offset:     time.Duration(offset.Offset),
+			Error:      time.Duration(offset.Error),
+			MeasuredAt: time.Unix(0, offset.MeasuredAt),
+		}
+	}
+	writeStatusJSON(w, status)
+}
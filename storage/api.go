@@ -0,0 +1,332 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package storage
+
+import (
+	"context"
+	"time"
+
+	"gossipgo/proto"
+	"gossipgo/util"
+	"gossipgo/util/hlc"
+)
+
+// Request is an interface for storage node requests.
+type Request interface {
+	// Header returns the request header.
+	Header() *RequestHeader
+}
+
+// Response is an interface for storage node responses.
+type Response interface {
+	// Header returns the response header.
+	Header() *ResponseHeader
+}
+
+// Header implements the Request interface for RequestHeader.
+func (rh *RequestHeader) Header() *RequestHeader {
+	return rh
+}
+
+// Header implements the Response interface for ResponseHeader.
+func (rh *ResponseHeader) Header() *ResponseHeader {
+	return rh
+}
+
+// Context returns a context which is done when the request's deadline
+// passes, or never if the request has no deadline. The returned
+// cancel function must be invoked to release its resources.
+func (rh *RequestHeader) Context() (context.Context, context.CancelFunc) {
+	if rh.Deadline == 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithDeadline(context.Background(), time.Unix(0, rh.Deadline))
+}
+
+// MethodForRequest returns the method name corresponding to the type
+// of the request.
+func MethodForRequest(args Request) (string, error) {
+	switch args.(type) {
+	case *ContainsRequest:
+		return "Contains", nil
+	case *GetRequest:
+		return "Get", nil
+	case *PutRequest:
+		return "Put", nil
+	case *IncrementRequest:
+		return "Increment", nil
+	case *DeleteRequest:
+		return "Delete", nil
+	case *DeleteRangeRequest:
+		return "DeleteRange", nil
+	case *ScanRequest:
+		return "Scan", nil
+	case *EndTransactionRequest:
+		return "EndTransaction", nil
+	case *AccumulateTSRequest:
+		return "AccumulateTS", nil
+	case *ReapQueueRequest:
+		return "ReapQueue", nil
+	case *EnqueueUpdateRequest:
+		return "EnqueueUpdate", nil
+	case *EnqueueMessageRequest:
+		return "EnqueueMessage", nil
+	case *InternalRangeLookupRequest:
+		return "InternalRangeLookup", nil
+	case *InternalMergeRequest:
+		return "InternalMerge", nil
+	case *BatchRequest:
+		return "Batch", nil
+	}
+	return "", util.Errorf("unhandled request %T", args)
+}
+
+// ToProtoTimestamp converts a hybrid logical clock timestamp to its
+// wire representation.
+func ToProtoTimestamp(ts hlc.Timestamp) proto.Timestamp {
+	return proto.Timestamp{WallTime: ts.WallTime, Logical: ts.Logical}
+}
+
+// FromProtoTimestamp converts the wire representation of a timestamp
+// to a hybrid logical clock timestamp.
+func FromProtoTimestamp(ts proto.Timestamp) hlc.Timestamp {
+	return hlc.Timestamp{WallTime: ts.WallTime, Logical: ts.Logical}
+}
+
+// IsReadOnly returns true if the method doesn't modify the store.
+func IsReadOnly(method string) bool {
+	switch method {
+	case "Contains", "Get", "Scan", "InternalRangeLookup":
+		return true
+	}
+	return false
+}
+
+// CreateReply returns an allocated response according to the
+// specified method.
+func CreateReply(method string) (Response, error) {
+	switch method {
+	case "Contains":
+		return &ContainsResponse{}, nil
+	case "Get":
+		return &GetResponse{}, nil
+	case "Put":
+		return &PutResponse{}, nil
+	case "Increment":
+		return &IncrementResponse{}, nil
+	case "Delete":
+		return &DeleteResponse{}, nil
+	case "DeleteRange":
+		return &DeleteRangeResponse{}, nil
+	case "Scan":
+		return &ScanResponse{}, nil
+	case "EndTransaction":
+		return &EndTransactionResponse{}, nil
+	case "AccumulateTS":
+		return &AccumulateTSResponse{}, nil
+	case "ReapQueue":
+		return &ReapQueueResponse{}, nil
+	case "EnqueueUpdate":
+		return &EnqueueUpdateResponse{}, nil
+	case "EnqueueMessage":
+		return &EnqueueMessageResponse{}, nil
+	case "InternalRangeLookup":
+		return &InternalRangeLookupResponse{}, nil
+	case "InternalMerge":
+		return &InternalMergeResponse{}, nil
+	case "Batch":
+		return &BatchResponse{}, nil
+	}
+	return nil, util.Errorf("unhandled method %s", method)
+}
+
+// GetValue returns the request contained in the union or nil if the
+// union is empty.
+func (ru *RequestUnion) GetValue() Request {
+	switch {
+	case ru.Contains != nil:
+		return ru.Contains
+	case ru.Get != nil:
+		return ru.Get
+	case ru.Put != nil:
+		return ru.Put
+	case ru.Increment != nil:
+		return ru.Increment
+	case ru.Delete != nil:
+		return ru.Delete
+	case ru.DeleteRange != nil:
+		return ru.DeleteRange
+	case ru.Scan != nil:
+		return ru.Scan
+	case ru.EndTransaction != nil:
+		return ru.EndTransaction
+	case ru.ReapQueue != nil:
+		return ru.ReapQueue
+	case ru.EnqueueUpdate != nil:
+		return ru.EnqueueUpdate
+	case ru.EnqueueMessage != nil:
+		return ru.EnqueueMessage
+	}
+	return nil
+}
+
+// SetValue sets the union to the specified request. Returns false if
+// the request type may not be part of a batch.
+func (ru *RequestUnion) SetValue(args Request) bool {
+	switch t := args.(type) {
+	case *ContainsRequest:
+		ru.Contains = t
+	case *GetRequest:
+		ru.Get = t
+	case *PutRequest:
+		ru.Put = t
+	case *IncrementRequest:
+		ru.Increment = t
+	case *DeleteRequest:
+		ru.Delete = t
+	case *DeleteRangeRequest:
+		ru.DeleteRange = t
+	case *ScanRequest:
+		ru.Scan = t
+	case *EndTransactionRequest:
+		ru.EndTransaction = t
+	case *ReapQueueRequest:
+		ru.ReapQueue = t
+	case *EnqueueUpdateRequest:
+		ru.EnqueueUpdate = t
+	case *EnqueueMessageRequest:
+		ru.EnqueueMessage = t
+	default:
+		return false
+	}
+	return true
+}
+
+// Key returns the key which addresses the request contained in the
+// union. Requests which span a key range are addressed by their start
+// key. Returns nil if the union is empty.
+func (ru *RequestUnion) Key() Key {
+	switch {
+	case ru.Contains != nil:
+		return ru.Contains.Key
+	case ru.Get != nil:
+		return ru.Get.Key
+	case ru.Put != nil:
+		return ru.Put.Key
+	case ru.Increment != nil:
+		return ru.Increment.Key
+	case ru.Delete != nil:
+		return ru.Delete.Key
+	case ru.DeleteRange != nil:
+		return ru.DeleteRange.StartKey
+	case ru.Scan != nil:
+		return ru.Scan.StartKey
+	case ru.EndTransaction != nil:
+		if len(ru.EndTransaction.Keys) > 0 {
+			return ru.EndTransaction.Keys[0]
+		}
+		return KeyMin
+	case ru.ReapQueue != nil:
+		return ru.ReapQueue.Inbox
+	case ru.EnqueueUpdate != nil:
+		return KeyMin
+	case ru.EnqueueMessage != nil:
+		return ru.EnqueueMessage.Inbox
+	}
+	return nil
+}
+
+// GetValue returns the response contained in the union or nil if the
+// union is empty.
+func (ru *ResponseUnion) GetValue() Response {
+	switch {
+	case ru.Contains != nil:
+		return ru.Contains
+	case ru.Get != nil:
+		return ru.Get
+	case ru.Put != nil:
+		return ru.Put
+	case ru.Increment != nil:
+		return ru.Increment
+	case ru.Delete != nil:
+		return ru.Delete
+	case ru.DeleteRange != nil:
+		return ru.DeleteRange
+	case ru.Scan != nil:
+		return ru.Scan
+	case ru.EndTransaction != nil:
+		return ru.EndTransaction
+	case ru.ReapQueue != nil:
+		return ru.ReapQueue
+	case ru.EnqueueUpdate != nil:
+		return ru.EnqueueUpdate
+	case ru.EnqueueMessage != nil:
+		return ru.EnqueueMessage
+	}
+	return nil
+}
+
+// SetValue sets the union to the specified response. Returns false if
+// the response type may not be part of a batch.
+func (ru *ResponseUnion) SetValue(reply Response) bool {
+	switch t := reply.(type) {
+	case *ContainsResponse:
+		ru.Contains = t
+	case *GetResponse:
+		ru.Get = t
+	case *PutResponse:
+		ru.Put = t
+	case *IncrementResponse:
+		ru.Increment = t
+	case *DeleteResponse:
+		ru.Delete = t
+	case *DeleteRangeResponse:
+		ru.DeleteRange = t
+	case *ScanResponse:
+		ru.Scan = t
+	case *EndTransactionResponse:
+		ru.EndTransaction = t
+	case *ReapQueueResponse:
+		ru.ReapQueue = t
+	case *EnqueueUpdateResponse:
+		ru.EnqueueUpdate = t
+	case *EnqueueMessageResponse:
+		ru.EnqueueMessage = t
+	default:
+		return false
+	}
+	return true
+}
+
+// Add adds a request to the batch request.
+func (br *BatchRequest) Add(args Request) {
+	union := RequestUnion{}
+	if !union.SetValue(args) {
+		panic(util.Errorf("unable to add %T to batch request", args))
+	}
+	br.Requests = append(br.Requests, union)
+}
+
+// Add adds a response to the batch response.
+func (br *BatchResponse) Add(reply Response) {
+	union := ResponseUnion{}
+	if !union.SetValue(reply) {
+		panic(util.Errorf("unable to add %T to batch response", reply))
+	}
+	br.Responses = append(br.Responses, union)
+}
@@ -69,6 +69,13 @@ func (a StoreAttributes) Less(b gossip.Ordered) bool {
 	return a.Capacity.PercentAvail() < b.(StoreAttributes).Capacity.PercentAvail()
 }
 
+// init registers the types of storage values gossiped by nodes and
+// ranges.
+func init() {
+	gossip.RegisterInfoType(gossip.KeyMaxAvailCapacityPrefix, StoreAttributes{})
+	gossip.RegisterInfoType(gossip.KeyFirstRangeMetadata, RangeLocations{})
+}
+
 // PercentAvail computes the percentage of disk space that is available.
 func (sc StoreCapacity) PercentAvail() float64 {
 	return float64(sc.Available) / float64(sc.Capacity)
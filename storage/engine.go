@@ -19,11 +19,9 @@ package storage
 
 import (
 	"bytes"
-	"encoding/binary"
 	"encoding/gob"
-	"time"
 
-	"gossipgo/util"
+	"gossipgo/util/hlc"
 )
 
 // Engine is the interface that wraps the core operations of a
@@ -38,6 +36,9 @@ type Engine interface {
 	// scan returns up to max key/value objects starting from
 	// start (inclusive) and ending at end (non-inclusive).
 	scan(start, end Key, max int64) ([]KeyValue, error)
+	// merge merges the operand encoded in value into the value stored
+	// at key; see newMergeValue.
+	merge(key Key, value Value) error
 	// delete removes the item from the db with the given key.
 	del(key Key) error
 	// capacity returns capacity details for the engine's available storage.
@@ -45,16 +46,16 @@ type Engine interface {
 }
 
 // putI sets the given key to the gob-serialized byte string of the
-// value provided. Used internally. Uses current time and default
-// expiration.
-func putI(engine Engine, key Key, value interface{}) error {
+// value provided. Used internally. Uses the supplied timestamp and
+// default expiration.
+func putI(engine Engine, key Key, value interface{}, ts hlc.Timestamp) error {
 	var buf bytes.Buffer
 	if err := gob.NewEncoder(&buf).Encode(value); err != nil {
 		return err
 	}
 	return engine.put(key, Value{
 		Bytes:     buf.Bytes(),
-		Timestamp: time.Now().UnixNano(),
+		Timestamp: ts,
 	})
 }
 
@@ -62,13 +63,13 @@ func putI(engine Engine, key Key, value interface{}) error {
 // "value". Returns true on success or false if the key was not
 // found. The timestamp of the write is returned as the second return
 // value.
-func getI(engine Engine, key Key, value interface{}) (bool, int64, error) {
+func getI(engine Engine, key Key, value interface{}) (bool, hlc.Timestamp, error) {
 	val, err := engine.get(key)
 	if err != nil {
-		return false, 0, err
+		return false, hlc.Timestamp{}, err
 	}
 	if len(val.Bytes) == 0 {
-		return false, 0, nil
+		return false, hlc.Timestamp{}, nil
 	}
 	if value != nil {
 		if err = gob.NewDecoder(bytes.NewBuffer(val.Bytes)).Decode(value); err != nil {
@@ -78,33 +79,18 @@ func getI(engine Engine, key Key, value interface{}) (bool, int64, error) {
 	return true, val.Timestamp, nil
 }
 
-// increment fetches the varint encoded int64 value specified by key
-// and adds "inc" to it then re-encodes as varint and puts the new
-// value to key using the timestamp "ts". The newly incremented value
-// is returned.
-func increment(engine Engine, key Key, inc int64, ts int64) (int64, error) {
-	// First retrieve existing value.
-	val, err := engine.get(key)
-	if err != nil {
+// increment merges "inc" into the varint encoded int64 value
+// specified by key using the timestamp "ts" and returns the newly
+// incremented value. If no value exists for the key, zero is
+// incremented. The merge and the read of the new value aren't atomic,
+// so callers must serialize increments of the same key.
+func increment(engine Engine, key Key, inc int64, ts hlc.Timestamp) (int64, error) {
+	if err := engine.merge(key, newMergeValue(mergeCounter, encodeVarint(inc), ts)); err != nil {
 		return 0, err
 	}
-	var int64Val int64
-	// If the value exists, attempt to decode it as a varint.
-	if len(val.Bytes) != 0 {
-		var numBytes int
-		int64Val, numBytes = binary.Varint(val.Bytes)
-		if numBytes == 0 {
-			return 0, util.Errorf("key %q cannot be incremented; not varint-encoded", key)
-		} else if numBytes < 0 {
-			return 0, util.Errorf("key %q cannot be incremented; integer overflow", key)
-		}
-	}
-	int64Val += inc
-	encoded := make([]byte, binary.MaxVarintLen64)
-	numBytes := binary.PutVarint(encoded, int64Val)
-	encoded = encoded[:numBytes]
-	if err = engine.put(key, Value{Bytes: encoded, Timestamp: ts}); err != nil {
+	val, err := engine.get(key)
+	if err != nil {
 		return 0, err
 	}
-	return int64Val, nil
+	return decodeVarint(key, val.Bytes)
 }
@@ -0,0 +1,139 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	gogoproto "github.com/gogo/protobuf/proto"
+	"gossipgo/proto"
+	"gossipgo/util/hlc"
+)
+
+// runWithEngines invokes fn with a new InMem engine and a new PebbleDB
+// engine in a temporary directory.
+func runWithEngines(t *testing.T, fn func(engine Engine)) {
+	fn(NewInMem(1 << 20))
+
+	dir, err := ioutil.TempDir("", "pebble")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pdb, err := NewPebbleDB(SSD, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pdb.Close()
+	fn(pdb)
+}
+
+// TestEngineMerge verifies counter, time series and byte append
+// merges, with and without an existing value, and that errors
+// merging into incompatible values are returned by the merge or by
+// the read which follows it.
+func TestEngineMerge(t *testing.T) {
+	tsBytes := func(samples ...*proto.InternalTimeSeriesSample) []byte {
+		b, err := gogoproto.Marshal(&proto.InternalTimeSeriesData{SampleDurationNanos: 10, Samples: samples})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	runWithEngines(t, func(engine Engine) {
+		ts := hlc.Timestamp{WallTime: 1}
+		if err := engine.put(Key("b"), Value{Bytes: []byte("ab")}); err != nil {
+			t.Fatal(err)
+		}
+		merges := []struct {
+			key     string
+			typ     mergeType
+			operand []byte
+		}{
+			{"a", mergeCounter, encodeVarint(5)},
+			{"a", mergeCounter, encodeVarint(-2)},
+			{"b", mergeBytes, []byte("cd")},
+			{"b", mergeBytes, []byte("e")},
+			{"c", mergeTimeSeries, tsBytes(&proto.InternalTimeSeriesSample{Offset: 2, IntCount: 1, IntSum: gogoproto.Int64(4)})},
+			{"c", mergeTimeSeries, tsBytes(&proto.InternalTimeSeriesSample{Offset: 2, IntCount: 1, IntSum: gogoproto.Int64(6)})},
+		}
+		for _, m := range merges {
+			ts.WallTime++
+			if err := engine.merge(Key(m.key), newMergeValue(m.typ, m.operand, ts)); err != nil {
+				t.Fatalf("%T: unexpected error merging into %q: %v", engine, m.key, err)
+			}
+		}
+		expValues := map[string][]byte{
+			"a": encodeVarint(3),
+			"b": []byte("abcde"),
+			"c": tsBytes(&proto.InternalTimeSeriesSample{
+				Offset:   2,
+				IntCount: 2,
+				IntSum:   gogoproto.Int64(10),
+				IntMax:   gogoproto.Int64(6),
+				IntMin:   gogoproto.Int64(4),
+			}),
+		}
+		for key, exp := range expValues {
+			val, err := engine.get(Key(key))
+			if err != nil {
+				t.Fatalf("%T: %v", engine, err)
+			}
+			if !bytes.Equal(val.Bytes, exp) {
+				t.Errorf("%T: expected key %q to have value %q; got %q", engine, key, exp, val.Bytes)
+			}
+		}
+		kvs, err := engine.scan(Key("a"), Key("c"), 10)
+		if err != nil || len(kvs) != 2 || !bytes.Equal(kvs[0].Value.Bytes, expValues["a"]) {
+			t.Errorf("%T: expected scan to return merged values; got %+v, %v", engine, kvs, err)
+		}
+		if val, _ := engine.get(Key("a")); val.Timestamp.WallTime != 3 {
+			t.Errorf("%T: expected timestamp of last merge; got %+v", engine, val.Timestamp)
+		}
+
+		// Incrementing a value which isn't a varint fails when merged or
+		// when read.
+		if err := engine.put(Key("d"), Value{Bytes: []byte{0xff}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := engine.merge(Key("d"), newMergeValue(mergeCounter, encodeVarint(1), ts)); err == nil {
+			if _, err := engine.get(Key("d")); err == nil {
+				t.Errorf("%T: expected error incrementing a value which isn't a varint", engine)
+			}
+		}
+		if err := engine.merge(Key("d"), Value{Bytes: []byte{0xff}}); err == nil {
+			t.Errorf("%T: expected error merging with an unknown merge type", engine)
+		}
+	})
+}
+
+// TestIncrement verifies that increments are merged and return the
+// newly incremented value.
+func TestIncrement(t *testing.T) {
+	runWithEngines(t, func(engine Engine) {
+		for i, inc := range []int64{5, -7, 10} {
+			exp := []int64{5, -2, 8}[i]
+			if val, err := increment(engine, Key("a"), inc, hlc.Timestamp{}); err != nil || val != exp {
+				t.Errorf("%T: expected increment by %d to return %d; got %d, %v", engine, inc, exp, val, err)
+			}
+		}
+	})
+}
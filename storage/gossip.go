@@ -0,0 +1,51 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package storage
+
+// GossipStorage persists checkpoints of a node's gossip info store to
+// a storage engine at a store-local key. It implements the
+// gossip.Storage interface.
+type GossipStorage struct {
+	engine Engine
+}
+
+// NewGossipStorage returns a GossipStorage which checkpoints gossip
+// to the specified engine.
+func NewGossipStorage(engine Engine) *GossipStorage {
+	return &GossipStorage{engine: engine}
+}
+
+// ReadGossip returns the gossip checkpoint, or nil if none has been
+// written.
+func (gs *GossipStorage) ReadGossip() ([]byte, error) {
+	val, err := gs.engine.get(keyGossipInfos)
+	if err != nil {
+		return nil, err
+	}
+	return val.Bytes, nil
+}
+
+// WriteGossip writes data as the gossip checkpoint. Writes to an
+// engine whose store hasn't yet been bootstrapped are silently
+// skipped, as bootstrapping requires an empty engine.
+func (gs *GossipStorage) WriteGossip(data []byte) error {
+	if ok, _, err := getI(gs.engine, keyStoreIdent, nil); err != nil || !ok {
+		return err
+	}
+	return gs.engine.put(keyGossipInfos, Value{Bytes: data})
+}
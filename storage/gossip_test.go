@@ -0,0 +1,51 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package storage
+
+import (
+	"bytes"
+	"testing"
+
+	"gossipgo/util/hlc"
+)
+
+// TestGossipStorage verifies that gossip checkpoints are written only
+// once the store is bootstrapped and are read back intact.
+func TestGossipStorage(t *testing.T) {
+	engine := NewInMem(1 << 20)
+	gs := NewGossipStorage(engine)
+	if data, err := gs.ReadGossip(); err != nil || data != nil {
+		t.Errorf("expected no checkpoint; got %q, %v", data, err)
+	}
+
+	// Writes before bootstrap are skipped, leaving the engine empty.
+	if err := gs.WriteGossip([]byte("infos")); err != nil {
+		t.Fatal(err)
+	}
+	store := NewStore(hlc.NewClock(hlc.UnixNano, 0), engine, nil)
+	if err := store.Bootstrap(testIdent); err != nil {
+		t.Fatalf("error bootstrapping store: %v", err)
+	}
+
+	if err := gs.WriteGossip([]byte("infos")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := gs.ReadGossip(); err != nil || !bytes.Equal(data, []byte("infos")) {
+		t.Errorf("expected checkpoint %q; got %q, %v", "infos", data, err)
+	}
+}
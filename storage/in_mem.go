@@ -107,6 +107,31 @@ func (in *InMem) scan(start, end Key, max int64) ([]KeyValue, error) {
 	return scanned, nil
 }
 
+// merge merges the operand encoded in value into the value stored at
+// key. The read, merge and write are done under the store's lock.
+func (in *InMem) merge(key Key, value Value) error {
+	in.Lock()
+	defer in.Unlock()
+	var existing Value
+	var existingSize int64
+	if val := in.data.Get(KeyValue{Key: key}); val != nil {
+		existing = val.(KeyValue).Value
+		existingSize = computeSize(val.(KeyValue))
+	}
+	merged, err := mergeValue(key, existing, value)
+	if err != nil {
+		return err
+	}
+	kv := KeyValue{Key: key, Value: merged}
+	size := computeSize(kv) - existingSize
+	if size+in.usedBytes > in.maxBytes {
+		return util.Errorf("in mem store at capacity %d + %d > %d", in.usedBytes, size, in.maxBytes)
+	}
+	in.usedBytes += size
+	in.data.Insert(kv)
+	return nil
+}
+
 // del removes the item from the db with the given key.
 func (in *InMem) del(key Key) error {
 	in.Lock()
@@ -126,6 +151,8 @@ func (in *InMem) del(key Key) error {
 // not be entirely accurate due to object storage costs and other
 // internal glue.
 func (in *InMem) capacity() (StoreCapacity, error) {
+	in.RLock()
+	defer in.RUnlock()
 	return StoreCapacity{
 		Capacity:  in.maxBytes,
 		Available: in.maxBytes - in.usedBytes,
@@ -112,7 +112,7 @@ func TestInMemCapacity(t *testing.T) {
 }
 
 func TestInMemOverCapacity(t *testing.T) {
-	engine := NewInMem(120 /* 120 bytes only -- enough for one node, not two */)
+	engine := NewInMem(140 /* 140 bytes only -- enough for one node, not two */)
 	bytes := []byte("0123456789")
 	var err error
 	if err = engine.put(Key("1"), Value{Bytes: bytes}); err != nil {
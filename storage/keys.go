@@ -26,6 +26,20 @@ func MakeKey(prefix, suffix Key) Key {
 	return Key(bytes.Join([][]byte{prefix, suffix}, []byte{}))
 }
 
+// PrefixEnd returns the first key which doesn't have k as a prefix.
+// Scanning from k to k.PrefixEnd() visits all keys with prefix k.
+func (k Key) PrefixEnd() Key {
+	end := append(Key(nil), k...)
+	for i := len(end) - 1; i >= 0; i-- {
+		end[i]++
+		if end[i] != 0 {
+			return end[:i+1]
+		}
+	}
+	// k is empty or all \xff bytes; no key follows the prefix.
+	return KeyMax
+}
+
 // Constants for system-reserved keys in the KV map.
 var (
 	// KeyMin is a minimum key value which sorts before all other keys.
@@ -48,4 +62,19 @@ var (
 	// KeyStoreIDGeneratorPrefix specifies key prefixes for sequence
 	// generators, one per node, for store IDs.
 	KeyStoreIDGeneratorPrefix = Key("\x00store-id-generator-")
+	// KeySchemaPrefix specifies key prefixes for structured data
+	// schemas. The value is the schema's YAML declaration, keyed by
+	// schema name.
+	KeySchemaPrefix = Key("\x00schema-")
+	// KeySequencePrefix specifies key prefixes for the sequence
+	// generators of auto-increment columns of structured data tables.
+	KeySequencePrefix = Key("\x00sequence-")
+	// KeyTimeSeriesPrefix specifies key prefixes for time series data.
+	// Each value accumulates the samples of one metric at one
+	// resolution over one key duration.
+	KeyTimeSeriesPrefix = Key("\x00tsd-")
+	// KeyStatusNodePrefix specifies key prefixes for node status
+	// records, keyed by node ID. The value is the JSON encoded status
+	// most recently recorded by the node.
+	KeyStatusNodePrefix = Key("\x00status-node-")
 )
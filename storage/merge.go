@@ -0,0 +1,246 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package storage
+
+import (
+	"encoding/binary"
+	"sort"
+
+	gogoproto "github.com/gogo/protobuf/proto"
+	"gossipgo/proto"
+	"gossipgo/util"
+	"gossipgo/util/hlc"
+)
+
+// A mergeType identifies the semantics with which a merge operand is
+// merged into an existing value. Merges of each type are associative,
+// so engines may combine operands before the value they're merged
+// into is known.
+type mergeType byte
+
+const (
+	// mergeCounter adds a varint encoded int64 to a varint encoded
+	// int64 value.
+	mergeCounter mergeType = iota + 1
+	// mergeTimeSeries accumulates the samples of an encoded
+	// proto.InternalTimeSeriesData into the time series value.
+	mergeTimeSeries
+	// mergeBytes appends bytes to the value.
+	mergeBytes
+)
+
+// newMergeValue returns the value passed to Engine.merge to merge
+// operand with the semantics of typ. The bytes of the value are the
+// merge type followed by the operand.
+func newMergeValue(typ mergeType, operand []byte, ts hlc.Timestamp) Value {
+	return Value{
+		Bytes:     append([]byte{byte(typ)}, operand...),
+		Timestamp: ts,
+	}
+}
+
+// decodeMergeValue returns the merge type and operand of a value
+// created by newMergeValue.
+func decodeMergeValue(value Value) (mergeType, []byte, error) {
+	if len(value.Bytes) == 0 {
+		return 0, nil, util.Error("empty merge value")
+	}
+	typ := mergeType(value.Bytes[0])
+	if typ < mergeCounter || typ > mergeBytes {
+		return 0, nil, util.Errorf("unknown merge type %d", typ)
+	}
+	return typ, value.Bytes[1:], nil
+}
+
+// mergeValue returns the result of merging value, created by
+// newMergeValue, into existing. The result has the timestamp of value.
+func mergeValue(key Key, existing, value Value) (Value, error) {
+	typ, operand, err := decodeMergeValue(value)
+	if err != nil {
+		return Value{}, err
+	}
+	b, err := applyMerge(key, typ, existing.Bytes, operand)
+	if err != nil {
+		return Value{}, err
+	}
+	return Value{Bytes: b, Timestamp: value.Timestamp, Expiration: existing.Expiration}, nil
+}
+
+// applyMerge merges operand into existing with the semantics of typ
+// and returns the result. An empty existing value is treated as zero,
+// an empty time series or an empty byte string respectively.
+func applyMerge(key Key, typ mergeType, existing, operand []byte) ([]byte, error) {
+	switch typ {
+	case mergeCounter:
+		inc, err := decodeVarint(key, operand)
+		if err != nil {
+			return nil, err
+		}
+		var int64Val int64
+		if len(existing) != 0 {
+			if int64Val, err = decodeVarint(key, existing); err != nil {
+				return nil, err
+			}
+		}
+		return encodeVarint(int64Val + inc), nil
+	case mergeTimeSeries:
+		return mergeTimeSeriesData(key, existing, operand)
+	case mergeBytes:
+		return append(append([]byte(nil), existing...), operand...), nil
+	}
+	return nil, util.Errorf("unknown merge type %d", typ)
+}
+
+// encodeVarint returns the varint encoding of i.
+func encodeVarint(i int64) []byte {
+	encoded := make([]byte, binary.MaxVarintLen64)
+	numBytes := binary.PutVarint(encoded, i)
+	return encoded[:numBytes]
+}
+
+// decodeVarint decodes the varint encoded value of key.
+func decodeVarint(key Key, b []byte) (int64, error) {
+	int64Val, numBytes := binary.Varint(b)
+	if numBytes == 0 {
+		return 0, util.Errorf("key %q cannot be incremented; not varint-encoded", key)
+	} else if numBytes < 0 {
+		return 0, util.Errorf("key %q cannot be incremented; integer overflow", key)
+	}
+	return int64Val, nil
+}
+
+// mergeTimeSeriesData merges the encoded proto.InternalTimeSeriesData
+// of operand into that of existing and returns the encoded result.
+// Samples with the same offset are accumulated: counts and sums are
+// added, and the minimum and maximum are kept. The start timestamp and
+// sample duration of the two collections must match. If existing is
+// empty, the result is the operand with its samples accumulated and
+// sorted by offset.
+func mergeTimeSeriesData(key Key, existing, operand []byte) ([]byte, error) {
+	update := &proto.InternalTimeSeriesData{}
+	if err := gogoproto.Unmarshal(operand, update); err != nil {
+		return nil, util.Errorf("merge value for key %q is not time series data: %s", key, err)
+	}
+	if len(existing) != 0 {
+		data := &proto.InternalTimeSeriesData{}
+		if err := gogoproto.Unmarshal(existing, data); err != nil {
+			return nil, util.Errorf("key %q cannot be merged; not time series data: %s", key, err)
+		}
+		if data.StartTimestampNanos != update.StartTimestampNanos ||
+			data.SampleDurationNanos != update.SampleDurationNanos {
+			return nil, util.Errorf("key %q cannot be merged; time series start %d and sample duration %d "+
+				"differ from %d and %d", key, update.StartTimestampNanos, update.SampleDurationNanos,
+				data.StartTimestampNanos, data.SampleDurationNanos)
+		}
+		update.Samples = append(data.Samples, update.Samples...)
+	}
+	update.Samples = mergeSamples(update.Samples)
+	return gogoproto.Marshal(update)
+}
+
+// mergeSamples accumulates samples with the same offset into a single
+// sample and returns the result sorted by offset.
+func mergeSamples(samples []*proto.InternalTimeSeriesSample) []*proto.InternalTimeSeriesSample {
+	byOffset := map[int32]*proto.InternalTimeSeriesSample{}
+	var merged []*proto.InternalTimeSeriesSample
+	for _, sample := range samples {
+		m, ok := byOffset[sample.Offset]
+		if !ok {
+			m = &proto.InternalTimeSeriesSample{Offset: sample.Offset}
+			byOffset[sample.Offset] = m
+			merged = append(merged, m)
+		}
+		mergeSample(m, sample)
+	}
+	sort.Sort(sampleSlice(merged))
+	return merged
+}
+
+// mergeSample accumulates sample into m. The minimum and maximum of a
+// sample with a count of one may be omitted, as they equal the sum;
+// they are set explicitly once a merged sample holds more than one
+// measurement.
+func mergeSample(m, sample *proto.InternalTimeSeriesSample) {
+	if sample.IntCount > 0 {
+		if m.IntCount == 0 {
+			m.IntSum, m.IntMax, m.IntMin = sample.IntSum, sample.IntMax, sample.IntMin
+		} else {
+			max, min := intMaxMin(m)
+			sMax, sMin := intMaxMin(sample)
+			if sMax > max {
+				max = sMax
+			}
+			if sMin < min {
+				min = sMin
+			}
+			m.IntSum = gogoproto.Int64(m.GetIntSum() + sample.GetIntSum())
+			m.IntMax, m.IntMin = gogoproto.Int64(max), gogoproto.Int64(min)
+		}
+		m.IntCount += sample.IntCount
+	}
+	if sample.FloatCount > 0 {
+		if m.FloatCount == 0 {
+			m.FloatSum, m.FloatMax, m.FloatMin = sample.FloatSum, sample.FloatMax, sample.FloatMin
+		} else {
+			max, min := floatMaxMin(m)
+			sMax, sMin := floatMaxMin(sample)
+			if sMax > max {
+				max = sMax
+			}
+			if sMin < min {
+				min = sMin
+			}
+			m.FloatSum = gogoproto.Float32(m.GetFloatSum() + sample.GetFloatSum())
+			m.FloatMax, m.FloatMin = gogoproto.Float32(max), gogoproto.Float32(min)
+		}
+		m.FloatCount += sample.FloatCount
+	}
+}
+
+// intMaxMin returns the maximum and minimum integer measurements of
+// the sample.
+func intMaxMin(s *proto.InternalTimeSeriesSample) (int64, int64) {
+	max, min := s.GetIntSum(), s.GetIntSum()
+	if s.IntMax != nil {
+		max = *s.IntMax
+	}
+	if s.IntMin != nil {
+		min = *s.IntMin
+	}
+	return max, min
+}
+
+// floatMaxMin returns the maximum and minimum floating point
+// measurements of the sample.
+func floatMaxMin(s *proto.InternalTimeSeriesSample) (float32, float32) {
+	max, min := s.GetFloatSum(), s.GetFloatSum()
+	if s.FloatMax != nil {
+		max = *s.FloatMax
+	}
+	if s.FloatMin != nil {
+		min = *s.FloatMin
+	}
+	return max, min
+}
+
+// sampleSlice implements sort.Interface, ordering samples by offset.
+type sampleSlice []*proto.InternalTimeSeriesSample
+
+func (s sampleSlice) Len() int           { return len(s) }
+func (s sampleSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s sampleSlice) Less(i, j int) bool { return s[i].Offset < s[j].Offset }
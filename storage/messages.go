@@ -1,5 +1,7 @@
 package storage
 
+import "gossipgo/util/hlc"
+
 // Key defines the key in the key-value datastore.
 type Key []byte
 
@@ -10,8 +12,9 @@ type Key []byte
 type Value struct {
 	// Bytes is the byte string value.
 	Bytes []byte
-	// Timestamp of value in nanoseconds since epoch.
-	Timestamp int64
+	// Timestamp of value, taken from the hybrid logical clock of the
+	// node which wrote it.
+	Timestamp hlc.Timestamp
 	// Expiration in nanoseconds.
 	Expiration int64
 }
@@ -26,9 +29,9 @@ type KeyValue struct {
 // RequestHeader is supplied with every storage node request.
 type RequestHeader struct {
 	// Timestamp specifies time at which read or writes should be
-	// performed. In nanoseconds since the epoch. Defaults to current
-	// wall time.
-	Timestamp int64
+	// performed. Taken from the client's hybrid logical clock. Defaults
+	// to the current time of the serving node's clock.
+	Timestamp hlc.Timestamp
 
 	// The following values are set internally and should not be set
 	// manually.
@@ -37,18 +40,25 @@ type RequestHeader struct {
 	Replica Replica
 	// MaxTimestamp is the maximum wall time seen by the client to
 	// date. This should be supplied with successive transactions for
-	// linearalizability for this client. In nanoseconds since the
-	// epoch.
-	MaxTimestamp int64
+	// linearalizability for this client. Set to Timestamp plus the
+	// maximum clock offset of the cluster.
+	MaxTimestamp hlc.Timestamp
 	// TxID is set non-empty if a transaction is underway. Empty string
 	// to start a new transaction.
 	TxID string
+	// Deadline is the wall time in Unix nanoseconds after which the
+	// client abandons the request. Zero means no deadline. Commands
+	// still pending at their deadline aren't executed.
+	Deadline int64
 }
 
 // ResponseHeader is returned with every storage node response.
 type ResponseHeader struct {
 	// Error is non-nil if an error occurred.
 	Error error
+	// Timestamp is the time of the serving node's hybrid logical clock
+	// when the response was sent. Clients update their clocks with it.
+	Timestamp hlc.Timestamp
 	// TxID is non-empty if a transaction is underway.
 	TxID string
 }
@@ -191,6 +201,22 @@ type AccumulateTSResponse struct {
 	ResponseHeader
 }
 
+// An InternalMergeRequest is arguments to the InternalMerge()
+// method. It specifies the key into which Value is merged. The bytes
+// of Value must be an encoded proto.InternalTimeSeriesData, the only
+// type of value which can currently be merged.
+type InternalMergeRequest struct {
+	RequestHeader
+	Key   Key
+	Value Value
+}
+
+// An InternalMergeResponse is the return value from the
+// InternalMerge() method.
+type InternalMergeResponse struct {
+	ResponseHeader
+}
+
 // A ReapQueueRequest is arguments to the ReapQueue() method. It
 // specifies the recipient inbox key to which messages are waiting
 // to be reapted and also the maximum number of results to return.
@@ -256,3 +282,53 @@ type InternalRangeLookupResponse struct {
 	EndKey    Key // The key in datastore whose value is the Locations object.
 	Locations RangeLocations
 }
+
+// A RequestUnion contains exactly one of the optional requests. It's
+// used to carry the constituent commands of a BatchRequest.
+type RequestUnion struct {
+	Contains       *ContainsRequest
+	Get            *GetRequest
+	Put            *PutRequest
+	Increment      *IncrementRequest
+	Delete         *DeleteRequest
+	DeleteRange    *DeleteRangeRequest
+	Scan           *ScanRequest
+	EndTransaction *EndTransactionRequest
+	ReapQueue      *ReapQueueRequest
+	EnqueueUpdate  *EnqueueUpdateRequest
+	EnqueueMessage *EnqueueMessageRequest
+}
+
+// A ResponseUnion contains exactly one of the optional responses. It's
+// used to carry the constituent replies of a BatchResponse.
+type ResponseUnion struct {
+	Contains       *ContainsResponse
+	Get            *GetResponse
+	Put            *PutResponse
+	Increment      *IncrementResponse
+	Delete         *DeleteResponse
+	DeleteRange    *DeleteRangeResponse
+	Scan           *ScanResponse
+	EndTransaction *EndTransactionResponse
+	ReapQueue      *ReapQueueResponse
+	EnqueueUpdate  *EnqueueUpdateResponse
+	EnqueueMessage *EnqueueMessageResponse
+}
+
+// A BatchRequest is arguments to the Batch() method. It contains one
+// or more requests. Requests which address the same range are
+// executed on that range as a single, atomic update.
+type BatchRequest struct {
+	RequestHeader
+	Requests []RequestUnion
+}
+
+// A BatchResponse is the return value from the Batch() method. It
+// contains one response per request, in the same order as the
+// requests in the matching BatchRequest. The error in the response
+// header is set to the first error from the slice of responses, if
+// applicable.
+type BatchResponse struct {
+	ResponseHeader
+	Responses []ResponseUnion
+}
@@ -1,37 +1,240 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
 package storage
 
 import (
+	"encoding/binary"
+	"io"
+	"syscall"
+
 	pebble "github.com/cockroachdb/pebble"
-	"log"
+	"gossipgo/util"
+)
+
+const (
+	// pebbleValueFull marks a stored value which isn't a merge
+	// operand. Merge operands are marked by their merge type.
+	pebbleValueFull = 0
+	// pebbleValueHeaderSize is the size of the marker, timestamp and
+	// expiration preceding the bytes of a stored value.
+	pebbleValueHeaderSize = 1 + 8 + 4 + 8
 )
 
+// pebbleMerger merges operands written by PebbleDB.merge.
+var pebbleMerger = &pebble.Merger{
+	Name: "gossipgo.storage.merge",
+	Merge: func(key, value []byte) (pebble.ValueMerger, error) {
+		kind, v, err := decodePebbleValue(value)
+		if err != nil {
+			return nil, err
+		}
+		return &pebbleValueMerger{key: append(Key(nil), key...), kind: kind, value: v}, nil
+	},
+}
+
+// PebbleDB is an engine backed by a Pebble database. Merges are
+// written as operands and combined by Pebble when the value is read
+// or compacted, so errors merging incompatible values are returned
+// when the value is read.
 type PebbleDB struct {
-	db *pebble.DB
+	typ DiskType // HDD or SSD
+	dir string   // The data directory
+	db  *pebble.DB
 }
 
-func (d *PebbleDB) Put(key string, value string) error {
-	keyBytes := []byte(key)
-	if err := d.db.Set(keyBytes, []byte(value), pebble.Sync); err != nil {
-		log.Fatal(err)
+// NewPebbleDB opens the Pebble database in dir, creating it if
+// necessary.
+func NewPebbleDB(typ DiskType, dir string) (*PebbleDB, error) {
+	db, err := pebble.Open(dir, &pebble.Options{Merger: pebbleMerger})
+	if err != nil {
+		return nil, err
+	}
+	return &PebbleDB{typ: typ, dir: dir, db: db}, nil
+}
+
+// Close closes the database.
+func (p *PebbleDB) Close() error {
+	return p.db.Close()
+}
+
+// Type returns either HDD or SSD depending on how engine
+// was configured.
+func (p *PebbleDB) Type() DiskType {
+	return p.typ
+}
+
+// put sets the given key to the value provided.
+func (p *PebbleDB) put(key Key, value Value) error {
+	return p.db.Set(key, encodePebbleValue(pebbleValueFull, value), pebble.Sync)
+}
+
+// get returns the value for the given key, nil otherwise.
+func (p *PebbleDB) get(key Key) (Value, error) {
+	b, closer, err := p.db.Get(key)
+	if err == pebble.ErrNotFound {
+		return Value{}, nil
+	} else if err != nil {
+		return Value{}, err
+	}
+	defer closer.Close()
+	return decodePebbleFullValue(key, b)
+}
+
+// scan returns up to max key/value objects starting from
+// start (inclusive) and ending at end (non-inclusive).
+func (p *PebbleDB) scan(start, end Key, max int64) ([]KeyValue, error) {
+	iter := p.db.NewIter(&pebble.IterOptions{LowerBound: start, UpperBound: end})
+	var scanned []KeyValue
+	for valid := iter.First(); valid && int64(len(scanned)) < max; valid = iter.Next() {
+		key := append(Key(nil), iter.Key()...)
+		value, err := decodePebbleFullValue(key, iter.Value())
+		if err != nil {
+			iter.Close()
+			return nil, err
+		}
+		scanned = append(scanned, KeyValue{Key: key, Value: value})
+	}
+	return scanned, iter.Close()
+}
+
+// merge writes the operand encoded in value as a Pebble merge
+// operand of the value stored at key.
+func (p *PebbleDB) merge(key Key, value Value) error {
+	typ, operand, err := decodeMergeValue(value)
+	if err != nil {
 		return err
 	}
-	return nil
+	v := Value{Bytes: operand, Timestamp: value.Timestamp}
+	return p.db.Merge(key, encodePebbleValue(byte(typ), v), pebble.Sync)
+}
+
+// del removes the item from the db with the given key.
+func (p *PebbleDB) del(key Key) error {
+	return p.db.Delete(key, pebble.Sync)
+}
+
+// capacity queries the underlying file system for disk capacity
+// information.
+func (p *PebbleDB) capacity() (StoreCapacity, error) {
+	var fs syscall.Statfs_t
+	var capacity StoreCapacity
+	if err := syscall.Statfs(p.dir, &fs); err != nil {
+		return capacity, err
+	}
+	capacity.Capacity = int64(fs.Bsize) * int64(fs.Blocks)
+	capacity.Available = int64(fs.Bsize) * int64(fs.Bavail)
+	capacity.DiskType = p.typ
+	return capacity, nil
 }
 
-func (d *PebbleDB) get(key string) (string, error) {
-	keyBytes := []byte(key)
-	value, _, err := d.db.Get(keyBytes)
-	return string(value), err
+// encodePebbleValue encodes the value as stored in Pebble: the kind
+// of value, either pebbleValueFull or a merge type, followed by the
+// timestamp, the expiration and the bytes of the value.
+func encodePebbleValue(kind byte, v Value) []byte {
+	b := make([]byte, pebbleValueHeaderSize, pebbleValueHeaderSize+len(v.Bytes))
+	b[0] = kind
+	binary.BigEndian.PutUint64(b[1:], uint64(v.Timestamp.WallTime))
+	binary.BigEndian.PutUint32(b[9:], uint32(v.Timestamp.Logical))
+	binary.BigEndian.PutUint64(b[13:], uint64(v.Expiration))
+	return append(b, v.Bytes...)
+}
+
+// decodePebbleValue decodes a value encoded by encodePebbleValue. The
+// bytes of the returned value are a copy.
+func decodePebbleValue(b []byte) (byte, Value, error) {
+	if len(b) < pebbleValueHeaderSize {
+		return 0, Value{}, util.Errorf("stored value of %d bytes is too short", len(b))
+	}
+	v := Value{
+		Bytes:      append([]byte(nil), b[pebbleValueHeaderSize:]...),
+		Expiration: int64(binary.BigEndian.Uint64(b[13:])),
+	}
+	v.Timestamp.WallTime = int64(binary.BigEndian.Uint64(b[1:]))
+	v.Timestamp.Logical = int32(binary.BigEndian.Uint32(b[9:]))
+	return b[0], v, nil
 }
 
-func NewPebbleDB(dir string) (*PebbleDB, error) {
-	pdb, err := pebble.Open("demo", &pebble.Options{})
+// decodePebbleFullValue decodes the value stored at key. Merge
+// operands without a base value are merged into an empty value.
+func decodePebbleFullValue(key Key, b []byte) (Value, error) {
+	kind, v, err := decodePebbleValue(b)
+	if err != nil || kind == pebbleValueFull {
+		return v, err
+	}
+	v.Bytes, err = applyMerge(key, mergeType(kind), nil, v.Bytes)
+	return v, err
+}
+
+// pebbleValueMerger combines a stored value and the merge operands
+// written after it, or a run of merge operands, in the manner of
+// mergeValue.
+type pebbleValueMerger struct {
+	key   Key
+	kind  byte
+	value Value
+}
+
+// MergeNewer implements the pebble.ValueMerger interface.
+func (m *pebbleValueMerger) MergeNewer(b []byte) error {
+	kind, v, err := decodePebbleValue(b)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	r := &PebbleDB{
-		db: pdb,
+	m.kind, m.value, err = combinePebbleValues(m.key, m.kind, m.value, kind, v)
+	return err
+}
+
+// MergeOlder implements the pebble.ValueMerger interface.
+func (m *pebbleValueMerger) MergeOlder(b []byte) error {
+	kind, v, err := decodePebbleValue(b)
+	if err != nil {
+		return err
+	}
+	m.kind, m.value, err = combinePebbleValues(m.key, kind, v, m.kind, m.value)
+	return err
+}
+
+// Finish implements the pebble.ValueMerger interface. If the base of
+// the merge is included, operands are merged into an empty value.
+func (m *pebbleValueMerger) Finish(includesBase bool) ([]byte, io.Closer, error) {
+	if includesBase && m.kind != pebbleValueFull {
+		b, err := applyMerge(m.key, mergeType(m.kind), nil, m.value.Bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		m.kind, m.value.Bytes = pebbleValueFull, b
 	}
-	return r, err
+	return encodePebbleValue(m.kind, m.value), nil, nil
 }
 
+// combinePebbleValues merges the newer merge operand into the older
+// value or merge operand. Operands of different merge types can't be
+// combined.
+func combinePebbleValues(key Key, olderKind byte, older Value, newerKind byte, newer Value) (byte, Value, error) {
+	if newerKind == pebbleValueFull {
+		return newerKind, newer, nil
+	}
+	if olderKind != pebbleValueFull && olderKind != newerKind {
+		return 0, Value{}, util.Errorf("key %q cannot be merged; merge type %d differs from %d", key, newerKind, olderKind)
+	}
+	b, err := applyMerge(key, mergeType(newerKind), older.Bytes, newer.Bytes)
+	if err != nil {
+		return 0, Value{}, err
+	}
+	return olderKind, Value{Bytes: b, Timestamp: newer.Timestamp, Expiration: older.Expiration}, nil
+}
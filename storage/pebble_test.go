@@ -1,19 +1,83 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
 package storage
 
 import (
-	"log"
-	"strings"
+	"bytes"
+	"io/ioutil"
+	"os"
 	"testing"
+
+	"gossipgo/util/hlc"
 )
 
-func TestPebbleDBSetAndGet(t *testing.T) {
-	db, err := NewPebbleDB("demo")
-	if (err != nil) {
-		log.Fatalf("error creating database %q", err)
-	}
-	db.Put("testKey", "testValue")
-	value, _ := db.get("testKey")
-	if !strings.Contains(value, "testValue") {
-		t.Errorf("expected body to contain %q, got %q", "testValue", value)
+// TestPebbleDBPutGetDelete verifies that values, including their
+// timestamps and merged values, are stored and survive reopening the
+// database.
+func TestPebbleDBPutGetDelete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pebble")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := NewPebbleDB(HDD, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := Value{Bytes: []byte("woof"), Timestamp: hlc.Timestamp{WallTime: 5, Logical: 1}, Expiration: 10}
+	if err := db.put(Key("dog"), value); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.put(Key("cat"), Value{Bytes: []byte("meow")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := increment(db, Key("counter"), 3, hlc.Timestamp{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if db, err = NewPebbleDB(HDD, dir); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if val, err := db.get(Key("dog")); err != nil || !bytes.Equal(val.Bytes, value.Bytes) ||
+		val.Timestamp != value.Timestamp || val.Expiration != value.Expiration {
+		t.Errorf("expected %+v after reopening; got %+v, %v", value, val, err)
+	}
+	if val, err := increment(db, Key("counter"), 4, hlc.Timestamp{}); err != nil || val != 7 {
+		t.Errorf("expected counter to be incremented to 7 after reopening; got %d, %v", val, err)
+	}
+	if err := db.del(Key("dog")); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := db.get(Key("dog")); err != nil || val.Bytes != nil {
+		t.Errorf("expected deleted value to be empty; got %+v, %v", val, err)
+	}
+	kvs, err := db.scan(KeyMin, KeyMax, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != 2 || string(kvs[0].Key) != "cat" || string(kvs[1].Key) != "counter" {
+		t.Errorf("expected scan to return cat and counter; got %+v", kvs)
+	}
+	if c, err := db.capacity(); err != nil || c.DiskType != HDD || c.Capacity == 0 {
+		t.Errorf("unexpected capacity %+v, %v", c, err)
 	}
 }
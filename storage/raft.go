@@ -18,6 +18,8 @@
 
 package storage
 
+import "context"
+
 // A LogEntry provides serialization of a read/write command. Once
 // committed to the log, the command is executed and the result
 // returned via the done channel.
@@ -26,5 +28,6 @@ type LogEntry struct {
 	Args   interface{}
 	Reply  interface{}
 
-	done chan error // Used to signal waiting RPC handler
+	ctx  context.Context // Done if the waiting RPC handler gave up
+	done chan error      // Used to signal waiting RPC handler
 }
@@ -20,12 +20,16 @@ package storage
 import (
 	"bytes"
 	"container/list"
+	"context"
 	"encoding/gob"
 	"sync"
 	"time"
 
+	gogoproto "github.com/gogo/protobuf/proto"
 	"gossipgo/gossip"
+	"gossipgo/proto"
 	"gossipgo/util"
+	"gossipgo/util/hlc"
 	"log"
 )
 
@@ -46,18 +50,22 @@ type RangeMetadata struct {
 // as appropriate.
 type Range struct {
 	Meta      RangeMetadata
+	clock     *hlc.Clock     // Hybrid logical clock of the node
 	engine    Engine         // The underlying key-value store
 	allocator *allocator     // Makes allocation decisions
 	gossip    *gossip.Gossip // Range may gossip based on contents
-	mu        sync.Mutex     // Protects the pending list
+	mu        sync.Mutex     // Protects the pending list and applying
 	pending   *list.List     // Not-yet-proposed log entries
+	applying  bool           // True while a goroutine applies pending entries
+	cmdMu     sync.RWMutex   // Serializes read-write commands with reads
 	// TODO(andybons): raft instance goes here.
 }
 
 // NewRange initializes the range starting at key.
-func NewRange(meta RangeMetadata, engine Engine, allocator *allocator, gossip *gossip.Gossip) *Range {
+func NewRange(meta RangeMetadata, clock *hlc.Clock, engine Engine, allocator *allocator, gossip *gossip.Gossip) *Range {
 	r := &Range{
 		Meta:      meta,
+		clock:     clock,
 		engine:    engine,
 		allocator: allocator,
 		gossip:    gossip,
@@ -80,11 +88,16 @@ func NewRange(meta RangeMetadata, engine Engine, allocator *allocator, gossip *g
 // is updated on each participant. If this replica has stale info for
 // the key, an error is returned to the client to retry at the replica
 // with newer information.
-func (r *Range) ReadOnlyCmd(method string, args, reply interface{}) error {
+//
+// The command isn't executed if ctx is done by the time it acquires
+// the range.
+func (r *Range) ReadOnlyCmd(ctx context.Context, method string, args, reply interface{}) error {
 	if r == nil {
 		return util.Errorf("invalid node specification")
 	}
-	return nil
+	r.cmdMu.RLock()
+	defer r.cmdMu.RUnlock()
+	return r.executeCmd(ctx, method, args, reply)
 }
 
 // ReadWriteCmd executes a read-write command against the store. If
@@ -97,27 +110,56 @@ func (r *Range) ReadOnlyCmd(method string, args, reply interface{}) error {
 // Commands which mutate the store must be proposed as part of the
 // raft consensus write protocol. Only after committed can the command
 // be executed. To facilitate this, ReadWriteCmd returns a channel
-// which is signaled upon completion.
-func (r *Range) ReadWriteCmd(method string, args, reply interface{}) <-chan error {
+// which is signaled upon completion. Commands are applied on a
+// goroutine of the range's, so callers may stop waiting on the channel
+// at any time; a command whose ctx is done before it's applied is
+// skipped, and the channel signaled with the context's error.
+func (r *Range) ReadWriteCmd(ctx context.Context, method string, args, reply interface{}) <-chan error {
 	if r == nil {
 		c := make(chan error, 1)
 		c <- util.Errorf("invalid node specification")
 		return c
 	}
-	r.mu.Lock()
-	defer r.mu.Unlock()
-
 	logEntry := &LogEntry{
+		ctx:    ctx,
 		Method: method,
 		Args:   args,
 		Reply:  reply,
 		done:   make(chan error, 1),
 	}
+	r.mu.Lock()
 	r.pending.PushBack(logEntry)
-
+	if !r.applying {
+		r.applying = true
+		go r.applyPending()
+	}
+	r.mu.Unlock()
 	return logEntry.done
 }
 
+// applyPending executes pending log entries in the order they were
+// proposed, signaling each entry's done channel with the result, and
+// returns once none remain. Only one goroutine applies entries at a
+// time. Until raft is in place, commands are considered committed as
+// soon as they're proposed.
+func (r *Range) applyPending() {
+	for {
+		r.mu.Lock()
+		e := r.pending.Front()
+		if e == nil {
+			r.applying = false
+			r.mu.Unlock()
+			return
+		}
+		logEntry := r.pending.Remove(e).(*LogEntry)
+		r.mu.Unlock()
+
+		r.cmdMu.Lock()
+		logEntry.done <- r.executeCmd(logEntry.ctx, logEntry.Method, logEntry.Args, logEntry.Reply)
+		r.cmdMu.Unlock()
+	}
+}
+
 // maybeGossip gossips in the event that this range has something
 // interesting to share and it's the leader of its consensus
 // group. For example, the range containing the start of the key space
@@ -139,18 +181,163 @@ func (r *Range) maybeGossip() {
 
 // executeCmd switches over the method and multiplexes to execute the
 // appropriate storage API command.
-func (r *Range) executeCmd(method string, args, reply interface{}) error {
+func (r *Range) executeCmd(ctx context.Context, method string, args, reply interface{}) error {
+	// Skip commands whose callers have stopped waiting for them.
+	if err := ctx.Err(); err != nil {
+		return util.Errorf("%s abandoned before executing: %s", method, err)
+	}
+	// Skip commands whose clients have already given up on them.
+	if header := args.(Request).Header(); header.Deadline != 0 && r.clock.PhysicalNow() > header.Deadline {
+		return util.Errorf("deadline exceeded before executing %s", method)
+	}
+	// Reject commands for keys this range doesn't hold; the client's
+	// range metadata is stale.
+	if err := r.checkKeys(args.(Request)); err != nil {
+		return err
+	}
+	// Update the node clock with the client's timestamp or, if none
+	// was supplied, execute the command at the current node time.
+	if header := args.(Request).Header(); header.Timestamp.IsEmpty() {
+		header.Timestamp = r.clock.Now()
+	} else {
+		r.clock.Update(header.Timestamp)
+	}
+	defer func() {
+		reply.(Response).Header().Timestamp = r.clock.Now()
+	}()
+
 	switch method {
+	case "Contains":
+		r.Contains(args.(*ContainsRequest), reply.(*ContainsResponse))
 	case "Get":
 		r.Get(args.(*GetRequest), reply.(*GetResponse))
 	case "Put":
 		r.Put(args.(*PutRequest), reply.(*PutResponse))
+	case "Increment":
+		r.Increment(args.(*IncrementRequest), reply.(*IncrementResponse))
+	case "Delete":
+		r.Delete(args.(*DeleteRequest), reply.(*DeleteResponse))
+	case "DeleteRange":
+		r.DeleteRange(args.(*DeleteRangeRequest), reply.(*DeleteRangeResponse))
+	case "Scan":
+		r.Scan(args.(*ScanRequest), reply.(*ScanResponse))
+	case "EndTransaction":
+		r.EndTransaction(args.(*EndTransactionRequest), reply.(*EndTransactionResponse))
+	case "AccumulateTS":
+		r.AccumulateTS(args.(*AccumulateTSRequest), reply.(*AccumulateTSResponse))
+	case "ReapQueue":
+		r.ReapQueue(args.(*ReapQueueRequest), reply.(*ReapQueueResponse))
+	case "EnqueueUpdate":
+		r.EnqueueUpdate(args.(*EnqueueUpdateRequest), reply.(*EnqueueUpdateResponse))
+	case "EnqueueMessage":
+		r.EnqueueMessage(args.(*EnqueueMessageRequest), reply.(*EnqueueMessageResponse))
+	case "InternalRangeLookup":
+		r.InternalRangeLookup(args.(*InternalRangeLookupRequest), reply.(*InternalRangeLookupResponse))
+	case "InternalMerge":
+		r.InternalMerge(args.(*InternalMergeRequest), reply.(*InternalMergeResponse))
+	case "Batch":
+		r.Batch(ctx, args.(*BatchRequest), reply.(*BatchResponse))
 	default:
 		return util.Errorf("unrecognized command type: %s", method)
 	}
 	return nil
 }
 
+// RangeStats holds the number of keys stored in a range and the
+// bytes occupied by their keys and values.
+type RangeStats struct {
+	KeyCount  int64
+	ByteCount int64
+}
+
+// statsScanBatchSize is the number of keys read per scan by Stats.
+const statsScanBatchSize = 1000
+
+// Stats computes the range's statistics by scanning its keys. The scan
+// isn't isolated from concurrent commands.
+//
+// TODO(spencer): maintain statistics incrementally as commands are
+// applied.
+func (r *Range) Stats() (RangeStats, error) {
+	var stats RangeStats
+	start := r.Meta.StartKey
+	for {
+		kvs, err := r.engine.scan(start, r.Meta.EndKey, statsScanBatchSize)
+		if err != nil {
+			return RangeStats{}, err
+		}
+		for _, kv := range kvs {
+			stats.KeyCount++
+			stats.ByteCount += int64(len(kv.Key) + len(kv.Value.Bytes))
+		}
+		if len(kvs) < statsScanBatchSize {
+			return stats, nil
+		}
+		start = MakeKey(kvs[len(kvs)-1].Key, Key{0})
+	}
+}
+
+// ContainsKey returns whether this range contains the specified key.
+func (r *Range) ContainsKey(key Key) bool {
+	return bytes.Compare(key, r.Meta.StartKey) >= 0 && bytes.Compare(key, r.Meta.EndKey) < 0
+}
+
+// checkKeys returns a RangeKeyMismatchError if the command, or any
+// command of a batch, is addressed to a key outside of this range.
+// Range lookups address metadata keys and are validated by
+// InternalRangeLookup.
+func (r *Range) checkKeys(args Request) error {
+	var keys []Key
+	switch t := args.(type) {
+	case *InternalRangeLookupRequest:
+		return nil
+	case *InternalMergeRequest:
+		keys = append(keys, t.Key)
+	case *BatchRequest:
+		for i := range t.Requests {
+			if t.Requests[i].GetValue() != nil {
+				keys = append(keys, t.Requests[i].Key())
+			}
+		}
+	default:
+		var ru RequestUnion
+		if ru.SetValue(args) {
+			keys = append(keys, ru.Key())
+		}
+	}
+	for _, key := range keys {
+		if !r.ContainsKey(key) {
+			return r.keyMismatchError(key, nil)
+		}
+	}
+	return nil
+}
+
+// keyMismatchError returns a RangeKeyMismatchError for the key range
+// [start, end), describing this range so the client can update its
+// range metadata.
+func (r *Range) keyMismatchError(start, end Key) error {
+	desc := toProtoDescriptor(r.Meta.StartKey, r.Meta.EndKey, r.Meta.Replicas.Replicas)
+	desc.RaftID = r.Meta.RangeID
+	return proto.NewRangeKeyMismatchError(proto.Key(start), proto.Key(end), desc)
+}
+
+// checkUncertainty returns a ReadWithinUncertaintyIntervalError if
+// the value read is later than the read timestamp but no later than
+// its MaxTimestamp. Such a value may have been written before the read
+// was sent by a node whose clock is ahead, so the read must be retried
+// at a later timestamp. Values above MaxTimestamp were certainly
+// written after the read was sent.
+func checkUncertainty(header *RequestHeader, val Value) error {
+	if header.Timestamp.Less(val.Timestamp) && val.Timestamp.LessEq(header.MaxTimestamp) {
+		return &proto.ReadWithinUncertaintyIntervalError{
+			Timestamp:         ToProtoTimestamp(header.Timestamp),
+			ExistingTimestamp: ToProtoTimestamp(val.Timestamp),
+		}
+	}
+	return nil
+}
+
 // Contains verifies the existence of a key in the key value store.
 func (r *Range) Contains(args *ContainsRequest, reply *ContainsResponse) {
 	val, err := r.engine.get(args.Key)
@@ -158,6 +345,10 @@ func (r *Range) Contains(args *ContainsRequest, reply *ContainsResponse) {
 		reply.Error = err
 		return
 	}
+	if err = checkUncertainty(&args.RequestHeader, val); err != nil {
+		reply.Error = err
+		return
+	}
 	if val.Bytes != nil {
 		reply.Exists = true
 	}
@@ -165,7 +356,15 @@ func (r *Range) Contains(args *ContainsRequest, reply *ContainsResponse) {
 
 // Get returns the value for a specified key.
 func (r *Range) Get(args *GetRequest, reply *GetResponse) {
-	reply.Value, reply.Error = r.engine.get(args.Key)
+	val, err := r.engine.get(args.Key)
+	if err == nil {
+		err = checkUncertainty(&args.RequestHeader, val)
+	}
+	if err != nil {
+		reply.Error = err
+		return
+	}
+	reply.Value = val
 }
 
 // Put sets the value for a specified key. Conditional puts are supported.
@@ -179,29 +378,34 @@ func (r *Range) Put(args *PutRequest, reply *PutResponse) {
 			return
 		}
 		if args.ExpValue.Bytes == nil && val.Bytes != nil {
+			reply.ActualValue = &Value{Bytes: val.Bytes}
 			reply.Error = util.Errorf("key %q already exists", args.Key)
 			return
-		} else if args.ExpValue != nil {
+		} else if args.ExpValue.Bytes != nil {
 			// Handle check for existence when there is no key.
 			if val.Bytes == nil {
 				reply.Error = util.Errorf("key %q does not exist", args.Key)
 				return
 			} else if !bytes.Equal(args.ExpValue.Bytes, val.Bytes) {
-				reply.ActualValue.Bytes = val.Bytes
+				reply.ActualValue = &Value{Bytes: val.Bytes}
 				reply.Error = util.Errorf("key %q does not match existing", args.Key)
 				return
 			}
 		}
 	}
+	// Stamp the value with the command's timestamp if not specified.
+	if args.Value.Timestamp.IsEmpty() {
+		args.Value.Timestamp = args.Timestamp
+	}
 	if err := r.engine.put(args.Key, args.Value); err != nil {
 		reply.Error = err
 		return
 	}
 }
 
-// Increment increments the value (interpreted as varint64 encoded) and
-// returns the newly incremented value (encoded as varint64). If no
-// value exists for the key, zero is incremented.
+// Increment increments the value (interpreted as varint64 encoded) by
+// merging the increment into it, and returns the newly incremented
+// value. If no value exists for the key, zero is incremented.
 func (r *Range) Increment(args *IncrementRequest, reply *IncrementResponse) {
 	reply.NewValue, reply.Error = increment(r.engine, args.Key, args.Increment, args.Timestamp)
 }
@@ -223,7 +427,18 @@ func (r *Range) DeleteRange(args *DeleteRangeRequest, reply *DeleteRangeResponse
 // to some maximum number of results. The last key of the iteration is
 // returned with the reply.
 func (r *Range) Scan(args *ScanRequest, reply *ScanResponse) {
-	reply.Rows, reply.Error = r.engine.scan(args.StartKey, args.EndKey, args.MaxResults)
+	rows, err := r.engine.scan(args.StartKey, args.EndKey, args.MaxResults)
+	if err != nil {
+		reply.Error = err
+		return
+	}
+	for _, row := range rows {
+		if err = checkUncertainty(&args.RequestHeader, row.Value); err != nil {
+			reply.Error = err
+			return
+		}
+	}
+	reply.Rows = rows
 }
 
 // EndTransaction either commits or aborts (rolls back) an extant
@@ -238,6 +453,22 @@ func (r *Range) AccumulateTS(args *AccumulateTSRequest, reply *AccumulateTSRespo
 	reply.Error = util.Error("unimplemented")
 }
 
+// InternalMerge merges args.Value into the value stored at args.Key.
+// Merges are not transactional; they're used internally to
+// accumulate time series samples without a read by the client.
+func (r *Range) InternalMerge(args *InternalMergeRequest, reply *InternalMergeResponse) {
+	if args.Value.Timestamp.IsEmpty() {
+		args.Value.Timestamp = args.Timestamp
+	}
+	// Engines may merge lazily, so invalid values are rejected before
+	// they're stored.
+	if err := gogoproto.Unmarshal(args.Value.Bytes, &proto.InternalTimeSeriesData{}); err != nil {
+		reply.Error = util.Errorf("merge value for key %q is not time series data: %s", args.Key, err)
+		return
+	}
+	reply.Error = r.engine.merge(args.Key, newMergeValue(mergeTimeSeries, args.Value.Bytes, args.Value.Timestamp))
+}
+
 // ReapQueue destructively queries messages from a delivery inbox
 // queue. This method must be called from within a transaction.
 func (r *Range) ReapQueue(args *ReapQueueRequest, reply *ReapQueueResponse) {
@@ -259,6 +490,113 @@ func (r *Range) EnqueueMessage(args *EnqueueMessageRequest, reply *EnqueueMessag
 	reply.Error = util.Error("unimplemented")
 }
 
+// Batch executes the commands contained in the batch in order as a
+// single, atomic update to the range. The batch is aborted on the
+// first command which fails: writes made by earlier commands are
+// rolled back and later commands are not executed. In that case,
+// every response in the batch carries an error and the first error
+// is set in the batch response header. A batch whose ctx is done
+// between commands is aborted the same way.
+func (r *Range) Batch(ctx context.Context, args *BatchRequest, reply *BatchResponse) {
+	var undo []KeyValue // Prior values of keys the batch may have written
+	for i := range args.Requests {
+		cmdArgs := args.Requests[i].GetValue()
+		if cmdArgs == nil {
+			r.abortBatch(args, reply, util.Errorf("empty request at index %d in batch", i), undo)
+			return
+		}
+		method, err := MethodForRequest(cmdArgs)
+		if err != nil {
+			r.abortBatch(args, reply, err, undo)
+			return
+		}
+		// Commands inherit the batch timestamp.
+		if header := cmdArgs.Header(); header.Timestamp.IsEmpty() {
+			header.Timestamp = args.Timestamp
+			header.MaxTimestamp = args.MaxTimestamp
+		}
+		cmdReply, err := CreateReply(method)
+		if err != nil {
+			r.abortBatch(args, reply, err, undo)
+			return
+		}
+		prior, err := r.priorValues(cmdArgs)
+		if err != nil {
+			r.abortBatch(args, reply, err, undo)
+			return
+		}
+		undo = append(undo, prior...)
+		if err = r.executeCmd(ctx, method, cmdArgs, cmdReply); err == nil {
+			err = cmdReply.Header().Error
+		}
+		reply.Add(cmdReply)
+		if err != nil {
+			r.abortBatch(args, reply, err, undo)
+			return
+		}
+	}
+}
+
+// abortBatch rolls back the writes recorded in undo, in reverse order,
+// and fills in an error response for each command in the batch which
+// doesn't yet carry an error of its own.
+func (r *Range) abortBatch(args *BatchRequest, reply *BatchResponse, err error, undo []KeyValue) {
+	for i := len(undo) - 1; i >= 0; i-- {
+		var rbErr error
+		if len(undo[i].Value.Bytes) == 0 {
+			rbErr = r.engine.del(undo[i].Key)
+		} else {
+			rbErr = r.engine.put(undo[i].Key, undo[i].Value)
+		}
+		if rbErr != nil {
+			log.Printf("failed to roll back batch write to key %q: %v", undo[i].Key, rbErr)
+		}
+	}
+	abortErr := util.Errorf("batch aborted: %v", err)
+	for i := range args.Requests {
+		if i < len(reply.Responses) {
+			if header := reply.Responses[i].GetValue().Header(); header.Error == nil {
+				header.Error = abortErr
+			}
+			continue
+		}
+		method, mErr := MethodForRequest(args.Requests[i].GetValue())
+		if mErr != nil {
+			method = "Get" // Placeholder response for an empty union.
+		}
+		cmdReply, _ := CreateReply(method)
+		cmdReply.Header().Error = abortErr
+		reply.Add(cmdReply)
+	}
+	reply.Error = err
+}
+
+// priorValues returns the current values of the keys which the
+// specified command may write, for rolling back a failed batch. A
+// missing key has an empty value. Conditional puts are PutRequests and
+// are covered whether or not they succeed. Commands which don't write,
+// including those which aren't yet implemented, return nil.
+func (r *Range) priorValues(args Request) ([]KeyValue, error) {
+	var key Key
+	switch t := args.(type) {
+	case *PutRequest:
+		key = t.Key
+	case *IncrementRequest:
+		key = t.Key
+	case *DeleteRequest:
+		key = t.Key
+	case *InternalMergeRequest:
+		key = t.Key
+	default:
+		return nil, nil
+	}
+	val, err := r.engine.get(key)
+	if err != nil {
+		return nil, err
+	}
+	return []KeyValue{{Key: key, Value: val}}, nil
+}
+
 // InternalRangeLookup looks up the metadata info for the given args.Key.
 // args.Key should be a metadata key, which are of the form "\0\0meta[12]<encoded_key>".
 func (r *Range) InternalRangeLookup(args *InternalRangeLookupRequest, reply *InternalRangeLookupResponse) {
@@ -271,7 +609,7 @@ func (r *Range) InternalRangeLookup(args *InternalRangeLookupRequest, reply *Int
 	// the end keys of the range the metadata represent, the check args.Key >= r.Meta.StartKey
 	// may result in false negatives.
 	if bytes.Compare(args.Key, r.Meta.EndKey) >= 0 {
-		reply.Error = util.Errorf("Key outside the range %v with end key %q", r.Meta.RangeID, r.Meta.EndKey)
+		reply.Error = r.keyMismatchError(args.Key, nil)
 		return
 	}
 
@@ -289,7 +627,7 @@ func (r *Range) InternalRangeLookup(args *InternalRangeLookupRequest, reply *Int
 		return
 	}
 
-	if err = gob.NewDecoder(bytes.NewBuffer(kvs[0].Value.Bytes)).Decode(reply.Locations); err != nil {
+	if err = gob.NewDecoder(bytes.NewBuffer(kvs[0].Value.Bytes)).Decode(&reply.Locations); err != nil {
 		reply.Error = err
 		return
 	}
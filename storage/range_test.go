@@ -0,0 +1,456 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	gogoproto "github.com/gogo/protobuf/proto"
+	"gossipgo/proto"
+	"gossipgo/util/hlc"
+)
+
+// createTestRangeWithClock creates a range spanning all keys on a new
+// in-memory store using the supplied clock.
+func createTestRangeWithClock(t *testing.T, clock *hlc.Clock) (*Range, Engine) {
+	engine := NewInMem(1 << 20)
+	store := NewStore(clock, engine, nil)
+	if err := store.Bootstrap(testIdent); err != nil {
+		t.Fatalf("error bootstrapping store: %v", err)
+	}
+	rng, err := store.CreateRange(KeyMin, KeyMax)
+	if err != nil {
+		t.Fatalf("failure to create first range: %v", err)
+	}
+	return rng, engine
+}
+
+// createTestRange creates a range spanning all keys on a new in-memory
+// store.
+func createTestRange(t *testing.T) (*Range, Engine) {
+	return createTestRangeWithClock(t, hlc.NewClock(hlc.UnixNano, 0))
+}
+
+// TestRangeUpdatesClock verifies that a range forwards its clock to
+// the timestamp of incoming requests, stamps written values with the
+// request timestamp and replies with its own clock time.
+func TestRangeUpdatesClock(t *testing.T) {
+	manual := hlc.NewManualClock(1)
+	clock := hlc.NewClock(manual.UnixNano, 0)
+	rng, engine := createTestRangeWithClock(t, clock)
+
+	ts := hlc.Timestamp{WallTime: 5, Logical: 3}
+	args := &PutRequest{
+		RequestHeader: RequestHeader{Timestamp: ts},
+		Key:           Key("a"),
+		Value:         Value{Bytes: []byte("value")},
+	}
+	reply := &PutResponse{}
+	if err := <-rng.ReadWriteCmd(context.Background(), "Put", args, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Error != nil {
+		t.Fatal(reply.Error)
+	}
+	if !ts.Less(reply.Timestamp) {
+		t.Errorf("expected reply timestamp %s to be later than request timestamp %s", reply.Timestamp, ts)
+	}
+	if now := clock.Now(); !ts.Less(now) {
+		t.Errorf("expected clock %s to be forwarded past request timestamp %s", now, ts)
+	}
+	val, err := engine.get(Key("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val.Timestamp != ts {
+		t.Errorf("expected value timestamp %s; got %s", ts, val.Timestamp)
+	}
+}
+
+// TestRangeUncertaintyInterval verifies that reads of values with
+// timestamps within the uncertainty interval of the read fail with
+// ReadWithinUncertaintyIntervalError.
+func TestRangeUncertaintyInterval(t *testing.T) {
+	rng, engine := createTestRange(t)
+	valTS := hlc.Timestamp{WallTime: 10}
+	if err := engine.put(Key("a"), Value{Bytes: []byte("value"), Timestamp: valTS}); err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		ts, maxTS    hlc.Timestamp
+		expUncertain bool
+	}{
+		// Value is later than read but within uncertainty interval.
+		{hlc.Timestamp{WallTime: 5}, hlc.Timestamp{WallTime: 20}, true},
+		{hlc.Timestamp{WallTime: 5}, valTS, true},
+		// Value is later than uncertainty interval.
+		{hlc.Timestamp{WallTime: 5}, hlc.Timestamp{WallTime: 8}, false},
+		// Value precedes read.
+		{valTS, hlc.Timestamp{WallTime: 20}, false},
+		{hlc.Timestamp{WallTime: 15}, hlc.Timestamp{WallTime: 20}, false},
+	}
+	for i, test := range testCases {
+		header := RequestHeader{Timestamp: test.ts, MaxTimestamp: test.maxTS}
+		getReply := &GetResponse{}
+		if err := rng.ReadOnlyCmd(context.Background(), "Get", &GetRequest{RequestHeader: header, Key: Key("a")}, getReply); err != nil {
+			t.Fatal(err)
+		}
+		scanReply := &ScanResponse{}
+		if err := rng.ReadOnlyCmd(context.Background(), "Scan", &ScanRequest{RequestHeader: header, StartKey: KeyMin, EndKey: KeyMax, MaxResults: 10}, scanReply); err != nil {
+			t.Fatal(err)
+		}
+		for _, err := range []error{getReply.Error, scanReply.Error} {
+			uErr, ok := err.(*proto.ReadWithinUncertaintyIntervalError)
+			if ok != test.expUncertain {
+				t.Errorf("%d: expected uncertain=%t; got %v", i, test.expUncertain, err)
+			} else if ok && FromProtoTimestamp(uErr.ExistingTimestamp) != valTS {
+				t.Errorf("%d: expected existing timestamp %s; got %+v", i, valTS, uErr.ExistingTimestamp)
+			}
+		}
+		if !test.expUncertain && !bytes.Equal(getReply.Value.Bytes, []byte("value")) {
+			t.Errorf("%d: expected value; got %q", i, getReply.Value.Bytes)
+		}
+	}
+}
+
+// TestRangeBatch verifies that a batch executes each of its commands
+// in order and returns their responses in request order.
+func TestRangeBatch(t *testing.T) {
+	rng, _ := createTestRange(t)
+	args := &BatchRequest{}
+	args.Add(&PutRequest{Key: Key("a"), Value: Value{Bytes: []byte("value")}})
+	args.Add(&IncrementRequest{Key: Key("b"), Increment: 5})
+	args.Add(&GetRequest{Key: Key("a")})
+	args.Add(&IncrementRequest{Key: Key("b"), Increment: 2})
+	reply := &BatchResponse{}
+	if err := <-rng.ReadWriteCmd(context.Background(), "Batch", args, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Error != nil {
+		t.Fatalf("unexpected batch error: %v", reply.Error)
+	}
+	if len(reply.Responses) != len(args.Requests) {
+		t.Fatalf("expected %d responses; got %d", len(args.Requests), len(reply.Responses))
+	}
+	if getReply := reply.Responses[2].Get; getReply == nil || !bytes.Equal(getReply.Value.Bytes, []byte("value")) {
+		t.Errorf("expected get of \"a\" to return \"value\"; got %+v", getReply)
+	}
+	if incReply := reply.Responses[3].Increment; incReply == nil || incReply.NewValue != 7 {
+		t.Errorf("expected second increment to return 7; got %+v", incReply)
+	}
+}
+
+// TestRangeBatchRollback verifies that a failed command aborts the
+// batch, rolling back the writes of earlier commands and skipping
+// later ones.
+func TestRangeBatchRollback(t *testing.T) {
+	rng, engine := createTestRange(t)
+	if err := engine.put(Key("a"), Value{Bytes: []byte("orig")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := engine.put(Key("c"), Value{Bytes: []byte{0xff}}); err != nil {
+		t.Fatal(err)
+	}
+	args := &BatchRequest{}
+	args.Add(&PutRequest{Key: Key("a"), Value: Value{Bytes: []byte("new")}})
+	args.Add(&PutRequest{Key: Key("b"), Value: Value{Bytes: []byte("new")}})
+	args.Add(&IncrementRequest{Key: Key("c"), Increment: 1})
+	args.Add(&PutRequest{Key: Key("d"), Value: Value{Bytes: []byte("new")}})
+	reply := &BatchResponse{}
+	if err := <-rng.ReadWriteCmd(context.Background(), "Batch", args, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Error == nil {
+		t.Fatal("expected batch to fail on increment of non-integer value")
+	}
+	if len(reply.Responses) != len(args.Requests) {
+		t.Fatalf("expected %d responses; got %d", len(args.Requests), len(reply.Responses))
+	}
+	for i := range reply.Responses {
+		if reply.Responses[i].GetValue().Header().Error == nil {
+			t.Errorf("expected error for command %d", i)
+		}
+	}
+	expValues := map[string][]byte{"a": []byte("orig"), "b": nil, "d": nil}
+	for key, exp := range expValues {
+		val, err := engine.get(Key(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(val.Bytes, exp) {
+			t.Errorf("expected key %q to have value %q after rollback; got %q", key, exp, val.Bytes)
+		}
+	}
+}
+
+// TestRangeInternalMerge verifies that merged time series samples
+// with the same offset are accumulated and that time series with a
+// different start or sample duration can't be merged.
+func TestRangeInternalMerge(t *testing.T) {
+	rng, engine := createTestRange(t)
+	merges := []*proto.InternalTimeSeriesData{
+		{
+			StartTimestampNanos: 100,
+			SampleDurationNanos: 10,
+			Samples: []*proto.InternalTimeSeriesSample{
+				{Offset: 3, IntCount: 1, IntSum: gogoproto.Int64(5)},
+				{Offset: 1, FloatCount: 1, FloatSum: gogoproto.Float32(1.5)},
+			},
+		},
+		{
+			StartTimestampNanos: 100,
+			SampleDurationNanos: 10,
+			Samples: []*proto.InternalTimeSeriesSample{
+				{Offset: 3, IntCount: 1, IntSum: gogoproto.Int64(-2)},
+				{Offset: 3, IntCount: 2, IntSum: gogoproto.Int64(20), IntMax: gogoproto.Int64(12), IntMin: gogoproto.Int64(8)},
+				{Offset: 1, FloatCount: 1, FloatSum: gogoproto.Float32(2.5)},
+			},
+		},
+	}
+	for _, data := range merges {
+		b, err := gogoproto.Marshal(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		args := &InternalMergeRequest{Key: Key("a"), Value: Value{Bytes: b}}
+		reply := &InternalMergeResponse{}
+		if err := <-rng.ReadWriteCmd(context.Background(), "InternalMerge", args, reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply.Error != nil {
+			t.Fatal(reply.Error)
+		}
+	}
+	expected := &proto.InternalTimeSeriesData{
+		StartTimestampNanos: 100,
+		SampleDurationNanos: 10,
+		Samples: []*proto.InternalTimeSeriesSample{
+			{
+				Offset:     1,
+				FloatCount: 2,
+				FloatSum:   gogoproto.Float32(4),
+				FloatMax:   gogoproto.Float32(2.5),
+				FloatMin:   gogoproto.Float32(1.5),
+			},
+			{
+				Offset:   3,
+				IntCount: 4,
+				IntSum:   gogoproto.Int64(23),
+				IntMax:   gogoproto.Int64(12),
+				IntMin:   gogoproto.Int64(-2),
+			},
+		},
+	}
+	val, err := engine.get(Key("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged := &proto.InternalTimeSeriesData{}
+	if err := gogoproto.Unmarshal(val.Bytes, merged); err != nil {
+		t.Fatal(err)
+	}
+	if !gogoproto.Equal(merged, expected) {
+		t.Errorf("expected merged time series %v; got %v", expected, merged)
+	}
+
+	// A mismatched sample duration can't be merged.
+	b, err := gogoproto.Marshal(&proto.InternalTimeSeriesData{StartTimestampNanos: 100, SampleDurationNanos: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := &InternalMergeRequest{Key: Key("a"), Value: Value{Bytes: b}}
+	reply := &InternalMergeResponse{}
+	if err := <-rng.ReadWriteCmd(context.Background(), "InternalMerge", args, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Error == nil {
+		t.Error("expected error merging time series with a different sample duration")
+	}
+}
+
+// TestRangeSkipsExpiredCommands verifies that commands whose deadline
+// has passed aren't executed.
+func TestRangeSkipsExpiredCommands(t *testing.T) {
+	manual := hlc.NewManualClock(10)
+	rng, engine := createTestRangeWithClock(t, hlc.NewClock(manual.UnixNano, 0))
+
+	args := &PutRequest{
+		RequestHeader: RequestHeader{Deadline: 5},
+		Key:           Key("a"),
+		Value:         Value{Bytes: []byte("value")},
+	}
+	if err := <-rng.ReadWriteCmd(context.Background(), "Put", args, &PutResponse{}); err == nil {
+		t.Error("expected error executing command past its deadline")
+	}
+	if val, err := engine.get(Key("a")); err != nil || val.Bytes != nil {
+		t.Errorf("expected expired put to be skipped; got %q, %v", val.Bytes, err)
+	}
+
+	args.Deadline = 20
+	if err := <-rng.ReadWriteCmd(context.Background(), "Put", args, &PutResponse{}); err != nil {
+		t.Errorf("unexpected error before deadline: %v", err)
+	}
+}
+
+// TestRangeKeyMismatch verifies that commands, including commands
+// within a batch, addressed to keys outside of the range fail with a
+// RangeKeyMismatchError describing the range.
+func TestRangeKeyMismatch(t *testing.T) {
+	engine := NewInMem(1 << 20)
+	store := NewStore(hlc.NewClock(hlc.UnixNano, 0), engine, nil)
+	if err := store.Bootstrap(testIdent); err != nil {
+		t.Fatal(err)
+	}
+	rng, err := store.CreateRange(Key("a"), Key("c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rng.ReadOnlyCmd(context.Background(), "Get", &GetRequest{Key: Key("b")}, &GetResponse{}); err != nil {
+		t.Errorf("expected success for key within range; got %v", err)
+	}
+	batch := &BatchRequest{}
+	batch.Add(&GetRequest{Key: Key("b")})
+	batch.Add(&GetRequest{Key: Key("c")})
+	for _, cmd := range []struct {
+		method string
+		args   Request
+	}{
+		{"Get", &GetRequest{Key: Key("c")}},
+		{"Get", &GetRequest{Key: KeyMin}},
+		{"Batch", batch},
+	} {
+		reply, _ := CreateReply(cmd.method)
+		err := rng.ReadOnlyCmd(context.Background(), cmd.method, cmd.args, reply)
+		mErr, ok := err.(*proto.RangeKeyMismatchError)
+		if !ok {
+			t.Errorf("%s: expected RangeKeyMismatchError; got %v", cmd.method, err)
+			continue
+		}
+		if !bytes.Equal(mErr.Range.StartKey, Key("a")) || !bytes.Equal(mErr.Range.EndKey, Key("c")) {
+			t.Errorf("%s: expected error to describe range [a, c); got %+v", cmd.method, mErr.Range)
+		}
+		if !mErr.CanRetry() {
+			t.Errorf("%s: expected error to be retryable", cmd.method)
+		}
+	}
+}
+
+// TestRangeBatchRollbackConditionalPut verifies that a conditional put
+// is undone when a later command in its batch fails.
+func TestRangeBatchRollbackConditionalPut(t *testing.T) {
+	rng, engine := createTestRange(t)
+	if err := engine.put(Key("a"), Value{Bytes: []byte("orig")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := engine.put(Key("c"), Value{Bytes: []byte{0xff}}); err != nil {
+		t.Fatal(err)
+	}
+	args := &BatchRequest{}
+	args.Add(&PutRequest{Key: Key("a"), Value: Value{Bytes: []byte("new")}, ExpValue: &Value{Bytes: []byte("orig")}})
+	args.Add(&PutRequest{Key: Key("b"), Value: Value{Bytes: []byte("new")}, ExpValue: &Value{}})
+	args.Add(&IncrementRequest{Key: Key("c"), Increment: 1})
+	reply := &BatchResponse{}
+	if err := <-rng.ReadWriteCmd(context.Background(), "Batch", args, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Error == nil {
+		t.Fatal("expected batch to fail on increment of non-integer value")
+	}
+	expValues := map[string][]byte{"a": []byte("orig"), "b": nil}
+	for key, exp := range expValues {
+		val, err := engine.get(Key(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(val.Bytes, exp) {
+			t.Errorf("expected key %q to have value %q after rollback; got %q", key, exp, val.Bytes)
+		}
+	}
+}
+
+// TestRangeAbandonedWrite verifies that a caller can stop waiting for
+// a write held up behind another command, and that the write is
+// skipped once its deadline has expired.
+func TestRangeAbandonedWrite(t *testing.T) {
+	rng, engine := createTestRange(t)
+	// Hold the range as an in-flight write would.
+	rng.cmdMu.Lock()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	args := &BatchRequest{}
+	args.Add(&PutRequest{Key: Key("a"), Value: Value{Bytes: []byte("value")}})
+	done := rng.ReadWriteCmd(ctx, "Batch", args, &BatchResponse{})
+	select {
+	case err := <-done:
+		t.Fatalf("expected write to wait for the range; got %v", err)
+	case <-ctx.Done():
+	}
+	rng.cmdMu.Unlock()
+
+	if err := <-done; err == nil {
+		t.Error("expected error for write whose deadline expired")
+	}
+	if val, err := engine.get(Key("a")); err != nil || val.Bytes != nil {
+		t.Errorf("expected abandoned write to be skipped; got %q, %v", val.Bytes, err)
+	}
+}
+
+// TestRangeConditionalPut verifies that conditional puts succeed only
+// if the existing value matches the expected value, where an empty
+// expected value matches only a missing key.
+func TestRangeConditionalPut(t *testing.T) {
+	rng, _ := createTestRange(t)
+	testCases := []struct {
+		value, expValue string
+		expSuccess      bool
+		actualValue     string
+	}{
+		{"a", "b", false, ""},  // Key doesn't exist
+		{"a", "", true, ""},    // Key doesn't exist, as expected
+		{"b", "", false, "a"},  // Key exists
+		{"b", "c", false, "a"}, // Value doesn't match
+		{"b", "a", true, ""},
+	}
+	for i, test := range testCases {
+		args := &PutRequest{
+			Key:      Key("key"),
+			Value:    Value{Bytes: []byte(test.value)},
+			ExpValue: &Value{},
+		}
+		if test.expValue != "" {
+			args.ExpValue.Bytes = []byte(test.expValue)
+		}
+		reply := &PutResponse{}
+		if err := <-rng.ReadWriteCmd(context.Background(), "Put", args, reply); err != nil {
+			t.Fatal(err)
+		}
+		if success := reply.Error == nil; success != test.expSuccess {
+			t.Errorf("%d: expected success %t; got %v", i, test.expSuccess, reply.Error)
+		}
+		var actualValue string
+		if reply.ActualValue != nil {
+			actualValue = string(reply.ActualValue.Bytes)
+		}
+		if actualValue != test.actualValue {
+			t.Errorf("%d: expected actual value %q; got %q", i, test.actualValue, actualValue)
+		}
+	}
+}
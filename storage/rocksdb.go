@@ -60,6 +60,12 @@ func (r *RocksDB) scan(start, end Key, max int64) ([]KeyValue, error) {
 	return []KeyValue{}, util.Error("scan unimplemented")
 }
 
+// merge merges the operand encoded in value into the value stored at
+// key.
+func (r *RocksDB) merge(key Key, value Value) error {
+	return util.Error("merge unimplemented")
+}
+
 // del removes the item from the db with the given key.
 func (r *RocksDB) del(key Key) error {
 	return util.Error("del unimplemented")
@@ -18,12 +18,14 @@
 package storage
 
 import (
+	"sort"
 	"strconv"
 	"sync"
-	"time"
 
 	"gossipgo/gossip"
+	"gossipgo/proto"
 	"gossipgo/util"
+	"gossipgo/util/hlc"
 )
 
 // Constants for store-reserved keys. These keys are prefixed with
@@ -41,6 +43,9 @@ var (
 	// keyRangeMetadataPrefix is the prefix for keys storing range metadata.
 	// The value is a struct of type RangeMetadata.
 	keyRangeMetadataPrefix = Key("\x00\x00\x00range-")
+	// keyGossipInfos is the checkpoint of the node's gossip info store,
+	// written to the node's first store. See GossipStorage.
+	keyGossipInfos = Key("\x00\x00\x00gossip-infos")
 )
 
 // rangeKey creates a range key as the concatenation of the
@@ -62,16 +67,19 @@ type StoreIdent struct {
 // to one physical device.
 type Store struct {
 	Ident     StoreIdent
+	clock     *hlc.Clock       // Hybrid logical clock of the node
 	engine    Engine           // The underlying key-value store
 	allocator *allocator       // Makes allocation decisions
 	gossip    *gossip.Gossip   // Passed to new ranges
-	mu        sync.Mutex       // Protects the ranges map
+	mu        sync.Mutex       // Protects the ranges map and range ID allocation
 	ranges    map[int64]*Range // Map of ranges by range ID
 }
 
-// NewStore returns a new instance of a store.
-func NewStore(engine Engine, gossip *gossip.Gossip) *Store {
+// NewStore returns a new instance of a store. The clock is shared by
+// all stores on a node.
+func NewStore(clock *hlc.Clock, engine Engine, gossip *gossip.Gossip) *Store {
 	return &Store{
+		clock:     clock,
 		engine:    engine,
 		allocator: &allocator{},
 		gossip:    gossip,
@@ -95,7 +103,7 @@ func (s *Store) Init() error {
 	if err != nil {
 		return err
 	}
-	rng := NewRange(meta, s.engine, s.allocator, s.gossip)
+	rng := NewRange(meta, s.clock, s.engine, s.allocator, s.gossip)
 	s.ranges[meta.RangeID] = rng
 
 	return nil
@@ -114,21 +122,47 @@ func (s *Store) Bootstrap(ident StoreIdent) error {
 	} else if len(kvs) > 0 {
 		return util.Errorf("engine not empty on bootstrap; first key-value %q: %q", kvs[0].Key, kvs[0].Value)
 	}
-	return putI(s.engine, keyStoreIdent, s.Ident)
+	return putI(s.engine, keyStoreIdent, s.Ident, s.clock.Now())
 }
 
-// GetRange fetches a range by ID. Returns an error if no range is found.
+// GetRange fetches a range by ID. Returns a RangeNotFoundError if no
+// range is found.
 func (s *Store) GetRange(rangeID int64) (*Range, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	if rng, ok := s.ranges[rangeID]; ok {
 		return rng, nil
 	}
-	return nil, util.Errorf("range %d not found on store", rangeID)
+	return nil, proto.NewRangeNotFoundError(rangeID)
 }
 
+// GetRanges returns the store's ranges ordered by range ID.
+func (s *Store) GetRanges() []*Range {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ranges := make([]*Range, 0, len(s.ranges))
+	for _, rng := range s.ranges {
+		ranges = append(ranges, rng)
+	}
+	sort.Sort(rangesByID(ranges))
+	return ranges
+}
+
+// rangesByID implements sort.Interface, ordering ranges by range ID.
+type rangesByID []*Range
+
+func (r rangesByID) Len() int           { return len(r) }
+func (r rangesByID) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r rangesByID) Less(i, j int) bool { return r[i].Meta.RangeID < r[j].Meta.RangeID }
+
 // CreateRange allocates a new range ID and stores range metadata.
-// On success, returns the new range.
+// On success, returns the new range. The store's lock is held while
+// the range ID generator is incremented, since the increment isn't
+// atomic with reading back its new value.
 func (s *Store) CreateRange(startKey, endKey Key) (*Range, error) {
-	rangeID, err := increment(s.engine, keyRangeIDGenerator, 1, time.Now().UnixNano())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rangeID, err := increment(s.engine, keyRangeIDGenerator, 1, s.clock.Now())
 	if err != nil {
 		return nil, err
 	}
@@ -143,11 +177,11 @@ func (s *Store) CreateRange(startKey, endKey Key) (*Range, error) {
 		EndKey:   endKey,
 		Replicas: RangeLocations{StartKey: startKey},
 	}
-	err = putI(s.engine, rangeKey(rangeID), meta)
+	err = putI(s.engine, rangeKey(rangeID), meta, s.clock.Now())
 	if err != nil {
 		return nil, err
 	}
-	rng := NewRange(meta, s.engine, s.allocator, s.gossip)
+	rng := NewRange(meta, s.clock, s.engine, s.allocator, s.gossip)
 	s.ranges[rangeID] = rng
 	return rng, nil
 }
@@ -17,7 +17,13 @@
 
 package storage
 
-import "testing"
+import (
+	"sync"
+	"testing"
+
+	"gossipgo/proto"
+	"gossipgo/util/hlc"
+)
 
 var testIdent = StoreIdent{
 	ClusterID: "cluster",
@@ -29,7 +35,7 @@ var testIdent = StoreIdent{
 // bootstrap.
 func TestStoreInitAndBootstrap(t *testing.T) {
 	engine := NewInMem(1 << 20)
-	store := NewStore(engine, nil)
+	store := NewStore(hlc.NewClock(hlc.UnixNano, 0), engine, nil)
 
 	// Can't init as haven't bootstrapped.
 	if err := store.Init(); err == nil {
@@ -44,6 +50,8 @@ func TestStoreInitAndBootstrap(t *testing.T) {
 	// Try to get 1st range--non-existent.
 	if _, err := store.GetRange(1); err == nil {
 		t.Error("expected error fetching non-existent range")
+	} else if _, ok := err.(*proto.RangeNotFoundError); !ok {
+		t.Errorf("expected RangeNotFoundError; got %v", err)
 	}
 
 	// Create range and fetch.
@@ -55,7 +63,7 @@ func TestStoreInitAndBootstrap(t *testing.T) {
 	}
 
 	// Now, attempt to initialize a store with a now-bootstrapped engine.
-	store = NewStore(engine, nil)
+	store = NewStore(hlc.NewClock(hlc.UnixNano, 0), engine, nil)
 	if err := store.Init(); err != nil {
 		t.Errorf("failure initializing bootstrapped store: %v", err)
 	}
@@ -74,7 +82,7 @@ func TestBootstrapOfNonEmptyStore(t *testing.T) {
 	if err := engine.put(Key("foo"), Value{Bytes: []byte("bar")}); err != nil {
 		t.Errorf("failure putting key foo into engine: %v", err)
 	}
-	store := NewStore(engine, nil)
+	store := NewStore(hlc.NewClock(hlc.UnixNano, 0), engine, nil)
 
 	// Can't init as haven't bootstrapped.
 	if err := store.Init(); err == nil {
@@ -86,3 +94,39 @@ func TestBootstrapOfNonEmptyStore(t *testing.T) {
 		t.Error("expected bootstrap error on non-empty store")
 	}
 }
+
+// TestStoreCreateRangeConcurrently verifies that ranges created
+// concurrently are allocated distinct range IDs.
+func TestStoreCreateRangeConcurrently(t *testing.T) {
+	store := NewStore(hlc.NewClock(hlc.UnixNano, 0), NewInMem(1<<20), nil)
+	if err := store.Bootstrap(testIdent); err != nil {
+		t.Fatal(err)
+	}
+	const count = 20
+	ids := make(chan int64, count)
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rng, err := store.CreateRange(KeyMin, KeyMax)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			ids <- rng.Meta.RangeID
+		}()
+	}
+	wg.Wait()
+	close(ids)
+	seen := map[int64]bool{}
+	for id := range ids {
+		if seen[id] {
+			t.Errorf("range ID %d allocated twice", id)
+		}
+		seen[id] = true
+	}
+	if len(seen) != count {
+		t.Errorf("expected %d ranges; got %d", count, len(seen))
+	}
+}
@@ -0,0 +1,521 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package storage
+
+import (
+	gogoproto "github.com/gogo/protobuf/proto"
+	"gossipgo/proto"
+	"gossipgo/util"
+)
+
+// This file converts storage requests and responses to and from the
+// protobuf messages of the proto package, which are their wire
+// representation. Fields without a protobuf counterpart are dropped:
+// Value.Expiration, the TxID of headers, the Keys of an
+// EndTransactionRequest, the CommitTimestamp of an
+// EndTransactionResponse and the Update of an EnqueueUpdateRequest.
+// AccumulateTS has no wire representation.
+
+// diskTypeAttrs maps disk types to their replica attribute.
+var diskTypeAttrs = map[DiskType]string{
+	SSD: "ssd",
+	HDD: "hdd",
+	MEM: "mem",
+}
+
+// toProtoReplica converts a replica to its wire representation. The
+// disk type and datacenter are carried as attributes; the range ID is
+// carried separately, as the RaftID of the request header or range
+// descriptor.
+func toProtoReplica(r Replica) proto.Replica {
+	attrs := []string{diskTypeAttrs[r.DiskType]}
+	if r.Datacenter != "" {
+		attrs = append(attrs, r.Datacenter)
+	}
+	return proto.Replica{
+		NodeID:  r.NodeID,
+		StoreID: r.StoreID,
+		Attrs:   proto.Attributes{Attrs: attrs},
+	}
+}
+
+// FromProtoReplica converts the wire representation of a replica of
+// the specified range. Attributes which don't name a disk type are
+// taken to be the datacenter.
+func FromProtoReplica(r proto.Replica, rangeID int64) Replica {
+	replica := Replica{
+		NodeID:  r.NodeID,
+		StoreID: r.StoreID,
+		RangeID: rangeID,
+	}
+	for _, attr := range r.Attrs.Attrs {
+		found := false
+		for diskType, name := range diskTypeAttrs {
+			if attr == name {
+				replica.DiskType = diskType
+				found = true
+			}
+		}
+		if !found {
+			replica.Datacenter = attr
+		}
+	}
+	return replica
+}
+
+// toProtoDescriptor returns the wire representation of the range
+// spanning [startKey, endKey) with the specified replicas.
+func toProtoDescriptor(startKey, endKey Key, replicas []Replica) *proto.RangeDescriptor {
+	desc := &proto.RangeDescriptor{
+		StartKey: proto.Key(startKey),
+		EndKey:   proto.Key(endKey),
+	}
+	for _, replica := range replicas {
+		desc.RaftID = replica.RangeID
+		desc.Replicas = append(desc.Replicas, toProtoReplica(replica))
+	}
+	return desc
+}
+
+func toProtoValue(v Value) proto.Value {
+	pv := proto.Value{Bytes: v.Bytes}
+	if !v.Timestamp.IsEmpty() {
+		ts := ToProtoTimestamp(v.Timestamp)
+		pv.Timestamp = &ts
+	}
+	return pv
+}
+
+func fromProtoValue(pv proto.Value) Value {
+	v := Value{Bytes: pv.Bytes}
+	if pv.Timestamp != nil {
+		v.Timestamp = FromProtoTimestamp(*pv.Timestamp)
+	}
+	return v
+}
+
+// toProtoHeader converts a request header to its wire representation.
+// The keys addressed by the request are carried in the header.
+func toProtoHeader(h *RequestHeader, key, endKey Key) proto.RequestHeader {
+	return proto.RequestHeader{
+		Timestamp:    ToProtoTimestamp(h.Timestamp),
+		Key:          proto.Key(key),
+		EndKey:       proto.Key(endKey),
+		Replica:      toProtoReplica(h.Replica),
+		RaftID:       h.Replica.RangeID,
+		MaxTimestamp: ToProtoTimestamp(h.MaxTimestamp),
+		Deadline:     h.Deadline,
+	}
+}
+
+func fromProtoHeader(ph *proto.RequestHeader) RequestHeader {
+	return RequestHeader{
+		Timestamp:    FromProtoTimestamp(ph.Timestamp),
+		Replica:      FromProtoReplica(ph.Replica, ph.RaftID),
+		MaxTimestamp: FromProtoTimestamp(ph.MaxTimestamp),
+		Deadline:     ph.Deadline,
+	}
+}
+
+// ToProtoRequest converts a request to its wire representation.
+// Returns the name of the method which serves the converted request;
+// a conditional put is served by ConditionalPut.
+func ToProtoRequest(args Request) (string, proto.Request, error) {
+	switch t := args.(type) {
+	case *ContainsRequest:
+		return proto.Contains, &proto.ContainsRequest{
+			RequestHeader: toProtoHeader(&t.RequestHeader, t.Key, nil),
+		}, nil
+	case *GetRequest:
+		return proto.Get, &proto.GetRequest{
+			RequestHeader: toProtoHeader(&t.RequestHeader, t.Key, nil),
+		}, nil
+	case *PutRequest:
+		if t.ExpValue != nil {
+			cpArgs := &proto.ConditionalPutRequest{
+				RequestHeader: toProtoHeader(&t.RequestHeader, t.Key, nil),
+				Value:         toProtoValue(t.Value),
+			}
+			// An expected value without bytes tests for non-existence.
+			if t.ExpValue.Bytes != nil {
+				expValue := toProtoValue(*t.ExpValue)
+				cpArgs.ExpValue = &expValue
+			}
+			return proto.ConditionalPut, cpArgs, nil
+		}
+		return proto.Put, &proto.PutRequest{
+			RequestHeader: toProtoHeader(&t.RequestHeader, t.Key, nil),
+			Value:         toProtoValue(t.Value),
+		}, nil
+	case *IncrementRequest:
+		return proto.Increment, &proto.IncrementRequest{
+			RequestHeader: toProtoHeader(&t.RequestHeader, t.Key, nil),
+			Increment:     t.Increment,
+		}, nil
+	case *DeleteRequest:
+		return proto.Delete, &proto.DeleteRequest{
+			RequestHeader: toProtoHeader(&t.RequestHeader, t.Key, nil),
+		}, nil
+	case *DeleteRangeRequest:
+		return proto.DeleteRange, &proto.DeleteRangeRequest{
+			RequestHeader: toProtoHeader(&t.RequestHeader, t.StartKey, t.EndKey),
+		}, nil
+	case *ScanRequest:
+		return proto.Scan, &proto.ScanRequest{
+			RequestHeader: toProtoHeader(&t.RequestHeader, t.StartKey, t.EndKey),
+			MaxResults:    t.MaxResults,
+		}, nil
+	case *EndTransactionRequest:
+		return proto.EndTransaction, &proto.EndTransactionRequest{
+			RequestHeader: toProtoHeader(&t.RequestHeader, nil, nil),
+			Commit:        t.Commit,
+		}, nil
+	case *ReapQueueRequest:
+		return proto.ReapQueue, &proto.ReapQueueRequest{
+			RequestHeader: toProtoHeader(&t.RequestHeader, t.Inbox, nil),
+			MaxResults:    t.MaxResults,
+		}, nil
+	case *EnqueueUpdateRequest:
+		return proto.EnqueueUpdate, &proto.EnqueueUpdateRequest{
+			RequestHeader: toProtoHeader(&t.RequestHeader, nil, nil),
+		}, nil
+	case *EnqueueMessageRequest:
+		return proto.EnqueueMessage, &proto.EnqueueMessageRequest{
+			RequestHeader: toProtoHeader(&t.RequestHeader, t.Inbox, nil),
+			Msg:           toProtoValue(t.Message),
+		}, nil
+	case *InternalRangeLookupRequest:
+		return proto.InternalRangeLookup, &proto.InternalRangeLookupRequest{
+			RequestHeader: toProtoHeader(&t.RequestHeader, t.Key, nil),
+			MaxRanges:     1,
+		}, nil
+	case *InternalMergeRequest:
+		// The wire value is tagged as time series data.
+		data := &proto.InternalTimeSeriesData{}
+		if err := gogoproto.Unmarshal(t.Value.Bytes, data); err != nil {
+			return "", nil, util.Errorf("merge value for key %q is not time series data: %s", t.Key, err)
+		}
+		value, err := data.ToValue()
+		if err != nil {
+			return "", nil, err
+		}
+		value.Timestamp = toProtoValue(t.Value).Timestamp
+		return proto.InternalMerge, &proto.InternalMergeRequest{
+			RequestHeader: toProtoHeader(&t.RequestHeader, t.Key, nil),
+			Value:         *value,
+		}, nil
+	case *BatchRequest:
+		bArgs := &proto.BatchRequest{
+			RequestHeader: toProtoHeader(&t.RequestHeader, nil, nil),
+		}
+		for i := range t.Requests {
+			_, cmdArgs, err := ToProtoRequest(t.Requests[i].GetValue())
+			if err != nil {
+				return "", nil, err
+			}
+			union := proto.RequestUnion{}
+			if !union.SetValue(cmdArgs) {
+				return "", nil, util.Errorf("unable to add %T to batch request", cmdArgs)
+			}
+			bArgs.Requests = append(bArgs.Requests, union)
+		}
+		return proto.Batch, bArgs, nil
+	}
+	return "", nil, util.Errorf("request %T has no wire representation", args)
+}
+
+// FromProtoRequest converts the wire representation of a request.
+// Returns the name of the method which executes the converted request.
+func FromProtoRequest(args proto.Request) (string, Request, error) {
+	header := fromProtoHeader(args.Header())
+	key := Key(args.Header().Key)
+	endKey := Key(args.Header().EndKey)
+	switch t := args.(type) {
+	case *proto.ContainsRequest:
+		return "Contains", &ContainsRequest{RequestHeader: header, Key: key}, nil
+	case *proto.GetRequest:
+		return "Get", &GetRequest{RequestHeader: header, Key: key}, nil
+	case *proto.PutRequest:
+		return "Put", &PutRequest{RequestHeader: header, Key: key, Value: fromProtoValue(t.Value)}, nil
+	case *proto.ConditionalPutRequest:
+		expValue := &Value{}
+		if t.ExpValue != nil {
+			*expValue = fromProtoValue(*t.ExpValue)
+		}
+		return "Put", &PutRequest{
+			RequestHeader: header,
+			Key:           key,
+			Value:         fromProtoValue(t.Value),
+			ExpValue:      expValue,
+		}, nil
+	case *proto.IncrementRequest:
+		return "Increment", &IncrementRequest{RequestHeader: header, Key: key, Increment: t.Increment}, nil
+	case *proto.DeleteRequest:
+		return "Delete", &DeleteRequest{RequestHeader: header, Key: key}, nil
+	case *proto.DeleteRangeRequest:
+		return "DeleteRange", &DeleteRangeRequest{RequestHeader: header, StartKey: key, EndKey: endKey}, nil
+	case *proto.ScanRequest:
+		return "Scan", &ScanRequest{
+			RequestHeader: header,
+			StartKey:      key,
+			EndKey:        endKey,
+			MaxResults:    t.MaxResults,
+		}, nil
+	case *proto.EndTransactionRequest:
+		return "EndTransaction", &EndTransactionRequest{RequestHeader: header, Commit: t.Commit}, nil
+	case *proto.ReapQueueRequest:
+		return "ReapQueue", &ReapQueueRequest{RequestHeader: header, Inbox: key, MaxResults: t.MaxResults}, nil
+	case *proto.EnqueueUpdateRequest:
+		return "EnqueueUpdate", &EnqueueUpdateRequest{RequestHeader: header}, nil
+	case *proto.EnqueueMessageRequest:
+		return "EnqueueMessage", &EnqueueMessageRequest{
+			RequestHeader: header,
+			Inbox:         key,
+			Message:       fromProtoValue(t.Msg),
+		}, nil
+	case *proto.InternalRangeLookupRequest:
+		return "InternalRangeLookup", &InternalRangeLookupRequest{RequestHeader: header, Key: key}, nil
+	case *proto.InternalMergeRequest:
+		if _, err := proto.InternalTimeSeriesDataFromValue(&t.Value); err != nil {
+			return "", nil, err
+		}
+		return "InternalMerge", &InternalMergeRequest{RequestHeader: header, Key: key, Value: fromProtoValue(t.Value)}, nil
+	case *proto.BatchRequest:
+		bArgs := &BatchRequest{RequestHeader: header}
+		for i := range t.Requests {
+			cmdArgs, ok := t.Requests[i].GetValue().(proto.Request)
+			if !ok {
+				return "", nil, util.Errorf("empty batch command %d", i)
+			}
+			_, storageArgs, err := FromProtoRequest(cmdArgs)
+			if err != nil {
+				return "", nil, err
+			}
+			union := RequestUnion{}
+			if !union.SetValue(storageArgs) {
+				return "", nil, util.Errorf("unable to add %T to batch request", storageArgs)
+			}
+			bArgs.Requests = append(bArgs.Requests, union)
+		}
+		return "Batch", bArgs, nil
+	}
+	return "", nil, util.Errorf("unhandled request %T", args)
+}
+
+// newProtoReply allocates the wire representation of a response.
+func newProtoReply(reply Response) (proto.Response, error) {
+	switch reply.(type) {
+	case *ContainsResponse:
+		return &proto.ContainsResponse{}, nil
+	case *GetResponse:
+		return &proto.GetResponse{}, nil
+	case *PutResponse:
+		return &proto.PutResponse{}, nil
+	case *IncrementResponse:
+		return &proto.IncrementResponse{}, nil
+	case *DeleteResponse:
+		return &proto.DeleteResponse{}, nil
+	case *DeleteRangeResponse:
+		return &proto.DeleteRangeResponse{}, nil
+	case *ScanResponse:
+		return &proto.ScanResponse{}, nil
+	case *EndTransactionResponse:
+		return &proto.EndTransactionResponse{}, nil
+	case *ReapQueueResponse:
+		return &proto.ReapQueueResponse{}, nil
+	case *EnqueueUpdateResponse:
+		return &proto.EnqueueUpdateResponse{}, nil
+	case *EnqueueMessageResponse:
+		return &proto.EnqueueMessageResponse{}, nil
+	case *InternalRangeLookupResponse:
+		return &proto.InternalRangeLookupResponse{}, nil
+	case *InternalMergeResponse:
+		return &proto.InternalMergeResponse{}, nil
+	case *BatchResponse:
+		return &proto.BatchResponse{}, nil
+	}
+	return nil, util.Errorf("response %T has no wire representation", reply)
+}
+
+// newReply allocates the response converted from the wire
+// representation of a response.
+func newReply(protoReply proto.Response) (Response, error) {
+	switch protoReply.(type) {
+	case *proto.ContainsResponse:
+		return &ContainsResponse{}, nil
+	case *proto.GetResponse:
+		return &GetResponse{}, nil
+	case *proto.PutResponse, *proto.ConditionalPutResponse:
+		return &PutResponse{}, nil
+	case *proto.IncrementResponse:
+		return &IncrementResponse{}, nil
+	case *proto.DeleteResponse:
+		return &DeleteResponse{}, nil
+	case *proto.DeleteRangeResponse:
+		return &DeleteRangeResponse{}, nil
+	case *proto.ScanResponse:
+		return &ScanResponse{}, nil
+	case *proto.EndTransactionResponse:
+		return &EndTransactionResponse{}, nil
+	case *proto.ReapQueueResponse:
+		return &ReapQueueResponse{}, nil
+	case *proto.EnqueueUpdateResponse:
+		return &EnqueueUpdateResponse{}, nil
+	case *proto.EnqueueMessageResponse:
+		return &EnqueueMessageResponse{}, nil
+	case *proto.InternalRangeLookupResponse:
+		return &InternalRangeLookupResponse{}, nil
+	case *proto.InternalMergeResponse:
+		return &InternalMergeResponse{}, nil
+	case *proto.BatchResponse:
+		return &BatchResponse{}, nil
+	}
+	return nil, util.Errorf("unhandled response %T", protoReply)
+}
+
+// ToProtoResponse converts a response into protoReply, its wire
+// representation. The error of the response header is converted to a
+// proto.Error. A failed conditional put carries the actual value in a
+// proto.ConditionFailedError.
+func ToProtoResponse(reply Response, protoReply proto.Response) error {
+	header := reply.Header()
+	protoReply.Header().SetGoError(header.Error)
+	protoReply.Header().Timestamp = ToProtoTimestamp(header.Timestamp)
+
+	switch t := reply.(type) {
+	case *ContainsResponse:
+		protoReply.(*proto.ContainsResponse).Exists = t.Exists
+	case *GetResponse:
+		if t.Value.Bytes != nil {
+			value := toProtoValue(t.Value)
+			protoReply.(*proto.GetResponse).Value = &value
+		}
+	case *PutResponse:
+		if t.Error != nil && t.ActualValue != nil {
+			actualValue := toProtoValue(*t.ActualValue)
+			protoReply.Header().SetGoError(&proto.ConditionFailedError{ActualValue: &actualValue})
+		}
+	case *IncrementResponse:
+		protoReply.(*proto.IncrementResponse).NewValue = t.NewValue
+	case *DeleteRangeResponse:
+		protoReply.(*proto.DeleteRangeResponse).NumDeleted = int64(t.NumDeleted)
+	case *ScanResponse:
+		sReply := protoReply.(*proto.ScanResponse)
+		for _, kv := range t.Rows {
+			sReply.Rows = append(sReply.Rows, proto.KeyValue{Key: proto.Key(kv.Key), Value: toProtoValue(kv.Value)})
+		}
+	case *EndTransactionResponse:
+		protoReply.(*proto.EndTransactionResponse).CommitWait = t.CommitWait
+	case *ReapQueueResponse:
+		rqReply := protoReply.(*proto.ReapQueueResponse)
+		for _, msg := range t.Messages {
+			rqReply.Messages = append(rqReply.Messages, toProtoValue(msg))
+		}
+	case *InternalRangeLookupResponse:
+		if t.Error == nil {
+			desc := toProtoDescriptor(t.Locations.StartKey, t.EndKey, t.Locations.Replicas)
+			protoReply.(*proto.InternalRangeLookupResponse).Ranges = []proto.RangeDescriptor{*desc}
+		}
+	case *BatchResponse:
+		bReply := protoReply.(*proto.BatchResponse)
+		for i := range t.Responses {
+			cmdReply := t.Responses[i].GetValue()
+			if cmdReply == nil {
+				return util.Errorf("empty batch response %d", i)
+			}
+			protoCmdReply, err := newProtoReply(cmdReply)
+			if err != nil {
+				return err
+			}
+			if err := ToProtoResponse(cmdReply, protoCmdReply); err != nil {
+				return err
+			}
+			union := proto.ResponseUnion{}
+			if !union.SetValue(protoCmdReply) {
+				return util.Errorf("unable to add %T to batch response", protoCmdReply)
+			}
+			bReply.Responses = append(bReply.Responses, union)
+		}
+	}
+	return nil
+}
+
+// FromProtoResponse converts protoReply, the wire representation of a
+// response, into reply.
+func FromProtoResponse(protoReply proto.Response, reply Response) error {
+	header := reply.Header()
+	header.Error = protoReply.Header().GoError()
+	header.Timestamp = FromProtoTimestamp(protoReply.Header().Timestamp)
+
+	switch t := protoReply.(type) {
+	case *proto.ContainsResponse:
+		reply.(*ContainsResponse).Exists = t.Exists
+	case *proto.GetResponse:
+		if t.Value != nil {
+			reply.(*GetResponse).Value = fromProtoValue(*t.Value)
+		}
+	case *proto.PutResponse, *proto.ConditionalPutResponse:
+		if cfErr, ok := header.Error.(*proto.ConditionFailedError); ok && cfErr.ActualValue != nil {
+			actualValue := fromProtoValue(*cfErr.ActualValue)
+			reply.(*PutResponse).ActualValue = &actualValue
+		}
+	case *proto.IncrementResponse:
+		reply.(*IncrementResponse).NewValue = t.NewValue
+	case *proto.DeleteRangeResponse:
+		reply.(*DeleteRangeResponse).NumDeleted = uint64(t.NumDeleted)
+	case *proto.ScanResponse:
+		sReply := reply.(*ScanResponse)
+		for _, kv := range t.Rows {
+			sReply.Rows = append(sReply.Rows, KeyValue{Key: Key(kv.Key), Value: fromProtoValue(kv.Value)})
+		}
+	case *proto.EndTransactionResponse:
+		reply.(*EndTransactionResponse).CommitWait = t.CommitWait
+	case *proto.ReapQueueResponse:
+		rqReply := reply.(*ReapQueueResponse)
+		for _, msg := range t.Messages {
+			rqReply.Messages = append(rqReply.Messages, fromProtoValue(msg))
+		}
+	case *proto.InternalRangeLookupResponse:
+		if len(t.Ranges) > 0 {
+			desc := t.Ranges[0]
+			lReply := reply.(*InternalRangeLookupResponse)
+			lReply.EndKey = Key(desc.EndKey)
+			lReply.Locations.StartKey = Key(desc.StartKey)
+			for _, replica := range desc.Replicas {
+				lReply.Locations.Replicas = append(lReply.Locations.Replicas, FromProtoReplica(replica, desc.RaftID))
+			}
+		}
+	case *proto.BatchResponse:
+		bReply := reply.(*BatchResponse)
+		for i := range t.Responses {
+			protoCmdReply, ok := t.Responses[i].GetValue().(proto.Response)
+			if !ok {
+				return util.Errorf("empty batch response %d", i)
+			}
+			cmdReply, err := newReply(protoCmdReply)
+			if err != nil {
+				return err
+			}
+			if err := FromProtoResponse(protoCmdReply, cmdReply); err != nil {
+				return err
+			}
+			bReply.Add(cmdReply)
+		}
+	}
+	return nil
+}
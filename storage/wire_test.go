@@ -0,0 +1,181 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package storage
+
+import (
+	"reflect"
+	"testing"
+
+	gogoproto "github.com/gogo/protobuf/proto"
+
+	"gossipgo/proto"
+	"gossipgo/util/hlc"
+)
+
+// roundTripRequest converts the request to its wire representation,
+// marshals and unmarshals it, and converts it back.
+func roundTripRequest(t *testing.T, args Request) (string, string, Request) {
+	protoMethod, protoArgs, err := ToProtoRequest(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := gogoproto.Marshal(protoArgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := proto.CreateArgs(protoMethod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gogoproto.Unmarshal(data, decoded); err != nil {
+		t.Fatal(err)
+	}
+	method, converted, err := FromProtoRequest(decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return protoMethod, method, converted
+}
+
+// TestRequestWireRoundTrip verifies requests survive conversion to
+// and from their wire representation.
+func TestRequestWireRoundTrip(t *testing.T) {
+	header := RequestHeader{
+		Timestamp:    hlc.Timestamp{WallTime: 10, Logical: 2},
+		MaxTimestamp: hlc.Timestamp{WallTime: 20},
+		Replica:      Replica{NodeID: 1, StoreID: 2, RangeID: 3, Datacenter: "us-east", DiskType: HDD},
+		Deadline:     30,
+	}
+	value := Value{Bytes: []byte("value"), Timestamp: hlc.Timestamp{WallTime: 5}}
+	tsBytes, err := gogoproto.Marshal(&proto.InternalTimeSeriesData{
+		StartTimestampNanos: 0,
+		SampleDurationNanos: 10,
+		Samples:             []*proto.InternalTimeSeriesSample{{Offset: 1, IntCount: 1, IntSum: gogoproto.Int64(5)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tsValue := Value{Bytes: tsBytes, Timestamp: hlc.Timestamp{WallTime: 5}}
+	testCases := []struct {
+		args        Request
+		protoMethod string
+		method      string
+	}{
+		{&GetRequest{RequestHeader: header, Key: Key("a")}, proto.Get, "Get"},
+		{&PutRequest{RequestHeader: header, Key: Key("a"), Value: value}, proto.Put, "Put"},
+		{&PutRequest{RequestHeader: header, Key: Key("a"), Value: value, ExpValue: &Value{Bytes: []byte("old")}}, proto.ConditionalPut, "Put"},
+		{&PutRequest{RequestHeader: header, Key: Key("a"), Value: value, ExpValue: &Value{}}, proto.ConditionalPut, "Put"},
+		{&IncrementRequest{RequestHeader: header, Key: Key("a"), Increment: 5}, proto.Increment, "Increment"},
+		{&ScanRequest{RequestHeader: header, StartKey: Key("a"), EndKey: Key("z"), MaxResults: 10}, proto.Scan, "Scan"},
+		{&DeleteRangeRequest{RequestHeader: header, StartKey: Key("a"), EndKey: Key("z")}, proto.DeleteRange, "DeleteRange"},
+		{&InternalRangeLookupRequest{RequestHeader: header, Key: Key("a")}, proto.InternalRangeLookup, "InternalRangeLookup"},
+		{&InternalMergeRequest{RequestHeader: header, Key: Key("a"), Value: tsValue}, proto.InternalMerge, "InternalMerge"},
+	}
+	for i, test := range testCases {
+		protoMethod, method, converted := roundTripRequest(t, test.args)
+		if protoMethod != test.protoMethod || method != test.method {
+			t.Errorf("%d: expected methods %s, %s; got %s, %s", i, test.protoMethod, test.method, protoMethod, method)
+		}
+		if !reflect.DeepEqual(converted, test.args) {
+			t.Errorf("%d: expected %+v; got %+v", i, test.args, converted)
+		}
+	}
+
+	// Batches carry each of their requests.
+	batch := &BatchRequest{RequestHeader: header}
+	batch.Add(&GetRequest{RequestHeader: header, Key: Key("a")})
+	batch.Add(&PutRequest{RequestHeader: header, Key: Key("b"), Value: value})
+	if _, _, converted := roundTripRequest(t, batch); !reflect.DeepEqual(converted, batch) {
+		t.Errorf("expected %+v; got %+v", batch, converted)
+	}
+
+	// Only time series data can be merged.
+	if _, _, err := ToProtoRequest(&InternalMergeRequest{RequestHeader: header, Key: Key("a"), Value: value}); err == nil {
+		t.Error("expected error merging a value which isn't time series data")
+	}
+}
+
+// TestResponseWireRoundTrip verifies responses and their errors
+// survive conversion to and from their wire representation.
+func TestResponseWireRoundTrip(t *testing.T) {
+	uncertaintyErr := &proto.ReadWithinUncertaintyIntervalError{
+		Timestamp:         proto.Timestamp{WallTime: 1},
+		ExistingTimestamp: proto.Timestamp{WallTime: 2},
+	}
+	testCases := []Response{
+		&GetResponse{
+			ResponseHeader: ResponseHeader{Timestamp: hlc.Timestamp{WallTime: 10}},
+			Value:          Value{Bytes: []byte("value"), Timestamp: hlc.Timestamp{WallTime: 5}},
+		},
+		&GetResponse{ResponseHeader: ResponseHeader{Error: uncertaintyErr}},
+		&ScanResponse{Rows: []KeyValue{{Key: Key("a"), Value: Value{Bytes: []byte("1")}}}},
+		&IncrementResponse{NewValue: 5},
+		&InternalRangeLookupResponse{
+			EndKey: Key("meta2z"),
+			Locations: RangeLocations{
+				StartKey: Key("meta2a"),
+				Replicas: []Replica{{NodeID: 1, StoreID: 1, RangeID: 4, DiskType: SSD}},
+			},
+		},
+		&GetResponse{ResponseHeader: ResponseHeader{Error: proto.NewRangeNotFoundError(3)}},
+		&PutResponse{ResponseHeader: ResponseHeader{Error: proto.NewRangeKeyMismatchError(
+			proto.Key("d"), nil, &proto.RangeDescriptor{StartKey: proto.Key("a"), EndKey: proto.Key("c")})}},
+		&IncrementResponse{ResponseHeader: ResponseHeader{Error: &proto.NotLeaderError{Leader: proto.Replica{NodeID: 2, StoreID: 3}}}},
+		&PutResponse{
+			ResponseHeader: ResponseHeader{Error: &proto.ConditionFailedError{ActualValue: &proto.Value{Bytes: []byte("b")}}},
+			ActualValue:    &Value{Bytes: []byte("b")},
+		},
+	}
+	for i, reply := range testCases {
+		protoReply, err := newProtoReply(reply)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ToProtoResponse(reply, protoReply); err != nil {
+			t.Fatal(err)
+		}
+		data, err := gogoproto.Marshal(protoReply)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := newProtoReply(reply)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := gogoproto.Unmarshal(data, decoded); err != nil {
+			t.Fatal(err)
+		}
+		converted, err := newReply(decoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := FromProtoResponse(decoded, converted); err != nil {
+			t.Fatal(err)
+		}
+		// Errors are compared by type and message, as marshaling
+		// caches sizes in the original error.
+		expErr, err := reply.Header().Error, converted.Header().Error
+		if reflect.TypeOf(err) != reflect.TypeOf(expErr) || (err != nil && err.Error() != expErr.Error()) {
+			t.Errorf("%d: expected error %v; got %v", i, expErr, err)
+		}
+		converted.Header().Error = expErr
+		if !reflect.DeepEqual(converted, reply) {
+			t.Errorf("%d: expected %+v; got %+v", i, reply, converted)
+		}
+	}
+}
@@ -17,17 +17,1032 @@
 
 package structured
 
-import "gossipgo/kv"
+import (
+	"bytes"
+	"hash/fnv"
+	"math"
+	"reflect"
+	"sort"
+	"sync"
+
+	"gossipgo/kv"
+	"gossipgo/storage"
+	"gossipgo/util"
+)
+
+const (
+	// scanBatchSize is the number of keys read per scan request when
+	// scanning tables. Index backfills index a batch of rows at a time.
+	scanBatchSize = 100
+	// scatterScanConcurrency is the number of the 65536 hash prefixes
+	// of a scattered table which are scanned concurrently.
+	scatterScanConcurrency = 16
+	// onDeleteBatchSize is the number of referencing rows looked up
+	// and updated per batch when applying foreign key ondelete
+	// policies.
+	onDeleteBatchSize = 100
+)
 
 // A DB implements the structured data API using the Cockroach kv
 // client API.
+//
+// Schemas are stored under storage.KeySchemaPrefix, keyed by schema
+// name. Rows and index entries are stored as described in the package
+// documentation. A row and its index entries are written in a single
+// batch, which is applied atomically so long as the table and its
+// indexes lie within a single range. Unique indexes are checked
+// before the batch is sent, so concurrent writers of the same value
+// may both succeed.
+//
+// Rows written with foreign key values must reference existing rows.
+// When a row is deleted, the ondelete policy of each foreign key
+// referencing it is applied to the referencing rows: they're deleted
+// ("cascade") or have their foreign key columns removed ("setnull").
+// Policies apply transitively, each referencing row being handled
+// before the row it references is deleted, so a failure part way
+// through never leaves dangling references.
+//
+// When a schema update adds an index to an existing table, the DB
+// backfills the index in the background with entries for the rows
+// already in the table. Lookups on the index fail until the backfill
+// completes.
+//
+// TODO(spencer): write rows and index entries transactionally, which
+// will make them atomic across ranges and close the race on unique
+// indexes.
+// TODO(spencer): persist backfill state so that other clients see
+// whether an index is ready and backfills resume after a restart.
+// TODO(spencer): delete the entries of dropped indexes.
+// TODO(spencer): fulltext and location indexes.
 type DB struct {
 	// kvDB is a client to the monolithic key-value map.
 	kvDB kv.DB
+
+	mu sync.Mutex // Protects backfills and sequences
+	// backfills maps from index prefix to the index's backfill. Only
+	// running and failed backfills are present.
+	backfills map[string]*backfill
+	// sequences maps from sequence key to the sequences of
+	// auto-increment columns.
+	sequences map[string]*sequence
+}
+
+// A backfill is a background job which writes index entries for the
+// rows already present in a table when an index is added to it.
+type backfill struct {
+	done chan struct{} // Closed when the backfill completes
+	err  error         // Set before done is closed
 }
 
 // NewDB returns a key-value datastore client which connects to the
 // Cockroach cluster via the supplied gossip instance.
 func NewDB(kvDB kv.DB) *DB {
-	return &DB{kvDB: kvDB}
+	return &DB{
+		kvDB:      kvDB,
+		backfills: map[string]*backfill{},
+		sequences: map[string]*sequence{},
+	}
+}
+
+// schemaKey returns the key at which the named schema is stored.
+func schemaKey(name string) storage.Key {
+	return storage.MakeKey(storage.KeySchemaPrefix, storage.Key(name))
+}
+
+// PutSchema validates the schema and stores it, replacing any
+// existing schema of the same name. Schema keys must be unique, so
+// it's an error for another schema to have the same key. The primary
+// key, scatter and interleave specifications of existing tables may
+// not be changed, as their rows would no longer be found. Indexes
+// which the schema adds to existing tables are backfilled in the
+// background; use WaitForIndex to wait for a backfill to complete.
+// The sequences of new auto-increment columns are created with the
+// columns' start values.
+func (db *DB) PutSchema(s *Schema) error {
+	if err := s.Validate(); err != nil {
+		return &invalidError{err.Error()}
+	}
+	schemas, err := db.GetSchemas()
+	if err != nil {
+		return err
+	}
+	var old *Schema
+	for _, other := range schemas {
+		if other.Name == s.Name {
+			old = other
+		} else if other.Key == s.Key {
+			return invalidf("schema %q: key %q already in use by schema %q", s.Name, s.Key, other.Name)
+		}
+	}
+	if old != nil && old.Key == s.Key {
+		for _, t := range s.Tables {
+			if oldT, ok := old.byKey[t.Key]; ok && oldT.keyLayout() != t.keyLayout() {
+				return invalidf("table %q: primary key, scatter and interleave may not be changed", t.Name)
+			}
+		}
+	}
+	if err := db.initSequences(s); err != nil {
+		return err
+	}
+	yaml, err := s.ToYAML()
+	if err != nil {
+		return err
+	}
+	pr := <-db.kvDB.Put(&storage.PutRequest{
+		Key:   schemaKey(s.Name),
+		Value: storage.Value{Bytes: yaml},
+	})
+	if pr.Error != nil {
+		return pr.Error
+	}
+	if old != nil && old.Key == s.Key {
+		db.startBackfills(old, s)
+	}
+	return nil
+}
+
+// GetSchema returns the named schema, or nil if it doesn't exist.
+func (db *DB) GetSchema(name string) (*Schema, error) {
+	gr := <-db.kvDB.Get(&storage.GetRequest{Key: schemaKey(name)})
+	if gr.Error != nil {
+		return nil, gr.Error
+	}
+	if len(gr.Value.Bytes) == 0 {
+		return nil, nil
+	}
+	return NewYAMLSchema(gr.Value.Bytes)
+}
+
+// GetSchemas returns all schemas, ordered by name.
+func (db *DB) GetSchemas() ([]*Schema, error) {
+	kvs, err := db.scanPrefix(storage.KeySchemaPrefix)
+	if err != nil {
+		return nil, err
+	}
+	var schemas []*Schema
+	for _, kv := range kvs {
+		s, err := NewYAMLSchema(kv.Value.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		schemas = append(schemas, s)
+	}
+	return schemas, nil
+}
+
+// PutRow writes the row to the named table, replacing any existing
+// row with the same primary key. The row is a Row, a
+// map[string]interface{} or a struct or pointer to struct whose
+// fields correspond to the table's columns. Values which are nil are
+// omitted. Missing or zero auto-increment column values are allocated
+// from the column's sequence and set in the supplied map or struct
+// pointer; the schema must have been stored with PutSchema, which
+// creates the sequences. Secondary and unique index entries are updated to match
+// the row in the same batch as the row is written. If another row has
+// the same value for a uniquely indexed column, a *ConflictError is
+// returned and nothing is written. Foreign key values must either be
+// entirely absent or reference an existing row. Returns the row as
+// written.
+func (db *DB) PutRow(s *Schema, tableName string, row interface{}) (Row, error) {
+	t, err := s.getTable(tableName)
+	if err != nil {
+		return nil, err
+	}
+	written, err := t.toRow(row)
+	if err != nil {
+		return nil, err
+	}
+	var allocated []*Column
+	for _, c := range t.Columns {
+		if v, ok := written[c.Name]; c.Auto == nil || (ok && v != int64(0)) {
+			continue
+		}
+		if written[c.Name], err = db.nextSequenceValue(s, t, c); err != nil {
+			return nil, err
+		}
+		allocated = append(allocated, c)
+	}
+	for _, c := range t.primaryKey {
+		if _, ok := written[c.Name]; !ok {
+			return nil, invalidf("table %q: missing primary key column %q", t.Name, c.Name)
+		}
+	}
+	pk, err := t.encodePrimaryKey(written)
+	if err != nil {
+		return nil, err
+	}
+	key, err := s.rowKey(t, pk)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check unique indexes before writing anything. The batch writes
+	// their entries with conditional puts which expect the entries
+	// read here, so a row writing the same value concurrently makes
+	// the batch fail.
+	expected := map[string][]byte{}
+	for _, c := range t.indexed() {
+		if v, ok := written[c.Name]; ok && c.indexType() == "unique" {
+			if expected[c.Name], err = db.checkUnique(s, t, c, v, pk); err != nil {
+				return nil, err
+			}
+		}
+	}
+	var old Row
+	if len(t.indexed()) > 0 {
+		if old, err = db.getRow(t, key, pk); err != nil {
+			return nil, err
+		}
+	}
+	if err := db.checkForeignKeys(s, t, pk, old, written); err != nil {
+		return nil, err
+	}
+
+	value, err := t.encodeRowValue(written)
+	if err != nil {
+		return nil, err
+	}
+	batch := &storage.BatchRequest{}
+	batch.Add(&storage.PutRequest{Key: key, Value: storage.Value{Bytes: value}})
+	if err := s.addIndexUpdates(batch, t, pk, old, written, expected); err != nil {
+		return nil, err
+	}
+	if err := db.writeBatch(batch); err != nil {
+		return nil, db.uniqueConflict(s, t, written, pk, err)
+	}
+	if err := t.setColumns(allocated, written, row); err != nil {
+		return nil, err
+	}
+	return written, nil
+}
+
+// GetRow reads the row of the named table with the primary key
+// column values of row, which is a Row, a map[string]interface{} or a
+// pointer to a struct. If the row exists, its column values are set
+// in row and true is returned. Otherwise, row is unchanged and false
+// is returned.
+func (db *DB) GetRow(s *Schema, tableName string, row interface{}) (bool, error) {
+	t, err := s.getTable(tableName)
+	if err != nil {
+		return false, err
+	}
+	if _, err := t.destValue(row); err != nil {
+		return false, err
+	}
+	pk, err := t.rowPrimaryKey(row)
+	if err != nil {
+		return false, err
+	}
+	key, err := s.rowKey(t, pk)
+	if err != nil {
+		return false, err
+	}
+	read, err := db.getRow(t, key, pk)
+	if err != nil || read == nil {
+		return false, err
+	}
+	return true, t.fromRow(read, row)
+}
+
+// DeleteRow deletes the row of the named table with the primary key
+// column values of row, along with its index entries, in a single
+// batch. The row is a Row, a map[string]interface{} or a struct or
+// pointer to struct. The ondelete policies of foreign keys which
+// reference the row are applied first. Deleting a row which doesn't
+// exist isn't an error.
+func (db *DB) DeleteRow(s *Schema, tableName string, row interface{}) error {
+	t, err := s.getTable(tableName)
+	if err != nil {
+		return err
+	}
+	pk, err := t.rowPrimaryKey(row)
+	if err != nil {
+		return err
+	}
+	return db.deleteRow(s, t, pk, map[string]struct{}{})
+}
+
+// deleteRow applies the ondelete policies of the foreign keys
+// referencing the row with the encoded primary key and then deletes
+// the row. Deleting is the set of keys of rows being deleted by the
+// enclosing calls; rows in it are skipped when encountered again
+// through a cycle of foreign keys.
+func (db *DB) deleteRow(s *Schema, t *Table, pk []byte, deleting map[string]struct{}) error {
+	key, err := s.rowKey(t, pk)
+	if err != nil {
+		return err
+	}
+	old, err := db.getRow(t, key, pk)
+	if err != nil || old == nil {
+		return err
+	}
+	deleting[string(key)] = struct{}{}
+	for rtName := range t.incomingForeignKeys {
+		if err := db.applyOnDelete(s, t, old, s.byName[rtName], deleting); err != nil {
+			return err
+		}
+	}
+	batch := &storage.BatchRequest{}
+	batch.Add(&storage.DeleteRequest{Key: key})
+	if err := s.addIndexUpdates(batch, t, pk, old, nil, nil); err != nil {
+		return err
+	}
+	return db.writeBatch(batch)
+}
+
+// applyOnDelete applies the ondelete policy of the foreign key from
+// table rt to the rows of rt which reference the row of table t.
+// Referencing rows are found via the implicit index on the foreign
+// key's first column and processed onDeleteBatchSize at a time.
+// Cascading deletes recurse; setnull updates of each batch of rows
+// are written in a single batch.
+func (db *DB) applyOnDelete(s *Schema, t *Table, row Row, rt *Table, deleting map[string]struct{}) error {
+	fk := rt.foreignKeys[t.Name] // Referenced column name -> column of rt
+	refNames := make([]string, 0, len(fk))
+	for name := range fk {
+		refNames = append(refNames, name)
+	}
+	sort.Strings(refNames)
+	first := fk[refNames[0]]
+	encoded, err := encodeKeyValue(s.indexPrefix(rt, first), row[refNames[0]])
+	if err != nil {
+		return err
+	}
+	prefix := storage.Key(encoded)
+	start, end := prefix, prefix.PrefixEnd()
+	for {
+		sr := <-db.kvDB.Scan(&storage.ScanRequest{
+			StartKey:   start,
+			EndKey:     end,
+			MaxResults: onDeleteBatchSize,
+		})
+		if sr.Error != nil {
+			return sr.Error
+		}
+		batch := &storage.BatchRequest{}
+		for _, kv := range sr.Rows {
+			pk := first.indexEntryPK(prefix, kv)
+			key, err := s.rowKey(rt, pk)
+			if err != nil {
+				return err
+			}
+			if _, ok := deleting[string(key)]; ok {
+				continue
+			}
+			ref, err := db.getRow(rt, key, pk)
+			if err != nil {
+				return err
+			}
+			if ref == nil || !references(ref, row, fk) {
+				continue // Stale index entry
+			}
+			if first.OnDelete == "cascade" {
+				if err := db.deleteRow(s, rt, pk, deleting); err != nil {
+					return err
+				}
+				continue
+			}
+			updated := Row{}
+			for name, v := range ref {
+				updated[name] = v
+			}
+			for _, c := range fk {
+				delete(updated, c.Name)
+			}
+			value, err := rt.encodeRowValue(updated)
+			if err != nil {
+				return err
+			}
+			batch.Add(&storage.PutRequest{Key: key, Value: storage.Value{Bytes: value}})
+			if err := s.addIndexUpdates(batch, rt, pk, ref, updated, nil); err != nil {
+				return err
+			}
+		}
+		if len(batch.Requests) > 0 {
+			if err := db.writeBatch(batch); err != nil {
+				return err
+			}
+		}
+		if len(sr.Rows) < onDeleteBatchSize {
+			return nil
+		}
+		start = storage.MakeKey(sr.Rows[len(sr.Rows)-1].Key, storage.Key{0})
+	}
+}
+
+// checkForeignKeys verifies that the foreign key values of the new row
+// reference existing rows. Foreign keys whose values are unchanged
+// from the old row, which may be nil, aren't checked again. A row may
+// reference itself.
+func (db *DB) checkForeignKeys(s *Schema, t *Table, pk []byte, old, new Row) error {
+	for ftName, fk := range t.foreignKeys {
+		ft := s.byName[ftName]
+		ref := Row{}
+		changed := old == nil
+		for refName, c := range fk {
+			oldV, hadOld := old[c.Name]
+			newV, hasNew := new[c.Name]
+			if hasNew {
+				ref[refName] = newV
+			}
+			if hadOld != hasNew || (hasNew && !equalKeyValues(oldV, newV)) {
+				changed = true
+			}
+		}
+		if len(ref) == 0 || !changed {
+			continue
+		}
+		if len(ref) != len(fk) {
+			return invalidf("table %q: foreign key to table %q is missing columns", t.Name, ft.Name)
+		}
+		refPK, err := ft.encodePrimaryKey(ref)
+		if err != nil {
+			return err
+		}
+		if ft == t && bytes.Equal(refPK, pk) {
+			continue
+		}
+		key, err := s.rowKey(ft, refPK)
+		if err != nil {
+			return err
+		}
+		found, err := db.getRow(ft, key, refPK)
+		if err != nil {
+			return err
+		}
+		if found == nil {
+			return invalidf("table %q: foreign key references missing %s row %v", t.Name, ft.Name, ref)
+		}
+	}
+	return nil
+}
+
+// LookupByIndex returns the rows of the named table whose value for
+// the named column equals the value. The column must have a secondary
+// or unique index, either specified or implied by a foreign key. Rows
+// are ordered by primary key. Lookups fail while the index is being
+// backfilled.
+func (db *DB) LookupByIndex(s *Schema, tableName, columnName string, value interface{}) ([]Row, error) {
+	t, c, err := s.getIndexedColumn(tableName, columnName)
+	if err != nil {
+		return nil, err
+	}
+	if value, err = c.convert(value); err != nil {
+		return nil, err
+	}
+	db.mu.Lock()
+	b, ok := db.backfills[string(s.indexPrefix(t, c))]
+	db.mu.Unlock()
+	if ok {
+		select {
+		case <-b.done:
+			return nil, util.Errorf("table %q: backfill of index on column %q failed: %v", t.Name, c.Name, b.err)
+		default:
+			return nil, util.Errorf("table %q: index on column %q is being backfilled", t.Name, c.Name)
+		}
+	}
+	return db.lookupIndex(s, t, c, value)
+}
+
+// WaitForIndex blocks until any backfill of the index on the named
+// column completes. Returns the backfill's error, if it failed.
+func (db *DB) WaitForIndex(s *Schema, tableName, columnName string) error {
+	t, c, err := s.getIndexedColumn(tableName, columnName)
+	if err != nil {
+		return err
+	}
+	db.mu.Lock()
+	b, ok := db.backfills[string(s.indexPrefix(t, c))]
+	db.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	<-b.done
+	return b.err
+}
+
+// lookupIndex returns the rows whose value for the indexed column
+// equals the value. Index entries referring to rows which no longer
+// exist or no longer have the value are skipped.
+func (db *DB) lookupIndex(s *Schema, t *Table, c *Column, value interface{}) ([]Row, error) {
+	prefix, err := encodeKeyValue(s.indexPrefix(t, c), value)
+	if err != nil {
+		return nil, err
+	}
+	var kvs []storage.KeyValue
+	if c.indexType() == "unique" {
+		gr := <-db.kvDB.Get(&storage.GetRequest{Key: prefix})
+		if gr.Error != nil {
+			return nil, gr.Error
+		}
+		if len(gr.Value.Bytes) > 0 {
+			kvs = append(kvs, storage.KeyValue{Key: prefix, Value: gr.Value})
+		}
+	} else if kvs, err = db.scanPrefix(prefix); err != nil {
+		return nil, err
+	}
+	var rows []Row
+	for _, kv := range kvs {
+		pk := c.indexEntryPK(prefix, kv)
+		key, err := s.rowKey(t, pk)
+		if err != nil {
+			return nil, err
+		}
+		row, err := db.getRow(t, key, pk)
+		if err != nil {
+			return nil, err
+		}
+		if row != nil && equalKeyValues(row[c.Name], value) {
+			rows = append(rows, row)
+		}
+	}
+	return rows, nil
+}
+
+// getRow returns the row stored at key, or nil if it doesn't exist.
+// The primary key column values are decoded from the encoded primary
+// key.
+func (db *DB) getRow(t *Table, key storage.Key, pk []byte) (Row, error) {
+	gr := <-db.kvDB.Get(&storage.GetRequest{Key: key})
+	if gr.Error != nil {
+		return nil, gr.Error
+	}
+	if len(gr.Value.Bytes) == 0 {
+		return nil, nil
+	}
+	return t.decodeRow(gr.Value.Bytes, pk)
+}
+
+// writeBatch sends the batch and returns its error, if any.
+func (db *DB) writeBatch(batch *storage.BatchRequest) error {
+	br := <-db.kvDB.Batch(batch)
+	return br.Error
+}
+
+// startBackfills starts a backfill for each index of the schema's
+// tables which the old version of the schema lacks. Tables are
+// matched by key; tables which are new have no rows to backfill.
+func (db *DB) startBackfills(old, s *Schema) {
+	for _, t := range s.Tables {
+		oldT, ok := old.byKey[t.Key]
+		if !ok {
+			continue
+		}
+		for _, c := range t.indexed() {
+			if oldC, ok := oldT.byKey[c.Key]; ok && oldC.indexType() == c.indexType() {
+				continue
+			}
+			b := &backfill{done: make(chan struct{})}
+			prefix := string(s.indexPrefix(t, c))
+			db.mu.Lock()
+			db.backfills[prefix] = b
+			db.mu.Unlock()
+			go func(t *Table, c *Column) {
+				b.err = db.backfillIndex(s, t, c)
+				if b.err == nil {
+					db.mu.Lock()
+					if db.backfills[prefix] == b {
+						delete(db.backfills, prefix)
+					}
+					db.mu.Unlock()
+				}
+				close(b.done)
+			}(t, c)
+		}
+	}
+}
+
+// A uniqueValue is the value of a uniquely indexed column of the row
+// with the encoded primary key.
+type uniqueValue struct {
+	value interface{}
+	pk    []byte
+}
+
+// backfillIndex scans the table's rows in batches of scanBatchSize
+// and writes the index entries of each batch of rows in a single
+// batch. Values already present in a unique index fail the backfill
+// with a *ConflictError. Unique index entries are written with
+// conditional puts, as by PutRow.
+func (db *DB) backfillIndex(s *Schema, t *Table, c *Column) error {
+	return db.scanTable(s, t, func(rows []rawRow) error {
+		batch := &storage.BatchRequest{}
+		// Values indexed by this batch, which unique index checks
+		// against the index can't yet see.
+		seen := map[string]struct{}{}
+		var unique []uniqueValue // Unique index entries written by the batch
+		for _, raw := range rows {
+			row, err := t.decodeRow(raw.value, raw.pk)
+			if err != nil {
+				return err
+			}
+			v, ok := row[c.Name]
+			if !ok {
+				continue
+			}
+			if c.indexType() == "unique" {
+				encoded, err := encodeKeyValue(nil, v)
+				if err != nil {
+					return err
+				}
+				if _, ok := seen[string(encoded)]; ok {
+					return &ConflictError{Table: t.Name, Column: c.Name, Value: v}
+				}
+				seen[string(encoded)] = struct{}{}
+				exp, err := db.checkUnique(s, t, c, v, raw.pk)
+				if err != nil {
+					return err
+				}
+				if bytes.Equal(exp, raw.pk) {
+					continue // Already indexed by a concurrent write
+				}
+				key, err := s.indexKey(t, c, v, raw.pk)
+				if err != nil {
+					return err
+				}
+				batch.Add(&storage.PutRequest{Key: key, Value: storage.Value{Bytes: raw.pk}, ExpValue: &storage.Value{Bytes: exp}})
+				unique = append(unique, uniqueValue{v, raw.pk})
+				continue
+			}
+			key, err := s.indexKey(t, c, v, raw.pk)
+			if err != nil {
+				return err
+			}
+			batch.Add(&storage.PutRequest{Key: key})
+		}
+		if len(batch.Requests) == 0 {
+			return nil
+		}
+		if err := db.writeBatch(batch); err != nil {
+			for _, u := range unique {
+				if cErr := db.uniqueConflict(s, t, Row{c.Name: u.value}, u.pk, err); cErr != err {
+					return cErr
+				}
+			}
+			return err
+		}
+		return nil
+	})
+}
+
+// decodeRow decodes the row from its encoded value and its encoded
+// primary key.
+func (t *Table) decodeRow(value, pk []byte) (Row, error) {
+	row := Row{}
+	if err := t.decodeRowValue(value, row); err != nil {
+		return nil, err
+	}
+	if _, err := t.decodePrimaryKey(pk, row); err != nil {
+		return nil, err
+	}
+	return row, nil
+}
+
+// decodePrimaryKey decodes the primary key column values encoded at
+// the start of b into row and returns the remainder of b.
+func (t *Table) decodePrimaryKey(b []byte, row Row) ([]byte, error) {
+	for _, c := range t.primaryKey {
+		v, rest, err := decodeKeyValue(b, c.Type)
+		if err != nil {
+			return nil, err
+		}
+		row[c.Name], b = v, rest
+	}
+	return b, nil
+}
+
+// checkUnique returns a *ConflictError if a row other than the row
+// with the encoded primary key has the value for the uniquely indexed
+// column. Otherwise, it returns the current value of the value's
+// index entry, which a conditional put of the entry must expect: nil
+// if there's no entry, the encoded primary key if the row already has
+// the entry, or the entry of a row which no longer has the value.
+func (db *DB) checkUnique(s *Schema, t *Table, c *Column, v interface{}, pk []byte) ([]byte, error) {
+	key, err := s.indexKey(t, c, v, pk)
+	if err != nil {
+		return nil, err
+	}
+	gr := <-db.kvDB.Get(&storage.GetRequest{Key: key})
+	if gr.Error != nil {
+		return nil, gr.Error
+	}
+	otherPK := gr.Value.Bytes
+	if len(otherPK) == 0 || bytes.Equal(otherPK, pk) {
+		return otherPK, nil
+	}
+	otherKey, err := s.rowKey(t, otherPK)
+	if err != nil {
+		return nil, err
+	}
+	other, err := db.getRow(t, otherKey, otherPK)
+	if err != nil {
+		return nil, err
+	}
+	if other != nil && equalKeyValues(other[c.Name], v) {
+		return nil, &ConflictError{Table: t.Name, Column: c.Name, Value: v}
+	}
+	return otherPK, nil
+}
+
+// uniqueConflict returns the *ConflictError of the first uniquely
+// indexed column of row whose value another row has, or err if there
+// is none. It's used to explain the failure of a batch whose
+// conditional puts of unique index entries may have lost a race with
+// another writer.
+func (db *DB) uniqueConflict(s *Schema, t *Table, row Row, pk []byte, err error) error {
+	for _, c := range t.indexed() {
+		if v, ok := row[c.Name]; ok && c.indexType() == "unique" {
+			if _, cErr := db.checkUnique(s, t, c, v, pk); cErr != nil {
+				if _, ok := cErr.(*ConflictError); ok {
+					return cErr
+				}
+			}
+		}
+	}
+	return err
+}
+
+// scanPrefix returns all key-value pairs whose keys have the prefix.
+func (db *DB) scanPrefix(prefix storage.Key) ([]storage.KeyValue, error) {
+	sr := <-db.kvDB.Scan(&storage.ScanRequest{
+		StartKey:   prefix,
+		EndKey:     prefix.PrefixEnd(),
+		MaxResults: math.MaxInt64,
+	})
+	if sr.Error != nil {
+		return nil, sr.Error
+	}
+	return sr.Rows, nil
+}
+
+// addIndexUpdates adds requests to the batch which delete the index
+// entries of the old row and write those of the new row for every
+// indexed column whose value changed. Either row may be nil. Unique
+// index entries are written with conditional puts which expect the
+// values in expected, keyed by column name, as returned by
+// checkUnique; a missing value expects no entry.
+func (s *Schema) addIndexUpdates(batch *storage.BatchRequest, t *Table, pk []byte, old, new Row, expected map[string][]byte) error {
+	for _, c := range t.indexed() {
+		oldV, hadOld := old[c.Name]
+		newV, hasNew := new[c.Name]
+		if hadOld && hasNew && equalKeyValues(oldV, newV) {
+			continue
+		}
+		if hadOld {
+			key, err := s.indexKey(t, c, oldV, pk)
+			if err != nil {
+				return err
+			}
+			batch.Add(&storage.DeleteRequest{Key: key})
+		}
+		if hasNew {
+			key, err := s.indexKey(t, c, newV, pk)
+			if err != nil {
+				return err
+			}
+			if c.indexType() == "unique" {
+				batch.Add(&storage.PutRequest{Key: key, Value: storage.Value{Bytes: pk}, ExpValue: &storage.Value{Bytes: expected[c.Name]}})
+			} else {
+				batch.Add(&storage.PutRequest{Key: key})
+			}
+		}
+	}
+	return nil
+}
+
+// getTable returns the named table of the schema.
+func (s *Schema) getTable(name string) (*Table, error) {
+	t, ok := s.byName[name]
+	if !ok {
+		return nil, invalidf("schema %q: unknown table %q", s.Name, name)
+	}
+	return t, nil
+}
+
+// getIndexedColumn returns the named table of the schema and its named
+// column, which must be indexed.
+func (s *Schema) getIndexedColumn(tableName, columnName string) (*Table, *Column, error) {
+	t, err := s.getTable(tableName)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, ok := t.byName[columnName]
+	if !ok {
+		return nil, nil, invalidf("table %q: unknown column %q", t.Name, columnName)
+	}
+	if c.indexType() == "" {
+		return nil, nil, invalidf("table %q: column %q has no secondary or unique index", t.Name, c.Name)
+	}
+	return t, c, nil
+}
+
+// tablePrefix returns the prefix of the keys of the table's rows.
+func (s *Schema) tablePrefix(t *Table) storage.Key {
+	return storage.Key(s.Key + "/" + t.Key + "/")
+}
+
+// indexPrefix returns the prefix of the keys of the entries of the
+// column's index.
+func (s *Schema) indexPrefix(t *Table, c *Column) storage.Key {
+	return storage.Key(s.Key + "/" + t.Key + ":" + c.Key + "/")
+}
+
+// rowKey returns the key of the table's row with the encoded primary
+// key. If the first primary key column is scattered, the encoded
+// primary key is prefixed by the first two bytes of its hash. Rows of
+// interleaved tables are stored under the key of the parent row which
+// they reference, followed by the table key and the encoded primary
+// key.
+func (s *Schema) rowKey(t *Table, pk []byte) (storage.Key, error) {
+	if t.parent == nil {
+		key := s.tablePrefix(t)
+		if t.primaryKey[0].Scatter {
+			key = append(key, scatterPrefix(pk)...)
+		}
+		return append(key, pk...), nil
+	}
+	parentPK, err := t.parentPrimaryKey(pk)
+	if err != nil {
+		return nil, err
+	}
+	key, err := s.rowKey(t.parent, parentPK)
+	if err != nil {
+		return nil, err
+	}
+	key = append(key, '/')
+	key = append(key, t.Key...)
+	key = append(key, '/')
+	return append(key, pk...), nil
+}
+
+// scatterPrefix returns the first two bytes of the hash of the
+// encoded primary key.
+func scatterPrefix(pk []byte) []byte {
+	h := fnv.New32a()
+	h.Write(pk)
+	return h.Sum(nil)[:2]
+}
+
+// indexKey returns the key of the index entry for the column value
+// of the row with the encoded primary key. Secondary index entries
+// are keyed by the value followed by the primary key and are empty.
+// Unique index entries are keyed by the value alone, so that rows
+// with the same value contend for the same key, and hold the primary
+// key.
+func (s *Schema) indexKey(t *Table, c *Column, v interface{}, pk []byte) (storage.Key, error) {
+	key, err := encodeKeyValue(s.indexPrefix(t, c), v)
+	if err != nil {
+		return nil, err
+	}
+	if c.indexType() == "unique" {
+		return key, nil
+	}
+	return append(key, pk...), nil
+}
+
+// indexEntryPK returns the encoded primary key of the row referenced
+// by the index entry kv of the column, whose key has the prefix of
+// the entries for its value.
+func (c *Column) indexEntryPK(prefix storage.Key, kv storage.KeyValue) []byte {
+	if c.indexType() == "unique" {
+		return kv.Value.Bytes
+	}
+	return []byte(kv.Key[len(prefix):])
+}
+
+// indexType returns the type of the column's index which the DB
+// maintains: "secondary", "unique" or "" for none. Foreign keys imply
+// a secondary index.
+func (c *Column) indexType() string {
+	switch {
+	case c.Index == "secondary" || c.Index == "unique":
+		return c.Index
+	case c.Index == "" && c.ForeignKey != "":
+		return "secondary"
+	}
+	return ""
+}
+
+// indexed returns the table's columns with secondary or unique
+// indexes.
+func (t *Table) indexed() []*Column {
+	var columns []*Column
+	for _, c := range t.Columns {
+		if c.indexType() != "" {
+			columns = append(columns, c)
+		}
+	}
+	return columns
+}
+
+// references returns whether the referencing row's values for the
+// foreign key columns equal the referenced row's primary key values.
+// The foreign key maps from referenced column name to referencing
+// column.
+func references(ref, row Row, fk map[string]*Column) bool {
+	for refName, c := range fk {
+		if !equalKeyValues(ref[c.Name], row[refName]) {
+			return false
+		}
+	}
+	return true
+}
+
+// equalKeyValues returns whether the column values are equal, as
+// determined by their key encodings.
+func equalKeyValues(a, b interface{}) bool {
+	aKey, aErr := encodeKeyValue(nil, a)
+	bKey, bErr := encodeKeyValue(nil, b)
+	return aErr == nil && bErr == nil && bytes.Equal(aKey, bKey)
+}
+
+// keyLayout returns a description of how the table's rows are keyed:
+// the keys and types of its primary key columns, whether it's
+// scattered and the key of the table in which it's interleaved.
+func (t *Table) keyLayout() string {
+	var layout string
+	for _, c := range t.primaryKey {
+		layout += c.Key + ":" + c.Type + ","
+	}
+	if t.primaryKey[0].Scatter {
+		layout += "scatter,"
+	}
+	if t.parent != nil {
+		layout += "interleave:" + t.parent.Key
+	}
+	return layout
+}
+
+// parentPrimaryKey returns the encoded primary key of the parent row
+// referenced by the interleaved table's row with the encoded primary
+// key.
+func (t *Table) parentPrimaryKey(pk []byte) ([]byte, error) {
+	row := Row{}
+	if _, err := t.decodePrimaryKey(pk, row); err != nil {
+		return nil, err
+	}
+	ref := Row{}
+	for refName, c := range t.foreignKeys[t.parent.Name] {
+		ref[refName] = row[c.Name]
+	}
+	return t.parent.encodePrimaryKey(ref)
+}
+
+// encodePrimaryKey returns the concatenated encoding of the row's
+// primary key column values.
+func (t *Table) encodePrimaryKey(row Row) ([]byte, error) {
+	var pk []byte
+	for _, c := range t.primaryKey {
+		var err error
+		if pk, err = encodeKeyValue(pk, row[c.Name]); err != nil {
+			return nil, invalidf("table %q, column %q: %v", t.Name, c.Name, err)
+		}
+	}
+	return pk, nil
+}
+
+// rowPrimaryKey returns the concatenated encoding of the primary key
+// column values of the row, which is a Row, a map[string]interface{}
+// or a struct or pointer to struct.
+func (t *Table) rowPrimaryKey(row interface{}) ([]byte, error) {
+	converted, err := t.toRow(row)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range t.primaryKey {
+		if _, ok := converted[c.Name]; !ok {
+			return nil, invalidf("table %q: missing primary key column %q", t.Name, c.Name)
+		}
+	}
+	return t.encodePrimaryKey(converted)
+}
+
+// setColumns sets the values of the columns in the written row in the
+// supplied row, if it's a map or a pointer to a struct.
+func (t *Table) setColumns(columns []*Column, written Row, row interface{}) error {
+	if len(columns) == 0 {
+		return nil
+	}
+	switch r := row.(type) {
+	case Row:
+		for _, c := range columns {
+			r[c.Name] = written[c.Name]
+		}
+	case map[string]interface{}:
+		for _, c := range columns {
+			r[c.Name] = written[c.Name]
+		}
+	default:
+		if reflect.ValueOf(row).Kind() != reflect.Ptr {
+			return nil
+		}
+		sv, err := t.structValue(row)
+		if err != nil {
+			return err
+		}
+		for _, c := range columns {
+			setField(sv.FieldByName(c.Name), written[c.Name])
+		}
+	}
+	return nil
 }
@@ -0,0 +1,553 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package structured
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"gossipgo/kv"
+	"gossipgo/storage"
+	"gossipgo/util/hlc"
+)
+
+var testYAMLSchema = []byte(`db:     PhotoDB
+db_key: pdb
+tables:
+- table:     User
+  table_key: us
+  columns:
+  - column:         ID
+    column_key:     id
+    type:           integer
+    primary_key:    true
+    scatter:        true
+    auto_increment: 100
+  - column:     Name
+    column_key: na
+    type:       string
+    index:      secondary
+  - column:     Email
+    column_key: em
+    type:       string
+    index:      unique
+  - column:     Tags
+    column_key: ta
+    type:       stringset
+- table:     Photo
+  table_key: ph
+  columns:
+  - column:      ID
+    column_key:  id
+    type:        integer
+    primary_key: true
+  - column:      UserID
+    column_key:  ui
+    type:        integer
+    foreign_key: User.ID
+`)
+
+// createTestDB returns a structured DB backed by a local, in-memory
+// range.
+func createTestDB(t *testing.T) *DB {
+	clock := hlc.NewClock(hlc.UnixNano, 0)
+	store := storage.NewStore(clock, storage.NewInMem(1<<20), nil)
+	if err := store.Bootstrap(storage.StoreIdent{ClusterID: "cluster", NodeID: 1, StoreID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	rng, err := store.CreateRange(storage.KeyMin, storage.KeyMax)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewDB(kv.NewLocalDB(rng))
+}
+
+// createTestDBWithSchema returns a structured DB with the test schema
+// registered.
+func createTestDBWithSchema(t *testing.T) (*DB, *Schema) {
+	db := createTestDB(t)
+	s, err := NewYAMLSchema(testYAMLSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutSchema(s); err != nil {
+		t.Fatal(err)
+	}
+	return db, s
+}
+
+// TestPutGetSchemas verifies schemas are stored and listed by name
+// and that schema keys must be unique.
+func TestPutGetSchemas(t *testing.T) {
+	db, s := createTestDBWithSchema(t)
+	fetched, err := db.GetSchema("PhotoDB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expYAML, _ := s.ToYAML()
+	if yaml, _ := fetched.ToYAML(); string(yaml) != string(expYAML) {
+		t.Errorf("expected schema:\n%s\ngot:\n%s", expYAML, yaml)
+	}
+	if missing, err := db.GetSchema("Missing"); missing != nil || err != nil {
+		t.Errorf("expected no schema; got %v, %v", missing, err)
+	}
+
+	// Another schema with the same key is rejected.
+	s.Name = "OtherDB"
+	if err := db.PutSchema(s); err == nil {
+		t.Error("expected error registering schema with duplicate key")
+	}
+	s.Key = "odb"
+	if err := db.PutSchema(s); err != nil {
+		t.Fatal(err)
+	}
+	schemas, err := db.GetSchemas()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(schemas) != 2 || schemas[0].Name != "OtherDB" || schemas[1].Name != "PhotoDB" {
+		t.Errorf("expected schemas OtherDB and PhotoDB; got %+v", schemas)
+	}
+}
+
+// TestRowCRUD verifies rows are written, read and deleted by primary
+// key, with auto-increment primary keys allocated from a sequence.
+func TestRowCRUD(t *testing.T) {
+	db, s := createTestDBWithSchema(t)
+	for i, name := range []string{"spencer", "peter"} {
+		row, err := db.PutRow(s, "User", Row{"Name": name, "Tags": []interface{}{"b", "a", "b"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id := row["ID"]; id != int64(100+i) {
+			t.Errorf("expected auto-increment ID %d; got %v", 100+i, id)
+		}
+	}
+	row := Row{"ID": "101"}
+	if found, err := db.GetRow(s, "User", row); !found || err != nil {
+		t.Fatalf("expected row; got %t, %v", found, err)
+	}
+	if exp := (Row{"ID": int64(101), "Name": "peter", "Tags": []string{"a", "b"}}); !reflect.DeepEqual(row, exp) {
+		t.Errorf("expected row %v; got %v", exp, row)
+	}
+
+	// Replace the row.
+	if _, err := db.PutRow(s, "User", Row{"ID": 101, "Name": "pete"}); err != nil {
+		t.Fatal(err)
+	}
+	if found, err := db.GetRow(s, "User", row); !found || err != nil || row["Name"] != "pete" || row["Tags"] != nil {
+		t.Errorf("expected replaced row; got %v, %v", row, err)
+	}
+
+	if err := db.DeleteRow(s, "User", Row{"ID": 101}); err != nil {
+		t.Fatal(err)
+	}
+	if found, err := db.GetRow(s, "User", Row{"ID": 101}); found || err != nil {
+		t.Errorf("expected deleted row; got %t, %v", found, err)
+	}
+
+	// Invalid rows.
+	for i, row := range []Row{
+		{"ID": 1, "Unknown": "a"},
+		{"ID": "a"},
+		{"ID": 1, "Tags": "a"},
+	} {
+		if _, err := db.PutRow(s, "User", row); err == nil {
+			t.Errorf("%d: expected error writing invalid row %v", i, row)
+		}
+	}
+	if _, err := db.GetRow(s, "Missing", Row{"ID": 1}); err == nil {
+		t.Error("expected error reading from missing table")
+	}
+}
+
+// TestIndexes verifies secondary and unique indexes are maintained
+// as rows are written and deleted.
+func TestIndexes(t *testing.T) {
+	db, s := createTestDBWithSchema(t)
+	for _, row := range []Row{
+		{"ID": 1, "Name": "spencer", "Email": "spencer@a.com"},
+		{"ID": 2, "Name": "spencer", "Email": "spencer@b.com"},
+		{"ID": 3, "Name": "peter", "Email": "peter@a.com"},
+	} {
+		if _, err := db.PutRow(s, "User", row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectIDs := func(column, value string, expIDs ...int64) {
+		rows, err := db.LookupByIndex(s, "User", column, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []int64
+		for _, row := range rows {
+			ids = append(ids, row["ID"].(int64))
+		}
+		if !reflect.DeepEqual(ids, expIDs) {
+			t.Errorf("%s=%s: expected IDs %v; got %v", column, value, expIDs, ids)
+		}
+	}
+	expectIDs("Name", "spencer", 1, 2)
+	expectIDs("Email", "peter@a.com", 3)
+
+	// Unique index values can't be reused by another row, but a row
+	// may be rewritten with its own value.
+	if _, err := db.PutRow(s, "User", Row{"ID": 4, "Email": "peter@a.com"}); err == nil {
+		t.Error("expected unique index violation")
+	} else if _, ok := err.(*ConflictError); !ok {
+		t.Errorf("expected conflict error; got %v", err)
+	}
+	if _, err := db.PutRow(s, "User", Row{"ID": 3, "Name": "pete", "Email": "peter@a.com"}); err != nil {
+		t.Fatal(err)
+	}
+	expectIDs("Name", "peter")
+	expectIDs("Name", "pete", 3)
+
+	if err := db.DeleteRow(s, "User", Row{"ID": 1}); err != nil {
+		t.Fatal(err)
+	}
+	expectIDs("Name", "spencer", 2)
+	expectIDs("Email", "spencer@a.com")
+
+	if _, err := db.LookupByIndex(s, "User", "Tags", "a"); err == nil {
+		t.Error("expected error querying unindexed column")
+	}
+
+	// Foreign keys are indexed implicitly.
+	for _, row := range []Row{{"ID": 1, "UserID": 2}, {"ID": 2, "UserID": 3}, {"ID": 3, "UserID": 2}} {
+		if _, err := db.PutRow(s, "Photo", row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rows, err := db.LookupByIndex(s, "Photo", "UserID", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || rows[0]["ID"] != int64(1) || rows[1]["ID"] != int64(3) {
+		t.Errorf("expected photos 1 and 3; got %v", rows)
+	}
+}
+
+// TestUniqueIndexRace verifies that a row whose unique index check
+// passed before another row wrote the same value fails to write, with
+// a *ConflictError, rather than duplicating the value.
+func TestUniqueIndexRace(t *testing.T) {
+	db, s := createTestDBWithSchema(t)
+	user := s.byName["User"]
+	row, err := user.toRow(Row{"ID": 1, "Email": "spencer@a.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, err := user.encodePrimaryKey(row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp, err := db.checkUnique(s, user, user.byName["Email"], row["Email"], pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.PutRow(s, "User", Row{"ID": 2, "Email": "spencer@a.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Write row 1 as PutRow would have, with the stale check.
+	key, err := s.rowKey(user, pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := user.encodeRowValue(row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := &storage.BatchRequest{}
+	batch.Add(&storage.PutRequest{Key: key, Value: storage.Value{Bytes: value}})
+	if err := s.addIndexUpdates(batch, user, pk, nil, row, map[string][]byte{"Email": exp}); err != nil {
+		t.Fatal(err)
+	}
+	err = db.writeBatch(batch)
+	if err == nil {
+		t.Fatal("expected write of duplicate unique value to fail")
+	}
+	if err = db.uniqueConflict(s, user, row, pk, err); err == nil {
+		t.Error("expected conflict error")
+	} else if _, ok := err.(*ConflictError); !ok {
+		t.Errorf("expected conflict error; got %v", err)
+	}
+	if ok, err := db.GetRow(s, "User", Row{"ID": 1}); err != nil || ok {
+		t.Errorf("expected row 1 not to be written; got %t, %v", ok, err)
+	}
+	rows, err := db.LookupByIndex(s, "User", "Email", "spencer@a.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0]["ID"] != int64(2) {
+		t.Errorf("expected only row 2 indexed; got %v", rows)
+	}
+}
+
+// TestIndexBackfill verifies that indexes added to a table with
+// existing rows are backfilled, and that backfilling a unique index
+// fails on duplicate values.
+func TestIndexBackfill(t *testing.T) {
+	db := createTestDB(t)
+	s, err := NewYAMLSchema(testYAMLSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := s.byName["User"]
+	user.byName["Name"].Index = ""
+	user.byName["Email"].Index = ""
+	if err := db.PutSchema(s); err != nil {
+		t.Fatal(err)
+	}
+	// Write enough rows to require several backfill batches.
+	for i := 1; i <= 2*scanBatchSize+10; i++ {
+		row := Row{"ID": i, "Name": "dup", "Email": fmt.Sprintf("%d@a.com", i)}
+		if _, err := db.PutRow(s, "User", row); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	updated, err := NewYAMLSchema(testYAMLSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated.byName["User"].byName["Name"].Index = "unique"
+	if err := db.PutSchema(updated); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.WaitForIndex(updated, "User", "Email"); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := db.LookupByIndex(updated, "User", "Email", "7@a.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0]["ID"] != int64(7) {
+		t.Errorf("expected row 7; got %v", rows)
+	}
+
+	// The unique index on Name can't be built over duplicate values.
+	if err := db.WaitForIndex(updated, "User", "Name"); err == nil {
+		t.Error("expected unique index backfill to fail")
+	} else if _, ok := err.(*ConflictError); !ok {
+		t.Errorf("expected conflict error; got %v", err)
+	}
+	if _, err := db.LookupByIndex(updated, "User", "Name", "dup"); err == nil {
+		t.Error("expected lookup on failed index to fail")
+	}
+}
+
+// TestForeignKeyEnforcement verifies that foreign keys must reference
+// existing rows and that deletes apply ondelete policies transitively,
+// through cycles and across many batches of referencing rows.
+func TestForeignKeyEnforcement(t *testing.T) {
+	db := createTestDB(t)
+	s, err := NewYAMLSchema([]byte(`db:     FKDB
+db_key: fk
+tables:
+- table:     User
+  table_key: us
+  columns:
+  - {column: ID, column_key: id, type: integer, primary_key: true}
+- table:     Album
+  table_key: al
+  columns:
+  - {column: ID, column_key: id, type: integer, primary_key: true}
+  - {column: UserID, column_key: ui, type: integer, foreign_key: User.ID, ondelete: cascade}
+- table:     Photo
+  table_key: ph
+  columns:
+  - {column: ID, column_key: id, type: integer, primary_key: true}
+  - {column: AlbumID, column_key: ai, type: integer, foreign_key: Album.ID, ondelete: cascade}
+- table:     Comment
+  table_key: co
+  columns:
+  - {column: ID, column_key: id, type: integer, primary_key: true}
+  - {column: PhotoID, column_key: pi, type: integer, foreign_key: Photo.ID}
+- table:     Node
+  table_key: no
+  columns:
+  - {column: ID, column_key: id, type: integer, primary_key: true}
+  - {column: Next, column_key: ne, type: integer, foreign_key: Node.ID, ondelete: cascade}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutSchema(s); err != nil {
+		t.Fatal(err)
+	}
+	put := func(table string, row Row) {
+		if _, err := db.PutRow(s, table, row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exists := func(table string, id int) bool {
+		found, err := db.GetRow(s, table, Row{"ID": id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return found
+	}
+
+	if _, err := db.PutRow(s, "Album", Row{"ID": 1, "UserID": 1}); err == nil {
+		t.Error("expected error referencing missing user")
+	}
+	put("User", Row{"ID": 1})
+	put("Album", Row{"ID": 1, "UserID": 1})
+	// Enough photos to require several batches.
+	numPhotos := 2*onDeleteBatchSize + 10
+	for i := 1; i <= numPhotos; i++ {
+		put("Photo", Row{"ID": i, "AlbumID": 1})
+	}
+	put("Comment", Row{"ID": 1, "PhotoID": 1})
+	put("Comment", Row{"ID": 2, "PhotoID": numPhotos})
+	put("Comment", Row{"ID": 3})
+
+	// Deleting the user cascades to its album and photos and sets the
+	// comments' photo references null.
+	if err := db.DeleteRow(s, "User", Row{"ID": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if exists("Album", 1) || exists("Photo", 1) || exists("Photo", numPhotos) {
+		t.Error("expected album and photos to be deleted")
+	}
+	for i := 1; i <= 3; i++ {
+		row := Row{"ID": i}
+		if found, err := db.GetRow(s, "Comment", row); !found || err != nil {
+			t.Fatalf("expected comment %d; got %t, %v", i, found, err)
+		}
+		if _, ok := row["PhotoID"]; ok {
+			t.Errorf("expected comment %d's photo reference to be null; got %v", i, row)
+		}
+	}
+	if rows, err := db.LookupByIndex(s, "Comment", "PhotoID", 1); len(rows) != 0 || err != nil {
+		t.Errorf("expected no comments of photo 1; got %v, %v", rows, err)
+	}
+
+	// Cascades terminate on cycles, and rows may reference themselves.
+	put("Node", Row{"ID": 1})
+	put("Node", Row{"ID": 2, "Next": 1})
+	put("Node", Row{"ID": 3, "Next": 2})
+	put("Node", Row{"ID": 1, "Next": 3})
+	put("Node", Row{"ID": 4, "Next": 4})
+	if err := db.DeleteRow(s, "Node", Row{"ID": 2}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		if exists("Node", i) {
+			t.Errorf("expected node %d to be deleted", i)
+		}
+	}
+	if !exists("Node", 4) {
+		t.Error("expected node 4 to remain")
+	}
+	if err := db.DeleteRow(s, "Node", Row{"ID": 4}); err != nil || exists("Node", 4) {
+		t.Errorf("expected node 4 to be deleted; got %v", err)
+	}
+}
+
+// TestStructRows verifies rows are written from and read into Go
+// structs of a schema built with NewGoSchema, with every column type
+// surviving the round trip.
+func TestStructRows(t *testing.T) {
+	db := createTestDB(t)
+	type Sink struct {
+		ID       int64      `roach:"id,pk,auto"`
+		Bool     bool       `roach:"bo"`
+		Int      int        `roach:"i"`
+		Int8     int8       `roach:"i8"`
+		Int64    int64      `roach:"i64"`
+		Float32  float32    `roach:"f32"`
+		Float64  float64    `roach:"f64"`
+		String   string     `roach:"str"`
+		Blob     []byte     `roach:"bl"`
+		Time     time.Time  `roach:"ti"`
+		Location LatLong    `roach:"lo"`
+		IS       IntegerSet `roach:"is"`
+		SS       StringSet  `roach:"ss"`
+		IM       IntegerMap `roach:"im"`
+		SM       StringMap  `roach:"sm"`
+	}
+	s, err := NewGoSchema("Test", "t", map[string]interface{}{"sk": Sink{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutSchema(s); err != nil {
+		t.Fatal(err)
+	}
+	ks := &Sink{
+		Bool:     true,
+		Int8:     -8,
+		Int:      -1,
+		Int64:    1 << 40,
+		Float32:  0.5,
+		Float64:  -2.25,
+		String:   "a\x00b",
+		Blob:     []byte{0, 1, 2},
+		Time:     time.Unix(1400000000, 123).UTC(),
+		Location: LatLong{latitude: 40.7, longitude: -74.0, altitude: 10, accuracy: 5},
+		IS:       IntegerSet{-5: {}, 3: {}, 100: {}},
+		SS:       StringSet{"a": {}, "b": {}},
+		IM:       IntegerMap{"x": -1, "y": 2},
+		SM:       StringMap{"k": "v"},
+	}
+	if _, err := db.PutRow(s, "Sink", ks); err != nil {
+		t.Fatal(err)
+	}
+	// The auto-increment primary key was allocated.
+	if ks.ID != 1 {
+		t.Errorf("expected allocated ID 1; got %d", ks.ID)
+	}
+	read := &Sink{ID: ks.ID}
+	if found, err := db.GetRow(s, "Sink", read); !found || err != nil {
+		t.Fatalf("expected row; got %t, %v", found, err)
+	}
+	if !reflect.DeepEqual(read, ks) {
+		t.Errorf("expected %+v; got %+v", ks, read)
+	}
+
+	// The same row is readable as a map.
+	row := map[string]interface{}{"ID": 1}
+	if found, err := db.GetRow(s, "Sink", row); !found || err != nil {
+		t.Fatalf("expected row; got %t, %v", found, err)
+	}
+	if row["IS"] == nil || !reflect.DeepEqual(row["IS"], []int64{-5, 3, 100}) {
+		t.Errorf("expected sorted integer set; got %v", row["IS"])
+	}
+
+	if err := db.DeleteRow(s, "Sink", Sink{ID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if found, err := db.GetRow(s, "Sink", read); found || err != nil {
+		t.Errorf("expected deleted row; got %t, %v", found, err)
+	}
+
+	// Structs must match the table.
+	type Other struct {
+		ID string
+	}
+	if _, err := db.PutRow(s, "Sink", Other{ID: "a"}); err == nil {
+		t.Error("expected error writing mismatched struct")
+	}
+	if _, err := db.GetRow(s, "Sink", Sink{ID: 1}); err == nil {
+		t.Error("expected error reading into non-pointer struct")
+	}
+}
@@ -321,7 +321,8 @@ random location for the columnar data of User 531 within the
 non-uniformly distributed data. For example, primary keys generated
 from a monotonically-increasing sequence or from the current
 time. Keep in mind, however, that using "scatter" makes range scans
-impossible.
+expensive: a scan must be fanned out across all 65536 hash prefixes
+and the results merged to yield rows in primary key order.
 
   pdb/us/\x09\x31<E(530)>: <data for user 530>
   ...
@@ -338,17 +339,18 @@ concision).
   - table: Address
     table_key: ad
     columns:
-    - column:      ID
-      column_key:  id
-      type:        integer
-      primary_key: true
-
     - column:      UserID
       column_key:  ui
       type:        integer
+      primary_key: true
       foreign_key: User.ID
       interleave:  true
 
+    - column:      ID
+      column_key:  id
+      type:        integer
+      primary_key: true
+
     - column:     Street
       column_key: st
       type:       string
@@ -364,19 +366,25 @@ creation, for example) are likely to be part of the same cockroach key
 range and therefore will be committed without requiring a distributed
 transaction. If "interleave" is specified, the referenced table
 entity's key is used as a key prefix. This makes for longer keys, but
-guarantees all data is proximately located. If User 531 has two
+guarantees all data is proximately located. The interleaved foreign
+key columns must be part of the primary key, so that a row's key can
+be determined from its primary key alone. If User 531 has two
 addresses, with ids 35 & 56 respectively, the underlying data would
 look like:
 
   pdb/us/<E(529)>: <data for user 529>
   ...
   pdb/us/<E(531)>: <data for user 531>
-  pdb/us/<E(531)>/ad/<E(35)>: <data for address 35>
-  pdb/us/<E(531)>/ad/<E(56)>: <data for address 56>
+  pdb/us/<E(531)>/ad/<E(531)><E(35)>: <data for address 35>
+  pdb/us/<E(531)>/ad/<E(531)><E(56)>: <data for address 56>
   ...
   pdb/us/<E(600)>: <data for user 600>
   ...
 
+A user and all of its addresses (its "entity group") can therefore be
+read with a single range scan. Interleaved tables may themselves be
+referenced by interleaved tables, but may not be scattered.
+
 Indexes
 
 Indexes provide efficient access to rows in the database by columnar
@@ -0,0 +1,387 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package structured
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"sort"
+	"time"
+
+	"gossipgo/util"
+)
+
+// Values of primary key and indexed columns are encoded in keys such
+// that the byte order of encoded values matches the natural order of
+// the values. Integers, floats and times are encoded as eight bytes,
+// big-endian, with their sign manipulated to sort negative values
+// before positive ones. Strings and blobs escape each 0x00 byte as
+// 0x00 0xff and are terminated by 0x00 0x01, so that an encoded value
+// is never a prefix of another.
+
+const (
+	escape     byte = 0x00
+	escaped00  byte = 0xff
+	terminator byte = 0x01
+)
+
+// encodeKeyValue appends the ordered encoding of the value to b. The
+// value must be of the Go type which stores values of its column type.
+func encodeKeyValue(b []byte, v interface{}) ([]byte, error) {
+	switch t := v.(type) {
+	case int64:
+		return encodeUint64(b, uint64(t)^(1<<63)), nil
+	case float64:
+		bits := math.Float64bits(t)
+		if bits&(1<<63) != 0 {
+			bits = ^bits
+		} else {
+			bits ^= 1 << 63
+		}
+		return encodeUint64(b, bits), nil
+	case string:
+		return encodeBytes(b, []byte(t)), nil
+	case []byte:
+		return encodeBytes(b, t), nil
+	case time.Time:
+		return encodeUint64(b, uint64(t.UnixNano())^(1<<63)), nil
+	}
+	return nil, util.Errorf("values of type %T can't be encoded in keys", v)
+}
+
+// decodeKeyValue decodes a value of the column type from the start of
+// b. Returns the value and the remainder of b.
+func decodeKeyValue(b []byte, typ string) (interface{}, []byte, error) {
+	switch typ {
+	case "integer", "float", "time":
+		if len(b) < 8 {
+			return nil, nil, util.Errorf("insufficient bytes to decode %s value: %q", typ, b)
+		}
+		u, rest := binary.BigEndian.Uint64(b), b[8:]
+		switch typ {
+		case "integer":
+			return int64(u ^ (1 << 63)), rest, nil
+		case "float":
+			if u&(1<<63) != 0 {
+				u ^= 1 << 63
+			} else {
+				u = ^u
+			}
+			return math.Float64frombits(u), rest, nil
+		default:
+			return time.Unix(0, int64(u^(1<<63))).UTC(), rest, nil
+		}
+	case "string", "blob":
+		var buf []byte
+		for {
+			i := bytes.IndexByte(b, escape)
+			if i == -1 || i+1 >= len(b) {
+				return nil, nil, util.Errorf("unterminated %s value: %q", typ, b)
+			}
+			buf = append(buf, b[:i]...)
+			switch b[i+1] {
+			case escaped00:
+				buf = append(buf, escape)
+				b = b[i+2:]
+			case terminator:
+				if typ == "string" {
+					return string(buf), b[i+2:], nil
+				}
+				if buf == nil {
+					buf = []byte{}
+				}
+				return buf, b[i+2:], nil
+			default:
+				return nil, nil, util.Errorf("invalid escape in %s value: %q", typ, b)
+			}
+		}
+	}
+	return nil, nil, util.Errorf("values of type %s can't be decoded from keys", typ)
+}
+
+func encodeUint64(b []byte, u uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], u)
+	return append(b, buf[:]...)
+}
+
+func encodeBytes(b, v []byte) []byte {
+	for _, c := range v {
+		b = append(b, c)
+		if c == escape {
+			b = append(b, escaped00)
+		}
+	}
+	return append(b, escape, terminator)
+}
+
+// Row values are encoded as a format byte followed by a sequence of
+// (column key, column value) pairs, each length-prefixed with a
+// uvarint, for the row's non-primary-key columns which have values.
+// Column values use a compact encoding for their type:
+//
+//	integer:    varint
+//	float:      eight bytes, big-endian IEEE 754
+//	string:     raw bytes
+//	blob:       raw bytes
+//	time:       varint nanoseconds since the Unix epoch
+//	latlong:    eight bytes per component, as float
+//	integerset: varint of the smallest value followed by uvarint
+//	            deltas between successive values
+//	stringset:  length-prefixed values in sorted order
+//	integermap: length-prefixed keys in sorted order, each followed
+//	            by its varint value
+//	stringmap:  length-prefixed keys in sorted order, each followed
+//	            by its length-prefixed value
+//
+// Storing column keys within the value keeps values readable when
+// debugging and allows columns to be added or removed from a table.
+// Values of columns no longer in the table are ignored on decode.
+
+// rowFormat identifies the format of encoded row values. The format
+// byte also distinguishes a row without values from a missing row.
+const rowFormat byte = 1
+
+// encodeRowValue returns the encoded value of the row.
+func (t *Table) encodeRowValue(row Row) ([]byte, error) {
+	b := []byte{rowFormat}
+	for _, c := range t.Columns {
+		v, ok := row[c.Name]
+		if c.PrimaryKey || !ok {
+			continue
+		}
+		data, err := encodeColumnValue(nil, v)
+		if err != nil {
+			return nil, util.Errorf("column %q: %v", c.Name, err)
+		}
+		b = appendLengthPrefixed(b, []byte(c.Key))
+		b = appendLengthPrefixed(b, data)
+	}
+	return b, nil
+}
+
+// decodeRowValue decodes the encoded row value into row.
+func (t *Table) decodeRowValue(b []byte, row Row) error {
+	if len(b) == 0 || b[0] != rowFormat {
+		return util.Errorf("table %q: unknown row value format", t.Name)
+	}
+	for b = b[1:]; len(b) > 0; {
+		key, rest, err := readLengthPrefixed(b)
+		if err != nil {
+			return err
+		}
+		data, rest, err := readLengthPrefixed(rest)
+		if err != nil {
+			return err
+		}
+		b = rest
+		c, ok := t.byKey[string(key)]
+		if !ok {
+			continue
+		}
+		if row[c.Name], err = decodeColumnValue(data, c.Type); err != nil {
+			return util.Errorf("column %q: %v", c.Name, err)
+		}
+	}
+	return nil
+}
+
+// encodeColumnValue appends the compact encoding of the column value
+// to b. The value must be of the Go type which stores values of its
+// column type.
+func encodeColumnValue(b []byte, v interface{}) ([]byte, error) {
+	switch t := v.(type) {
+	case int64:
+		return appendVarint(b, t), nil
+	case float64:
+		return encodeUint64(b, math.Float64bits(t)), nil
+	case string:
+		return append(b, t...), nil
+	case []byte:
+		return append(b, t...), nil
+	case time.Time:
+		return appendVarint(b, t.UnixNano()), nil
+	case []float64:
+		for _, f := range t {
+			b = encodeUint64(b, math.Float64bits(f))
+		}
+		return b, nil
+	case []int64:
+		for i, n := range t {
+			if i == 0 {
+				b = appendVarint(b, n)
+			} else {
+				b = appendUvarint(b, uint64(n-t[i-1]))
+			}
+		}
+		return b, nil
+	case []string:
+		for _, s := range t {
+			b = appendLengthPrefixed(b, []byte(s))
+		}
+		return b, nil
+	case map[string]int64:
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			b = appendLengthPrefixed(b, []byte(k))
+			b = appendVarint(b, t[k])
+		}
+		return b, nil
+	case map[string]string:
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			b = appendLengthPrefixed(b, []byte(k))
+			b = appendLengthPrefixed(b, []byte(t[k]))
+		}
+		return b, nil
+	}
+	return nil, util.Errorf("values of type %T can't be encoded", v)
+}
+
+// decodeColumnValue decodes the compact encoding of a value of the
+// column type.
+func decodeColumnValue(b []byte, typ string) (interface{}, error) {
+	switch typ {
+	case "integer":
+		n, err := readVarint(b)
+		return n, err
+	case "float":
+		if len(b) != 8 {
+			return nil, util.Errorf("invalid float value: %q", b)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+	case "string":
+		return string(b), nil
+	case "blob":
+		return append([]byte{}, b...), nil
+	case "time":
+		n, err := readVarint(b)
+		if err != nil {
+			return nil, err
+		}
+		return time.Unix(0, n).UTC(), nil
+	case "latlong":
+		if len(b)%8 != 0 {
+			return nil, util.Errorf("invalid latlong value: %q", b)
+		}
+		ll := make([]float64, len(b)/8)
+		for i := range ll {
+			ll[i] = math.Float64frombits(binary.BigEndian.Uint64(b[i*8:]))
+		}
+		return ll, nil
+	case "integerset":
+		set := []int64{}
+		for len(b) > 0 {
+			if len(set) == 0 {
+				n, l := binary.Varint(b)
+				if l <= 0 {
+					return nil, util.Errorf("invalid integerset value")
+				}
+				set, b = append(set, n), b[l:]
+				continue
+			}
+			delta, l := binary.Uvarint(b)
+			if l <= 0 {
+				return nil, util.Errorf("invalid integerset value")
+			}
+			set, b = append(set, set[len(set)-1]+int64(delta)), b[l:]
+		}
+		return set, nil
+	case "stringset":
+		set := []string{}
+		for len(b) > 0 {
+			s, rest, err := readLengthPrefixed(b)
+			if err != nil {
+				return nil, err
+			}
+			set, b = append(set, string(s)), rest
+		}
+		return set, nil
+	case "integermap":
+		m := map[string]int64{}
+		for len(b) > 0 {
+			k, rest, err := readLengthPrefixed(b)
+			if err != nil {
+				return nil, err
+			}
+			n, l := binary.Varint(rest)
+			if l <= 0 {
+				return nil, util.Errorf("invalid integermap value")
+			}
+			m[string(k)], b = n, rest[l:]
+		}
+		return m, nil
+	case "stringmap":
+		m := map[string]string{}
+		for len(b) > 0 {
+			k, rest, err := readLengthPrefixed(b)
+			if err != nil {
+				return nil, err
+			}
+			v, rest, err := readLengthPrefixed(rest)
+			if err != nil {
+				return nil, err
+			}
+			m[string(k)], b = string(v), rest
+		}
+		return m, nil
+	}
+	return nil, util.Errorf("unknown column type %q", typ)
+}
+
+func appendVarint(b []byte, n int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutVarint(buf[:], n)]...)
+}
+
+func appendUvarint(b []byte, n uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], n)]...)
+}
+
+func appendLengthPrefixed(b, data []byte) []byte {
+	return append(appendUvarint(b, uint64(len(data))), data...)
+}
+
+// readVarint decodes b, which must contain exactly one varint.
+func readVarint(b []byte) (int64, error) {
+	n, l := binary.Varint(b)
+	if l <= 0 || l != len(b) {
+		return 0, util.Errorf("invalid varint: %q", b)
+	}
+	return n, nil
+}
+
+// readLengthPrefixed reads a length-prefixed byte slice from the start
+// of b. Returns the slice and the remainder of b.
+func readLengthPrefixed(b []byte) ([]byte, []byte, error) {
+	n, l := binary.Uvarint(b)
+	if l <= 0 || uint64(len(b)-l) < n {
+		return nil, nil, util.Errorf("invalid length-prefixed value: %q", b)
+	}
+	return b[l : l+int(n)], b[l+int(n):], nil
+}
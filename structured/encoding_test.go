@@ -0,0 +1,114 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package structured
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestKeyValueEncoding verifies that encoded values decode to the
+// original values and sort in the order of the values.
+func TestKeyValueEncoding(t *testing.T) {
+	testCases := []struct {
+		typ    string
+		values []interface{}
+	}{
+		{"integer", []interface{}{int64(math.MinInt64), int64(-1), int64(0), int64(1), int64(531), int64(math.MaxInt64)}},
+		{"float", []interface{}{math.Inf(-1), -1.5, -0.25, 0.0, 0.25, 1.5, math.Inf(1)}},
+		{"string", []interface{}{"", "\x00", "\x00\x00", "\x00a", "a", "a\x00", "ab", "b"}},
+		{"blob", []interface{}{[]byte{}, []byte{0}, []byte{0, 0xff}, []byte{1}, []byte{0xff}}},
+		{"time", []interface{}{time.Unix(0, -1).UTC(), time.Unix(0, 0).UTC(), time.Unix(1400000000, 5).UTC()}},
+	}
+	for _, test := range testCases {
+		var last []byte
+		for i, v := range test.values {
+			// Append a suffix to verify decoding stops at the end of the value.
+			encoded, err := encodeKeyValue(nil, v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, rest, err := decodeKeyValue(append(encoded, "suffix"...), test.typ)
+			if err != nil {
+				t.Fatalf("%s %d: %v", test.typ, i, err)
+			}
+			if !reflect.DeepEqual(decoded, v) || string(rest) != "suffix" {
+				t.Errorf("%s %d: expected %v with suffix; got %v with %q", test.typ, i, v, decoded, rest)
+			}
+			if i > 0 && bytes.Compare(last, encoded) >= 0 {
+				t.Errorf("%s %d: expected %q to sort before %q", test.typ, i, last, encoded)
+			}
+			last = encoded
+		}
+	}
+}
+
+// TestKeyValueEncodingUnsupported verifies that composite values
+// can't be encoded in keys.
+func TestKeyValueEncodingUnsupported(t *testing.T) {
+	for _, v := range []interface{}{[]int64{1}, map[string]string{}, true, nil} {
+		if _, err := encodeKeyValue(nil, v); err == nil {
+			t.Errorf("expected error encoding %v", v)
+		}
+	}
+	if _, _, err := decodeKeyValue([]byte("abc"), "string"); err == nil {
+		t.Error("expected error decoding unterminated string")
+	}
+}
+
+// TestColumnValueEncoding verifies the compact encoding of each type of
+// column value round trips.
+func TestColumnValueEncoding(t *testing.T) {
+	testCases := []struct {
+		typ   string
+		value interface{}
+	}{
+		{"integer", int64(0)},
+		{"integer", int64(-1 << 40)},
+		{"float", -2.5},
+		{"string", ""},
+		{"string", "a\x00b"},
+		{"blob", []byte{0, 1, 0xff}},
+		{"time", time.Unix(1400000000, 123).UTC()},
+		{"latlong", []float64{40.7, -74.0, 10, 5}},
+		{"integerset", []int64{}},
+		{"integerset", []int64{-5, 3, 100, 1 << 40}},
+		{"stringset", []string{"", "a", "b"}},
+		{"integermap", map[string]int64{"x": -1, "y": 2}},
+		{"stringmap", map[string]string{"": "", "k": "v"}},
+	}
+	for i, test := range testCases {
+		encoded, err := encodeColumnValue(nil, test.value)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		decoded, err := decodeColumnValue(encoded, test.typ)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if !reflect.DeepEqual(decoded, test.value) {
+			t.Errorf("%d: expected %v; got %v", i, test.value, decoded)
+		}
+	}
+	if _, err := decodeColumnValue([]byte{1, 2, 3}, "float"); err == nil {
+		t.Error("expected error decoding truncated float")
+	}
+}
@@ -18,8 +18,13 @@
 package structured
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strings"
 )
 
 const (
@@ -30,6 +35,23 @@ const (
 
 // A RESTServer provides a RESTful HTTP API to interact with
 // an underlying key-value store.
+//
+// Schemas are declared in YAML and rows are represented in JSON as
+// objects keyed by column name. Schemas, tables and columns are
+// addressed by name:
+//
+//	GET    /structured/                           list schemas
+//	PUT    /structured/[<schema>]                 register a schema
+//	GET    /structured/<schema>                   fetch a schema
+//	PUT    /structured/<schema>/<table>           write a row
+//	GET    /structured/<schema>/<table>/<pk>...   fetch a row
+//	DELETE /structured/<schema>/<table>/<pk>...   delete a row
+//	GET    /structured/<schema>/<table>?<column>=<value>
+//	                                              query an index
+//
+// Rows are addressed by their primary key column values, one path
+// segment per column in primary key order. POST may be used in place
+// of PUT.
 type RESTServer struct {
 	db *DB // Structured database client
 }
@@ -42,15 +64,234 @@ func NewRESTServer(db *DB) *RESTServer {
 // HandleAction arbitrates requests to the appropriate function
 // based on the request’s HTTP method.
 func (s *RESTServer) HandleAction(w http.ResponseWriter, r *http.Request) {
+	path, err := splitPath(r.URL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	switch r.Method {
 	case "GET":
-		//s.handleGetAction(w, r)
+		s.handleGetAction(w, r, path)
 	case "PUT", "POST":
-		//s.handlePutAction(w, r)
+		s.handlePutAction(w, r, path)
 	case "DELETE":
-		//s.handleDeleteAction(w, r)
+		s.handleDeleteAction(w, r, path)
 	default:
 		errStr := fmt.Sprintf("unhandled HTTP method %s: %s", r.Method, http.StatusText(http.StatusBadRequest))
 		http.Error(w, errStr, http.StatusBadRequest)
 	}
 }
+
+// splitPath returns the unescaped segments of the URL path following
+// StructuredKeyPrefix. Segments are unescaped individually so that
+// primary key values may contain escaped '/' characters.
+func splitPath(u *url.URL) ([]string, error) {
+	trimmed := strings.Trim(strings.TrimPrefix(u.EscapedPath(), StructuredKeyPrefix), "/")
+	if trimmed == "" {
+		return nil, nil
+	}
+	path := strings.Split(trimmed, "/")
+	for i := range path {
+		var err error
+		if path[i], err = url.PathUnescape(path[i]); err != nil {
+			return nil, err
+		}
+	}
+	return path, nil
+}
+
+func (s *RESTServer) handleGetAction(w http.ResponseWriter, r *http.Request, path []string) {
+	if len(path) == 0 {
+		// Schemas are listed as a stream of YAML documents.
+		schemas, err := s.db.GetSchemas()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		var docs [][]byte
+		for _, schema := range schemas {
+			doc, err := schema.ToYAML()
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			docs = append(docs, doc)
+		}
+		writeYAML(w, bytes.Join(docs, []byte("---\n")))
+		return
+	}
+	schema, ok := s.getSchema(w, path[0])
+	if !ok {
+		return
+	}
+	switch {
+	case len(path) == 1:
+		doc, err := schema.ToYAML()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeYAML(w, doc)
+	case len(path) == 2:
+		query := r.URL.Query()
+		if len(query) != 1 {
+			http.Error(w, "expected a single <column>=<value> index query", http.StatusBadRequest)
+			return
+		}
+		for column, values := range query {
+			rows, err := s.db.LookupByIndex(schema, path[1], column, values[0])
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			if rows == nil {
+				rows = []Row{}
+			}
+			writeJSON(w, rows)
+		}
+	default:
+		row, err := primaryKeyRow(schema, path[1], path[2:])
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		found, err := s.db.GetRow(schema, path[1], row)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if !found {
+			http.Error(w, "row not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, row)
+	}
+}
+
+func (s *RESTServer) handlePutAction(w http.ResponseWriter, r *http.Request, path []string) {
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer r.Body.Close()
+	switch len(path) {
+	case 0, 1:
+		schema, err := NewYAMLSchema(b)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(path) == 1 && path[0] != schema.Name {
+			http.Error(w, fmt.Sprintf("schema name %q doesn't match path %q", schema.Name, path[0]), http.StatusBadRequest)
+			return
+		}
+		if err := s.db.PutSchema(schema); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	case 2:
+		schema, ok := s.getSchema(w, path[0])
+		if !ok {
+			return
+		}
+		var row Row
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.UseNumber()
+		if err := dec.Decode(&row); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		written, err := s.db.PutRow(schema, path[1], row)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, written)
+	default:
+		http.Error(w, "rows are written to /structured/<schema>/<table>", http.StatusBadRequest)
+	}
+}
+
+func (s *RESTServer) handleDeleteAction(w http.ResponseWriter, r *http.Request, path []string) {
+	if len(path) < 3 {
+		http.Error(w, "only rows may be deleted", http.StatusBadRequest)
+		return
+	}
+	schema, ok := s.getSchema(w, path[0])
+	if !ok {
+		return
+	}
+	row, err := primaryKeyRow(schema, path[1], path[2:])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := s.db.DeleteRow(schema, path[1], row); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// getSchema fetches the named schema. If the schema can't be fetched,
+// an error is written to w and false is returned.
+func (s *RESTServer) getSchema(w http.ResponseWriter, name string) (*Schema, bool) {
+	schema, err := s.db.GetSchema(name)
+	if err != nil {
+		writeError(w, err)
+		return nil, false
+	}
+	if schema == nil {
+		http.Error(w, fmt.Sprintf("schema %q not found", name), http.StatusNotFound)
+		return nil, false
+	}
+	return schema, true
+}
+
+// primaryKeyRow returns a row of the named table with the primary key
+// column values, supplied in primary key column order.
+func primaryKeyRow(schema *Schema, tableName string, values []string) (Row, error) {
+	t, err := schema.getTable(tableName)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) != len(t.primaryKey) {
+		return nil, invalidf("table %q: expected %d primary key values; got %d", t.Name, len(t.primaryKey), len(values))
+	}
+	row := Row{}
+	for i, c := range t.primaryKey {
+		row[c.Name] = values[i]
+	}
+	return row, nil
+}
+
+// writeError writes the error with status bad request if it's caused
+// by invalid input and internal server error otherwise.
+func writeError(w http.ResponseWriter, err error) {
+	switch err.(type) {
+	case *invalidError:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case *ConflictError:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+func writeYAML(w http.ResponseWriter, b []byte) {
+	w.Header().Set("Content-Type", "text/yaml")
+	w.Write(b)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
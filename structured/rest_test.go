@@ -0,0 +1,85 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package structured
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestRESTServer verifies registering and fetching schemas and
+// writing, reading, querying and deleting rows via the REST API.
+func TestRESTServer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(NewRESTServer(createTestDB(t)).HandleAction))
+	defer server.Close()
+
+	request := func(method, path, body string, expStatus int) string {
+		req, err := http.NewRequest(method, server.URL+StructuredKeyPrefix+path, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != expStatus {
+			t.Errorf("%s %s: expected status %d; got %d: %s", method, path, expStatus, resp.StatusCode, b)
+		}
+		return string(b)
+	}
+
+	request("GET", "PhotoDB", "", http.StatusNotFound)
+	request("PUT", "", "db: [", http.StatusBadRequest)
+	request("PUT", "OtherDB", string(testYAMLSchema), http.StatusBadRequest)
+	request("PUT", "PhotoDB", string(testYAMLSchema), http.StatusOK)
+	if yaml := request("GET", "PhotoDB", "", http.StatusOK); !strings.HasPrefix(yaml, "db: PhotoDB\ndb_key: pdb\n") {
+		t.Errorf("unexpected schema YAML:\n%s", yaml)
+	}
+	if yaml := request("GET", "", "", http.StatusOK); !strings.Contains(yaml, "db: PhotoDB") {
+		t.Errorf("unexpected schema list:\n%s", yaml)
+	}
+
+	if body := request("POST", "PhotoDB/User", `{"Name": "spencer", "Email": "s/k@a.com"}`, http.StatusOK); body != `{"Email":"s/k@a.com","ID":100,"Name":"spencer"}` {
+		t.Errorf("unexpected written row %s", body)
+	}
+	request("PUT", "PhotoDB/User", `{"ID": 1, "Email": "s/k@a.com"}`, http.StatusConflict)
+	request("PUT", "PhotoDB/User", `{"ID": 1, "Unknown": 1}`, http.StatusBadRequest)
+	request("PUT", "PhotoDB/Missing", `{"ID": 1}`, http.StatusBadRequest)
+	if body := request("GET", "PhotoDB/User/100", "", http.StatusOK); body != `{"Email":"s/k@a.com","ID":100,"Name":"spencer"}` {
+		t.Errorf("unexpected row %s", body)
+	}
+	if body := request("GET", "PhotoDB/User?Email=s%2Fk@a.com", "", http.StatusOK); body != `[{"Email":"s/k@a.com","ID":100,"Name":"spencer"}]` {
+		t.Errorf("unexpected query result %s", body)
+	}
+	request("GET", "PhotoDB/User/abc", "", http.StatusBadRequest)
+	request("DELETE", "PhotoDB/User/100", "", http.StatusOK)
+	request("GET", "PhotoDB/User/100", "", http.StatusNotFound)
+	if body := request("GET", "PhotoDB/User?Name=spencer", "", http.StatusOK); body != `[]` {
+		t.Errorf("expected no rows; got %s", body)
+	}
+	request("DELETE", "PhotoDB", "", http.StatusBadRequest)
+}
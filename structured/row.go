@@ -0,0 +1,479 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package structured
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// A Row maps column names to column values. Values are stored using
+// the following Go types, by column type:
+//
+//	integer:    int64
+//	float:      float64
+//	string:     string
+//	blob:       []byte
+//	time:       time.Time
+//	latlong:    []float64 (latitude, longitude[, altitude[, accuracy]])
+//	integerset: []int64, sorted
+//	stringset:  []string, sorted
+//	integermap: map[string]int64
+//	stringmap:  map[string]string
+//
+// Rows encode to JSON naturally; blobs are base64 encoded and times
+// are formatted per RFC 3339.
+//
+// Rows may also be supplied to and read into Go structs, such as those
+// from which a schema is built with NewGoSchema. Struct fields map to
+// the columns of the same name.
+type Row map[string]interface{}
+
+// An invalidError indicates that a schema, row or key supplied by the
+// client is invalid.
+type invalidError struct {
+	msg string
+}
+
+func (e *invalidError) Error() string {
+	return e.msg
+}
+
+// invalidf returns an invalidError formatted from the arguments.
+func invalidf(format string, a ...interface{}) error {
+	return &invalidError{fmt.Sprintf(format, a...)}
+}
+
+// A ConflictError indicates that a row couldn't be written because
+// another row has the same value for a uniquely indexed column.
+type ConflictError struct {
+	Table, Column string
+	Value         interface{}
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("table %q: unique index on column %q already contains %v", e.Table, e.Column, e.Value)
+}
+
+// convert returns the value as the Go type which stores values of the
+// column type. In addition to values of that type, convert accepts
+// the Go types of struct fields for the column type, values as
+// decoded from JSON (e.g. json.Number, float64, base64 strings for
+// blobs and RFC 3339 strings for times) and, for scalar types, values
+// formatted as strings, as found in URLs.
+func (c *Column) convert(v interface{}) (interface{}, error) {
+	var result interface{}
+	var err error
+	switch c.Type {
+	case "integer":
+		result, err = toInt64(v)
+	case "float":
+		result, err = toFloat64(v)
+	case "string":
+		result, err = toString(v)
+	case "blob":
+		switch t := v.(type) {
+		case []byte:
+			result = t
+		case string:
+			result, err = base64.StdEncoding.DecodeString(t)
+		default:
+			err = fmt.Errorf("expected base64 string")
+		}
+	case "time":
+		switch t := v.(type) {
+		case time.Time:
+			result = t
+		case string:
+			result, err = time.Parse(time.RFC3339Nano, t)
+		default:
+			err = fmt.Errorf("expected RFC 3339 string")
+		}
+	case "latlong":
+		if t, ok := v.(LatLong); ok {
+			v = []float64{t.latitude, t.longitude, t.altitude, t.accuracy}
+		}
+		var ll []float64
+		if ll, err = toFloat64Slice(v); err == nil && (len(ll) < 2 || len(ll) > 4) {
+			err = fmt.Errorf("expected 2-4 values; got %d", len(ll))
+		}
+		result = ll
+	case "integerset":
+		if t, ok := v.(IntegerSet); ok {
+			list := make([]int64, 0, len(t))
+			for i := range t {
+				list = append(list, i)
+			}
+			v = list
+		}
+		var set []int64
+		if set, err = toInt64Slice(v); err == nil {
+			sort.Sort(int64Slice(set))
+			n := 0
+			for i := range set {
+				if i == 0 || set[i] != set[n-1] {
+					set[n] = set[i]
+					n++
+				}
+			}
+			result = set[:n]
+		}
+	case "stringset":
+		if t, ok := v.(StringSet); ok {
+			list := make([]string, 0, len(t))
+			for s := range t {
+				list = append(list, s)
+			}
+			v = list
+		}
+		var set []string
+		if set, err = toStringSlice(v); err == nil {
+			sort.Strings(set)
+			n := 0
+			for i := range set {
+				if i == 0 || set[i] != set[n-1] {
+					set[n] = set[i]
+					n++
+				}
+			}
+			result = set[:n]
+		}
+	case "integermap":
+		m := map[string]int64{}
+		switch t := v.(type) {
+		case map[string]int64:
+			m = t
+		case IntegerMap:
+			m = t
+		case map[string]interface{}:
+			for k, e := range t {
+				if m[k], err = toInt64(e); err != nil {
+					break
+				}
+			}
+		default:
+			err = fmt.Errorf("expected map of integers")
+		}
+		result = m
+	case "stringmap":
+		m := map[string]string{}
+		switch t := v.(type) {
+		case map[string]string:
+			m = t
+		case StringMap:
+			m = t
+		case map[string]interface{}:
+			for k, e := range t {
+				if m[k], err = toString(e); err != nil {
+					break
+				}
+			}
+		default:
+			err = fmt.Errorf("expected map of strings")
+		}
+		result = m
+	default:
+		err = fmt.Errorf("unknown type")
+	}
+	if err != nil {
+		return nil, invalidf("column %q: invalid %s value %v: %v", c.Name, c.Type, v, err)
+	}
+	return result, nil
+}
+
+func toInt64(v interface{}) (int64, error) {
+	switch t := v.(type) {
+	case int64:
+		return t, nil
+	case int:
+		return int64(t), nil
+	case int32:
+		return int64(t), nil
+	case int16:
+		return int64(t), nil
+	case int8:
+		return int64(t), nil
+	case bool:
+		if t {
+			return 1, nil
+		}
+		return 0, nil
+	case float64:
+		if t != float64(int64(t)) {
+			return 0, fmt.Errorf("not an integer")
+		}
+		return int64(t), nil
+	case json.Number:
+		return t.Int64()
+	case string:
+		return strconv.ParseInt(t, 10, 64)
+	}
+	return 0, fmt.Errorf("expected integer")
+}
+
+func toFloat64(v interface{}) (float64, error) {
+	switch t := v.(type) {
+	case float64:
+		return t, nil
+	case float32:
+		return float64(t), nil
+	case int64:
+		return float64(t), nil
+	case int:
+		return float64(t), nil
+	case json.Number:
+		return t.Float64()
+	case string:
+		return strconv.ParseFloat(t, 64)
+	}
+	return 0, fmt.Errorf("expected float")
+}
+
+func toString(v interface{}) (string, error) {
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+	return "", fmt.Errorf("expected string")
+}
+
+func toFloat64Slice(v interface{}) ([]float64, error) {
+	if s, ok := v.([]float64); ok {
+		return s, nil
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected list of floats")
+	}
+	s := make([]float64, len(list))
+	for i, e := range list {
+		var err error
+		if s[i], err = toFloat64(e); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func toInt64Slice(v interface{}) ([]int64, error) {
+	if s, ok := v.([]int64); ok {
+		return append([]int64(nil), s...), nil
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected list of integers")
+	}
+	s := make([]int64, len(list))
+	for i, e := range list {
+		var err error
+		if s[i], err = toInt64(e); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func toStringSlice(v interface{}) ([]string, error) {
+	if s, ok := v.([]string); ok {
+		return append([]string(nil), s...), nil
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected list of strings")
+	}
+	s := make([]string, len(list))
+	for i, e := range list {
+		var err error
+		if s[i], err = toString(e); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// toRow returns the row supplied as a Row, a map[string]interface{}
+// or a struct or pointer to struct, as a Row of column values for the
+// table. Struct fields which are zero-valued auto-increment columns
+// are omitted so that their values are allocated, and zero-valued
+// foreign key columns are omitted as null references.
+func (t *Table) toRow(v interface{}) (Row, error) {
+	var row Row
+	switch r := v.(type) {
+	case Row:
+		row = r
+	case map[string]interface{}:
+		row = Row(r)
+	default:
+		sv, err := t.structValue(v)
+		if err != nil {
+			return nil, err
+		}
+		row = Row{}
+		for i := 0; i < sv.NumField(); i++ {
+			f := sv.Field(i)
+			c := t.byName[sv.Type().Field(i).Name]
+			if (c.Auto != nil || c.ForeignKey != "") && f.Interface() == reflect.Zero(f.Type()).Interface() {
+				continue
+			}
+			if (f.Kind() == reflect.Map || f.Kind() == reflect.Slice) && f.IsNil() {
+				continue
+			}
+			row[c.Name] = f.Interface()
+		}
+	}
+	converted := Row{}
+	for name, value := range row {
+		c, ok := t.byName[name]
+		if !ok {
+			return nil, invalidf("table %q: unknown column %q", t.Name, name)
+		}
+		if value == nil {
+			continue
+		}
+		var err error
+		if converted[name], err = c.convert(value); err != nil {
+			return nil, err
+		}
+	}
+	return converted, nil
+}
+
+// fromRow sets the row of column values into v, which is a Row, a
+// map[string]interface{} or a pointer to a struct. Entries and fields
+// of columns which the row lacks are cleared.
+func (t *Table) fromRow(row Row, v interface{}) error {
+	var m map[string]interface{}
+	switch r := v.(type) {
+	case Row:
+		m = r
+	case map[string]interface{}:
+		m = r
+	default:
+		sv, err := t.destValue(v)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < sv.NumField(); i++ {
+			f := sv.Field(i)
+			f.Set(reflect.Zero(f.Type()))
+			if value, ok := row[sv.Type().Field(i).Name]; ok {
+				setField(f, value)
+			}
+		}
+		return nil
+	}
+	for name := range m {
+		delete(m, name)
+	}
+	for name, value := range row {
+		m[name] = value
+	}
+	return nil
+}
+
+// destValue returns the struct pointed to by v for reading a row into
+// it. Maps are returned as the zero Value.
+func (t *Table) destValue(v interface{}) (reflect.Value, error) {
+	switch v.(type) {
+	case Row, map[string]interface{}:
+		return reflect.Value{}, nil
+	}
+	if reflect.ValueOf(v).Kind() != reflect.Ptr {
+		return reflect.Value{}, invalidf("table %q: rows must be read into a map or a pointer to a struct; got %T", t.Name, v)
+	}
+	return t.structValue(v)
+}
+
+// structValue returns the struct supplied as v, a struct or pointer to
+// a struct. Each field of the struct must correspond to a column of
+// the table of the same name and type.
+func (t *Table) structValue(v interface{}) (reflect.Value, error) {
+	sv := reflect.Indirect(reflect.ValueOf(v))
+	if sv.Kind() != reflect.Struct {
+		return reflect.Value{}, invalidf("table %q: unsupported row type %T", t.Name, v)
+	}
+	for i := 0; i < sv.NumField(); i++ {
+		sf := sv.Type().Field(i)
+		c, ok := t.byName[sf.Name]
+		if !ok {
+			return reflect.Value{}, invalidf("table %q: field %s.%s has no column", t.Name, sv.Type().Name(), sf.Name)
+		}
+		if typ, err := getSchemaType(sf); err != nil || typ != c.Type {
+			return reflect.Value{}, invalidf("table %q: field %s.%s of type %s doesn't match column type %s",
+				t.Name, sv.Type().Name(), sf.Name, sf.Type, c.Type)
+		}
+	}
+	return sv, nil
+}
+
+// setField sets the struct field to the column value. The field type
+// must correspond to the column type of the value, as verified by
+// structValue.
+func setField(f reflect.Value, v interface{}) {
+	switch t := v.(type) {
+	case int64:
+		if f.Kind() == reflect.Bool {
+			f.SetBool(t != 0)
+		} else {
+			f.SetInt(t)
+		}
+	case float64:
+		f.SetFloat(t)
+	case string:
+		f.SetString(t)
+	case []byte:
+		f.SetBytes(t)
+	case time.Time:
+		f.Set(reflect.ValueOf(t))
+	case []float64:
+		var ll LatLong
+		for i, p := range []*float64{&ll.latitude, &ll.longitude, &ll.altitude, &ll.accuracy} {
+			if i < len(t) {
+				*p = t[i]
+			}
+		}
+		f.Set(reflect.ValueOf(ll))
+	case []int64:
+		set := IntegerSet{}
+		for _, i := range t {
+			set[i] = struct{}{}
+		}
+		f.Set(reflect.ValueOf(set))
+	case []string:
+		set := StringSet{}
+		for _, s := range t {
+			set[s] = struct{}{}
+		}
+		f.Set(reflect.ValueOf(set))
+	case map[string]int64:
+		f.Set(reflect.ValueOf(IntegerMap(t)))
+	case map[string]string:
+		f.Set(reflect.ValueOf(StringMap(t)))
+	}
+}
+
+// int64Slice implements sort.Interface.
+type int64Slice []int64
+
+func (s int64Slice) Len() int           { return len(s) }
+func (s int64Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s int64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,349 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package structured
+
+import (
+	"bytes"
+	"math"
+	"sort"
+	"sync"
+
+	"gossipgo/storage"
+)
+
+// numScatterPrefixes is the number of two-byte hash prefixes under
+// which the rows of a scattered table are spread.
+const numScatterPrefixes = 1 << 16
+
+// A rawRow is the encoded primary key and value of a row, as read by
+// a scan.
+type rawRow struct {
+	pk, value []byte
+}
+
+// rawRows implements sort.Interface, ordering rows by primary key.
+type rawRows []rawRow
+
+func (r rawRows) Len() int           { return len(r) }
+func (r rawRows) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r rawRows) Less(i, j int) bool { return bytes.Compare(r[i].pk, r[j].pk) < 0 }
+
+// ScanRows returns up to maxRows rows of the named table, in primary
+// key order, whose primary keys lie between start, inclusive, and
+// end, exclusive. Start and end specify values for a prefix of the
+// primary key columns; either may be nil to leave the scan unbounded
+// on that side. If maxRows is zero, all rows are returned.
+//
+// The rows of a scattered table are spread across 65536 hash
+// prefixes, so the scan is fanned out across all of them and the
+// results merged. The rows of an interleaved table are interspersed
+// with those of its ancestors, so the scan reads the entire keyspace
+// of its root ancestor.
+func (db *DB) ScanRows(s *Schema, tableName string, start, end Row, maxRows int64) ([]Row, error) {
+	t, err := s.getTable(tableName)
+	if err != nil {
+		return nil, err
+	}
+	startPK, err := t.encodePrimaryKeyPrefix(start)
+	if err != nil {
+		return nil, err
+	}
+	endPK, err := t.encodePrimaryKeyPrefix(end)
+	if err != nil {
+		return nil, err
+	}
+	if maxRows <= 0 {
+		maxRows = math.MaxInt64
+	}
+	var raws []rawRow
+	switch {
+	case t.parent != nil:
+		raws, err = db.scanInterleaved(s, t, startPK, endPK, maxRows)
+	case t.primaryKey[0].Scatter:
+		raws, err = db.scanScattered(s, t, startPK, endPK, maxRows)
+	default:
+		raws, err = db.scanRange(s, t, s.tablePrefix(t), startPK, endPK, maxRows)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]Row, len(raws))
+	for i, raw := range raws {
+		if rows[i], err = t.decodeRow(raw.value, raw.pk); err != nil {
+			return nil, err
+		}
+	}
+	return rows, nil
+}
+
+// GetEntityGroup reads the row of the named table with the primary key
+// column values of row, along with the rows of every table which is
+// interleaved in it, transitively, with a single scan of the row's key
+// range. Rows are returned keyed by table name, in key order. Returns
+// nil if the row doesn't exist.
+func (db *DB) GetEntityGroup(s *Schema, tableName string, row interface{}) (map[string][]Row, error) {
+	t, err := s.getTable(tableName)
+	if err != nil {
+		return nil, err
+	}
+	pk, err := t.rowPrimaryKey(row)
+	if err != nil {
+		return nil, err
+	}
+	key, err := s.rowKey(t, pk)
+	if err != nil {
+		return nil, err
+	}
+	var group map[string][]Row
+	err = db.scanKeys(key, key.PrefixEnd(), func(kvs []storage.KeyValue) (bool, error) {
+		for _, kv := range kvs {
+			rt, rpk, ok := s.parseRowKey(kv.Key)
+			if !ok {
+				continue
+			}
+			// The row itself sorts first; without it, there's no group.
+			if group == nil {
+				if rt != t || !bytes.Equal(rpk, pk) {
+					return false, nil
+				}
+				group = map[string][]Row{}
+			}
+			r, err := rt.decodeRow(kv.Value.Bytes, rpk)
+			if err != nil {
+				return false, err
+			}
+			group[rt.Name] = append(group[rt.Name], r)
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return group, nil
+}
+
+// scanKeys scans the keys from start to end in batches of
+// scanBatchSize, calling fn with each batch until the keys are
+// exhausted, fn returns false or fn returns an error.
+func (db *DB) scanKeys(start, end storage.Key, fn func([]storage.KeyValue) (bool, error)) error {
+	for {
+		sr := <-db.kvDB.Scan(&storage.ScanRequest{
+			StartKey:   start,
+			EndKey:     end,
+			MaxResults: scanBatchSize,
+		})
+		if sr.Error != nil {
+			return sr.Error
+		}
+		if more, err := fn(sr.Rows); !more || err != nil {
+			return err
+		}
+		if len(sr.Rows) < scanBatchSize {
+			return nil
+		}
+		start = storage.MakeKey(sr.Rows[len(sr.Rows)-1].Key, storage.Key{0})
+	}
+}
+
+// scanRange returns up to maxRows rows of the table whose keys are the
+// prefix followed by an encoded primary key between startPK,
+// inclusive, and endPK, exclusive. A nil endPK leaves the scan
+// unbounded. Rows of interleaved tables stored among the table's rows
+// are skipped.
+func (db *DB) scanRange(s *Schema, t *Table, prefix storage.Key, startPK, endPK []byte, maxRows int64) ([]rawRow, error) {
+	end := prefix.PrefixEnd()
+	if endPK != nil {
+		end = storage.MakeKey(prefix, endPK)
+	}
+	var rows []rawRow
+	err := db.scanKeys(storage.MakeKey(prefix, startPK), end, func(kvs []storage.KeyValue) (bool, error) {
+		for _, kv := range kvs {
+			if rt, pk, ok := s.parseRowKey(kv.Key); ok && rt == t {
+				rows = append(rows, rawRow{pk: pk, value: kv.Value.Bytes})
+				if int64(len(rows)) == maxRows {
+					return false, nil
+				}
+			}
+		}
+		return true, nil
+	})
+	return rows, err
+}
+
+// scanScattered scans each of the hash prefixes of the scattered
+// table for up to maxRows rows between startPK and endPK and merges
+// the results, returning the first maxRows rows in primary key order.
+// Up to scatterScanConcurrency prefixes are scanned concurrently.
+func (db *DB) scanScattered(s *Schema, t *Table, startPK, endPK []byte, maxRows int64) ([]rawRow, error) {
+	results := make([][]rawRow, numScatterPrefixes)
+	var mu sync.Mutex // Protects err
+	var err error
+	var wg sync.WaitGroup
+	for w := 0; w < scatterScanConcurrency; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for h := w; h < numScatterPrefixes; h += scatterScanConcurrency {
+				prefix := storage.MakeKey(s.tablePrefix(t), storage.Key{byte(h >> 8), byte(h)})
+				rows, scanErr := db.scanRange(s, t, prefix, startPK, endPK, maxRows)
+				mu.Lock()
+				if scanErr != nil && err == nil {
+					err = scanErr
+				}
+				failed := err != nil
+				mu.Unlock()
+				if failed {
+					return
+				}
+				results[h] = rows
+			}
+		}(w)
+	}
+	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+	var rows rawRows
+	for _, r := range results {
+		rows = append(rows, r...)
+	}
+	return limitRows(rows, maxRows), nil
+}
+
+// scanInterleaved returns the first maxRows rows of the interleaved
+// table between startPK and endPK in primary key order, found by
+// scanning the keyspace of the table's root ancestor.
+func (db *DB) scanInterleaved(s *Schema, t *Table, startPK, endPK []byte, maxRows int64) ([]rawRow, error) {
+	var rows rawRows
+	err := db.scanTable(s, t, func(raws []rawRow) error {
+		for _, raw := range raws {
+			if bytes.Compare(raw.pk, startPK) >= 0 && (endPK == nil || bytes.Compare(raw.pk, endPK) < 0) {
+				rows = append(rows, raw)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return limitRows(rows, maxRows), nil
+}
+
+// limitRows sorts the rows by primary key and returns the first
+// maxRows of them.
+func limitRows(rows rawRows, maxRows int64) []rawRow {
+	sort.Sort(rows)
+	if int64(len(rows)) > maxRows {
+		rows = rows[:maxRows]
+	}
+	return rows
+}
+
+// scanTable calls fn with each batch of the table's rows, in key
+// order. Rows of interleaved tables are found by scanning the
+// keyspace of the table's root ancestor.
+func (db *DB) scanTable(s *Schema, t *Table, fn func([]rawRow) error) error {
+	root := t
+	for root.parent != nil {
+		root = root.parent
+	}
+	prefix := s.tablePrefix(root)
+	return db.scanKeys(prefix, prefix.PrefixEnd(), func(kvs []storage.KeyValue) (bool, error) {
+		var rows []rawRow
+		for _, kv := range kvs {
+			if rt, pk, ok := s.parseRowKey(kv.Key); ok && rt == t {
+				rows = append(rows, rawRow{pk: pk, value: kv.Value.Bytes})
+			}
+		}
+		if len(rows) == 0 {
+			return true, nil
+		}
+		return true, fn(rows)
+	})
+}
+
+// parseRowKey returns the table and encoded primary key of the row
+// stored at the key. Returns false if the key isn't the key of a row
+// of one of the schema's tables.
+func (s *Schema) parseRowKey(key storage.Key) (*Table, []byte, bool) {
+	prefix := []byte(s.Key + "/")
+	if !bytes.HasPrefix(key, prefix) {
+		return nil, nil, false
+	}
+	rest := []byte(key[len(prefix):])
+	var t *Table
+	for {
+		i := bytes.IndexByte(rest, '/')
+		if i < 0 {
+			return nil, nil, false
+		}
+		child, ok := s.byKey[string(rest[:i])]
+		if !ok || child.parent != t {
+			return nil, nil, false
+		}
+		t, rest = child, rest[i+1:]
+		if t.primaryKey[0].Scatter {
+			if len(rest) < 2 {
+				return nil, nil, false
+			}
+			rest = rest[2:]
+		}
+		remainder, err := t.decodePrimaryKey(rest, Row{})
+		if err != nil {
+			return nil, nil, false
+		}
+		pk := rest[:len(rest)-len(remainder)]
+		if len(remainder) == 0 {
+			return t, pk, true
+		}
+		// An interleaved row follows.
+		if remainder[0] != '/' {
+			return nil, nil, false
+		}
+		rest = remainder[1:]
+	}
+}
+
+// encodePrimaryKeyPrefix returns the concatenated encoding of the
+// row's values for a prefix of the primary key columns. Returns nil
+// for an empty row.
+func (t *Table) encodePrimaryKeyPrefix(row Row) ([]byte, error) {
+	if len(row) == 0 {
+		return nil, nil
+	}
+	converted, err := t.toRow(row)
+	if err != nil {
+		return nil, err
+	}
+	var pk []byte
+	n := 0
+	for _, c := range t.primaryKey {
+		v, ok := converted[c.Name]
+		if !ok {
+			break
+		}
+		if pk, err = encodeKeyValue(pk, v); err != nil {
+			return nil, invalidf("table %q, column %q: %v", t.Name, c.Name, err)
+		}
+		n++
+	}
+	if n != len(converted) {
+		return nil, invalidf("table %q: scan bounds must specify values for a prefix of the primary key columns", t.Name)
+	}
+	return pk, nil
+}
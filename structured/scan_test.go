@@ -0,0 +1,191 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package structured
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+var testInterleavedYAMLSchema = []byte(`db:     BlogDB
+db_key: bdb
+tables:
+- table:     User
+  table_key: us
+  columns:
+  - {column: ID, column_key: id, type: integer, primary_key: true}
+  - {column: Name, column_key: na, type: string}
+- table:     Post
+  table_key: po
+  columns:
+  - {column: UserID, column_key: ui, type: integer, primary_key: true, foreign_key: User.ID, interleave: true}
+  - {column: ID, column_key: id, type: integer, primary_key: true}
+- table:     Comment
+  table_key: co
+  columns:
+  - {column: UserID, column_key: ui, type: integer, primary_key: true, foreign_key: Post.UserID, interleave: true}
+  - {column: PostID, column_key: pi, type: integer, primary_key: true, foreign_key: Post.ID, interleave: true}
+  - {column: ID, column_key: id, type: integer, primary_key: true}
+`)
+
+// rowIDs returns the values of the column of the rows.
+func rowIDs(rows []Row, column string) []int64 {
+	var ids []int64
+	for _, row := range rows {
+		ids = append(ids, row[column].(int64))
+	}
+	return ids
+}
+
+// TestScanRows verifies table scans honor bounds and limits and
+// return rows in primary key order, including for scattered tables.
+func TestScanRows(t *testing.T) {
+	db, s := createTestDBWithSchema(t)
+	for _, id := range []int64{5, 3, 9, 1, 7} {
+		if _, err := db.PutRow(s, "User", Row{"ID": id}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.PutRow(s, "Photo", Row{"ID": id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// User is scattered; Photo isn't.
+	for _, table := range []string{"User", "Photo"} {
+		testCases := []struct {
+			start, end Row
+			maxRows    int64
+			expIDs     []int64
+		}{
+			{nil, nil, 0, []int64{1, 3, 5, 7, 9}},
+			{nil, nil, 2, []int64{1, 3}},
+			{Row{"ID": 3}, Row{"ID": 9}, 0, []int64{3, 5, 7}},
+			{Row{"ID": "4"}, nil, 2, []int64{5, 7}},
+			{Row{"ID": 10}, nil, 0, nil},
+		}
+		for i, test := range testCases {
+			rows, err := db.ScanRows(s, table, test.start, test.end, test.maxRows)
+			if err != nil {
+				t.Fatalf("%s %d: %v", table, i, err)
+			}
+			if ids := rowIDs(rows, "ID"); !reflect.DeepEqual(ids, test.expIDs) {
+				t.Errorf("%s %d: expected IDs %v; got %v", table, i, test.expIDs, ids)
+			}
+		}
+	}
+	if _, err := db.ScanRows(s, "User", Row{"Name": "a"}, nil, 0); err == nil {
+		t.Error("expected error scanning from non-primary key column")
+	}
+}
+
+// TestInterleavedTables verifies that interleaved rows are stored
+// under the keys of the rows they reference, can be read with their
+// parent in a single scan, and are deleted with their parent.
+func TestInterleavedTables(t *testing.T) {
+	db := createTestDB(t)
+	s, err := NewYAMLSchema(testInterleavedYAMLSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutSchema(s); err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range []struct {
+		table string
+		row   Row
+	}{
+		{"User", Row{"ID": 1, "Name": "spencer"}},
+		{"User", Row{"ID": 2, "Name": "peter"}},
+		{"Post", Row{"UserID": 1, "ID": 10}},
+		{"Post", Row{"UserID": 1, "ID": 11}},
+		{"Post", Row{"UserID": 2, "ID": 12}},
+		{"Comment", Row{"UserID": 1, "PostID": 10, "ID": 100}},
+		{"Comment", Row{"UserID": 1, "PostID": 11, "ID": 101}},
+		{"Comment", Row{"UserID": 2, "PostID": 12, "ID": 102}},
+	} {
+		if _, err := db.PutRow(s, w.table, w.row); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Comments are keyed under their post, under its user.
+	comment, post := s.byName["Comment"], s.byName["Post"]
+	pk, err := comment.encodePrimaryKey(Row{"UserID": int64(1), "PostID": int64(10), "ID": int64(100)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := s.rowKey(comment, pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	postPK, _ := post.encodePrimaryKey(Row{"UserID": int64(1), "ID": int64(10)})
+	postKey, _ := s.rowKey(post, postPK)
+	if !bytes.HasPrefix(key, append(postKey, "/co/"...)) {
+		t.Errorf("expected comment key %q to be prefixed by post key %q", key, postKey)
+	}
+	if rt, rpk, ok := s.parseRowKey(key); !ok || rt != comment || !bytes.Equal(rpk, pk) {
+		t.Errorf("expected key to parse as comment row; got %v, %q, %t", rt, rpk, ok)
+	}
+
+	group, err := db.GetEntityGroup(s, "User", Row{"ID": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(group["User"]) != 1 || group["User"][0]["Name"] != "spencer" {
+		t.Errorf("expected user 1; got %v", group["User"])
+	}
+	if ids := rowIDs(group["Post"], "ID"); !reflect.DeepEqual(ids, []int64{10, 11}) {
+		t.Errorf("expected posts 10 and 11; got %v", ids)
+	}
+	if ids := rowIDs(group["Comment"], "ID"); !reflect.DeepEqual(ids, []int64{100, 101}) {
+		t.Errorf("expected comments 100 and 101; got %v", ids)
+	}
+
+	// Scans of the parent table skip interleaved rows, and scans of
+	// interleaved tables find rows under every parent.
+	if rows, err := db.ScanRows(s, "User", nil, nil, 0); err != nil || !reflect.DeepEqual(rowIDs(rows, "ID"), []int64{1, 2}) {
+		t.Errorf("expected users 1 and 2; got %v, %v", rows, err)
+	}
+	if rows, err := db.ScanRows(s, "Comment", Row{"UserID": 1}, nil, 0); err != nil || !reflect.DeepEqual(rowIDs(rows, "ID"), []int64{100, 101, 102}) {
+		t.Errorf("expected comments 100-102; got %v, %v", rows, err)
+	}
+	if rows, err := db.ScanRows(s, "Post", Row{"UserID": 2}, nil, 0); err != nil || !reflect.DeepEqual(rowIDs(rows, "ID"), []int64{12}) {
+		t.Errorf("expected post 12; got %v, %v", rows, err)
+	}
+
+	// Deleting a user deletes its entity group.
+	if err := db.DeleteRow(s, "User", Row{"ID": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if group, err := db.GetEntityGroup(s, "User", Row{"ID": 1}); group != nil || err != nil {
+		t.Errorf("expected no entity group; got %v, %v", group, err)
+	}
+	if rows, err := db.ScanRows(s, "Comment", nil, nil, 0); err != nil || !reflect.DeepEqual(rowIDs(rows, "ID"), []int64{102}) {
+		t.Errorf("expected comment 102; got %v, %v", rows, err)
+	}
+
+	// The interleaving of an existing table can't be changed.
+	s.byName["Comment"].byName["PostID"].Interleave = false
+	s.byName["Comment"].byName["UserID"].Interleave = false
+	if err := s.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutSchema(s); err == nil {
+		t.Error("expected error changing interleaving of existing table")
+	}
+}
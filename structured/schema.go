@@ -166,6 +166,9 @@ type Table struct {
 	// delete the referencing object ("cascade") or set the columns
 	// null ("setnull").
 	incomingForeignKeys map[string]map[string]*Column
+	// parent is the table in which this table is interleaved, or nil
+	// if the table isn't interleaved.
+	parent *Table
 }
 
 // Schema contains a named sequence of Table schemas. The Key should
@@ -212,7 +215,8 @@ var ValidIndexTypes = map[string]struct{}{
 
 // NewGoSchema returns a schema using name and key and a map from
 // Table Key to an instance of a Go struct corresponding to the
-// Table (the Table name is derived from the Go struct name).
+// Table (the Table name is derived from the Go struct name). Tables
+// are sorted by name.
 func NewGoSchema(name, key string, schemaMap map[string]interface{}) (*Schema, error) {
 	s := &Schema{
 		Name: name,
@@ -225,12 +229,20 @@ func NewGoSchema(name, key string, schemaMap map[string]interface{}) (*Schema, e
 		}
 		s.Tables = append(s.Tables, table)
 	}
+	sort.Sort(tablesByName(s.Tables))
 	if err := s.Validate(); err != nil {
 		return nil, err
 	}
 	return s, nil
 }
 
+// tablesByName implements sort.Interface, ordering tables by name.
+type tablesByName []*Table
+
+func (s tablesByName) Len() int           { return len(s) }
+func (s tablesByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s tablesByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
 // Validate validates the schema for consistency, correctness and
 // completeness. Foreign keys are matched to their respective
 // tables. Parameters are verified as valid (e.g. OnDelete can only
@@ -240,6 +252,11 @@ func (s *Schema) Validate() error {
 	s.byName = make(map[string]*Table)
 	s.byKey = make(map[string]*Table)
 
+	// Verify schema key.
+	if err := validateKey(s.Key); err != nil {
+		return fmt.Errorf("schema %q: %v", s.Name, err)
+	}
+
 	// First pass through validation validates all tables. This establishes
 	// primary keys, necessary to validate columns in second pass.
 	for _, t := range s.Tables {
@@ -255,15 +272,16 @@ func (s *Schema) Validate() error {
 		}
 		s.byKey[t.Key] = t
 
-		// Verify table key length.
-		if len(t.Key) > 3 {
-			return fmt.Errorf("table %q: key %q is limited to 1-3 characters", t.Name, t.Key)
+		// Verify table key.
+		if err := validateKey(t.Key); err != nil {
+			return fmt.Errorf("table %q: %v", t.Name, err)
 		}
 
 		// Init table data structures.
 		t.primaryKey = make([]*Column, 0, 1)
 		t.foreignKeys = make(map[string]map[string]*Column)
 		t.incomingForeignKeys = make(map[string]map[string]*Column)
+		t.parent = nil
 
 		// Validate table.
 		if err := s.validateTable(t); err != nil {
@@ -293,6 +311,15 @@ func (s *Schema) Validate() error {
 		}
 	}
 
+	// Fourth pass: verify interleaved tables don't form cycles.
+	for _, t := range s.Tables {
+		for p, depth := t.parent, 0; p != nil; p, depth = p.parent, depth+1 {
+			if depth == len(s.Tables) {
+				return fmt.Errorf("table %q: cycle of interleaved tables", t.Name)
+			}
+		}
+	}
+
 	return nil
 }
 
@@ -315,9 +342,9 @@ func (s *Schema) validateTable(t *Table) error {
 		}
 		t.byKey[c.Key] = c
 
-		// Verify column key length.
-		if len(c.Key) > 3 {
-			return fmt.Errorf("column %q: key %q is limited to 1-3 characters", c.Name, c.Key)
+		// Verify column key.
+		if err := validateKey(c.Key); err != nil {
+			return fmt.Errorf("column %q: %v", c.Name, err)
 		}
 
 		// Add to table's primary key.
@@ -329,6 +356,19 @@ func (s *Schema) validateTable(t *Table) error {
 	return nil
 }
 
+// validateKey verifies that a schema, table or column key is 1-3
+// characters and doesn't contain the '/' or ':' characters, which
+// delimit keys within row and index keys.
+func validateKey(key string) error {
+	if len(key) == 0 || len(key) > 3 {
+		return fmt.Errorf("key %q is limited to 1-3 characters", key)
+	}
+	if strings.ContainsAny(key, "/:") {
+		return fmt.Errorf("key %q may not contain '/' or ':'", key)
+	}
+	return nil
+}
+
 // validateColumn validates the column options.
 func (s *Schema) validateColumn(c *Column, t *Table) error {
 	if _, ok := ValidTypes[c.Type]; !ok {
@@ -460,6 +500,23 @@ func (s *Schema) validateForeignKey(t *Table, fkTable string) error {
 	if !reflect.DeepEqual(fkColNames, ftPKColNames) {
 		return fmt.Errorf("component mismatch: foreign key has %s; primary key of ref'd table has %s", fkColNames, ftPKColNames)
 	}
+
+	// Interleaved rows are located by their primary key, so it must
+	// include the foreign key columns, which locate the parent row.
+	if lastCol.Interleave {
+		if t.parent != nil {
+			return fmt.Errorf("table may only be interleaved in one table; already interleaved in %q", t.parent.Name)
+		}
+		for _, c := range t.foreignKeys[fkTable] {
+			if !c.PrimaryKey {
+				return fmt.Errorf("interleaved foreign key column %q must be part of the primary key", c.Name)
+			}
+		}
+		if t.primaryKey[0].Scatter {
+			return fmt.Errorf("interleaved tables may not specify scatter")
+		}
+		t.parent = ft
+	}
 	return nil
 }
 
@@ -235,6 +235,33 @@ func TestBadForeignKeys(t *testing.T) {
 	}
 }
 
+// TestInterleave verifies that interleaved tables reference their
+// parent table, and that they must include the interleaved foreign
+// key in the primary key and may not be scattered.
+func TestInterleave(t *testing.T) {
+	s, err := createTestSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.byName["Comment"].parent != s.byName["PhotoStream"] {
+		t.Errorf("expected Comment to be interleaved in PhotoStream")
+	}
+	if s.byName["PhotoStream"].parent != nil {
+		t.Errorf("expected PhotoStream not to be interleaved")
+	}
+
+	psID := s.byName["Comment"].byName["PhotoStreamID"]
+	psID.Scatter = true
+	if err := s.Validate(); err == nil {
+		t.Errorf("expected error validating scattered interleaved table")
+	}
+	psID.Scatter = false
+	psID.PrimaryKey = false
+	if err := s.Validate(); err == nil {
+		t.Errorf("expected error validating interleaved foreign key outside primary key")
+	}
+}
+
 // TestColumnOptions verifies settings of trivial column options
 // (e.g. "scatter").
 func TestColumnOptions(t *testing.T) {
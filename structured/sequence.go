@@ -0,0 +1,113 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package structured
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"gossipgo/kv"
+	"gossipgo/storage"
+)
+
+// sequenceBlockSize is the number of values a DB reserves at a time
+// from the sequence of an auto-increment column.
+const sequenceBlockSize = 100
+
+// A sequence allocates the values of an auto-increment column. The
+// sequence's counter, stored under storage.KeySequencePrefix, holds
+// the last value reserved by any DB. Each DB reserves values in blocks
+// of sequenceBlockSize with a single increment of the counter, so that
+// the counter doesn't become a hot key. Values are unique, but DBs
+// allocate from their blocks concurrently, so values aren't allocated
+// in order across DBs and values left in a block when a DB exits are
+// never used.
+type sequence struct {
+	key storage.Key
+
+	mu    sync.Mutex // Protects next and limit
+	next  int64      // The next value to allocate
+	limit int64      // The end of the reserved block, exclusive
+}
+
+// sequenceKey returns the key of the counter of the auto-increment
+// column's sequence.
+func (s *Schema) sequenceKey(t *Table, c *Column) storage.Key {
+	return storage.MakeKey(storage.KeySequencePrefix, storage.Key(s.Key+"/"+t.Key+"/"+c.Key))
+}
+
+// allocate returns the next value of the sequence, reserving a new
+// block of values if the current block is exhausted.
+func (seq *sequence) allocate(kvDB kv.DB) (int64, error) {
+	seq.mu.Lock()
+	defer seq.mu.Unlock()
+	if seq.next == seq.limit {
+		ir := <-kvDB.Increment(&storage.IncrementRequest{Key: seq.key, Increment: sequenceBlockSize})
+		if ir.Error != nil {
+			return 0, ir.Error
+		}
+		seq.next, seq.limit = ir.NewValue-sequenceBlockSize+1, ir.NewValue+1
+	}
+	v := seq.next
+	seq.next++
+	return v, nil
+}
+
+// nextSequenceValue allocates the next value of the auto-increment
+// column from the DB's sequence for the column.
+func (db *DB) nextSequenceValue(s *Schema, t *Table, c *Column) (int64, error) {
+	key := s.sequenceKey(t, c)
+	db.mu.Lock()
+	seq, ok := db.sequences[string(key)]
+	if !ok {
+		seq = &sequence{key: key}
+		db.sequences[string(key)] = seq
+	}
+	db.mu.Unlock()
+	return seq.allocate(db.kvDB)
+}
+
+// initSequences persists the start values of the schema's
+// auto-increment columns which don't yet have sequences by
+// initializing their counters to one less than the start value.
+// Counters are initialized with conditional puts which expect them
+// to be absent, so a sequence created concurrently by another DB is
+// left intact. Once a column's sequence exists, changes to its start
+// value have no effect.
+func (db *DB) initSequences(s *Schema) error {
+	for _, t := range s.Tables {
+		for _, c := range t.Columns {
+			if c.Auto == nil {
+				continue
+			}
+			encoded := make([]byte, binary.MaxVarintLen64)
+			encoded = encoded[:binary.PutVarint(encoded, *c.Auto-1)]
+			pr := <-db.kvDB.Put(&storage.PutRequest{
+				Key:      s.sequenceKey(t, c),
+				Value:    storage.Value{Bytes: encoded},
+				ExpValue: &storage.Value{},
+			})
+			// A failed condition carries the actual value: the sequence
+			// already exists.
+			if pr.Error != nil && pr.ActualValue == nil {
+				return pr.Error
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package structured
+
+import (
+	"encoding/binary"
+	"sync"
+	"testing"
+
+	"gossipgo/storage"
+)
+
+// TestSequenceBlocks verifies that each DB reserves blocks of values
+// from a sequence starting at the column's start value, and that the
+// start value is persisted with the sequence.
+func TestSequenceBlocks(t *testing.T) {
+	db1, s := createTestDBWithSchema(t)
+	db2 := NewDB(db1.kvDB)
+	put := func(db *DB, expID int64) {
+		row, err := db.PutRow(s, "User", Row{"ID": 0})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if row["ID"] != expID {
+			t.Errorf("expected ID %d; got %v", expID, row["ID"])
+		}
+	}
+	put(db1, 100)
+	put(db2, 100+sequenceBlockSize)
+	put(db1, 101)
+	put(db2, 101+sequenceBlockSize)
+
+	// The counter holds the last value reserved.
+	gr := <-db1.kvDB.Get(&storage.GetRequest{Key: s.sequenceKey(s.byName["User"], s.byName["User"].byName["ID"])})
+	if v, _ := binary.Varint(gr.Value.Bytes); gr.Error != nil || v != 99+2*sequenceBlockSize {
+		t.Errorf("expected counter %d; got %d, %v", 99+2*sequenceBlockSize, v, gr.Error)
+	}
+
+	// Changing the start value of an existing sequence has no effect.
+	updated, err := NewYAMLSchema(testYAMLSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	*updated.byName["User"].byName["ID"].Auto = 1
+	if err := db1.PutSchema(updated); err != nil {
+		t.Fatal(err)
+	}
+	put(NewDB(db1.kvDB), 100+2*sequenceBlockSize)
+}
+
+// TestSequenceConcurrency verifies that values allocated by concurrent
+// inserts from several goroutines on each of several DBs are unique.
+func TestSequenceConcurrency(t *testing.T) {
+	const numDBs, numWorkers, numInserts = 3, 4, 60
+	db, s := createTestDBWithSchema(t)
+	var mu sync.Mutex
+	ids := map[int64]struct{}{}
+	var wg sync.WaitGroup
+	for i := 0; i < numDBs; i++ {
+		nodeDB := NewDB(db.kvDB)
+		for j := 0; j < numWorkers; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for k := 0; k < numInserts; k++ {
+					row, err := nodeDB.PutRow(s, "User", Row{})
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					mu.Lock()
+					if _, ok := ids[row["ID"].(int64)]; ok {
+						t.Errorf("duplicate ID %d", row["ID"])
+					}
+					ids[row["ID"].(int64)] = struct{}{}
+					mu.Unlock()
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	if len(ids) != numDBs*numWorkers*numInserts {
+		t.Errorf("expected %d IDs; got %d", numDBs*numWorkers*numInserts, len(ids))
+	}
+}
@@ -0,0 +1,248 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+// Package ts stores and queries time series data, such as the metrics
+// recorded periodically by each node. Datapoints are accumulated into
+// samples by the storage engine: each InternalMerge of a datapoint
+// into a sample adds to its count and sum and updates its minimum and
+// maximum, so writers never read before writing.
+//
+// Data is first stored at a ten second resolution, with the samples of
+// one hour held in a single value. Data older than rollupThreshold is
+// downsampled by Rollup to a one hour resolution, with the samples of
+// one day held in a single value, and the high resolution data is
+// deleted.
+package ts
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"time"
+
+	gogoproto "github.com/gogo/protobuf/proto"
+	"gossipgo/kv"
+	"gossipgo/proto"
+	"gossipgo/storage"
+	"gossipgo/util"
+)
+
+const (
+	// rollupThreshold is the age after which high resolution data is
+	// downsampled by Rollup.
+	rollupThreshold = 24 * time.Hour
+	// scanBatchSize is the number of values fetched per scan.
+	scanBatchSize = 100
+)
+
+// A Resolution is the granularity at which time series data is
+// stored.
+type Resolution byte
+
+const (
+	// Resolution10s stores ten second samples, one hour per key.
+	Resolution10s Resolution = iota
+	// Resolution1h stores one hour samples, one day per key.
+	Resolution1h
+)
+
+// SampleDuration returns the duration of a sample in nanoseconds.
+func (r Resolution) SampleDuration() int64 {
+	if r == Resolution1h {
+		return int64(time.Hour)
+	}
+	return int64(10 * time.Second)
+}
+
+// KeyDuration returns the duration of the samples stored in a
+// single value, in nanoseconds.
+func (r Resolution) KeyDuration() int64 {
+	if r == Resolution1h {
+		return int64(24 * time.Hour)
+	}
+	return int64(time.Hour)
+}
+
+// DB stores and queries time series data in a key value store.
+//
+// TODO(spencer): rollups merge the downsampled data and then delete
+// the high resolution data without a transaction; a failure between
+// the two counts the data twice.
+type DB struct {
+	kvDB kv.DB
+}
+
+// NewDB returns a time series DB which stores data in kvDB.
+func NewDB(kvDB kv.DB) *DB {
+	return &DB{kvDB: kvDB}
+}
+
+// resolutionPrefix returns the prefix of the keys of all data stored
+// at the resolution.
+func resolutionPrefix(r Resolution) storage.Key {
+	return storage.MakeKey(storage.KeyTimeSeriesPrefix, storage.Key{byte(r)})
+}
+
+// dataKey returns the key of the value holding the samples of the
+// named metric at the resolution which start at keyTime. Keys are
+// laid out as the resolution prefix, the name terminated by a zero
+// byte and the big-endian key time, so the values of a metric sort in
+// time order.
+func dataKey(name string, r Resolution, keyTime int64) storage.Key {
+	var t [8]byte
+	binary.BigEndian.PutUint64(t[:], uint64(keyTime))
+	return storage.MakeKey(storage.MakeKey(resolutionPrefix(r), storage.Key(name+"\x00")), t[:])
+}
+
+// parseDataKey returns the metric name and key time of a key within
+// the resolution prefix. Returns false if the key is malformed.
+func parseDataKey(key storage.Key, r Resolution) (string, int64, bool) {
+	prefix := resolutionPrefix(r)
+	if !bytes.HasPrefix(key, prefix) {
+		return "", 0, false
+	}
+	b := key[len(prefix):]
+	i := bytes.IndexByte(b, 0)
+	if i < 0 || len(b) != i+9 {
+		return "", 0, false
+	}
+	return string(b[:i]), int64(binary.BigEndian.Uint64(b[i+1:])), true
+}
+
+// StoreData merges the datapoints of each time series into the
+// samples stored at the resolution. Datapoints falling into the same
+// sample are accumulated.
+func (db *DB) StoreData(r Resolution, data []proto.TimeSeriesData) error {
+	for _, ts := range data {
+		if ts.Name == "" || strings.IndexByte(ts.Name, 0) >= 0 {
+			return util.Errorf("invalid time series name %q", ts.Name)
+		}
+		for _, dp := range ts.Datapoints {
+			if dp.TimestampNanos < 0 {
+				return util.Errorf("time series %q: negative timestamp %d", ts.Name, dp.TimestampNanos)
+			}
+		}
+		internal, err := ts.ToInternal(r.KeyDuration(), r.SampleDuration())
+		if err != nil {
+			return err
+		}
+		for _, itsd := range internal {
+			if err := db.merge(dataKey(ts.Name, r, itsd.StartTimestampNanos), itsd); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// merge merges the samples of data into the value at key.
+func (db *DB) merge(key storage.Key, data *proto.InternalTimeSeriesData) error {
+	b, err := gogoproto.Marshal(data)
+	if err != nil {
+		return err
+	}
+	mr := <-db.kvDB.InternalMerge(&storage.InternalMergeRequest{
+		Key:   key,
+		Value: storage.Value{Bytes: b},
+	})
+	return mr.Error
+}
+
+// scanData invokes fn with the decoded values of each key from start,
+// inclusive, to end, exclusive, in key order.
+func (db *DB) scanData(start, end storage.Key, fn func(storage.Key, *proto.InternalTimeSeriesData) error) error {
+	for {
+		sr := <-db.kvDB.Scan(&storage.ScanRequest{
+			StartKey:   start,
+			EndKey:     end,
+			MaxResults: scanBatchSize,
+		})
+		if sr.Error != nil {
+			return sr.Error
+		}
+		for _, kv := range sr.Rows {
+			data := &proto.InternalTimeSeriesData{}
+			if err := gogoproto.Unmarshal(kv.Value.Bytes, data); err != nil {
+				return util.Errorf("key %q: invalid time series data: %s", kv.Key, err)
+			}
+			if err := fn(kv.Key, data); err != nil {
+				return err
+			}
+		}
+		if len(sr.Rows) < scanBatchSize {
+			return nil
+		}
+		start = storage.MakeKey(sr.Rows[len(sr.Rows)-1].Key, storage.Key{0})
+	}
+}
+
+// Rollup downsamples the ten second data of every metric whose key
+// duration ended more than rollupThreshold before now, expressed in
+// unix nanoseconds. The samples of each hour are merged into a single
+// one hour sample and the ten second data is deleted.
+func (db *DB) Rollup(now int64) error {
+	cutoff := now - int64(rollupThreshold)
+	prefix := resolutionPrefix(Resolution10s)
+	var keys []storage.Key
+	err := db.scanData(prefix, prefix.PrefixEnd(), func(key storage.Key, data *proto.InternalTimeSeriesData) error {
+		name, keyTime, ok := parseDataKey(key, Resolution10s)
+		if !ok {
+			return util.Errorf("malformed time series key %q", key)
+		}
+		if keyTime+Resolution10s.KeyDuration() > cutoff {
+			return nil
+		}
+		if err := db.merge(dataKey(name, Resolution1h, rollupKeyTime(keyTime)), rollupData(keyTime, data)); err != nil {
+			return err
+		}
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if dr := <-db.kvDB.Delete(&storage.DeleteRequest{Key: key}); dr.Error != nil {
+			return dr.Error
+		}
+	}
+	return nil
+}
+
+// rollupKeyTime returns the one hour resolution key time of the ten
+// second data stored at keyTime.
+func rollupKeyTime(keyTime int64) int64 {
+	return keyTime / Resolution1h.KeyDuration() * Resolution1h.KeyDuration()
+}
+
+// rollupData returns the ten second data stored at keyTime as one
+// hour resolution data. Every sample is placed at the offset of the
+// hour; the storage engine accumulates them into a single sample when
+// the data is merged.
+func rollupData(keyTime int64, data *proto.InternalTimeSeriesData) *proto.InternalTimeSeriesData {
+	offset := int32((keyTime - rollupKeyTime(keyTime)) / Resolution1h.SampleDuration())
+	rollup := &proto.InternalTimeSeriesData{
+		StartTimestampNanos: rollupKeyTime(keyTime),
+		SampleDurationNanos: Resolution1h.SampleDuration(),
+	}
+	for _, s := range data.Samples {
+		sample := *s
+		sample.Offset = offset
+		rollup.Samples = append(rollup.Samples, &sample)
+	}
+	return rollup
+}
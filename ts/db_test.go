@@ -0,0 +1,190 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package ts
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"gossipgo/kv"
+	"gossipgo/proto"
+	"gossipgo/storage"
+	"gossipgo/util/hlc"
+)
+
+// createTestDB returns a time series DB backed by a single range
+// spanning all keys on a new in-memory store.
+func createTestDB(t *testing.T) *DB {
+	clock := hlc.NewClock(hlc.UnixNano, 0)
+	store := storage.NewStore(clock, storage.NewInMem(1<<20), nil)
+	if err := store.Bootstrap(storage.StoreIdent{ClusterID: "cluster", NodeID: 1, StoreID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	rng, err := store.CreateRange(storage.KeyMin, storage.KeyMax)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewDB(kv.NewLocalDB(rng))
+}
+
+// intData returns a time series with an integer datapoint for each
+// timestamp and value pair.
+func intData(name string, points ...int64) proto.TimeSeriesData {
+	data := proto.TimeSeriesData{Name: name}
+	for i := 0; i+1 < len(points); i += 2 {
+		v := points[i+1]
+		data.Datapoints = append(data.Datapoints, &proto.TimeSeriesDatapoint{TimestampNanos: points[i], IntValue: &v})
+	}
+	return data
+}
+
+// floatData returns a time series with a floating point datapoint at
+// each timestamp.
+func floatData(name string, timestamp int64, values ...float32) proto.TimeSeriesData {
+	data := proto.TimeSeriesData{Name: name}
+	for i := range values {
+		data.Datapoints = append(data.Datapoints, &proto.TimeSeriesDatapoint{TimestampNanos: timestamp, FloatValue: &values[i]})
+	}
+	return data
+}
+
+// TestDataKeys verifies that data keys of a metric sort in time order
+// and parse back to their name and key time.
+func TestDataKeys(t *testing.T) {
+	k1 := dataKey("cpu", Resolution10s, int64(time.Hour))
+	k2 := dataKey("cpu", Resolution10s, int64(2*time.Hour))
+	if bytes.Compare(k1, k2) >= 0 {
+		t.Errorf("expected %q to sort before %q", k1, k2)
+	}
+	if other := dataKey("cpu.user", Resolution10s, 0); bytes.Compare(k2, other) >= 0 {
+		t.Errorf("expected keys of %q to sort before keys of %q", "cpu", "cpu.user")
+	}
+	if name, keyTime, ok := parseDataKey(k2, Resolution10s); !ok || name != "cpu" || keyTime != int64(2*time.Hour) {
+		t.Errorf("unexpected parse of %q: %q, %d, %t", k2, name, keyTime, ok)
+	}
+	if _, _, ok := parseDataKey(k2, Resolution1h); ok {
+		t.Errorf("expected key %q not to parse at one hour resolution", k2)
+	}
+}
+
+// TestStoreData verifies that datapoints stored separately are
+// accumulated into samples by the storage engine.
+func TestStoreData(t *testing.T) {
+	db := createTestDB(t)
+	sec := int64(time.Second)
+	for _, data := range [][]proto.TimeSeriesData{
+		{intData("cpu", 1*sec, 5, 12*sec, 7)},
+		{intData("cpu", 3*sec, 9, 15*sec, 1), intData("mem", 1*sec, 100)},
+		{floatData("load", 2*sec, 0.5, 1.5)},
+	} {
+		if err := db.StoreData(Resolution10s, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testCases := []struct {
+		name      string
+		agg       Aggregator
+		expPoints []Datapoint
+	}{
+		{"cpu", AggregatorSum, []Datapoint{{0, 14}, {10 * sec, 8}}},
+		{"cpu", AggregatorAvg, []Datapoint{{0, 7}, {10 * sec, 4}}},
+		{"cpu", AggregatorMax, []Datapoint{{0, 9}, {10 * sec, 7}}},
+		{"mem", AggregatorMax, []Datapoint{{0, 100}}},
+		{"load", AggregatorAvg, []Datapoint{{0, 1}}},
+		{"load", AggregatorMax, []Datapoint{{0, 1.5}}},
+		{"disk", AggregatorAvg, []Datapoint{}},
+	}
+	for i, test := range testCases {
+		points, err := db.Query(test.name, 0, 20*sec, test.agg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(points, test.expPoints) {
+			t.Errorf("%d: expected %v; got %v", i, test.expPoints, points)
+		}
+	}
+
+	// Invalid names and timestamps are rejected.
+	for _, data := range []proto.TimeSeriesData{
+		intData("", 0, 1),
+		intData("a\x00b", 0, 1),
+		intData("cpu", -1, 1),
+	} {
+		if err := db.StoreData(Resolution10s, []proto.TimeSeriesData{data}); err == nil {
+			t.Errorf("expected error storing %v", data)
+		}
+	}
+}
+
+// TestRollup verifies that ten second data older than the rollup
+// threshold is downsampled to one hour samples and deleted, and that
+// queries combine the one hour and ten second data.
+func TestRollup(t *testing.T) {
+	db := createTestDB(t)
+	hour := int64(time.Hour)
+	data := intData("cpu",
+		0, 4, 10*int64(time.Second), 8, // Rolled up into the first hour.
+		hour+30*int64(time.Minute), 3, // Rolled up into the second hour.
+		25*hour, 10) // Recent; not rolled up.
+	if err := db.StoreData(Resolution10s, []proto.TimeSeriesData{data}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Rollup(int64(rollupThreshold) + 2*hour); err != nil {
+		t.Fatal(err)
+	}
+
+	prefix := resolutionPrefix(Resolution10s)
+	var keyTimes []int64
+	if err := db.scanData(prefix, prefix.PrefixEnd(), func(key storage.Key, _ *proto.InternalTimeSeriesData) error {
+		_, keyTime, _ := parseDataKey(key, Resolution10s)
+		keyTimes = append(keyTimes, keyTime)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if exp := []int64{25 * hour}; !reflect.DeepEqual(keyTimes, exp) {
+		t.Errorf("expected ten second data at %v after rollup; got %v", exp, keyTimes)
+	}
+
+	points, err := db.Query("cpu", 0, 26*hour, AggregatorMax)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := []Datapoint{{0, 8}, {hour, 3}, {25 * hour, 10}}; !reflect.DeepEqual(points, exp) {
+		t.Errorf("expected %v; got %v", exp, points)
+	}
+	if points, err = db.Query("cpu", 0, hour, AggregatorAvg); err != nil {
+		t.Fatal(err)
+	}
+	if exp := []Datapoint{{0, 6}}; !reflect.DeepEqual(points, exp) {
+		t.Errorf("expected %v; got %v", exp, points)
+	}
+
+	// Rolling up again is a no-op.
+	if err := db.Rollup(int64(rollupThreshold) + 2*hour); err != nil {
+		t.Fatal(err)
+	}
+	if points, err = db.Query("cpu", 0, hour, AggregatorSum); err != nil {
+		t.Fatal(err)
+	}
+	if exp := []Datapoint{{0, 12}}; !reflect.DeepEqual(points, exp) {
+		t.Errorf("expected %v; got %v", exp, points)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package ts
+
+import (
+	"log"
+	"time"
+
+	"gossipgo/proto"
+)
+
+// rollupInterval is the interval at which a poller downsamples old
+// data.
+const rollupInterval = time.Hour
+
+// A Source supplies the current measurements of a set of metrics,
+// such as the capacities of a node's stores.
+type Source interface {
+	GetTimeSeriesData() []proto.TimeSeriesData
+	// RollsUp returns true if the source's poller should roll up old
+	// data. Rollups rewrite the data of every metric in the cluster and
+	// merges aren't idempotent, so only one source in the cluster
+	// should return true at a time.
+	RollsUp() bool
+}
+
+// A Poller records the measurements of a source at ten second
+// resolution every ten seconds and periodically rolls up old data.
+type Poller struct {
+	db         *DB
+	source     Source
+	closer     chan struct{}
+	lastRollup time.Time // Time of the last rollup by this poller
+}
+
+// NewPoller returns a poller which records the measurements of the
+// source in db.
+func NewPoller(db *DB, source Source) *Poller {
+	return &Poller{
+		db:     db,
+		source: source,
+		closer: make(chan struct{}),
+	}
+}
+
+// Start launches the poller in a goroutine.
+func (p *Poller) Start() {
+	go p.poll()
+}
+
+// Stop stops the poller.
+func (p *Poller) Stop() {
+	close(p.closer)
+}
+
+// poll records the source's measurements until the poller is stopped.
+// Errors are logged; the measurements of a failed poll are dropped.
+func (p *Poller) poll() {
+	ticker := time.NewTicker(time.Duration(Resolution10s.SampleDuration()))
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			p.record(now)
+		case <-p.closer:
+			return
+		}
+	}
+}
+
+// record stores the source's current measurements and, if the source
+// rolls up and a rollup interval has passed since the last one, rolls
+// up old data.
+func (p *Poller) record(now time.Time) {
+	if err := p.db.StoreData(Resolution10s, p.source.GetTimeSeriesData()); err != nil {
+		log.Printf("unable to record time series data: %v", err)
+	}
+	if now.Sub(p.lastRollup) >= rollupInterval && p.source.RollsUp() {
+		if err := p.db.Rollup(now.UnixNano()); err != nil {
+			log.Printf("unable to roll up time series data: %v", err)
+		}
+		p.lastRollup = now
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package ts
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"gossipgo/proto"
+)
+
+// testSource is a Source with no measurements.
+type testSource struct {
+	rollsUp bool
+}
+
+func (ts testSource) GetTimeSeriesData() []proto.TimeSeriesData { return nil }
+func (ts testSource) RollsUp() bool                             { return ts.rollsUp }
+
+// TestPollersRollupOnce verifies that when several pollers record
+// to the same database at once, only the one whose source rolls up
+// does so, and old data is rolled up into hourly samples exactly once.
+func TestPollersRollupOnce(t *testing.T) {
+	db := createTestDB(t)
+	hour := int64(time.Hour)
+	data := intData("cpu", 0, 4, 10*int64(time.Second), 8)
+	if err := db.StoreData(Resolution10s, []proto.TimeSeriesData{data}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(0, int64(rollupThreshold)+2*hour)
+
+	// A poller whose source doesn't roll up leaves old data alone.
+	follower := NewPoller(db, testSource{})
+	follower.record(now)
+	points, err := db.Query("cpu", 0, hour, AggregatorSum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := []Datapoint{{0, 4}, {10 * int64(time.Second), 8}}; !reflect.DeepEqual(points, exp) {
+		t.Errorf("expected ten second data %v before rollup; got %v", exp, points)
+	}
+
+	pollers := []*Poller{NewPoller(db, testSource{rollsUp: true}), NewPoller(db, testSource{})}
+	var wg sync.WaitGroup
+	for _, p := range pollers {
+		wg.Add(1)
+		go func(p *Poller) {
+			defer wg.Done()
+			p.record(now)
+		}(p)
+	}
+	wg.Wait()
+	if points, err = db.Query("cpu", 0, hour, AggregatorSum); err != nil {
+		t.Fatal(err)
+	}
+	if exp := []Datapoint{{0, 12}}; !reflect.DeepEqual(points, exp) {
+		t.Errorf("expected hourly data %v; got %v", exp, points)
+	}
+}
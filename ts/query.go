@@ -0,0 +1,189 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package ts
+
+import (
+	"math"
+	"sort"
+
+	"gossipgo/proto"
+	"gossipgo/storage"
+	"gossipgo/util"
+)
+
+// An Aggregator computes the value of a datapoint from the
+// measurements accumulated in a sample.
+type Aggregator int
+
+const (
+	// AggregatorAvg is the average of the sample's measurements.
+	AggregatorAvg Aggregator = iota
+	// AggregatorSum is the sum of the sample's measurements.
+	AggregatorSum
+	// AggregatorMax is the maximum of the sample's measurements.
+	AggregatorMax
+	// AggregatorRate is the change per second of the average since
+	// the previous sample.
+	AggregatorRate
+)
+
+var aggregatorNames = map[string]Aggregator{
+	"avg":  AggregatorAvg,
+	"sum":  AggregatorSum,
+	"max":  AggregatorMax,
+	"rate": AggregatorRate,
+}
+
+// ParseAggregator returns the aggregator with the specified name:
+// one of "avg", "sum", "max" or "rate".
+func ParseAggregator(name string) (Aggregator, error) {
+	agg, ok := aggregatorNames[name]
+	if !ok {
+		return 0, util.Errorf("unknown aggregator %q", name)
+	}
+	return agg, nil
+}
+
+// A Datapoint is the aggregated value of the sample starting at
+// TimestampNanos, expressed in unix nanoseconds.
+type Datapoint struct {
+	TimestampNanos int64   `json:"timestamp_nanos"`
+	Value          float64 `json:"value"`
+}
+
+// timedSample is a sample with the unix nanosecond timestamp at which
+// it starts.
+type timedSample struct {
+	timestamp int64
+	*proto.InternalTimeSeriesSample
+}
+
+type timedSamples []timedSample
+
+func (s timedSamples) Len() int           { return len(s) }
+func (s timedSamples) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s timedSamples) Less(i, j int) bool { return s[i].timestamp < s[j].timestamp }
+
+// Query returns the datapoints of the named metric for the samples
+// overlapping the window from start, inclusive, to end, exclusive,
+// expressed in unix nanoseconds. Each sample is reduced to a
+// datapoint by the aggregator. Ten second samples are returned where
+// they exist; older data is returned from its one hour rollup.
+func (db *DB) Query(name string, start, end int64, agg Aggregator) ([]Datapoint, error) {
+	hourly, _, err := db.readSamples(name, Resolution1h, start, end)
+	if err != nil {
+		return nil, err
+	}
+	samples, keyTimes, err := db.readSamples(name, Resolution10s, start, end)
+	if err != nil {
+		return nil, err
+	}
+	// An hour which hasn't been rolled up, or whose rollup is in
+	// progress, is read from its ten second data.
+	for _, s := range hourly {
+		if _, ok := keyTimes[s.timestamp]; !ok {
+			samples = append(samples, s)
+		}
+	}
+	sort.Sort(samples)
+
+	datapoints := []Datapoint{}
+	for i, s := range samples {
+		dp := Datapoint{TimestampNanos: s.timestamp}
+		switch agg {
+		case AggregatorAvg:
+			dp.Value = sampleAvg(s)
+		case AggregatorSum:
+			dp.Value = sampleSum(s)
+		case AggregatorMax:
+			dp.Value = sampleMax(s)
+		case AggregatorRate:
+			if i == 0 {
+				continue
+			}
+			prev := samples[i-1]
+			seconds := float64(s.timestamp-prev.timestamp) / 1e9
+			dp.Value = (sampleAvg(s) - sampleAvg(prev)) / seconds
+		default:
+			return nil, util.Errorf("unknown aggregator %d", agg)
+		}
+		datapoints = append(datapoints, dp)
+	}
+	return datapoints, nil
+}
+
+// readSamples returns the samples of the named metric stored at the
+// resolution which overlap the window from start to end, along with
+// the key times of the values read.
+func (db *DB) readSamples(name string, r Resolution, start, end int64) (timedSamples, map[int64]struct{}, error) {
+	if start < 0 {
+		start = 0
+	}
+	if end <= start {
+		return nil, nil, nil
+	}
+	var samples timedSamples
+	keyTimes := map[int64]struct{}{}
+	startKey := dataKey(name, r, start/r.KeyDuration()*r.KeyDuration())
+	err := db.scanData(startKey, dataKey(name, r, end), func(key storage.Key, data *proto.InternalTimeSeriesData) error {
+		keyTimes[data.StartTimestampNanos] = struct{}{}
+		for _, s := range data.Samples {
+			ts := data.StartTimestampNanos + int64(s.Offset)*data.SampleDurationNanos
+			if ts+data.SampleDurationNanos > start && ts < end {
+				samples = append(samples, timedSample{timestamp: ts, InternalTimeSeriesSample: s})
+			}
+		}
+		return nil
+	})
+	return samples, keyTimes, err
+}
+
+// sampleSum returns the sum of the sample's measurements.
+func sampleSum(s timedSample) float64 {
+	return float64(s.GetIntSum()) + float64(s.GetFloatSum())
+}
+
+// sampleAvg returns the average of the sample's measurements.
+func sampleAvg(s timedSample) float64 {
+	count := s.IntCount + s.FloatCount
+	if count == 0 {
+		return 0
+	}
+	return sampleSum(s) / float64(count)
+}
+
+// sampleMax returns the maximum of the sample's measurements. The
+// maximum of a single measurement is omitted from the sample, as it
+// equals the sum.
+func sampleMax(s timedSample) float64 {
+	max := math.Inf(-1)
+	if s.IntCount > 0 {
+		max = float64(s.GetIntSum())
+		if s.IntMax != nil {
+			max = float64(*s.IntMax)
+		}
+	}
+	if s.FloatCount > 0 {
+		fMax := float64(s.GetFloatSum())
+		if s.FloatMax != nil {
+			fMax = float64(*s.FloatMax)
+		}
+		max = math.Max(max, fMax)
+	}
+	return max
+}
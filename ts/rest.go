@@ -0,0 +1,112 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package ts
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"gossipgo/util"
+)
+
+const (
+	// TimeSeriesKeyPrefix is the prefix for RESTful endpoints used to
+	// query time series data.
+	TimeSeriesKeyPrefix = "/ts/"
+	// defaultQueryWindow is the window queried if no start is given.
+	defaultQueryWindow = time.Hour
+)
+
+// A RESTServer provides a RESTful HTTP API to query time series data:
+//
+//	GET /ts/<name>?start=<nanos>&end=<nanos>&agg=<aggregator>
+//
+// Start and end are unix nanoseconds; end defaults to now and start
+// to an hour before end. The aggregator is one of avg (the default),
+// sum, max or rate. Datapoints are returned as a JSON array.
+type RESTServer struct {
+	db *DB // Time series database client
+}
+
+// NewRESTServer allocates and returns a new server.
+func NewRESTServer(db *DB) *RESTServer {
+	return &RESTServer{db: db}
+}
+
+// HandleAction arbitrates requests to the appropriate function
+// based on the request’s HTTP method.
+func (s *RESTServer) HandleAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		errStr := fmt.Sprintf("unhandled HTTP method %s: %s", r.Method, http.StatusText(http.StatusBadRequest))
+		http.Error(w, errStr, http.StatusBadRequest)
+		return
+	}
+	name, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), TimeSeriesKeyPrefix))
+	if err != nil || name == "" {
+		http.Error(w, "expected a time series name", http.StatusBadRequest)
+		return
+	}
+	query := r.URL.Query()
+	end, err := parseNanos(query.Get("end"), time.Now().UnixNano())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	start, err := parseNanos(query.Get("start"), end-int64(defaultQueryWindow))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	agg := AggregatorAvg
+	if aggName := query.Get("agg"); aggName != "" {
+		if agg, err = ParseAggregator(aggName); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	datapoints, err := s.db.Query(name, start, end, agg)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	b, err := json.Marshal(datapoints)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// parseNanos parses a unix nanosecond timestamp, returning def if s
+// is empty.
+func parseNanos(s string, def int64) (int64, error) {
+	if s == "" {
+		return def, nil
+	}
+	nanos, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, util.Errorf("invalid timestamp %q", s)
+	}
+	return nanos, nil
+}
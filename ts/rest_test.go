@@ -0,0 +1,83 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package ts
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"gossipgo/proto"
+)
+
+// TestRESTServer verifies time series queries over HTTP, including
+// the rate aggregator and invalid queries.
+func TestRESTServer(t *testing.T) {
+	db := createTestDB(t)
+	sec := int64(time.Second)
+	data := intData("cr.store.1.available", 0, 100, 10*sec, 150, 20*sec, 120)
+	if err := db.StoreData(Resolution10s, []proto.TimeSeriesData{data}); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(NewRESTServer(db).HandleAction))
+	defer server.Close()
+
+	get := func(path string, expStatus int) []byte {
+		resp, err := http.Get(server.URL + TimeSeriesKeyPrefix + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != expStatus {
+			t.Errorf("GET %s: expected status %d; got %d: %s", path, expStatus, resp.StatusCode, b)
+		}
+		return b
+	}
+
+	testCases := []struct {
+		agg       string
+		expPoints []Datapoint
+	}{
+		{"", []Datapoint{{0, 100}, {10 * sec, 150}, {20 * sec, 120}}},
+		{"sum", []Datapoint{{0, 100}, {10 * sec, 150}, {20 * sec, 120}}},
+		{"rate", []Datapoint{{10 * sec, 5}, {20 * sec, -3}}},
+	}
+	for i, test := range testCases {
+		path := fmt.Sprintf("cr.store.1.available?start=0&end=%d&agg=%s", 30*sec, test.agg)
+		var points []Datapoint
+		if err := json.Unmarshal(get(path, http.StatusOK), &points); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(points, test.expPoints) {
+			t.Errorf("%d: expected %v; got %v", i, test.expPoints, points)
+		}
+	}
+
+	get("", http.StatusBadRequest)
+	get("cr.store.1.available?start=x", http.StatusBadRequest)
+	get("cr.store.1.available?agg=median", http.StatusBadRequest)
+}
@@ -49,3 +49,9 @@ func Error(a ...interface{}) error {
 	}
 	return fmt.Errorf("%s", fmt.Sprint(a...))
 }
+
+// Retryable is implemented by errors which know whether the operation
+// which produced them may be retried.
+type Retryable interface {
+	CanRetry() bool
+}
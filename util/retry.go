@@ -17,15 +17,20 @@
 
 package util
 
-import "time"
+import (
+	"math/rand"
+	"time"
+)
 
 // Options provides control of retry loop logic via the
 // RetryWithBackoffOptions method.
 type Options struct {
-	Backoff     time.Duration // Default retry backoff interval
-	MaxBackoff  time.Duration // Maximum retry backoff interval
-	Constant    float64       // Default backoff constant
-	MaxAttempts int           // Maximum number of attempts (0 for infinite)
+	Backoff     time.Duration   // Default retry backoff interval
+	MaxBackoff  time.Duration   // Maximum retry backoff interval
+	Constant    float64         // Default backoff constant
+	MaxAttempts int             // Maximum number of attempts (0 for infinite)
+	Jitter      float64         // Backoffs are randomized by +/- this fraction
+	Stopper     <-chan struct{} // Retries stop with an error if closed
 }
 
 // RetryWithBackoff is uses default retry constants to implement an
@@ -53,13 +58,24 @@ func RetryWithBackoffOptions(opts Options, fn func() bool) error {
 			return Errorf("exceeded maximum retry attempts: %d", opts.MaxAttempts)
 		}
 		select {
-		case <-time.After(backoff):
+		case <-time.After(jitter(backoff, opts.Jitter)):
 			// Increase backoff.
 			backoff = time.Duration(float64(backoff) * opts.Constant)
 			if backoff > opts.MaxBackoff {
 				backoff = opts.MaxBackoff
 			}
+		case <-opts.Stopper:
+			return Errorf("retry stopped after %d attempts", count)
 		}
 	}
 	return nil
 }
+
+// jitter randomizes the backoff by up to +/- the specified fraction so
+// that clients retrying in lockstep spread out.
+func jitter(backoff time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 {
+		return backoff
+	}
+	return time.Duration(float64(backoff) * (1 + fraction*(2*rand.Float64()-1)))
+}
@@ -23,7 +23,7 @@ import (
 )
 
 func TestRetry(t *testing.T) {
-	opts := Options{time.Microsecond * 10, time.Second, 2, 10}
+	opts := Options{Backoff: time.Microsecond * 10, MaxBackoff: time.Second, Constant: 2, MaxAttempts: 10}
 	var retries int
 	err := RetryWithBackoffOptions(opts, func() bool {
 		retries++
@@ -41,7 +41,7 @@ func TestRetryExceedsMaxBackoff(t *testing.T) {
 	timer := time.AfterFunc(time.Second, func() {
 		t.Error("max backoff not respected")
 	})
-	opts := Options{time.Microsecond * 10, time.Microsecond * 10, 1000, 3}
+	opts := Options{Backoff: time.Microsecond * 10, MaxBackoff: time.Microsecond * 10, Constant: 1000, MaxAttempts: 3}
 	err := RetryWithBackoffOptions(opts, func() bool {
 		return false
 	})
@@ -53,7 +53,7 @@ func TestRetryExceedsMaxBackoff(t *testing.T) {
 
 func TestRetryExceedsMaxAttempts(t *testing.T) {
 	var retries int
-	opts := Options{time.Microsecond * 10, time.Second, 2, 3}
+	opts := Options{Backoff: time.Microsecond * 10, MaxBackoff: time.Second, Constant: 2, MaxAttempts: 3}
 	err := RetryWithBackoffOptions(opts, func() bool {
 		retries++
 		return false
@@ -62,3 +62,30 @@ func TestRetryExceedsMaxAttempts(t *testing.T) {
 		t.Error("expected 3 retries, got", retries, ":", err)
 	}
 }
+
+func TestRetryStopper(t *testing.T) {
+	stopper := make(chan struct{})
+	var retries int
+	opts := Options{Backoff: time.Microsecond * 10, MaxBackoff: time.Second, Constant: 2, Stopper: stopper}
+	err := RetryWithBackoffOptions(opts, func() bool {
+		retries++
+		if retries == 3 {
+			close(stopper)
+		}
+		return false
+	})
+	if err == nil || retries != 3 {
+		t.Error("expected retries to stop after 3, got", retries, ":", err)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	if b := jitter(time.Second, 0); b != time.Second {
+		t.Errorf("expected no jitter; got %s", b)
+	}
+	for i := 0; i < 100; i++ {
+		if b := jitter(time.Second, 0.25); b < 750*time.Millisecond || b > 1250*time.Millisecond {
+			t.Fatalf("expected backoff within 25%% of 1s; got %s", b)
+		}
+	}
+}